@@ -14,8 +14,9 @@
       const json = await res.json();
       backend = (json.backend || "").replace(/\/+$/, "");
     } catch {
-      // Fallback: assume the backend is the same origin (self-hosted).
-      backend = window.location.origin;
+      // Fallback: assume the backend serves this page (self-hosted),
+      // possibly under a subpath.
+      backend = (window.location.origin + window.location.pathname).replace(/\/[^\/]*$/, "");
     }
   }
 
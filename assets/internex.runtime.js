@@ -18,6 +18,13 @@
    * ═══════════════════════════════════════════════════════════════════════ */
 
   var PROXY_ORIGIN = location.origin;
+  // Proxy URL prefix, including the path the proxy is mounted under (its
+  // BasePath), taken from this page's own proxy URL.
+  var PROXY_BASE = (function () {
+    var m = /^(.*?)\/(?:proxy$|[pf]\/)/.exec(location.pathname || "");
+    return m ? m[1] : "";
+  })();
+  var PROXY_PATH = PROXY_BASE + "/proxy?url=";
   var BASE_URL     = window.__internex_base || "";
   var BASE_ORIGIN  = "";
   try { BASE_ORIGIN = new URL(BASE_URL).origin; } catch (_) { /* */ }
@@ -184,7 +191,7 @@
       if (b) {
         try { baseScheme = new URL(b).protocol; } catch (_) { /* */ }
       }
-      return "/proxy?url=" + encodeURIComponent(baseScheme + s);
+      return PROXY_PATH + encodeURIComponent(baseScheme + s);
     }
 
     // Absolute  http(s)://… or ws(s)://…
@@ -199,24 +206,24 @@
           var bo = getBaseOrigin();
           if (bo) {
             var remap = new URL(abs.pathname + abs.search + abs.hash, bo);
-            return "/proxy?url=" + encodeURIComponent(remap.href);
+            return PROXY_PATH + encodeURIComponent(remap.href);
           }
         }
       } catch (_) { /* ignore */ }
-      return "/proxy?url=" + encodeURIComponent(s);
+      return PROXY_PATH + encodeURIComponent(s);
     }
 
     // Root-relative  /path
     if (c0 === "/") {
       var origin = getBaseOrigin();
-      if (origin) return "/proxy?url=" + encodeURIComponent(origin + s);
+      if (origin) return PROXY_PATH + encodeURIComponent(origin + s);
       return s;
     }
 
     // Relative  path/file
     var baseURL = getBaseURL();
     if (baseURL) {
-      try { return "/proxy?url=" + encodeURIComponent(new URL(s, baseURL).href); }
+      try { return PROXY_PATH + encodeURIComponent(new URL(s, baseURL).href); }
       catch (_) { /* fall through */ }
     }
 
@@ -797,6 +804,27 @@
     }
   } catch (_) { /* ignore */ }
 
+  // Targets of statically rewritten location / document.domain accesses.
+  // The server (RewriteOptions.location) turns `location = x`,
+  // `location.href = x` and `document.domain` into accesses on these.
+  var _docDomain = null;
+  try {
+    Object.defineProperty(window.__internex, "location", {
+      get: function () { return window.location; },
+      set: function (v) { _locationAssign.call(window.location, rewriteUrl(String(v))); },
+    });
+    Object.defineProperty(window.__internex, "domain", {
+      get: function () {
+        if (_docDomain !== null) return _docDomain;
+        var u = targetURL();
+        return u ? u.hostname : document.domain;
+      },
+      // Relaxing document.domain to the upstream's parent domain would
+      // throw on the proxy's host; remember it for reads instead.
+      set: function (v) { _docDomain = String(v); },
+    });
+  } catch (_) { /* ignore */ }
+
   // Anchor clicks  (capture phase so we beat framework listeners)
   document.addEventListener("click", function (e) {
     var el = e.target;
@@ -811,37 +839,63 @@
     else { location.href = dest; }
   }, true);
 
-  // Form submissions
+  // Form submissions.  A GET submission replaces the query of its action
+  // with the form fields, which would drop ?url=, so GET forms submit to
+  // <base>/f/<base64url target> instead, where the query is the target's.
+  function formPathTarget(u) {
+    try {
+      var p = new URL(u, location.href);
+      var prefix = PROXY_BASE + "/f/";
+      if (p.origin !== location.origin || p.pathname.indexOf(prefix) !== 0) return "";
+      var b64 = p.pathname.slice(prefix.length).replace(/-/g, "+").replace(/_/g, "/");
+      return decodeURIComponent(escape(atob(b64)));
+    } catch (_) {
+      return "";
+    }
+  }
+
+  function formPath(target) {
+    var u = new URL(target);
+    u.search = "";
+    u.hash = "";
+    var b64 = btoa(unescape(encodeURIComponent(u.href)))
+      .replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    return PROXY_BASE + "/f/" + b64;
+  }
+
+  function rewriteFormAction(form) {
+    var action = _getAttribute.call(form, "action");
+    var method = String(_getAttribute.call(form, "method") || "").trim().toLowerCase();
+    var target = action ? formPathTarget(action) : "";
+    if (method === "post" || method === "dialog") {
+      if (target) _setAttribute.call(form, "action", rewriteUrl(target));
+      else if (action && !isProxied(action)) _setAttribute.call(form, "action", rewriteUrl(action));
+      return;
+    }
+    if (target) return;
+    if (!action) target = getBaseURL();
+    else if (isProxied(action)) target = decodeUrl(action);
+    else target = resolveAbsolute(action);
+    if (/^https?:\/\//i.test(target)) _setAttribute.call(form, "action", formPath(target));
+  }
+
   document.addEventListener("submit", function (e) {
     var form = e.target;
     if (!form || form.tagName !== "FORM") return;
-    var action = _getAttribute.call(form, "action");
-    if (action && !isProxied(action)) {
-      _setAttribute.call(form, "action", rewriteUrl(action));
-    }
+    try { rewriteFormAction(form); } catch (_) { /* ignore */ }
   }, true);
 
   // Programmatic form submission (form.submit() / requestSubmit())
   if (_formSubmit) {
     HTMLFormElement.prototype.submit = function () {
-      try {
-        var action = _getAttribute.call(this, "action");
-        if (action && !isProxied(action)) {
-          _setAttribute.call(this, "action", rewriteUrl(action));
-        }
-      } catch (_) { /* ignore */ }
+      try { rewriteFormAction(this); } catch (_) { /* ignore */ }
       return _formSubmit.apply(this, arguments);
     };
   }
 
   if (_formRequestSubmit) {
     HTMLFormElement.prototype.requestSubmit = function () {
-      try {
-        var action = _getAttribute.call(this, "action");
-        if (action && !isProxied(action)) {
-          _setAttribute.call(this, "action", rewriteUrl(action));
-        }
-      } catch (_) { /* ignore */ }
+      try { rewriteFormAction(this); } catch (_) { /* ignore */ }
       return _formRequestSubmit.apply(this, arguments);
     };
   }
@@ -921,7 +975,19 @@
    * §10  SERVICE WORKER PATCH
    * ═══════════════════════════════════════════════════════════════════════ */
 
-  if (_swRegister) {
+  // A worker registered through the proxy would intercept every proxied
+  // origin under its scope, so the proxy can have registration stubbed
+  // out (window.__internex_no_sw, set by the injector): register rejects
+  // as if service workers were unavailable and no registrations exist.
+  if (window.__internex_no_sw && navigator.serviceWorker) {
+    var swc = navigator.serviceWorker;
+    swc.register = function () {
+      return Promise.reject(new DOMException(
+        "Service workers are disabled by the proxy", "SecurityError"));
+    };
+    swc.getRegistration = function () { return Promise.resolve(undefined); };
+    swc.getRegistrations = function () { return Promise.resolve([]); };
+  } else if (_swRegister) {
     navigator.serviceWorker.register = function (url, opts) {
       return _swRegister(rewriteUrl(url), opts);
     };
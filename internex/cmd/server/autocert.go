@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertTLSConfig builds a TLS config for TLS_DOMAINS: certificates
+// are obtained from Let's Encrypt (TLS-ALPN-01) for the given domains
+// and cached on disk in cacheDir ("autocert-cache" if empty).
+func autocertTLSConfig(domains []string, cacheDir string) *tls.Config {
+	if cacheDir == "" {
+		cacheDir = "autocert-cache"
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	return m.TLSConfig()
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"internex/internal/rewriter"
 	"internex/internal/transport"
 )
 
@@ -20,7 +29,26 @@ func main() {
 	if host == "" {
 		host = "localhost"
 	}
-	transport.ProxyOrigin = "http://" + host + ":" + port
+	// TLS: either a static cert/key pair or Let's Encrypt via autocert.
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	tlsDomains := os.Getenv("TLS_DOMAINS")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("TLS_CERT and TLS_KEY must be set together")
+	}
+	useTLS := certFile != "" || tlsDomains != ""
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	transport.ProxyOrigin = scheme + "://" + host + ":" + port
+
+	// Mounting under a subpath, e.g. BASE_PATH=/internex behind a reverse
+	// proxy that forwards https://host/internex/ unchanged.
+	if v := strings.Trim(os.Getenv("BASE_PATH"), "/"); v != "" {
+		transport.BasePath = "/" + v
+		transport.ProxyOrigin += transport.BasePath
+	}
 
 	// Determine assets directory (default: ../../../assets relative to binary).
 	assetsDir := os.Getenv("ASSETS_DIR")
@@ -30,11 +58,379 @@ func main() {
 	}
 	transport.AssetsDir = assetsDir
 
+	// Developer diagnostics; never enable in production.
+	if envBool("DEBUG_MODE") {
+		transport.DebugMode = true
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+		log.Print("DEBUG_MODE enabled: request bodies will be logged")
+	}
+
+	// Optional compressed upstream transfers, e.g. "zstd,gzip".
+	if v := os.Getenv("UPSTREAM_ENCODINGS"); v != "" {
+		transport.UpstreamEncodings = strings.Split(v, ",")
+	}
+
+	// Upstream TLS: self-signed internal tools, mutual TLS, private CAs.
+	upstreamTLS, err := transport.BuildTLSConfig(transport.UpstreamTLSOptions{
+		InsecureSkipVerify: envBool("TLS_INSECURE_SKIP_VERIFY"),
+		ClientCertFile:     os.Getenv("TLS_CLIENT_CERT"),
+		ClientKeyFile:      os.Getenv("TLS_CLIENT_KEY"),
+		CABundleFile:       os.Getenv("TLS_CA_BUNDLE"),
+	})
+	if err != nil {
+		log.Fatalf("upstream TLS: %v", err)
+	}
+	transport.SetTLSConfig(upstreamTLS)
+
+	// Route upstream traffic through a corporate proxy or SOCKS5 gateway.
+	if v := os.Getenv("EGRESS_PROXY"); v != "" {
+		if err := transport.SetEgressProxy(v); err != nil {
+			log.Fatalf("egress proxy: %v", err)
+		}
+	}
+
+	// Global per-origin rate limit, e.g. RATE_LIMIT_RPS=20 RATE_LIMIT_BURST=40.
+	if v := os.Getenv("RATE_LIMIT_RPS"); v != "" {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("invalid RATE_LIMIT_RPS: %v", err)
+		}
+		burst, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST"))
+		transport.SetRateLimit("*", rps, burst)
+		transport.RateLimitPerClient = envBool("RATE_LIMIT_PER_CLIENT")
+	}
+
+	// Tell upstreams the browser's address (X-Forwarded-For).
+	transport.ForwardClientIP = envBool("FORWARD_CLIENT_IP")
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		if err := transport.SetTrustedProxies(strings.Split(v, ",")); err != nil {
+			log.Fatalf("trusted proxies: %v", err)
+		}
+	}
+
+	// Serve these media types as downloads, e.g. "application/pdf,image/*".
+	if v := os.Getenv("FORCE_DOWNLOAD_TYPES"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			transport.ForceDownloadTypes = append(transport.ForceDownloadTypes, strings.TrimSpace(t))
+		}
+	}
+
+	// Replace the browser's User-Agent for every upstream.
+	if v := os.Getenv("UPSTREAM_USER_AGENT"); v != "" {
+		transport.SetOriginHeaders("*", http.Header{"User-Agent": {v}})
+	}
+
+	// Cap simultaneous requests per upstream origin.
+	if v := os.Getenv("ORIGIN_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid ORIGIN_CONCURRENCY: %v", err)
+		}
+		transport.SetOriginConcurrency("*", n)
+		transport.OriginQueueTimeout = envDuration("ORIGIN_QUEUE_TIMEOUT", transport.OriginQueueTimeout)
+	}
+
+	// Cap simultaneous upstream requests across all origins.
+	if v := os.Getenv("MAX_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid MAX_CONCURRENCY: %v", err)
+		}
+		transport.SetMaxConcurrency(n)
+		transport.ConcurrencyQueueTimeout = envDuration("CONCURRENCY_QUEUE_TIMEOUT", transport.ConcurrencyQueueTimeout)
+	}
+
+	// Cap concurrent WebSocket bridges per client and origin.
+	if v := os.Getenv("MAX_WEBSOCKETS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid MAX_WEBSOCKETS: %v", err)
+		}
+		transport.SetMaxWebSockets(n)
+	}
+
+	// Total time budget shared by a navigation and its subresources.
+	transport.NavigationBudget = envDuration("NAVIGATION_BUDGET", 0)
+
+	// Cap on rewritable bodies buffered in memory; oversize bodies stream
+	// through unrewritten unless MAX_BODY_REJECT is set.
+	if v := os.Getenv("MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid MAX_BODY_BYTES: %v", err)
+		}
+		transport.MaxBodyBytes = n
+	}
+	if envBool("MAX_BODY_REJECT") {
+		transport.OversizeBodyAction = transport.OversizeReject
+	}
+
+	// Content-Length validation on buffered bodies: log (default), reject, off.
+	switch os.Getenv("CONTENT_LENGTH_CHECK") {
+	case "reject":
+		transport.ContentLengthCheck = transport.LengthCheckReject
+	case "off":
+		transport.ContentLengthCheck = transport.LengthCheckOff
+	}
+
+	// Upstream request header limits; past them cookies and then the
+	// largest headers are dropped, or the request fails with
+	// HEADER_LIMIT_REJECT.
+	if v := os.Getenv("MAX_COOKIE_HEADER_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid MAX_COOKIE_HEADER_BYTES: %v", err)
+		}
+		transport.MaxCookieHeaderBytes = n
+	}
+	if v := os.Getenv("MAX_HEADER_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid MAX_HEADER_BYTES: %v", err)
+		}
+		transport.MaxForwardedHeaderBytes = n
+	}
+	if envBool("HEADER_LIMIT_REJECT") {
+		transport.HeaderLimitPolicy = transport.HeaderLimitReject
+	}
+
+	transport.InjectBaseTag = envBool("INJECT_BASE_TAG")
+	transport.RewriteJSON = envBool("REWRITE_JSON")
+	if v := os.Getenv("SNIFF_CONTENT_TYPE"); v != "" {
+		transport.SniffContentType = envBool("SNIFF_CONTENT_TYPE")
+	}
+	transport.RewriteModuleURLs = envBool("REWRITE_MODULE_URLS")
+	transport.RewriteMetaCSP = envBool("REWRITE_META_CSP")
+	transport.RewriteLocation = envBool("REWRITE_LOCATION")
+	transport.DisableServiceWorkers = envBool("DISABLE_SERVICE_WORKERS")
+	transport.EnableRewriteFastPath = envBool("REWRITE_FAST_PATH")
+	if v, ok := os.LookupEnv("REWRITE_CATEGORIES"); ok {
+		cats, err := transport.ParseContentCategories(v)
+		if err != nil {
+			log.Fatalf("invalid REWRITE_CATEGORIES: %v", err)
+		}
+		transport.RewriteCategories = cats
+	}
+	if v, ok := os.LookupEnv("RUNTIME_SHIM_PATH"); ok {
+		transport.RuntimeShimPath = v
+	}
+	if v := os.Getenv("PRESERVE_HEADERS"); v != "" {
+		transport.PreservedHeaders = strings.Split(v, ",")
+	}
+	if v := os.Getenv("GZIP_RESPONSES"); v != "" {
+		transport.GzipResponses = envBool("GZIP_RESPONSES")
+	}
+	if v := os.Getenv("GZIP_MIN_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid GZIP_MIN_BYTES %q: want a non-negative byte count", v)
+		}
+		transport.GzipMinBytes = n
+	}
+	transport.ModificationLog = envBool("MODIFICATION_LOG")
+	transport.AllowUserinfo = envBool("ALLOW_URL_USERINFO")
+	// Requires wildcard DNS (and certificates) for *.<proxy host>.
+	transport.CookieDomainMapping = envBool("COOKIE_DOMAIN_MAPPING")
+	transport.HeadFallbackToGET = envBool("HEAD_FALLBACK_GET")
+	transport.AllowMethodOverride = envBool("ALLOW_METHOD_OVERRIDE")
+	transport.DisableHTTP2 = envBool("DISABLE_HTTP2")
+	if v := os.Getenv("ABORT_ON_UPSTREAM_RESET"); v != "" {
+		transport.AbortOnUpstreamReset = envBool("ABORT_ON_UPSTREAM_RESET")
+	}
+
+	if name := os.Getenv("SESSION_BACKEND"); name != "" {
+		backend, err := transport.OpenSessionBackend(name, os.Getenv("SESSION_BACKEND_URL"))
+		if err != nil {
+			log.Fatalf("session backend: %v", err)
+		}
+		transport.DefaultSessions = transport.NewSessionStoreWithBackend(backend)
+	}
+	// Sessions persist across restarts: loaded here, saved on shutdown.
+	sessionFile := os.Getenv("SESSION_FILE")
+	if sessionFile != "" {
+		if err := transport.DefaultSessions.LoadFile(sessionFile); err != nil {
+			log.Fatalf("loading sessions: %v", err)
+		}
+	}
+
+	transport.SessionNamespaceHeader = os.Getenv("SESSION_NAMESPACE_HEADER")
+	transport.ClientSessions = envBool("CLIENT_SESSIONS")
+	transport.SessionAdminToken = os.Getenv("SESSION_ADMIN_TOKEN")
+	transport.StorageEndpoints = envBool("STORAGE_ENDPOINTS")
+
+	switch os.Getenv("COOKIE_SAMESITE") {
+	case "preserve":
+		transport.CookieSameSitePolicy = transport.SameSitePreserve
+	case "none":
+		transport.CookieSameSitePolicy = transport.SameSiteNone
+	case "lax":
+		transport.CookieSameSitePolicy = transport.SameSiteLax
+	case "strict":
+		transport.CookieSameSitePolicy = transport.SameSiteStrict
+	}
+
+	switch os.Getenv("ORIGIN_POLICY") {
+	case "preserve-proxy":
+		transport.OriginPolicy = transport.OriginPreserveProxy
+	case "strip":
+		transport.OriginPolicy = transport.OriginStrip
+	}
+
+	if os.Getenv("AUTH_CHALLENGES") == "strip" {
+		transport.AuthChallenges = transport.AuthStrip
+	}
+
+	if v := os.Getenv("RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid RETRY_ATTEMPTS %q: %v", v, err)
+		}
+		transport.SetRetryPolicy(transport.RetryPolicy{
+			Attempts:  n,
+			BaseDelay: envDuration("RETRY_BASE_DELAY", 100*time.Millisecond),
+			MaxDelay:  envDuration("RETRY_MAX_DELAY", 2*time.Second),
+		})
+	}
+
+	transport.SetDNSCacheTTL(envDuration("DNS_CACHE_TTL", 30*time.Second))
+	// Intranet deployments must opt in to loopback and private upstreams.
+	transport.AllowPrivateUpstreams = envBool("ALLOW_PRIVATE_UPSTREAMS")
+	// Pinned upstream addresses, e.g. "www.example.com=203.0.113.5,api.example.com=203.0.113.6".
+	// Private addresses need ALLOW_PRIVATE_UPSTREAMS.
+	if v := os.Getenv("HOST_OVERRIDES"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			host, ip, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || host == "" || ip == "" {
+				log.Fatalf("invalid HOST_OVERRIDES entry %q: want host=ip", pair)
+			}
+			if err := transport.SetHostOverride(host, ip); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if v := os.Getenv("RESPONSE_CACHE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid RESPONSE_CACHE_BYTES: %v", err)
+		}
+		transport.SetResponseCache(n, envDuration("RESPONSE_CACHE_TTL", 5*time.Minute))
+	}
+	transport.CacheVaryCookie = envBool("RESPONSE_CACHE_VARY_COOKIE")
+
+	// Load the rewriter now rather than on the first request.
+	if err := startRewriter(rewriter.Warmup); err != nil {
+		log.Fatal(err)
+	}
+
 	mux := transport.NewMux()
 
 	addr := ":" + port
-	log.Printf("listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	// Event streams and WebSocket bridges lift the read and write
+	// deadlines themselves, so these only bound ordinary exchanges.  A
+	// WRITE_TIMEOUT also caps how long a proxied download may take.
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", 0),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 0),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 120*time.Second),
+	}
+	srv.RegisterOnShutdown(transport.CloseWebSockets)
+
+	if tlsDomains != "" && certFile == "" {
+		var domains []string
+		for _, d := range strings.Split(tlsDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		srv.TLSConfig = autocertTLSConfig(domains, os.Getenv("TLS_CACHE_DIR"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listen := func() error {
+		log.Printf("listening on %s (%s)", addr, scheme)
+		if useTLS {
+			// Empty file names use the certificates in srv.TLSConfig.
+			return srv.ListenAndServeTLS(certFile, keyFile)
+		}
+		return srv.ListenAndServe()
+	}
+	grace := envDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	if err := runServer(ctx, srv, listen, grace, sessionFile); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// runServer runs serve (srv's ListenAndServe or equivalent) until ctx is
+// done, then drains in-flight requests; streams still open after the
+// grace period are force-closed.  Once no handler can touch the session
+// store any more it is saved to sessionFile, if set.
+func runServer(ctx context.Context, srv *http.Server, serve func() error, grace time.Duration, sessionFile string) error {
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down (grace period %s)", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown incomplete: %v; forcing close", err)
+		srv.Close()
+	}
+
+	if sessionFile != "" {
+		if err := transport.DefaultSessions.SaveFile(sessionFile); err != nil {
+			log.Printf("saving sessions: %v", err)
+		} else {
+			log.Printf("saved sessions to %s", sessionFile)
+		}
+	}
+	return nil
+}
+
+// startRewriter runs warmup to load the rewriter.  Without it the proxy
+// only works in pass-through mode, which must be opted into with
+// REWRITER_FALLBACK; otherwise the warmup error is returned.
+func startRewriter(warmup func() error) error {
+	err := warmup()
+	if err == nil {
+		return nil
+	}
+	if !envBool("REWRITER_FALLBACK") {
+		return fmt.Errorf("rewriter warmup failed: %w (set REWRITER_FALLBACK=1 to proxy without rewriting)", err)
+	}
+	log.Printf("rewriter warmup failed: %v; proxying without rewriting", err)
+	transport.PassThrough = true
+	return nil
+}
+
+// envBool reports whether the named env var is set to a true value
+// ("1", "t", "true", ...).
+func envBool(name string) bool {
+	v, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && v
+}
+
+// envDuration parses the named env var as a time.Duration, returning def
+// when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"internex/internal/transport"
+)
+
+// TestMain runs main instead of the tests when runMain re-executes the
+// test binary.
+func TestMain(m *testing.M) {
+	if os.Getenv("INTERNEX_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs main in a child process with env added to the
+// environment, stopping it after timeout.  It returns main's log output
+// and exit error.
+func runMain(t *testing.T, timeout time.Duration, env ...string) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	cmd.Env = append(append(os.Environ(), "INTERNEX_RUN_MAIN=1", "PORT=0"), env...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// startMain starts main in a child process with env added, returning a
+// func that interrupts it and returns its log output.
+func startMain(t *testing.T, env ...string) func() string {
+	t.Helper()
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(append(os.Environ(), "INTERNEX_RUN_MAIN=1"), env...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	stop := func() string {
+		if !stopped {
+			stopped = true
+			cmd.Process.Signal(os.Interrupt)
+			cmd.Wait()
+		}
+		return out.String()
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+// freePort returns a loopback port that was free a moment ago.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and
+// its key to dir, returning their paths and the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "internex test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServesTLSFromCertFiles(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+	port := freePort(t)
+	stop := startMain(t, "HOST=127.0.0.1", "PORT="+port, "TLS_CERT="+certFile, "TLS_KEY="+keyFile, "REWRITER_FALLBACK=1")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if resp, err = client.Get("https://127.0.0.1:" + port + "/readyz"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("no TLS response: %v\n%s", err, stop())
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || !resp.TLS.HandshakeComplete {
+		t.Fatal("response was not served over a completed TLS handshake")
+	}
+	if got := resp.TLS.PeerCertificates[0]; !got.Equal(cert) {
+		t.Error("server presented a different certificate than TLS_CERT")
+	}
+	if out := stop(); !strings.Contains(out, "(https)") {
+		t.Errorf("server did not report an https listener:\n%s", out)
+	}
+}
+
+// waitListening waits for main to accept connections on addr.
+func waitListening(t *testing.T, addr string, stop func() string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return
+		}
+	}
+	t.Fatalf("server never listened on %s:\n%s", addr, stop())
+}
+
+func TestSlowHeadersAreDropped(t *testing.T) {
+	port := freePort(t)
+	addr := "127.0.0.1:" + port
+	stop := startMain(t, "HOST=127.0.0.1", "PORT="+port, "READ_HEADER_TIMEOUT=200ms", "REWRITER_FALLBACK=1")
+	waitListening(t, addr, stop)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A slowloris client: the request line and a header, never the end.
+	start := time.Now()
+	if _, err := io.WriteString(conn, "GET /readyz HTTP/1.1\r\nHost: 127.0.0.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	elapsed := time.Since(start)
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection still open 5s after READ_HEADER_TIMEOUT=200ms")
+	}
+	if len(reply) > 0 && !strings.HasPrefix(string(reply), "HTTP/1.1 408") {
+		t.Fatalf("server answered a request whose headers never finished: %q", reply)
+	}
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("dropped after %v, before the header timeout", elapsed)
+	}
+}
+
+func TestInvalidEnvIsFatal(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"GZIP_MIN_BYTES=1k", "invalid GZIP_MIN_BYTES"},
+		{"GZIP_MIN_BYTES=-1", "invalid GZIP_MIN_BYTES"},
+		{"RESPONSE_CACHE_BYTES=64MB", "invalid RESPONSE_CACHE_BYTES"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			out, err := runMain(t, 10*time.Second, tt.env)
+			var exit *exec.ExitError
+			if !errors.As(err, &exit) || exit.ExitCode() != 1 {
+				t.Fatalf("main exited with %v, want status 1; output:\n%s", err, out)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("output %q does not mention %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartRewriter(t *testing.T) {
+	failed := func() error { return errors.New("library not loaded") }
+	tests := []struct {
+		name         string
+		warmup       func() error
+		fallback     string
+		wantErr      bool
+		wantPassThru bool
+	}{
+		{"loaded", func() error { return nil }, "", false, false},
+		{"failed", failed, "", true, false},
+		{"failed with fallback", failed, "1", false, true},
+		{"failed with fallback off", failed, "false", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REWRITER_FALLBACK", tt.fallback)
+			t.Cleanup(func() { transport.PassThrough = false })
+
+			err := startRewriter(tt.warmup)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("startRewriter = %v, want error %v", err, tt.wantErr)
+			}
+			if transport.PassThrough != tt.wantPassThru {
+				t.Errorf("PassThrough = %v, want %v", transport.PassThrough, tt.wantPassThru)
+			}
+		})
+	}
+}
+
+// startServer serves h on a loopback listener under runServer, returning
+// the server URL, a cancel func that triggers shutdown and a channel
+// receiving runServer's result.
+func startServer(t *testing.T, h http.Handler, grace time.Duration, sessionFile string) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, srv, func() error { return srv.Serve(ln) }, grace, sessionFile) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	old := transport.DefaultSessions
+	transport.DefaultSessions = transport.NewSessionStore()
+	t.Cleanup(func() { transport.DefaultSessions = old })
+	sessionFile := filepath.Join(t.TempDir(), "sessions.json")
+
+	arrived, release := make(chan struct{}), make(chan struct{})
+	url, shutdown, done := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		transport.DefaultSessions.SetLocalStorage("https://example.com", "theme", "dark")
+		io.WriteString(w, "finished")
+	}), time.Minute, sessionFile)
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		got <- result{string(b), err}
+	}()
+
+	<-arrived
+	shutdown()
+	select {
+	case err := <-done:
+		t.Fatalf("runServer returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("runServer: %v", err)
+	}
+	if r := <-got; r.err != nil || r.body != "finished" {
+		t.Fatalf("in-flight request got %q, %v; want it to complete", r.body, r.err)
+	}
+
+	// The session written by the drained request was saved.
+	loaded := transport.NewSessionStore()
+	if err := loaded.LoadFile(sessionFile); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := loaded.GetLocalStorage("https://example.com", "theme"); !ok || v != "dark" {
+		t.Errorf("saved localStorage theme = %q, %v; want dark", v, ok)
+	}
+}
+
+func TestShutdownForceClosesAfterGrace(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	url, shutdown, done := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(arrived)
+		<-release
+	}), 50*time.Millisecond, "")
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	<-arrived
+	shutdown()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runServer: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runServer did not force-close a stream after the grace period")
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("stream ended cleanly; want it cut off")
+	}
+}
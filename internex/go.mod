@@ -1,3 +1,11 @@
 module internex
 
 go 1.22
+
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.21.0
+	golang.org/x/text v0.21.0
+	golang.org/x/time v0.8.0
+)
@@ -0,0 +1,50 @@
+package rewriter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// defaultProxyOrigin is used by RewriteContext when the context carries
+// no options, e.g. for callers outside a proxied request.
+const defaultProxyOrigin = "http://localhost:8080"
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of ctx carrying opts for RewriteContext.
+// The transport layer sets this per request with the proxy origin and
+// the upstream document URL.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+// OptionsFromContext returns the options stored by WithOptions, if any.
+func OptionsFromContext(ctx context.Context) (Options, bool) {
+	opts, ok := ctx.Value(optionsKey{}).(Options)
+	return opts, ok
+}
+
+// RewriteContext reads src and rewrites it according to kind with the
+// options carried by ctx, or DefaultOptions for a local proxy and no base
+// URL when there are none.
+func RewriteContext(ctx context.Context, kind ContentKind, src io.Reader) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("rewriter: reading source: %w", err)
+	}
+
+	opts, ok := OptionsFromContext(ctx)
+	if !ok {
+		opts = DefaultOptions(defaultProxyOrigin, "")
+	}
+	result, err := RewriteWithOptions(kind, string(body), opts)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(result), nil
+}
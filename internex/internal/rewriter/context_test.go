@@ -0,0 +1,114 @@
+package rewriter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// ffiCall is one envelope passed to the rewriter.
+type ffiCall struct {
+	kind  ContentKind
+	input rewriteInput
+}
+
+// captureFFI replaces the rewriter with one that records each envelope
+// and returns out (or err) for it.
+func captureFFI(t *testing.T, out string, err error) *[]ffiCall {
+	t.Helper()
+	var calls []ffiCall
+	old := rewriteFFI
+	rewriteFFI = func(kind ContentKind, envelope []byte) (string, error) {
+		var in rewriteInput
+		if e := json.Unmarshal(envelope, &in); e != nil {
+			t.Errorf("envelope is not valid JSON: %v", e)
+		}
+		calls = append(calls, ffiCall{kind, in})
+		return out, err
+	}
+	t.Cleanup(func() { rewriteFFI = old })
+	return &calls
+}
+
+func TestRewriteContextEnvelope(t *testing.T) {
+	custom := Options{
+		ProxyOrigin:     "https://proxy.example:8443/internex",
+		BaseURL:         "https://example.com/dir/page.html",
+		InjectBase:      true,
+		RewriteLocation: true,
+		RuntimePath:     "/rt.js",
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want rewriteInput
+	}{
+		{
+			name: "options from context",
+			ctx:  WithOptions(context.Background(), custom),
+			want: rewriteInput{
+				ProxyOrigin:     "https://proxy.example:8443/internex",
+				BaseURL:         "https://example.com/dir/page.html",
+				Content:         "<p>doc</p>",
+				InjectBase:      true,
+				RewriteLocation: true,
+				RuntimePath:     "/rt.js",
+			},
+		},
+		{
+			name: "defaults without options",
+			ctx:  context.Background(),
+			want: rewriteInput{
+				ProxyOrigin:         defaultProxyOrigin,
+				Content:             "<p>doc</p>",
+				InlineJS:            true,
+				RewriteInlineStyles: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := captureFFI(t, "<p>rewritten</p>", nil)
+			r, err := RewriteContext(tt.ctx, HTML, strings.NewReader("<p>doc</p>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, _ := io.ReadAll(r)
+			if string(out) != "<p>rewritten</p>" {
+				t.Errorf("output = %q, want the rewriter's", out)
+			}
+			if len(*calls) != 1 {
+				t.Fatalf("%d rewriter calls, want 1", len(*calls))
+			}
+			if c := (*calls)[0]; c.kind != HTML || c.input != tt.want {
+				t.Errorf("envelope = %v %+v, want html %+v", c.kind, c.input, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteContextCancelled(t *testing.T) {
+	calls := captureFFI(t, "", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RewriteContext(ctx, JS, strings.NewReader("x()")); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if len(*calls) != 0 {
+		t.Error("a cancelled context still reached the rewriter")
+	}
+}
+
+func TestRewriteFallsBackOnError(t *testing.T) {
+	captureFFI(t, "", errors.New("rejected"))
+	r, err := Rewrite(CSS, strings.NewReader("a{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := io.ReadAll(r); string(out) != "a{}" {
+		t.Errorf("Rewrite = %q, want the input back", out)
+	}
+}
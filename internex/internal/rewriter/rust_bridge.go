@@ -9,15 +9,21 @@ package rewriter
 extern char* rewrite_html(const char* input);
 extern char* rewrite_css(const char* input);
 extern char* rewrite_js(const char* input);
+extern char* rewrite_html_n(const char* input, size_t len);
+extern char* rewrite_css_n(const char* input, size_t len);
+extern char* rewrite_js_n(const char* input, size_t len);
 extern void  free_string(char* ptr);
 */
 import "C"
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -28,90 +34,250 @@ const (
 	HTML ContentKind = iota
 	CSS
 	JS
+	// XML feeds are rewritten in Go; see RewriteXML.
+	XML
 )
 
+// String returns the kind name used by the Rust FFI ("html", "css", "js").
+func (k ContentKind) String() string {
+	switch k {
+	case HTML:
+		return "html"
+	case CSS:
+		return "css"
+	case JS:
+		return "js"
+	case XML:
+		return "xml"
+	default:
+		return fmt.Sprintf("ContentKind(%d)", int(k))
+	}
+}
+
+// Options configures a single rewrite.  The zero value disables the
+// optional inline passes; DefaultOptions returns the settings the
+// positional RewriteHTML/CSS/JS helpers use.
+type Options struct {
+	// ProxyOrigin is the scheme://host[:port] the proxy is served from.
+	ProxyOrigin string
+	// BaseURL is the original URL of the document, used to resolve
+	// relative references.
+	BaseURL string
+	// InlineJS wraps inline <script> bodies in the runtime scope.
+	InlineJS bool
+	// RewriteInlineStyles rewrites style attributes and <style> elements.
+	RewriteInlineStyles bool
+	// KeepIntegrity leaves integrity attributes in place.
+	KeepIntegrity bool
+	// InjectBase adds a <base href> pointing through the proxy unless the
+	// page declares its own.
+	InjectBase bool
+	// ModuleURLs rewrites import("…") calls with a single string literal
+	// argument and replaces import.meta.url with the module's proxied URL
+	// (JS only).  Computed specifiers are left to the client runtime.
+	ModuleURLs bool
+	// RewriteMetaCSP rewrites <meta http-equiv="Content-Security-Policy">
+	// policies to admit the proxy.  When false such tags are removed, as
+	// the proxy removes the CSP header (HTML only).
+	RewriteMetaCSP bool
+	// RewriteLocation routes location assignments and document.domain
+	// through the client runtime, so navigations stay on the proxy and
+	// the upstream host is reported (JS and inline scripts).
+	RewriteLocation bool
+	// RuntimePath is the path on ProxyOrigin the client runtime is
+	// loaded from; empty means the rewriter default,
+	// /internex.runtime.js (HTML only).
+	RuntimePath string
+	// OmitRuntime skips injecting the client runtime (HTML only).
+	OmitRuntime bool
+	// DisableServiceWorkers has the injected runtime stub out
+	// navigator.serviceWorker registration (HTML only).
+	DisableServiceWorkers bool
+}
+
+// DefaultOptions returns the options used by RewriteHTML, RewriteCSS and
+// RewriteJS.
+func DefaultOptions(proxyOrigin, baseURL string) Options {
+	return Options{
+		ProxyOrigin:         proxyOrigin,
+		BaseURL:             baseURL,
+		InlineJS:            true,
+		RewriteInlineStyles: true,
+	}
+}
+
 // rewriteInput is the JSON envelope sent to the Rust FFI functions.
 type rewriteInput struct {
-	ProxyOrigin string `json:"proxy_origin"`
-	BaseURL     string `json:"base_url"`
-	Content     string `json:"content"`
+	ProxyOrigin           string `json:"proxy_origin"`
+	BaseURL               string `json:"base_url"`
+	Content               string `json:"content"`
+	InlineJS              bool   `json:"inline_js"`
+	RewriteInlineStyles   bool   `json:"rewrite_inline_styles"`
+	KeepIntegrity         bool   `json:"keep_integrity"`
+	InjectBase            bool   `json:"inject_base"`
+	ModuleURLs            bool   `json:"module_urls"`
+	RewriteMetaCSP        bool   `json:"rewrite_meta_csp"`
+	RewriteLocation       bool   `json:"rewrite_location"`
+	RuntimePath           string `json:"runtime_path,omitempty"`
+	OmitRuntime           bool   `json:"omit_runtime"`
+	DisableServiceWorkers bool   `json:"disable_service_workers"`
 }
 
-// RewriteHTML rewrites an HTML document through the Rust rewriter.
-func RewriteHTML(proxyOrigin, baseURL, content string) string {
-	return callRewrite("html", proxyOrigin, baseURL, content)
+// newRewriteInput builds the envelope for content rewritten with opts.
+func newRewriteInput(content string, opts Options) rewriteInput {
+	return rewriteInput{
+		ProxyOrigin:           opts.ProxyOrigin,
+		BaseURL:               opts.BaseURL,
+		Content:               content,
+		InlineJS:              opts.InlineJS,
+		RewriteInlineStyles:   opts.RewriteInlineStyles,
+		KeepIntegrity:         opts.KeepIntegrity,
+		ModuleURLs:            opts.ModuleURLs,
+		InjectBase:            opts.InjectBase,
+		RewriteMetaCSP:        opts.RewriteMetaCSP,
+		RewriteLocation:       opts.RewriteLocation,
+		RuntimePath:           opts.RuntimePath,
+		OmitRuntime:           opts.OmitRuntime,
+		DisableServiceWorkers: opts.DisableServiceWorkers,
+	}
 }
 
-// RewriteCSS rewrites a CSS stylesheet through the Rust rewriter.
-func RewriteCSS(proxyOrigin, baseURL, content string) string {
-	return callRewrite("css", proxyOrigin, baseURL, content)
+// envelopeBufs holds buffers the JSON envelope is encoded into.  The
+// buffer is lent to the rewriter for the duration of the call (the
+// *_n entry points take a pointer and length and copy what they keep),
+// so a rewrite no longer copies the document into a Go string and then
+// into C memory: the only per-call copy of the input is the encoding
+// itself, into a reused buffer.
+var envelopeBufs = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledEnvelope is the largest buffer returned to envelopeBufs, so an
+// occasional huge document does not stay resident.
+const maxPooledEnvelope = 4 << 20
+
+// RewriteWithOptions rewrites content of the given kind through the Rust
+// rewriter.  It fails if the envelope cannot be encoded or the rewriter
+// rejects the input.
+func RewriteWithOptions(kind ContentKind, content string, opts Options) (string, error) {
+	if kind == XML {
+		return RewriteXML(opts.ProxyOrigin, opts.BaseURL, content)
+	}
+
+	buf := envelopeBufs.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledEnvelope {
+			envelopeBufs.Put(buf)
+		}
+	}()
+	enc := json.NewEncoder(buf)
+	// The rewriter parses the envelope; HTML-safe escaping only inflates it.
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(newRewriteInput(content, opts))
+	if err != nil {
+		return "", fmt.Errorf("rewriter: encoding input: %w", err)
+	}
+
+	return rewriteFFI(kind, buf.Bytes())
 }
 
-// RewriteJS rewrites JavaScript source through the Rust rewriter.
-func RewriteJS(proxyOrigin, baseURL, content string) string {
-	return callRewrite("js", proxyOrigin, baseURL, content)
+// rewriteFFI hands an encoded envelope to the Rust rewriter; replaced in
+// tests.
+var rewriteFFI = rewriteEnvelope
+
+// rewriteEnvelope lends envelope to the rewriter entry point for kind and
+// returns its output.
+func rewriteEnvelope(kind ContentKind, envelope []byte) (string, error) {
+	// Passing Go memory is allowed: it holds no Go pointers and the
+	// rewriter does not retain it past the call.
+	cInput := (*C.char)(unsafe.Pointer(&envelope[0]))
+	cLen := C.size_t(len(envelope))
+
+	var cResult *C.char
+	switch kind {
+	case HTML:
+		cResult = C.rewrite_html_n(cInput, cLen)
+	case CSS:
+		cResult = C.rewrite_css_n(cInput, cLen)
+	case JS:
+		cResult = C.rewrite_js_n(cInput, cLen)
+	default:
+		return "", fmt.Errorf("rewriter: unsupported kind %v", kind)
+	}
+	if cResult == nil {
+		return "", fmt.Errorf("rewriter: %v rewrite failed", kind)
+	}
+	defer C.free_string(cResult)
+
+	return C.GoString(cResult), nil
 }
 
-// callRewrite marshals the input into JSON, calls the given Rust FFI function,
-// converts the result back to a Go string, and frees the Rust-allocated memory.
-func callRewrite(kind string, proxyOrigin, baseURL, content string) string {
-	payload, err := json.Marshal(rewriteInput{
-		ProxyOrigin: proxyOrigin,
-		BaseURL:     baseURL,
-		Content:     content,
-	})
+// rewriteCopying is RewriteWithOptions without envelopeBufs: the envelope
+// is marshalled into a fresh slice and copied into C memory for the
+// NUL-terminated entry points.  It is kept only so BenchmarkRewrite can
+// measure what the pooled path saves.
+func rewriteCopying(kind ContentKind, content string, opts Options) (string, error) {
+	payload, err := json.Marshal(newRewriteInput(content, opts))
 	if err != nil {
-		return content
+		return "", fmt.Errorf("rewriter: encoding input: %w", err)
 	}
-
 	cInput := C.CString(string(payload))
 	defer C.free(unsafe.Pointer(cInput))
 
 	var cResult *C.char
 	switch kind {
-	case "html":
+	case HTML:
 		cResult = C.rewrite_html(cInput)
-	case "css":
+	case CSS:
 		cResult = C.rewrite_css(cInput)
-	case "js":
+	case JS:
 		cResult = C.rewrite_js(cInput)
 	default:
-		return content
+		return "", fmt.Errorf("rewriter: unsupported kind %v", kind)
 	}
 	if cResult == nil {
-		return content
+		return "", fmt.Errorf("rewriter: %v rewrite failed", kind)
 	}
 	defer C.free_string(cResult)
 
-	return C.GoString(cResult)
+	return C.GoString(cResult), nil
+}
+
+// RewriteHTML rewrites an HTML document through the Rust rewriter.
+func RewriteHTML(proxyOrigin, baseURL, content string) string {
+	return callRewrite(HTML, proxyOrigin, baseURL, content)
+}
+
+// RewriteCSS rewrites a CSS stylesheet through the Rust rewriter.
+func RewriteCSS(proxyOrigin, baseURL, content string) string {
+	return callRewrite(CSS, proxyOrigin, baseURL, content)
+}
+
+// RewriteJS rewrites JavaScript source through the Rust rewriter.
+func RewriteJS(proxyOrigin, baseURL, content string) string {
+	return callRewrite(JS, proxyOrigin, baseURL, content)
+}
+
+// callRewrite rewrites with DefaultOptions, returning content unchanged if
+// the rewriter fails.
+func callRewrite(kind ContentKind, proxyOrigin, baseURL, content string) string {
+	result, err := RewriteWithOptions(kind, content, DefaultOptions(proxyOrigin, baseURL))
+	if err != nil {
+		return content
+	}
+	return result
 }
 
 // Rewrite reads source content, transforms it according to kind, and returns
-// a reader over the rewritten bytes.  This calls into the Rust shared library
-// through CGo.
+// a reader over the rewritten bytes.  It is RewriteContext without request
+// options; content the rewriter rejects is returned unchanged.
 func Rewrite(kind ContentKind, src io.Reader) (io.Reader, error) {
 	body, err := io.ReadAll(src)
 	if err != nil {
 		return nil, fmt.Errorf("rewriter: reading source: %w", err)
 	}
-
-	content := string(body)
-
-	// TODO: plumb proxy_origin and base_url from the request context.
-	proxyOrigin := "http://localhost:8080"
-	baseURL := ""
-
-	var result string
-	switch kind {
-	case HTML:
-		result = callRewrite("html", proxyOrigin, baseURL, content)
-	case CSS:
-		result = callRewrite("css", proxyOrigin, baseURL, content)
-	case JS:
-		result = callRewrite("js", proxyOrigin, baseURL, content)
-	default:
-		result = content
+	out, err := RewriteContext(context.Background(), kind, strings.NewReader(string(body)))
+	if err != nil {
+		return strings.NewReader(string(body)), nil
 	}
-
-	return strings.NewReader(result), nil
+	return out, nil
 }
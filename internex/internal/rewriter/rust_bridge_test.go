@@ -0,0 +1,149 @@
+package rewriter
+
+import (
+	"strings"
+	"testing"
+)
+
+// benchDoc is a 64 KiB page with a link every few hundred bytes.
+var benchDoc = "<!doctype html><html><body>" +
+	strings.Repeat(`<p>Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. <a href="https://example.com/next">next</a> <img src="https://cdn.example.com/a.png"></p>`+"\n", 300) +
+	"</body></html>"
+
+func TestRewriteCopyingMatchesPooled(t *testing.T) {
+	opts := DefaultOptions("http://localhost:8080", "https://example.com/")
+	for _, kind := range []ContentKind{HTML, CSS, JS} {
+		pooled, err := RewriteWithOptions(kind, benchDoc, opts)
+		if err != nil {
+			t.Fatalf("%v: RewriteWithOptions: %v", kind, err)
+		}
+		copied, err := rewriteCopying(kind, benchDoc, opts)
+		if err != nil {
+			t.Fatalf("%v: rewriteCopying: %v", kind, err)
+		}
+		if pooled != copied {
+			t.Errorf("%v: pooled and copying paths disagree", kind)
+		}
+	}
+}
+
+func BenchmarkRewrite(b *testing.B) {
+	opts := DefaultOptions("http://localhost:8080", "https://example.com/")
+	paths := []struct {
+		name    string
+		rewrite func(ContentKind, string, Options) (string, error)
+	}{
+		{"copying", rewriteCopying},
+		{"pooled", RewriteWithOptions},
+	}
+	for _, p := range paths {
+		b.Run(p.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchDoc)))
+			for i := 0; i < b.N; i++ {
+				if _, err := p.rewrite(HTML, benchDoc, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteWithOptionsEnvelope(t *testing.T) {
+	const doc = `<script src="https://example.com/a.js"></script>`
+	tests := []struct {
+		name string
+		kind ContentKind
+		opts Options
+		want rewriteInput
+	}{
+		{
+			name: "defaults",
+			kind: HTML,
+			opts: DefaultOptions("http://localhost:8080", "https://example.com/"),
+			want: rewriteInput{ProxyOrigin: "http://localhost:8080", BaseURL: "https://example.com/", Content: doc,
+				InlineJS: true, RewriteInlineStyles: true},
+		},
+		{
+			name: "integrity kept, inline scripts and styles left alone",
+			kind: HTML,
+			opts: Options{ProxyOrigin: "http://localhost:8080", KeepIntegrity: true},
+			want: rewriteInput{ProxyOrigin: "http://localhost:8080", Content: doc, KeepIntegrity: true},
+		},
+		{
+			name: "module URLs and location for a script",
+			kind: JS,
+			opts: Options{ProxyOrigin: "https://proxy.test", BaseURL: "https://example.com/m.js", ModuleURLs: true, RewriteLocation: true},
+			want: rewriteInput{ProxyOrigin: "https://proxy.test", BaseURL: "https://example.com/m.js", Content: doc,
+				ModuleURLs: true, RewriteLocation: true},
+		},
+		{
+			name: "runtime options",
+			kind: HTML,
+			opts: Options{ProxyOrigin: "https://proxy.test", RuntimePath: "/rt.js", DisableServiceWorkers: true, RewriteMetaCSP: true},
+			want: rewriteInput{ProxyOrigin: "https://proxy.test", Content: doc,
+				RuntimePath: "/rt.js", DisableServiceWorkers: true, RewriteMetaCSP: true},
+		},
+		{
+			name: "runtime omitted",
+			kind: CSS,
+			opts: Options{ProxyOrigin: "https://proxy.test", OmitRuntime: true, InjectBase: true},
+			want: rewriteInput{ProxyOrigin: "https://proxy.test", Content: doc, OmitRuntime: true, InjectBase: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := captureFFI(t, "out", nil)
+			got, err := RewriteWithOptions(tt.kind, doc, tt.opts)
+			if err != nil || got != "out" {
+				t.Fatalf("RewriteWithOptions = %q, %v", got, err)
+			}
+			if len(*calls) != 1 {
+				t.Fatalf("%d FFI calls, want 1", len(*calls))
+			}
+			call := (*calls)[0]
+			if call.kind != tt.kind {
+				t.Errorf("kind = %v, want %v", call.kind, tt.kind)
+			}
+			if call.input != tt.want {
+				t.Errorf("envelope = %+v\nwant       %+v", call.input, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvelopeWireFormat(t *testing.T) {
+	var raw string
+	old := rewriteFFI
+	rewriteFFI = func(kind ContentKind, envelope []byte) (string, error) {
+		raw = string(envelope)
+		return "", nil
+	}
+	t.Cleanup(func() { rewriteFFI = old })
+
+	RewriteWithOptions(HTML, "<a href=\"x\">&</a>", Options{ProxyOrigin: "http://p", KeepIntegrity: true})
+	for _, want := range []string{`"proxy_origin":"http://p"`, `"keep_integrity":true`, `"inline_js":false`, `"content":"<a href=\"x\">&</a>"`} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("envelope %s lacks %s", raw, want)
+		}
+	}
+	if strings.Contains(raw, "runtime_path") {
+		t.Errorf("envelope %s has an empty runtime_path", raw)
+	}
+}
+
+func TestWrappersUseDefaultOptions(t *testing.T) {
+	for _, tt := range []struct {
+		kind    ContentKind
+		rewrite func(proxyOrigin, baseURL, content string) string
+	}{{HTML, RewriteHTML}, {CSS, RewriteCSS}, {JS, RewriteJS}} {
+		calls := captureFFI(t, "out", nil)
+		if got := tt.rewrite("http://p", "https://example.com/", "in"); got != "out" {
+			t.Errorf("%v wrapper = %q", tt.kind, got)
+		}
+		want := newRewriteInput("in", DefaultOptions("http://p", "https://example.com/"))
+		if len(*calls) != 1 || (*calls)[0].kind != tt.kind || (*calls)[0].input != want {
+			t.Errorf("%v wrapper sent %+v, want %+v", tt.kind, *calls, want)
+		}
+	}
+}
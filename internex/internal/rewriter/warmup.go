@@ -0,0 +1,53 @@
+package rewriter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// warmupOrigin and warmupBase are the fixed origins used by Warmup and
+// Ping; nothing is fetched.
+const (
+	warmupOrigin = "http://localhost:8080"
+	warmupBase   = "https://example.com/"
+)
+
+// warmupSamples holds a tiny document per kind, each with one absolute
+// URL the rewriter must route through the proxy.
+var warmupSamples = []struct {
+	kind    ContentKind
+	content string
+}{
+	{HTML, `<!doctype html><a href="https://example.com/a">a</a>`},
+	{CSS, `a{background:url(https://example.com/a.png)}`},
+	{JS, `fetch("https://example.com/a.json");`},
+}
+
+// Warmup rewrites a small document of each kind, forcing the shared
+// library to load and its code to be paged in before the first request.
+// It fails if any rewrite errors or leaves its URL unproxied.
+func Warmup() error {
+	for _, s := range warmupSamples {
+		if err := checkRewrite(s.kind, s.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping checks that the rewriter is answering, with a single cheap
+// rewrite.  It is meant for readiness probes.
+func Ping() error {
+	return checkRewrite(warmupSamples[1].kind, warmupSamples[1].content)
+}
+
+func checkRewrite(kind ContentKind, content string) error {
+	out, err := RewriteWithOptions(kind, content, DefaultOptions(warmupOrigin, warmupBase))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, warmupOrigin+"/proxy?url=") {
+		return fmt.Errorf("rewriter: %v rewrite left its URL unproxied", kind)
+	}
+	return nil
+}
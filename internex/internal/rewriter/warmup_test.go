@@ -0,0 +1,29 @@
+package rewriter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWarmupLoadsRewriter(t *testing.T) {
+	if err := Warmup(); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+	if err := Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestWarmupRejectsUnproxiedOutput(t *testing.T) {
+	calls := captureFFI(t, `<a href="https://example.com/a">a</a>`, nil)
+	err := Warmup()
+	if err == nil || !strings.Contains(err.Error(), "unproxied") {
+		t.Fatalf("Warmup = %v, want an unproxied-URL error", err)
+	}
+	if len(*calls) != 1 {
+		t.Errorf("%d rewriter calls, want Warmup to stop at the first failure", len(*calls))
+	}
+	if c := (*calls)[0]; c.input.ProxyOrigin != warmupOrigin || c.input.BaseURL != warmupBase {
+		t.Errorf("warmup envelope origin/base = %q, %q", c.input.ProxyOrigin, c.input.BaseURL)
+	}
+}
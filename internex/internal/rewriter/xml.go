@@ -0,0 +1,188 @@
+package rewriter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// XML feeds (RSS, Atom, sitemaps)
+// ---------------------------------------------------------------------------
+//
+// Feeds are rewritten in Go: the document is tokenized with encoding/xml
+// and copied through byte-for-byte, replacing only the URL values, so
+// CDATA sections, comments, namespaces and formatting survive untouched.
+//
+// Rewritten are the text of RSS <link>, <comments>, <url> (channel image),
+// <guid> unless isPermaLink="false", and sitemap <loc>; and the href, src
+// and url attributes of any element, which covers Atom <link href>, RSS
+// <enclosure url> and Media RSS <media:content url>.  Only http(s) URLs
+// are rewritten; relative ones are resolved against the base URL.
+
+// urlTextElements are elements whose text content is a URL.
+var urlTextElements = map[string]bool{
+	"link":     true,
+	"comments": true,
+	"url":      true,
+	"guid":     true,
+	"loc":      true,
+}
+
+// urlAttrs are attributes holding a URL, on any element.
+var urlAttrs = map[string]bool{
+	"href": true,
+	"src":  true,
+	"url":  true,
+}
+
+// RewriteXML rewrites the URLs of an XML feed through the proxy.  It
+// fails on malformed XML.
+func RewriteXML(proxyOrigin, baseURL, content string) (string, error) {
+	base, _ := url.Parse(baseURL)
+	x := xmlRewriter{proxy: strings.TrimRight(proxyOrigin, "/"), base: base}
+	return x.rewrite(content)
+}
+
+type xmlRewriter struct {
+	proxy string
+	base  *url.URL
+}
+
+// xmlFrame is an open element: whether its text is a URL.
+type xmlFrame struct {
+	urlText bool
+}
+
+func (x *xmlRewriter) rewrite(src string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(src))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	// Bytes are copied verbatim, so the declared encoding does not matter.
+	d.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	var out strings.Builder
+	out.Grow(len(src) + len(src)/8)
+	var stack []xmlFrame
+	var last int64
+	for {
+		tok, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("rewriter: parsing XML: %w", err)
+		}
+		end := d.InputOffset()
+		raw := src[last:end]
+		last = end
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			urlText := urlTextElements[t.Name.Local]
+			if t.Name.Local == "guid" && attrValue(t, "isPermaLink") == "false" {
+				urlText = false
+			}
+			raw = x.rewriteAttrs(raw, t)
+			if !strings.HasSuffix(raw, "/>") {
+				stack = append(stack, xmlFrame{urlText: urlText})
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 && stack[len(stack)-1].urlText {
+				raw = x.rewriteText(raw, string(t))
+			}
+		}
+		out.WriteString(raw)
+	}
+	out.WriteString(src[last:])
+	return out.String(), nil
+}
+
+func attrValue(t xml.StartElement, local string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// rewriteAttrs replaces URL attribute values inside the raw start tag.
+func (x *xmlRewriter) rewriteAttrs(raw string, t xml.StartElement) string {
+	for _, a := range t.Attr {
+		if !urlAttrs[a.Name.Local] || (a.Name.Space != "" && a.Name.Space != "xlink") {
+			continue
+		}
+		proxied, ok := x.proxyURL(a.Value)
+		if !ok {
+			continue
+		}
+		name := a.Name.Local
+		if a.Name.Space != "" {
+			name = a.Name.Space + ":" + name
+		}
+		re := regexp.MustCompile(`(\s` + regexp.QuoteMeta(name) + `\s*=\s*)("[^"]*"|'[^']*')`)
+		raw = re.ReplaceAllStringFunc(raw, func(m string) string {
+			sub := re.FindStringSubmatch(m)
+			quote := sub[2][:1]
+			return sub[1] + quote + escapeXMLAttr(proxied) + quote
+		})
+	}
+	return raw
+}
+
+// rewriteText replaces the URL in a text node or CDATA section, keeping
+// surrounding whitespace and the CDATA markers.
+func (x *xmlRewriter) rewriteText(raw, text string) string {
+	trimmed := strings.TrimSpace(text)
+	proxied, ok := x.proxyURL(trimmed)
+	if !ok {
+		return raw
+	}
+	if inner, ok := strings.CutPrefix(raw, "<![CDATA["); ok {
+		inner = strings.TrimSuffix(inner, "]]>")
+		if strings.Contains(proxied, "]]>") {
+			return raw
+		}
+		return "<![CDATA[" + strings.Replace(inner, trimmed, proxied, 1) + "]]>"
+	}
+	lead := raw[:len(raw)-len(strings.TrimLeft(raw, " \t\r\n"))]
+	trail := raw[len(strings.TrimRight(raw, " \t\r\n")):]
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(proxied))
+	return lead + buf.String() + trail
+}
+
+// proxyURL resolves raw against the base and returns its proxy form.
+func (x *xmlRewriter) proxyURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || strings.HasPrefix(raw, x.proxy+"/proxy?url=") || strings.HasPrefix(raw, "/proxy?url=") {
+		return "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	if x.base != nil {
+		u = x.base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	return x.proxy + "/proxy?url=" + url.QueryEscape(u.String()), true
+}
+
+func escapeXMLAttr(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
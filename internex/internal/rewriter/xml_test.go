@@ -0,0 +1,127 @@
+package rewriter
+
+import (
+	"net/url"
+	"testing"
+)
+
+const xmlProxy = "http://localhost:8080"
+
+// proxied is the proxy form of u that RewriteXML writes.
+func proxied(u string) string {
+	return xmlProxy + "/proxy?url=" + url.QueryEscape(u)
+}
+
+func TestRewriteXML(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+		in   string
+		want string
+	}{
+		{
+			name: "rss link",
+			base: "https://example.com/feed.xml",
+			in:   `<rss version="2.0"><channel><link>https://example.com/</link></channel></rss>`,
+			want: `<rss version="2.0"><channel><link>` + proxied("https://example.com/") + `</link></channel></rss>`,
+		},
+		{
+			name: "rss relative comments keep whitespace",
+			base: "https://example.com/feed.xml",
+			in:   "<item><comments>\n  /post/1#comments\n</comments></item>",
+			want: "<item><comments>\n  " + proxied("https://example.com/post/1#comments") + "\n</comments></item>",
+		},
+		{
+			name: "rss enclosure url",
+			base: "https://example.com/feed.xml",
+			in:   `<item><enclosure url="https://cdn.example.com/ep1.mp3" length="1024" type="audio/mpeg"/></item>`,
+			want: `<item><enclosure url="` + proxied("https://cdn.example.com/ep1.mp3") + `" length="1024" type="audio/mpeg"/></item>`,
+		},
+		{
+			name: "rss enclosure single quotes",
+			base: "https://example.com/feed.xml",
+			in:   `<enclosure type='audio/mpeg' url='ep2.mp3'/>`,
+			want: `<enclosure type='audio/mpeg' url='` + proxied("https://example.com/ep2.mp3") + `'/>`,
+		},
+		{
+			name: "cdata link",
+			base: "https://example.com/feed.xml",
+			in:   `<item><link><![CDATA[https://example.com/a?x=1&y=2]]></link></item>`,
+			want: `<item><link><![CDATA[` + proxied("https://example.com/a?x=1&y=2") + `]]></link></item>`,
+		},
+		{
+			name: "entity-escaped link",
+			base: "https://example.com/feed.xml",
+			in:   `<item><link>https://example.com/b?x=1&amp;y=2</link></item>`,
+			want: `<item><link>` + proxied("https://example.com/b?x=1&y=2") + `</link></item>`,
+		},
+		{
+			name: "entity-escaped enclosure url",
+			base: "https://example.com/feed.xml",
+			in:   `<enclosure url="https://cdn.example.com/e.mp3?a=1&amp;b=2"/>`,
+			want: `<enclosure url="` + proxied("https://cdn.example.com/e.mp3?a=1&b=2") + `"/>`,
+		},
+		{
+			name: "guid that is not a permalink",
+			base: "https://example.com/feed.xml",
+			in:   `<item><guid isPermaLink="false">https://example.com/p/1</guid><guid>https://example.com/p/2</guid></item>`,
+			want: `<item><guid isPermaLink="false">https://example.com/p/1</guid><guid>` + proxied("https://example.com/p/2") + `</guid></item>`,
+		},
+		{
+			name: "rss description untouched",
+			base: "https://example.com/feed.xml",
+			in:   `<item><title>See https://example.com/x</title><description><![CDATA[<a href="https://example.com/x">x</a>]]></description></item>`,
+			want: `<item><title>See https://example.com/x</title><description><![CDATA[<a href="https://example.com/x">x</a>]]></description></item>`,
+		},
+		{
+			name: "atom links",
+			base: "https://example.com/atom.xml",
+			in: `<feed xmlns="http://www.w3.org/2005/Atom"><id>https://example.com/</id>` +
+				`<link rel="self" href="https://example.com/atom.xml"/>` +
+				`<entry><link href="/entry/1" rel="alternate"></link></entry></feed>`,
+			want: `<feed xmlns="http://www.w3.org/2005/Atom"><id>https://example.com/</id>` +
+				`<link rel="self" href="` + proxied("https://example.com/atom.xml") + `"/>` +
+				`<entry><link href="` + proxied("https://example.com/entry/1") + `" rel="alternate"></link></entry></feed>`,
+		},
+		{
+			name: "atom link with entity-escaped href",
+			base: "https://example.com/atom.xml",
+			in:   `<link href="https://example.com/e?id=1&amp;v=2"/>`,
+			want: `<link href="` + proxied("https://example.com/e?id=1&v=2") + `"/>`,
+		},
+		{
+			name: "non-http and already proxied left alone",
+			base: "https://example.com/feed.xml",
+			in:   `<item><link>mailto:editor@example.com</link><enclosure url="` + proxied("https://example.com/a.mp3") + `"/></item>`,
+			want: `<item><link>mailto:editor@example.com</link><enclosure url="` + proxied("https://example.com/a.mp3") + `"/></item>`,
+		},
+		{
+			name: "declaration and comments kept",
+			base: "https://example.com/feed.xml",
+			in:   "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<!-- feed --><rss><link>https://example.com/</link></rss>\n",
+			want: "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<!-- feed --><rss><link>" + proxied("https://example.com/") + "</link></rss>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RewriteXML(xmlProxy+"/", tt.base, tt.in)
+			if err != nil {
+				t.Fatalf("RewriteXML: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("RewriteXML =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteXMLViaRewriteWithOptions(t *testing.T) {
+	in := `<rss><channel><link>https://example.com/</link></channel></rss>`
+	got, err := RewriteWithOptions(XML, in, DefaultOptions(xmlProxy, "https://example.com/feed.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<rss><channel><link>` + proxied("https://example.com/") + `</link></channel></rss>`; got != want {
+		t.Errorf("RewriteWithOptions(XML) = %s, want %s", got, want)
+	}
+}
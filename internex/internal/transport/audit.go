@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Modification audit
+// ---------------------------------------------------------------------------
+//
+// Regulated deployments need a record of what the proxy changed in each
+// response.  When ModificationLog is set, the per-request log line gains
+// counts of URLs rewritten, headers stripped and scripts injected.  Body
+// counts are taken by diffing the document before and after rewriting,
+// so they cover the Rust rewriter and the Go JSON pass alike.
+
+// ModificationLog adds modification counts to every proxy request log.
+var ModificationLog bool
+
+// modifications aggregates the changes made to one response.
+type modifications struct {
+	urlsRewritten   int
+	headersStripped int
+	scriptsInjected int
+}
+
+// countHeaders records the upstream headers CopyResponseHeadersWithContext
+// drops from src when passing through the security headers in keep.
+func (m *modifications) countHeaders(src http.Header, keep []string) {
+	for k := range src {
+		if droppedResponseHeader(k, keep) {
+			m.headersStripped++
+		}
+	}
+}
+
+// proxyURLMarkers follow the proxy origin in each form of proxy URL the
+// rewriters emit.
+var proxyURLMarkers = []string{"/proxy?url=", "/p/", "/f/"}
+
+// countBody records the proxy URLs and <script> elements present in
+// after but not in before.  Proxy URLs are counted under each of
+// origins, the proxy origins the document may have been rewritten
+// against.
+func (m *modifications) countBody(before, after string, origins ...string) {
+	seen := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		if seen[origin] {
+			continue
+		}
+		seen[origin] = true
+		for _, marker := range proxyURLMarkers {
+			prefix := origin + marker
+			m.urlsRewritten += max(0, strings.Count(after, prefix)-strings.Count(before, prefix))
+		}
+	}
+	m.scriptsInjected += max(0, countScriptTags(after)-countScriptTags(before))
+}
+
+// logFields returns the counts as structured-logging key/value pairs.
+func (m *modifications) logFields() []any {
+	return []any{
+		"urls_rewritten", m.urlsRewritten,
+		"headers_stripped", m.headersStripped,
+		"scripts_injected", m.scriptsInjected,
+	}
+}
+
+func countScriptTags(s string) int {
+	return strings.Count(strings.ToLower(s), "<script")
+}
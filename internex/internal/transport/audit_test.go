@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestModificationCounts(t *testing.T) {
+	const origin = "http://localhost:8080"
+	upstream := http.Header{
+		"Content-Type":            {"text/html"},
+		"Connection":              {"close"},
+		"Content-Security-Policy": {"default-src 'self'"},
+		"X-Frame-Options":         {"DENY"},
+		"Referrer-Policy":         {"no-referrer"},
+	}
+	before := `<html><head><script src="app.js"></script></head><body>
+<a href="https://example.com/p/1">one</a>
+<a href="` + origin + `/proxy?url=https%3A%2F%2Fexample.com%2F">already proxied</a>
+<form action="https://example.com/search"></form>
+<img src="https://cdn.example.com/a.png">
+</body></html>`
+	after := `<html><head><script src="` + origin + `/internex.runtime.js"></script><script src="app.js"></script></head><body>
+<a href="` + origin + `/proxy?url=https%3A%2F%2Fexample.com%2Fp%2F1">one</a>
+<a href="` + origin + `/proxy?url=https%3A%2F%2Fexample.com%2F">already proxied</a>
+<form action="` + origin + `/f/aHR0cHM6Ly9leGFtcGxlLmNvbS9zZWFyY2g"></form>
+<img src="` + origin + `/p/aHR0cHM6Ly9jZG4uZXhhbXBsZS5jb20vYS5wbmc">
+</body></html>`
+
+	tests := []struct {
+		name      string
+		keep      []string
+		preserved []string
+		origins   []string
+		want      modifications
+	}{
+		{"default", nil, nil, []string{origin}, modifications{urlsRewritten: 3, headersStripped: 4, scriptsInjected: 1}},
+		{"keep", []string{"content-security-policy"}, nil, []string{origin}, modifications{urlsRewritten: 3, headersStripped: 3, scriptsInjected: 1}},
+		{"preserved", nil, []string{"X-Frame-Options", "Referrer-Policy"}, []string{origin}, modifications{urlsRewritten: 3, headersStripped: 2, scriptsInjected: 1}},
+		{"origin counted once", nil, nil, []string{origin, origin}, modifications{urlsRewritten: 3, headersStripped: 4, scriptsInjected: 1}},
+		{"other origin", nil, nil, []string{"https://proxy.example"}, modifications{headersStripped: 4, scriptsInjected: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := PreservedHeaders
+			PreservedHeaders = tt.preserved
+			defer func() { PreservedHeaders = old }()
+
+			var m modifications
+			m.countHeaders(upstream, tt.keep)
+			m.countBody(before, after, tt.origins...)
+			if m != tt.want {
+				t.Errorf("counts = %+v, want %+v", m, tt.want)
+			}
+		})
+	}
+}
+
+func TestModificationLogRecordsCounts(t *testing.T) {
+	resetSessions(t)
+	logs := withCaptureLogger(t)
+	ModificationLog = true
+	t.Cleanup(func() { ModificationLog = false })
+
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Write([]byte(`{"next":"https://example.com/2","items":[{"img":"https://cdn.example.com/a.png"}],"n":3}`))
+	})
+	rec := serve(t, http.MethodGet, EncodeProxyPath(up.URL+"/data.json")+"&rewrite_json=1&keep=x-frame-options", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	e := logs.wait(t, "proxy request")
+	for k, want := range map[string]int{"urls_rewritten": 2, "headers_stripped": 1, "scripts_injected": 0} {
+		if got := e.kv[k]; got != want {
+			t.Errorf("%s = %v, want %d", k, got, want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"net/http"
+)
+
+// ---------------------------------------------------------------------------
+// HTTP authentication challenges
+// ---------------------------------------------------------------------------
+//
+// A 401 from the upstream carries a WWW-Authenticate challenge.  Relayed
+// verbatim, it makes the browser show its usual credentials prompt for
+// the proxy origin; the Authorization header it then sends is forwarded
+// upstream like any other allowlisted header.  Note that browsers scope
+// cached credentials to the proxy origin, so every proxied site under
+// the same /proxy path may receive them.
+//
+// 407 is different: Proxy-Authenticate is hop-by-hop and addressed to
+// the proxy itself (normally the configured egress proxy), and the
+// browser's answer would never reach it.  Such responses become 502s.
+
+// AuthChallengeMode selects how upstream 401 challenges are handled.
+type AuthChallengeMode int
+
+const (
+	// AuthRelay passes 401 responses and their WWW-Authenticate
+	// challenges to the browser unmodified.
+	AuthRelay AuthChallengeMode = iota
+	// AuthStrip removes WWW-Authenticate so the browser never prompts;
+	// the 401 status and body are still relayed.
+	AuthStrip
+)
+
+// AuthChallenges is the policy applied to upstream 401 responses.
+var AuthChallenges = AuthRelay
+
+// applyAuthChallenge adjusts the challenge headers already copied into
+// dst.  It returns false when the response must not be relayed at all.
+func applyAuthChallenge(dst http.Header, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		if AuthChallenges == AuthStrip {
+			dst.Del("WWW-Authenticate")
+		}
+	case http.StatusProxyAuthRequired:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthChallengeRoundTrip(t *testing.T) {
+	const challenge = `Basic realm="staff", charset="UTF-8"`
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && user == "ann" && pass == "s3cret" {
+			w.Write([]byte("welcome"))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	tests := []struct {
+		name          string
+		mode          AuthChallengeMode
+		wantChallenge string
+	}{
+		{"relayed", AuthRelay, challenge},
+		{"stripped", AuthStrip, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := AuthChallenges
+			AuthChallenges = tt.mode
+			t.Cleanup(func() { AuthChallenges = old })
+
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/admin", nil)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want 401", rec.Code)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantChallenge)
+			}
+
+			// The browser answers the prompt; its Authorization goes upstream.
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth("ann", "s3cret")
+			rec = proxyRequest(t, http.MethodGet, up.URL+"/admin", req.Header)
+			if rec.Code != http.StatusOK || rec.Body.String() != "welcome" {
+				t.Errorf("authorized request = %d %q, want 200 welcome", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestProxyAuthRequiredNotRelayed(t *testing.T) {
+	resetSessions(t)
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="egress"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+	rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if got := rec.Header().Get("Proxy-Authenticate"); got != "" {
+		t.Errorf("Proxy-Authenticate relayed: %q", got)
+	}
+}
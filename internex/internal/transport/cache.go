@@ -0,0 +1,210 @@
+package transport
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Rewritten response cache
+// ---------------------------------------------------------------------------
+//
+// An optional in-memory LRU of rewritten documents, so reloads are
+// neither re-fetched nor re-rewritten.  Entries are keyed by session,
+// target URL and the cookies sent upstream, so a page is never served to
+// another session or after the session's cookies change.  Requests with
+// credentials of their own (Authorization, Proxy-Authorization) bypass
+// the cache: the session key is shared by every client by default, so
+// such a page would reach clients without them.  Only plain 200 GET
+// responses are stored, and never ones that set cookies, vary on
+// request headers other than Accept-Encoding or Origin (or Cookie, with
+// CacheVaryCookie), or are marked no-store or no-cache.  A request with a matching If-None-Match or
+// If-Modified-Since is answered 304 from the cache.
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    string
+	expires time.Time
+}
+
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+// CacheVaryCookie lets responses with Vary: Cookie be cached.  Entries are
+// keyed by session and by the cookies sent upstream, so such a response
+// is only replayed to the session and cookie state it was fetched with.
+// Off by default: Vary: Cookie responses are not stored at all.
+var CacheVaryCookie bool
+
+var docCache = &responseCache{
+	lru:     list.New(),
+	entries: make(map[string]*list.Element),
+}
+
+// SetResponseCache sizes the rewritten response cache to maxBytes of
+// bodies, each kept for at most ttl.  A zero or negative value for
+// either disables the cache, which is the default.  Existing entries are
+// dropped.
+func SetResponseCache(maxBytes int64, ttl time.Duration) {
+	docCache.mu.Lock()
+	defer docCache.mu.Unlock()
+	docCache.maxBytes = maxBytes
+	docCache.ttl = ttl
+	docCache.size = 0
+	docCache.lru.Init()
+	docCache.entries = make(map[string]*list.Element)
+}
+
+func (c *responseCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxBytes > 0 && c.ttl > 0
+}
+
+// cacheKey identifies a cached document.
+func cacheKey(sessKey, targetURL, cookieHeader string) string {
+	return sessKey + "\x00" + targetURL + "\x00" + cookieHeader
+}
+
+// get returns the fresh entry for key, if any.
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// put stores a document, evicting the least recently used entries to
+// stay within maxBytes.  Bodies larger than the whole cache are skipped.
+func (c *responseCache) put(key string, status int, header http.Header, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxBytes <= 0 || c.ttl <= 0 || int64(len(body)) > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	e := &cacheEntry{key: key, status: status, header: header, body: body, expires: time.Now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += int64(len(body))
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// cacheableRequest reports whether r may be answered from, or stored in,
+// the cache.  Requests whose keep or norewrite parameters change the
+// response are not, nor are requests carrying credentials.
+func cacheableRequest(r *http.Request, method string) bool {
+	if method != http.MethodGet || r.Method != http.MethodGet ||
+		r.Header.Get("Range") != "" || isWebSocketUpgrade(r.Header) ||
+		r.Header.Get("Authorization") != "" || r.Header.Get("Proxy-Authorization") != "" ||
+		r.URL.Query().Has("keep") || r.URL.Query().Has("norewrite") {
+		return false
+	}
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "no-cache") &&
+		!strings.EqualFold(r.Header.Get("Pragma"), "no-cache")
+}
+
+// cacheableResponse reports whether an upstream response may be stored.
+func cacheableResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, v := range resp.Header.Values("Cache-Control") {
+		v = strings.ToLower(v)
+		if strings.Contains(v, "no-store") || strings.Contains(v, "no-cache") {
+			return false
+		}
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(f)) {
+			case "", "accept-encoding", "origin":
+			case "cookie":
+				if !CacheVaryCookie {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cachedHeaders are the headers repeated on a 304 from the cache.
+var cachedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// serveCached answers r from e: 304 when its validators match, else the
+// stored document.
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry) {
+	h := w.Header()
+	h.Set("X-Cache", "HIT")
+	if notModified(r.Header, e.header) {
+		for _, k := range cachedHeaders {
+			if vs := e.header.Values(k); len(vs) > 0 {
+				h[k] = append([]string(nil), vs...)
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for k, vs := range e.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	writeRewritten(w, r, e.status, e.body)
+}
+
+// notModified evaluates a request's conditional headers against a
+// cached response's validators (RFC 9110 §13.2.2): If-None-Match takes
+// precedence over If-Modified-Since.
+func notModified(req, cached http.Header) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(cached.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(cached.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withResponseCache enables the document cache for the test.
+func withResponseCache(t *testing.T) {
+	t.Helper()
+	SetResponseCache(1<<20, time.Minute)
+	t.Cleanup(func() { SetResponseCache(0, 0) })
+}
+
+func TestResponseCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		setCookie  bool
+		first      http.Header
+		second     http.Header
+		wantStatus int
+		wantHits   int32
+		wantCached bool
+	}{
+		{
+			name:       "repeat is served from cache",
+			wantStatus: http.StatusOK,
+			wantHits:   1,
+			wantCached: true,
+		},
+		{
+			name:       "conditional request gets 304",
+			second:     http.Header{"If-None-Match": {`"v1"`}},
+			wantStatus: http.StatusNotModified,
+			wantHits:   1,
+			wantCached: true,
+		},
+		{
+			name:       "stale validator gets the document",
+			second:     http.Header{"If-None-Match": {`"v0"`}},
+			wantStatus: http.StatusOK,
+			wantHits:   1,
+			wantCached: true,
+		},
+		{
+			name:       "responses setting cookies are not stored",
+			setCookie:  true,
+			wantStatus: http.StatusOK,
+			wantHits:   2,
+		},
+		{
+			name:       "no-cache request bypasses",
+			second:     http.Header{"Cache-Control": {"no-cache"}},
+			wantStatus: http.StatusOK,
+			wantHits:   2,
+		},
+		{
+			name:       "credentials are never shared",
+			first:      http.Header{"Authorization": {"Bearer alice"}},
+			second:     http.Header{"Authorization": {"Bearer bob"}},
+			wantStatus: http.StatusOK,
+			wantHits:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			withResponseCache(t)
+			up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/css")
+				w.Header().Set("ETag", `"v1"`)
+				if tt.setCookie {
+					w.Header().Set("Set-Cookie", "a=1")
+				}
+				w.Write([]byte("/* " + r.Header.Get("Authorization") + " */"))
+			})
+
+			first := proxyRequest(t, http.MethodGet, up.URL+"/a.css", tt.first)
+			if first.Code != http.StatusOK {
+				t.Fatalf("first status = %d", first.Code)
+			}
+			second := proxyRequest(t, http.MethodGet, up.URL+"/a.css", tt.second)
+			if second.Code != tt.wantStatus {
+				t.Errorf("second status = %d, want %d", second.Code, tt.wantStatus)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+			if cached := second.Header().Get("X-Cache") == "HIT"; cached != tt.wantCached {
+				t.Errorf("served from cache = %v, want %v", cached, tt.wantCached)
+			}
+			if tt.second.Get("Authorization") != "" && second.Body.String() != "/* "+tt.second.Get("Authorization")+" */" {
+				t.Errorf("second body = %q, got another client's page", second.Body.String())
+			}
+		})
+	}
+}
+
+func TestCacheableRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+		want   bool
+	}{
+		{"plain", "/proxy?url=x", nil, true},
+		{"authorization", "/proxy?url=x", http.Header{"Authorization": {"Basic YTpi"}}, false},
+		{"proxy authorization", "/proxy?url=x", http.Header{"Proxy-Authorization": {"Basic YTpi"}}, false},
+		{"range", "/proxy?url=x", http.Header{"Range": {"bytes=0-1"}}, false},
+		{"no-store", "/proxy?url=x", http.Header{"Cache-Control": {"no-store"}}, false},
+		{"norewrite", "/proxy?url=x&norewrite=js", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, tt.target, nil)
+			for k, vs := range tt.header {
+				r.Header[k] = vs
+			}
+			if got := cacheableRequest(r, http.MethodGet); got != tt.want {
+				t.Errorf("cacheableRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaryCookieNotShared(t *testing.T) {
+	for _, varyCookie := range []bool{false, true} {
+		t.Run(fmt.Sprintf("CacheVaryCookie=%v", varyCookie), func(t *testing.T) {
+			resetSessions(t)
+			withResponseCache(t)
+			ClientSessions = true
+			CacheVaryCookie = varyCookie
+			t.Cleanup(func() { ClientSessions, CacheVaryCookie = false, false })
+			var n atomic.Int32
+			up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/css")
+				w.Header().Set("Vary", "Accept-Encoding, Cookie")
+				fmt.Fprintf(w, "/* page %d */", n.Add(1))
+			})
+			as := func(client string) *httptest.ResponseRecorder {
+				return proxyRequest(t, http.MethodGet, up.URL+"/a.css", http.Header{"Cookie": {ClientTokenCookie + "=" + client}})
+			}
+
+			alice := as("alice")
+			again := as("alice")
+			bob := as("bob")
+			if bob.Body.String() == alice.Body.String() {
+				t.Errorf("bob was served alice's page %q", bob.Body.String())
+			}
+			if cached := again.Header().Get("X-Cache") == "HIT"; cached != varyCookie {
+				t.Errorf("repeat served from cache = %v, want %v", cached, varyCookie)
+			}
+			wantHits := int32(3)
+			if varyCookie {
+				wantHits = 2
+			}
+			if got := hits.Load(); got != wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, wantHits)
+			}
+		})
+	}
+}
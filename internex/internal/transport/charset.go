@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ---------------------------------------------------------------------------
+// Charset transcoding
+// ---------------------------------------------------------------------------
+//
+// The rewriter works on UTF-8.  Documents in another charset are decoded
+// to UTF-8 before rewriting and served with charset=utf-8, which takes
+// precedence over any <meta charset> left in the markup.  Built in are
+// UTF-8 and windows-1252, which browsers also use for the "iso-8859-1",
+// "latin1" and "us-ascii" labels; every other WHATWG encoding (Shift_JIS,
+// GBK, EUC-KR, …) comes from golang.org/x/text (see charset_xtext.go).
+// Documents in a charset we cannot decode are passed through unrewritten.
+
+// CharsetDecoder converts a document in some charset to UTF-8.
+type CharsetDecoder func(b []byte) (string, error)
+
+var (
+	charsetsMu sync.RWMutex
+	charsets   = map[string]CharsetDecoder{
+		"utf-8":             decodeUTF8,
+		"utf8":              decodeUTF8,
+		"unicode-1-1-utf-8": decodeUTF8,
+		"windows-1252":      decodeWindows1252,
+		"cp1252":            decodeWindows1252,
+		"x-cp1252":          decodeWindows1252,
+		"iso-8859-1":        decodeWindows1252,
+		"iso8859-1":         decodeWindows1252,
+		"iso_8859-1":        decodeWindows1252,
+		"latin1":            decodeWindows1252,
+		"l1":                decodeWindows1252,
+		"ascii":             decodeWindows1252,
+		"us-ascii":          decodeWindows1252,
+	}
+
+	// fallbackCharset, when set, resolves labels missing from charsets.
+	fallbackCharset func(label string) (CharsetDecoder, bool)
+)
+
+// RegisterCharset installs a decoder for a charset label, replacing any
+// existing one.  Labels are case-insensitive.
+func RegisterCharset(label string, dec CharsetDecoder) {
+	charsetsMu.Lock()
+	defer charsetsMu.Unlock()
+	charsets[strings.ToLower(label)] = dec
+}
+
+func lookupCharset(label string) (CharsetDecoder, bool) {
+	label = strings.ToLower(strings.TrimSpace(label))
+	charsetsMu.RLock()
+	dec, ok := charsets[label]
+	charsetsMu.RUnlock()
+	if !ok && fallbackCharset != nil {
+		return fallbackCharset(label)
+	}
+	return dec, ok
+}
+
+func decodeUTF8(b []byte) (string, error) {
+	return string(bytes.TrimPrefix(b, utf8BOM)), nil
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// windows1252High maps bytes 0x80–0x9F; the rest of the charset matches
+// Latin-1, i.e. the byte value is the code point.
+var windows1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(b []byte) (string, error) {
+	var sb strings.Builder
+	sb.Grow(len(b) + len(b)/8)
+	for _, c := range b {
+		switch {
+		case c < 0x80:
+			sb.WriteByte(c)
+		case c < 0xA0:
+			sb.WriteRune(windows1252High[c-0x80])
+		default:
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String(), nil
+}
+
+// metaCharsetRE finds <meta charset=x> and the charset= parameter of
+// <meta http-equiv="Content-Type" content="…">.
+var metaCharsetRE = regexp.MustCompile(`(?i)<meta[^>]*?charset\s*=\s*["']?\s*([a-z0-9_.:-]+)`)
+
+// cssCharsetRE matches a leading @charset rule.
+var cssCharsetRE = regexp.MustCompile(`^@charset\s+"([^"]+)"`)
+
+// xmlEncodingRE matches the encoding of an XML declaration.
+var xmlEncodingRE = regexp.MustCompile(`^<\?xml[^>]*?encoding\s*=\s*["']([^"']+)["']`)
+
+// documentCharset returns the charset label of a document: a BOM, then
+// the Content-Type charset parameter, then an in-document declaration
+// (<meta> in the first 1024 bytes of HTML, @charset in CSS, the XML
+// declaration).  It returns
+// "" when none is declared.
+func documentCharset(contentType string, category ContentCategory, body []byte) string {
+	if bytes.HasPrefix(body, utf8BOM) {
+		return "utf-8"
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return params["charset"]
+	}
+	switch category {
+	case ContentHTML:
+		prescan := body[:min(len(body), 1024)]
+		if m := metaCharsetRE.FindSubmatch(prescan); m != nil {
+			return string(m[1])
+		}
+	case ContentCSS:
+		if m := cssCharsetRE.FindSubmatch(body); m != nil {
+			return string(m[1])
+		}
+	case ContentXML:
+		if m := xmlEncodingRE.FindSubmatch(body); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// decodeDocument converts body from the charset label (see
+// documentCharset) to UTF-8.  It reports whether the result is safe to
+// rewrite: false for a charset with no decoder.  An empty label is
+// assumed to mean UTF-8.
+func decodeDocument(label string, body []byte) (string, bool, error) {
+	if label == "" {
+		return string(body), true, nil
+	}
+	dec, ok := lookupCharset(label)
+	if !ok {
+		return "", false, nil
+	}
+	s, err := dec(body)
+	if err != nil {
+		return "", false, fmt.Errorf("decoding %s document: %w", label, err)
+	}
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	return s, true, nil
+}
+
+// setUTF8Charset sets the charset parameter of h's Content-Type to utf-8.
+func setUTF8Charset(h http.Header) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	params["charset"] = "utf-8"
+	h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+}
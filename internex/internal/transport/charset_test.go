@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+)
+
+func mustEncode(t *testing.T, enc interface{ String(string) (string, error) }, s string) string {
+	t.Helper()
+	out, err := enc.String(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDecodeDocument(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		body  string
+		want  string
+	}{
+		{"unlabelled", "", "plain", "plain"},
+		{"latin-1", "ISO-8859-1", "caf\xe9", "café"},
+		{"windows-1252 quotes", "windows-1252", "\x93hi\x94", "“hi”"},
+		{"shift_jis", "Shift_JIS", mustEncode(t, japanese.ShiftJIS.NewEncoder(), "日本語"), "日本語"},
+		{"euc-kr", "EUC-KR", mustEncode(t, korean.EUCKR.NewEncoder(), "한국어"), "한국어"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := decodeDocument(tt.label, []byte(tt.body))
+			if err != nil || !ok {
+				t.Fatalf("decodeDocument(%q) = ok %v, err %v", tt.label, ok, err)
+			}
+			if got != tt.want {
+				t.Errorf("decodeDocument(%q) = %q, want %q", tt.label, got, tt.want)
+			}
+		})
+	}
+
+	if _, ok, _ := decodeDocument("x-no-such-charset", []byte("x")); ok {
+		t.Error("unknown charset reported as decodable")
+	}
+}
+
+func TestProxyTranscodesLegacyCharsets(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "latin-1 header",
+			contentType: "text/html; charset=ISO-8859-1",
+			body:        "<html><body><a href=\"https://example.com/caf\xe9\">Caf\xe9</a></body></html>",
+			want:        "Café",
+		},
+		{
+			name:        "shift_jis meta",
+			contentType: "text/html",
+			body:        `<html><head><meta charset="Shift_JIS"></head><body>` + mustEncode(t, japanese.ShiftJIS.NewEncoder(), "日本語") + `</body></html>`,
+			want:        "日本語",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+			if ct := rec.Header().Get("Content-Type"); !strings.Contains(ct, "charset=utf-8") {
+				t.Errorf("Content-Type = %q, want charset=utf-8", ct)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package transport
+
+import (
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Labels not built in are resolved against the full WHATWG encoding
+// index from golang.org/x/text, so Shift_JIS, GBK, EUC-KR and the rest
+// are rewritten like UTF-8 pages.
+func init() {
+	fallbackCharset = func(label string) (CharsetDecoder, bool) {
+		enc, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, false
+		}
+		return func(b []byte) (string, error) {
+			out, err := enc.NewDecoder().Bytes(b)
+			return string(out), err
+		}, true
+	}
+}
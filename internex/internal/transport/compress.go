@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ---------------------------------------------------------------------------
+// Client-side compression
+// ---------------------------------------------------------------------------
+//
+// Upstream bodies are decoded before rewriting, so rewritten documents
+// would otherwise reach the client uncompressed.  They are re-encoded
+// with gzip when the client accepts it.  Streamed pass-through bodies are
+// never touched.
+
+// GzipResponses enables gzip encoding of rewritten documents.
+var GzipResponses = true
+
+// GzipMinBytes is the smallest rewritten body that is compressed; below
+// it the gzip overhead outweighs the saving.
+var GzipMinBytes = 1024
+
+// writeRewritten writes a rewritten document with status, gzip-encoded
+// when enabled, large enough and accepted by r.  It sets Content-Length
+// either way.
+func writeRewritten(w http.ResponseWriter, r *http.Request, status int, body string) {
+	h := w.Header()
+	if GzipResponses && len(body) >= GzipMinBytes && h.Get("Content-Encoding") == "" {
+		normalizeVary(h, "Accept-Encoding")
+		if clientAcceptsCoding(r.Header, "gzip") {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+			io.WriteString(zw, body)
+			if zw.Close() == nil {
+				h.Set("Content-Encoding", "gzip")
+				h.Set("Content-Length", strconv.Itoa(buf.Len()))
+				w.WriteHeader(status)
+				w.Write(buf.Bytes())
+				return
+			}
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteRewrittenGzip(t *testing.T) {
+	small := strings.Repeat("a", GzipMinBytes-1)
+	large := strings.Repeat("<p>hello</p>", GzipMinBytes)
+	tests := []struct {
+		name     string
+		body     string
+		accept   string
+		vary     string
+		wantGzip bool
+		wantVary string
+	}{
+		{"large, gzip accepted", large, "gzip, deflate, br", "", true, "Accept-Encoding"},
+		{"exactly the threshold", strings.Repeat("a", GzipMinBytes), "gzip", "", true, "Accept-Encoding"},
+		{"below the threshold", small, "gzip", "", false, ""},
+		{"no Accept-Encoding", large, "", "", false, "Accept-Encoding"},
+		{"identity only", large, "identity", "", false, "Accept-Encoding"},
+		{"gzip refused", large, "gzip;q=0, br", "", false, "Accept-Encoding"},
+		{"wildcard", large, "*", "", true, "Accept-Encoding"},
+		{"upstream Vary merged", large, "gzip", "origin, accept-encoding", true, "Origin, Accept-Encoding"},
+		{"upstream Vary kept below the threshold", small, "gzip", "Origin", false, "Origin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			if tt.vary != "" {
+				w.Header().Set("Vary", tt.vary)
+			}
+			writeRewritten(w, r, http.StatusOK, tt.body)
+
+			if got := w.Header().Get("Vary"); got != tt.wantVary {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+			if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length = %s for a %d-byte body", cl, w.Body.Len())
+			}
+			gzipped := w.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("gzip = %v, want %v", gzipped, tt.wantGzip)
+			}
+			body := w.Body.String()
+			if gzipped {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			}
+			if body != tt.body {
+				t.Errorf("body does not round-trip (%d bytes, want %d)", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestWriteRewrittenGzipDisabled(t *testing.T) {
+	GzipResponses = false
+	t.Cleanup(func() { GzipResponses = true })
+
+	r := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	writeRewritten(w, r, http.StatusOK, strings.Repeat("a", 2*GzipMinBytes))
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding = %q with GzipResponses off", ce)
+	}
+	if v := w.Header().Get("Vary"); v != "" {
+		t.Errorf("Vary = %q with GzipResponses off", v)
+	}
+}
@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Per-origin concurrency limits
+// ---------------------------------------------------------------------------
+//
+// Independent of rate limiting, each upstream origin can be capped to N
+// simultaneous in-flight requests.  A slot is held from just before the
+// upstream fetch until the upstream body is closed.  Requests that cannot
+// get a slot within OriginQueueTimeout are answered with 503.
+
+// OriginQueueTimeout is how long a request waits for a free per-origin
+// slot before giving up.
+var OriginQueueTimeout = 2 * time.Second
+
+var (
+	originSemMu              sync.Mutex
+	defaultOriginConcurrency int
+	originConcurrency        = make(map[string]int)
+	originSems               = make(map[string]chan struct{})
+)
+
+// SetOriginConcurrency caps simultaneous upstream requests to origin
+// (e.g. "https://example.com").  An empty origin or "*" sets the default
+// for origins without their own entry.  n <= 0 removes the cap.
+func SetOriginConcurrency(origin string, n int) {
+	originSemMu.Lock()
+	defer originSemMu.Unlock()
+	if origin == "" || origin == "*" {
+		defaultOriginConcurrency = n
+	} else {
+		originConcurrency[origin] = n
+	}
+	// Slots already held are released into their old semaphores.
+	originSems = make(map[string]chan struct{})
+}
+
+// originSemaphore returns the semaphore for origin, or nil if uncapped.
+func originSemaphore(origin string) chan struct{} {
+	originSemMu.Lock()
+	defer originSemMu.Unlock()
+
+	n, ok := originConcurrency[origin]
+	if !ok {
+		n = defaultOriginConcurrency
+	}
+	if n <= 0 {
+		return nil
+	}
+	sem, ok := originSems[origin]
+	if !ok {
+		sem = make(chan struct{}, n)
+		originSems[origin] = sem
+	}
+	return sem
+}
+
+// acquireOriginSlot waits for a free slot for origin.  It returns a
+// release func (safe to call more than once) and true on success, or
+// false if the queue timeout or ctx expired first.
+func acquireOriginSlot(ctx context.Context, origin string) (func(), bool) {
+	sem := originSemaphore(origin)
+	if sem == nil {
+		return func() {}, true
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-sem }) }
+
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	timer := time.NewTimer(OriginQueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Global concurrency limit
+// ---------------------------------------------------------------------------
+//
+// MaxIdleConns only bounds idle connections.  SetMaxConcurrency caps the
+// number of upstream requests in flight across all origins, which bounds
+// the proxy's outbound sockets.  A slot is held around the round trip and
+// until the body is closed; WebSocket bridges give theirs back once the
+// handshake completes.
+
+// ConcurrencyQueueTimeout is how long an upstream request waits for a
+// global slot.  Zero rejects immediately when all slots are busy.
+var ConcurrencyQueueTimeout = 2 * time.Second
+
+// ErrUpstreamBusy is returned by upstream fetches that found no free
+// global slot in time.
+var ErrUpstreamBusy = errors.New("too many concurrent upstream requests")
+
+var (
+	globalSemMu sync.RWMutex
+	globalSem   chan struct{}
+)
+
+// SetMaxConcurrency caps simultaneous upstream requests across all
+// origins.  n <= 0 removes the cap.
+func SetMaxConcurrency(n int) {
+	globalSemMu.Lock()
+	defer globalSemMu.Unlock()
+	if n <= 0 {
+		globalSem = nil
+		return
+	}
+	// Slots already held are released into the old semaphore.
+	globalSem = make(chan struct{}, n)
+}
+
+// acquireGlobalSlot waits for a global slot.  It returns a release func
+// (safe to call more than once), or ErrUpstreamBusy or ctx's error.
+func acquireGlobalSlot(ctx context.Context) (func(), error) {
+	globalSemMu.RLock()
+	sem := globalSem
+	globalSemMu.RUnlock()
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-sem }) }
+
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if ConcurrencyQueueTimeout <= 0 {
+		return nil, ErrUpstreamBusy
+	}
+
+	timer := time.NewTimer(ConcurrencyQueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrUpstreamBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// releaseOnClose runs release once the wrapped body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+// Close closes the body and releases the slot.  Bodies are closed from
+// several places (deferred closes, hooks, error paths), so only the first
+// call releases.
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// ---------------------------------------------------------------------------
+// WebSocket bridge limit
+// ---------------------------------------------------------------------------
+//
+// Each bridge holds a hijacked client connection, an upstream connection
+// and two copy goroutines for as long as the socket is open.
+// SetMaxWebSockets caps the bridges open at once per client and upstream
+// origin, the client being its token with ClientSessions and its address
+// otherwise.  An upgrade over the cap is answered with 503 before anything is sent
+// upstream; there is no queue, as sockets are not expected to close soon.
+
+var (
+	wsMu      sync.Mutex
+	maxWS     int
+	wsBridges = make(map[string]int)
+)
+
+// SetMaxWebSockets caps concurrent WebSocket bridges per client and
+// origin.  n <= 0 removes the cap.  Bridges already open are unaffected.
+func SetMaxWebSockets(n int) {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	maxWS = n
+}
+
+// webSocketKey returns the key r's bridge to origin counts against.
+// Session keys are not used: without client tokens every browser shares
+// one.
+func webSocketKey(r *http.Request, origin string) string {
+	if ClientSessions {
+		if c, err := r.Cookie(ClientTokenCookie); err == nil && validNamespace(c.Value) {
+			return "~" + c.Value + "|" + origin
+		}
+	}
+	return clientIP(r) + "|" + origin
+}
+
+// acquireWebSocketSlot reserves a bridge for key.  It returns a release
+// func (safe to call more than once) and true, or false if key is at the
+// cap.
+func acquireWebSocketSlot(key string) (func(), bool) {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	if maxWS > 0 && wsBridges[key] >= maxWS {
+		return nil, false
+	}
+	wsBridges[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			wsMu.Lock()
+			defer wsMu.Unlock()
+			if wsBridges[key]--; wsBridges[key] <= 0 {
+				delete(wsBridges, key)
+			}
+		})
+	}, true
+}
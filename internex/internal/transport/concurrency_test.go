@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrency(t *testing.T) {
+	const limit = 2
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		queued  bool
+	}{
+		{"rejected when the queue timeout is zero", 0, false},
+		{"queued until a slot frees", 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			SetMaxConcurrency(limit)
+			oldTimeout := ConcurrencyQueueTimeout
+			ConcurrencyQueueTimeout = tt.timeout
+			t.Cleanup(func() {
+				SetMaxConcurrency(0)
+				ConcurrencyQueueTimeout = oldTimeout
+			})
+
+			arrived := make(chan struct{}, limit+1)
+			unblock := make(chan struct{})
+			up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				arrived <- struct{}{}
+				<-unblock
+				w.Write([]byte("ok"))
+			})
+			t.Cleanup(func() {
+				select {
+				case <-unblock:
+				default:
+					close(unblock)
+				}
+			})
+
+			fetch := func() <-chan *httptest.ResponseRecorder {
+				done := make(chan *httptest.ResponseRecorder, 1)
+				go func() {
+					req := httptest.NewRequest(http.MethodGet, EncodeProxyPath(up.URL+"/slow"), nil)
+					rec := httptest.NewRecorder()
+					NewMux().ServeHTTP(rec, req)
+					done <- rec
+				}()
+				return done
+			}
+			var inFlight []<-chan *httptest.ResponseRecorder
+			for i := 0; i < limit; i++ {
+				inFlight = append(inFlight, fetch())
+				<-arrived
+			}
+
+			extra := fetch()
+			if !tt.queued {
+				rec := <-extra
+				if rec.Code != http.StatusServiceUnavailable {
+					t.Errorf("request %d: status = %d, want 503", limit+1, rec.Code)
+				}
+			} else {
+				select {
+				case <-arrived:
+					t.Fatalf("request %d reached the upstream while %d were in flight", limit+1, limit)
+				case rec := <-extra:
+					t.Fatalf("request %d finished early with %d", limit+1, rec.Code)
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+
+			close(unblock)
+			for i, done := range inFlight {
+				if rec := <-done; rec.Code != http.StatusOK {
+					t.Errorf("request %d: status = %d", i+1, rec.Code)
+				}
+			}
+			want := int32(limit)
+			if tt.queued {
+				if rec := <-extra; rec.Code != http.StatusOK {
+					t.Errorf("queued request: status = %d, want 200", rec.Code)
+				}
+				want++
+			}
+			if got := hits.Load(); got != want {
+				t.Errorf("upstream hits = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestOriginConcurrency(t *testing.T) {
+	const limit = 2
+	resetSessions(t)
+	oldTimeout := OriginQueueTimeout
+	OriginQueueTimeout = 100 * time.Millisecond
+
+	arrived := make(chan struct{}, limit+1)
+	unblock := make(chan struct{})
+	busy, busyHits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-unblock
+		w.Write([]byte("ok"))
+	})
+	other, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	})
+	SetOriginConcurrency(busy.URL, limit)
+	SetOriginConcurrency(other.URL, limit)
+	t.Cleanup(func() {
+		close(unblock)
+		SetOriginConcurrency(busy.URL, 0)
+		SetOriginConcurrency(other.URL, 0)
+		OriginQueueTimeout = oldTimeout
+	})
+
+	fetch := func(target string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			req := httptest.NewRequest(http.MethodGet, EncodeProxyPath(target), nil)
+			rec := httptest.NewRecorder()
+			NewMux().ServeHTTP(rec, req)
+			done <- rec
+		}()
+		return done
+	}
+	var inFlight []<-chan *httptest.ResponseRecorder
+	for i := 0; i < limit; i++ {
+		inFlight = append(inFlight, fetch(busy.URL+"/slow"))
+		<-arrived
+	}
+
+	// Another origin has its own slots.
+	select {
+	case rec := <-fetch(other.URL + "/"):
+		if rec.Code != http.StatusOK {
+			t.Errorf("other origin: status = %d, want 200", rec.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("other origin blocked behind the busy one")
+	}
+
+	start := time.Now()
+	rec := <-fetch(busy.URL + "/slow")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request %d: status = %d, want 503", limit+1, rec.Code)
+	}
+	if waited := time.Since(start); waited < OriginQueueTimeout {
+		t.Errorf("rejected after %v, before OriginQueueTimeout %v", waited, OriginQueueTimeout)
+	}
+	if got := busyHits.Load(); got != limit {
+		t.Errorf("busy upstream hits = %d, want %d", got, limit)
+	}
+
+	unblock <- struct{}{}
+	unblock <- struct{}{}
+	for i, done := range inFlight {
+		if rec := <-done; rec.Code != http.StatusOK {
+			t.Errorf("request %d: status = %d", i+1, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// CORS response rewriting
+// ---------------------------------------------------------------------------
+//
+// Every proxied page runs at ProxyOrigin, so an upstream
+// Access-Control-Allow-Origin naming the real site would never match the
+// Origin the browser sends.  These helpers re-target CORS headers at the
+// proxy while keeping the upstream's intent (wildcard vs. credentialed).
+
+// rewriteCORSHeaders adjusts Access-Control-* headers already copied into
+// dst.  A wildcard without credentials stays "*"; anything else is pinned
+// to ProxyOrigin, since browsers reject "*" for credentialed requests.
+func rewriteCORSHeaders(dst http.Header) {
+	allowOrigin := dst.Get("Access-Control-Allow-Origin")
+	if allowOrigin == "" {
+		return
+	}
+
+	credentials := strings.EqualFold(strings.TrimSpace(dst.Get("Access-Control-Allow-Credentials")), "true")
+	if credentials {
+		dst.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		dst.Del("Access-Control-Allow-Credentials")
+	}
+
+	if allowOrigin == "*" && !credentials {
+		return
+	}
+	dst.Set("Access-Control-Allow-Origin", ExtractOrigin(ProxyOrigin))
+	dst.Add("Vary", "Origin")
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// synthesizePreflightHeaders fills in any allow headers the upstream left
+// out of its preflight response, approving exactly what the browser asked
+// for.  Headers the upstream did send are left alone.
+func synthesizePreflightHeaders(dst, reqHeader http.Header) {
+	if dst.Get("Access-Control-Allow-Origin") == "" {
+		dst.Set("Access-Control-Allow-Origin", ExtractOrigin(ProxyOrigin))
+		dst.Set("Access-Control-Allow-Credentials", "true")
+		dst.Add("Vary", "Origin")
+	}
+	if dst.Get("Access-Control-Allow-Methods") == "" {
+		dst.Set("Access-Control-Allow-Methods", reqHeader.Get("Access-Control-Request-Method"))
+	}
+	if dst.Get("Access-Control-Allow-Headers") == "" {
+		if h := reqHeader.Get("Access-Control-Request-Headers"); h != "" {
+			dst.Set("Access-Control-Allow-Headers", h)
+		}
+	}
+	normalizeVary(dst)
+}
@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCORSCredentialed(t *testing.T) {
+	proxy := ExtractOrigin(ProxyOrigin)
+	tests := []struct {
+		name        string
+		allowOrigin string
+		credentials string
+		wantOrigin  string
+		wantCreds   string
+	}{
+		{"credentialed site origin", "https://site.example", "true", proxy, "true"},
+		{"credentialed wildcard", "*", "true", proxy, "true"},
+		{"credentials flag case", "https://site.example", " TRUE ", proxy, "true"},
+		{"uncredentialed site origin", "https://site.example", "", proxy, ""},
+		{"public wildcard", "*", "", "*", ""},
+		{"false credentials dropped", "*", "false", "*", ""},
+		{"no CORS", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.allowOrigin != "" {
+					w.Header().Set("Access-Control-Allow-Origin", tt.allowOrigin)
+				}
+				if tt.credentials != "" {
+					w.Header().Set("Access-Control-Allow-Credentials", tt.credentials)
+				}
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/api", http.Header{"Origin": {proxy}})
+			h := rec.Header()
+			if got := h.Values("Access-Control-Allow-Origin"); strings.Join(got, "|") != tt.wantOrigin {
+				t.Errorf("Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials"); got != tt.wantCreds {
+				t.Errorf("Allow-Credentials = %q, want %q", got, tt.wantCreds)
+			}
+			if tt.wantCreds == "true" && h.Get("Access-Control-Allow-Origin") == "*" {
+				t.Error("wildcard Allow-Origin on a credentialed response")
+			}
+			pinned := tt.wantOrigin == proxy
+			if varies := strings.Contains(h.Get("Vary"), "Origin"); varies != pinned {
+				t.Errorf("Vary = %q, want Origin listed: %v", h.Get("Vary"), pinned)
+			}
+		})
+	}
+}
+
+func TestCORSPreflightSynthesized(t *testing.T) {
+	resetSessions(t)
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	proxy := ExtractOrigin(ProxyOrigin)
+	rec := proxyRequest(t, http.MethodOptions, up.URL+"/api", http.Header{
+		"Origin":                         {proxy},
+		"Access-Control-Request-Method":  {"PUT"},
+		"Access-Control-Request-Headers": {"x-token"},
+	})
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      proxy,
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "PUT",
+		"Access-Control-Allow-Headers":     "x-token",
+		"Vary":                             "Origin",
+	}
+	for k, v := range want {
+		if got := rec.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
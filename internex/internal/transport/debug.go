@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Debug mode
+// ---------------------------------------------------------------------------
+
+// DebugMode enables developer-only diagnostics such as request body
+// capture.  It must never be enabled in production.  Set from the
+// DEBUG_MODE env var by cmd/server/main.go.
+var DebugMode bool
+
+// DebugBodyLimit bounds how many bytes of each request body are captured
+// when DebugMode is on.  The full body is still forwarded upstream.
+var DebugBodyLimit int64 = 4096
+
+// boundedBuffer keeps the first limit bytes written to it and counts the
+// rest, so capturing never grows with the size of the upload.
+type boundedBuffer struct {
+	buf   bytes.Buffer
+	limit int64
+	total int64
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.limit - int64(b.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// teeBody forwards reads from the client body while copying a bounded
+// prefix into buf.  The capture is logged once the transport closes it.
+type teeBody struct {
+	io.Reader
+	src       io.ReadCloser
+	buf       *boundedBuffer
+	targetURL string
+	logged    bool
+}
+
+func (t *teeBody) Close() error {
+	if !t.logged {
+		t.logged = true
+		getLogger().Debug("request body capture",
+			"url", t.targetURL,
+			"bytes", t.buf.total,
+			"truncated", t.buf.total > int64(t.buf.buf.Len()),
+			"body", redactBody(t.buf.buf.String()),
+		)
+	}
+	return t.src.Close()
+}
+
+// teeRequestBody wraps body so that a bounded, redacted copy is logged
+// without consuming it ahead of the upstream request.
+func teeRequestBody(body io.ReadCloser, targetURL string) io.ReadCloser {
+	buf := &boundedBuffer{limit: DebugBodyLimit}
+	return &teeBody{
+		Reader:    io.TeeReader(body, buf),
+		src:       body,
+		buf:       buf,
+		targetURL: targetURL,
+	}
+}
+
+// secretFieldPattern matches credential-like fields in form-encoded and
+// JSON bodies so their values can be masked before logging.
+var secretFieldPattern = regexp.MustCompile(
+	`(?i)("?(?:password|passwd|pass|secret|token|access_token|refresh_token|api[_-]?key|authorization|session)"?\s*[:=]\s*"?)([^"&\s,}]+)`,
+)
+
+// redactBody masks the values of credential-like fields.
+func redactBody(s string) string {
+	return secretFieldPattern.ReplaceAllString(s, "${1}[REDACTED]")
+}
+
+// injectDebugCookies stores each name=value from the set_cookie query
+// parameters in the session jar under key, so an authenticated flow can
+// be tested without logging in.  Callers must check DebugMode.
+func injectDebugCookies(key string, values []string) {
+	var cookies []*http.Cookie
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		c := &http.Cookie{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)}
+		if !ok || c.Valid() != nil {
+			getLogger().Warn("ignoring invalid set_cookie parameter", "value", v)
+			continue
+		}
+		getLogger().Debug("injecting debug cookie", "session", key, "name", c.Name)
+		cookies = append(cookies, c)
+	}
+	DefaultSessions.storeCookies(key, cookies)
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureLogger records log entries as message and key/value pairs.
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+type logEntry struct {
+	msg string
+	kv  map[string]any
+}
+
+func (l *captureLogger) log(msg string, kv ...any) {
+	e := logEntry{msg: msg, kv: make(map[string]any)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		e.kv[kv[i].(string)] = kv[i+1]
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) Debug(msg string, kv ...any) { l.log(msg, kv...) }
+func (l *captureLogger) Info(msg string, kv ...any)  { l.log(msg, kv...) }
+func (l *captureLogger) Warn(msg string, kv ...any)  { l.log(msg, kv...) }
+func (l *captureLogger) Error(msg string, kv ...any) { l.log(msg, kv...) }
+
+// wait returns the first entry logged with msg, waiting up to a second
+// for it.
+func (l *captureLogger) wait(t *testing.T, msg string) logEntry {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		l.mu.Lock()
+		for _, e := range l.entries {
+			if e.msg == msg {
+				l.mu.Unlock()
+				return e
+			}
+		}
+		l.mu.Unlock()
+	}
+	t.Fatalf("no %q log entry", msg)
+	return logEntry{}
+}
+
+// withCaptureLogger sends the package log to a captureLogger for the test.
+func withCaptureLogger(t *testing.T) *captureLogger {
+	t.Helper()
+	l := &captureLogger{}
+	SetLogger(l)
+	t.Cleanup(func() { SetLogger(nil) })
+	return l
+}
+
+func TestDebugTeeForwardsFullBody(t *testing.T) {
+	const limit = 64
+	tests := []struct {
+		name      string
+		body      string
+		wantBody  string
+		truncated bool
+	}{
+		{"small", "name=ada&password=hunter2", "name=ada&password=[REDACTED]", false},
+		{"large", "password=hunter2&blob=" + strings.Repeat("x", 100_000),
+			"password=[REDACTED]&blob=" + strings.Repeat("x", limit-len("password=hunter2&blob=")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			logs := withCaptureLogger(t)
+			DebugMode, DebugBodyLimit = true, limit
+			t.Cleanup(func() { DebugMode, DebugBodyLimit = false, 4096 })
+
+			var received []byte
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				received, _ = io.ReadAll(r.Body)
+			})
+			req := httptest.NewRequest(http.MethodPost, EncodeProxyPath(up.URL+"/upload"), strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			NewMux().ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if !bytes.Equal(received, []byte(tt.body)) {
+				t.Errorf("upstream received %d bytes, want %d", len(received), len(tt.body))
+			}
+			e := logs.wait(t, "request body capture")
+			if e.kv["bytes"] != int64(len(tt.body)) {
+				t.Errorf("logged bytes = %v, want %d", e.kv["bytes"], len(tt.body))
+			}
+			if e.kv["truncated"] != tt.truncated {
+				t.Errorf("truncated = %v, want %v", e.kv["truncated"], tt.truncated)
+			}
+			if e.kv["body"] != tt.wantBody {
+				t.Errorf("captured body = %q, want %q", e.kv["body"], tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDebugCookieInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		debug  bool
+		params []string
+		want   string // Cookie the upstream sees, now and on the next request
+	}{
+		{"debug mode", true, []string{"session=abc", " theme = dark "}, "session=abc; theme=dark"},
+		{"invalid ones ignored", true, []string{"session=abc", "no-equals", "bad name=1"}, "session=abc"},
+		{"ignored outside debug mode", false, []string{"session=abc"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := DebugMode
+			DebugMode = tt.debug
+			t.Cleanup(func() { DebugMode = old })
+
+			var cookies []string
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				cookies = append(cookies, r.Header.Get("Cookie"))
+				if r.URL.RawQuery != "" {
+					t.Errorf("upstream query = %q, want the proxy parameters kept off it", r.URL.RawQuery)
+				}
+			})
+			path := EncodeProxyPath(up.URL + "/")
+			for _, p := range tt.params {
+				path += "&set_cookie=" + url.QueryEscape(p)
+			}
+			serve(t, http.MethodGet, path, nil)
+			proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+			for i, got := range cookies {
+				if got != tt.want {
+					t.Errorf("request %d sent Cookie %q, want %q", i+1, got, tt.want)
+				}
+			}
+		})
+	}
+}
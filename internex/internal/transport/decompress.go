@@ -0,0 +1,183 @@
+package transport
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Upstream response decompression
+// ---------------------------------------------------------------------------
+//
+// By default the proxy asks upstreams for identity-encoded bodies so the
+// rewriter always sees plain text.  Operators can opt in to compressed
+// transfers by listing codings in UpstreamEncodings; bodies are then decoded
+// here before rewriting.  gzip and deflate use the standard library; zstd
+// is registered in decompress_zstd.go.
+
+// UpstreamEncodings lists the content codings advertised to upstreams in
+// Accept-Encoding, in preference order (e.g. "zstd", "gzip").  Codings
+// without a registered decoder are never advertised.  When empty, upstreams
+// are asked for "identity".
+var UpstreamEncodings []string
+
+// ContentDecoder wraps an encoded body in a reader yielding decoded bytes.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]ContentDecoder{
+		"gzip":    decodeGzip,
+		"x-gzip":  decodeGzip,
+		"deflate": decodeDeflate,
+	}
+)
+
+func decodeGzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func decodeDeflate(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// RegisterContentDecoder installs a decoder for the given content coding,
+// replacing any existing one.  Coding names are case-insensitive.
+func RegisterContentDecoder(coding string, dec ContentDecoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[strings.ToLower(coding)] = dec
+}
+
+func lookupDecoder(coding string) (ContentDecoder, bool) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	dec, ok := decoders[strings.ToLower(coding)]
+	return dec, ok
+}
+
+// upstreamAcceptEncoding builds the Accept-Encoding value sent upstream.
+func upstreamAcceptEncoding() string {
+	var codings []string
+	for _, c := range UpstreamEncodings {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if _, ok := lookupDecoder(c); ok {
+			codings = append(codings, c)
+		}
+	}
+	if len(codings) == 0 {
+		return "identity"
+	}
+	return strings.Join(codings, ", ")
+}
+
+// decodedBody reads through a chain of decoders and closes every one of
+// them, then the raw upstream body.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		err = c.Close()
+	}
+	return err
+}
+
+// contentCodings returns the codings listed in h's Content-Encoding
+// headers, lowercased and in the order they were applied, with identity
+// entries dropped.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+// decodeResponseBody replaces resp.Body with a decoding reader when the
+// upstream applied a Content-Encoding, and removes the now-stale
+// Content-Encoding and Content-Length headers.  Stacked codings
+// ("gzip, br") are undone in reverse order of application.  It returns
+// false (leaving the response untouched) when any coding in the chain has
+// no registered decoder.
+func decodeResponseBody(resp *http.Response) (bool, error) {
+	codings := contentCodings(resp.Header)
+	if len(codings) == 0 {
+		return true, nil
+	}
+
+	decs := make([]ContentDecoder, len(codings))
+	for i, c := range codings {
+		dec, ok := lookupDecoder(c)
+		if !ok {
+			return false, nil
+		}
+		decs[i] = dec
+	}
+
+	var r io.Reader = resp.Body
+	closers := []io.Closer{resp.Body}
+	for i := len(decs) - 1; i >= 0; i-- {
+		rc, err := decs[i](r)
+		if err != nil {
+			// Close the decoders built so far, not resp.Body (the last
+			// closer), which the caller still owns.
+			for _, c := range closers[:len(closers)-1] {
+				c.Close()
+			}
+			return false, fmt.Errorf("decoding %s body: %w", codings[i], err)
+		}
+		r = rc
+		closers = append([]io.Closer{rc}, closers...)
+	}
+
+	resp.Body = &decodedBody{Reader: r, closers: closers}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return true, nil
+}
+
+// clientAcceptsEncoding reports whether the client's Accept-Encoding
+// header allows every coding in a Content-Encoding value such as
+// "gzip" or "gzip, br".
+func clientAcceptsEncoding(h http.Header, contentEncoding string) bool {
+	for _, c := range strings.Split(contentEncoding, ",") {
+		if !clientAcceptsCoding(h, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientAcceptsCoding reports whether the client's Accept-Encoding header
+// allows a single content coding.
+func clientAcceptsCoding(h http.Header, coding string) bool {
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "" || coding == "identity" {
+		return true
+	}
+	for _, part := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := strings.ReplaceAll(strings.ToLower(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func encodeZstd(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeGzip(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUpstreamAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		encodings []string
+		want      string
+	}{
+		{"default", nil, "identity"},
+		{"zstd first", []string{"zstd", "gzip"}, "zstd, gzip"},
+		{"normalized", []string{" ZSTD "}, "zstd"},
+		{"unknown skipped", []string{"br", "gzip"}, "gzip"},
+		{"only unknown", []string{"br"}, "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := UpstreamEncodings
+			UpstreamEncodings = tt.encodings
+			defer func() { UpstreamEncodings = old }()
+			if got := upstreamAcceptEncoding(); got != tt.want {
+				t.Errorf("upstreamAcceptEncoding() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyDecodesAndRewrites(t *testing.T) {
+	const link = "https://cdn.example.com/img.png"
+	doc := `{"image":"` + link + `"}`
+	tests := []struct {
+		coding string
+		encode func(*testing.T, string) []byte
+	}{
+		{"zstd", encodeZstd},
+		{"gzip", encodeGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.coding, func(t *testing.T) {
+			resetSessions(t)
+			old := UpstreamEncodings
+			UpstreamEncodings = []string{tt.coding}
+			defer func() { UpstreamEncodings = old }()
+
+			var accepted string
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				accepted = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", tt.coding)
+				w.Write(tt.encode(t, doc))
+			})
+
+			path := EncodeProxyPath(up.URL+"/data.json") + "&rewrite_json=1"
+			rec := serve(t, http.MethodGet, path, http.Header{"Accept-Encoding": {"identity"}})
+
+			if accepted != tt.coding {
+				t.Errorf("upstream Accept-Encoding = %q, want %q", accepted, tt.coding)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+				t.Errorf("Content-Encoding = %q, want decoded body", ce)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, "/proxy?url="+url.QueryEscape(link)) {
+				t.Errorf("body = %q, want the link rewritten", body)
+			}
+		})
+	}
+}
+
+// trackedBody records whether it was closed.
+type trackedBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDecodeResponseBodyChain(t *testing.T) {
+	const doc = "<p>stacked</p>"
+	var inner *trackedBody
+	RegisterContentDecoder("x-tracked", func(r io.Reader) (io.ReadCloser, error) {
+		inner = &trackedBody{Reader: r}
+		return inner, nil
+	})
+	t.Cleanup(func() {
+		decodersMu.Lock()
+		delete(decoders, "x-tracked")
+		decodersMu.Unlock()
+	})
+
+	tests := []struct {
+		name        string
+		encoding    []string
+		body        []byte
+		wantErr     bool
+		wantTracked bool // the x-tracked decoder was closed
+	}{
+		{"gzip then zstd", []string{"gzip, zstd"}, encodeZstd(t, string(encodeGzip(t, doc))), false, false},
+		{"split headers", []string{"gzip", "zstd"}, encodeZstd(t, string(encodeGzip(t, doc))), false, false},
+		{"identity ignored", []string{"identity, gzip"}, encodeGzip(t, doc), false, false},
+		{"inner failure closes outer decoders", []string{"gzip, x-tracked"}, []byte(doc), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner = nil
+			raw := &trackedBody{Reader: bytes.NewReader(tt.body)}
+			resp := &http.Response{Header: http.Header{"Content-Encoding": tt.encoding}, Body: raw}
+
+			ok, err := decodeResponseBody(resp)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("decodeResponseBody succeeded, want an error")
+				}
+				if raw.closed {
+					t.Error("the upstream body was closed; the caller owns it")
+				}
+				if tt.wantTracked && (inner == nil || !inner.closed) {
+					t.Error("the decoder built before the failure was not closed")
+				}
+				return
+			}
+			if err != nil || !ok {
+				t.Fatalf("decodeResponseBody = %v, %v", ok, err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != doc {
+				t.Errorf("body = %q, want %q", got, doc)
+			}
+			if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("Content-Encoding = %q after decoding", ce)
+			}
+			resp.Body.Close()
+			if !raw.closed {
+				t.Error("closing the decoded body left the upstream body open")
+			}
+		})
+	}
+}
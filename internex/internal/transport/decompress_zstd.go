@@ -0,0 +1,20 @@
+package transport
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd, which some upstreams prefer over gzip, is decoded with
+// github.com/klauspost/compress/zstd so it can be listed in
+// UpstreamEncodings.
+func init() {
+	RegisterContentDecoder("zstd", func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	})
+}
@@ -0,0 +1,221 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// DNS cache
+// ---------------------------------------------------------------------------
+//
+// Upstream hostnames are resolved once per TTL instead of on every dial.
+// Successful lookups and NXDOMAIN answers are cached; transient errors
+// are not.  Dials always go to the resolved IPs, so the address check in
+// dialUpstream sees cached and fresh results alike.
+//
+// Unless AllowPrivateUpstreams is set, every address is checked before it
+// is dialed: a proxied URL naming (or resolving to) a loopback, link-local,
+// private or otherwise non-public address is refused with
+// ErrForbiddenUpstream, so /proxy cannot reach the proxy host, cloud
+// metadata endpoints or the internal network.
+
+// maxDNSEntries bounds the cache; expired entries are swept past it.
+const maxDNSEntries = 10000
+
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsEntry
+	// lookup resolves a host; replaced in tests.
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var upstreamDNS = &dnsCache{
+	ttl:     30 * time.Second,
+	entries: make(map[string]dnsEntry),
+	lookup:  net.DefaultResolver.LookupIPAddr,
+}
+
+// upstreamDialer is the dialer behind every upstream connection.
+var upstreamDialer = &net.Dialer{
+	Timeout:   15 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// SetDNSCacheTTL sets how long upstream DNS answers are cached.  Zero
+// or negative disables caching.  The default is 30 seconds.
+func SetDNSCacheTTL(ttl time.Duration) {
+	upstreamDNS.mu.Lock()
+	defer upstreamDNS.mu.Unlock()
+	upstreamDNS.ttl = ttl
+	upstreamDNS.entries = make(map[string]dnsEntry)
+}
+
+// AllowPrivateUpstreams lets upstream connections go to non-public
+// addresses.  It is off by default; set it for deployments that proxy
+// intranet sites.
+var AllowPrivateUpstreams bool
+
+// ErrForbiddenUpstream is returned for upstreams at an address refused by
+// the dialer; see AllowPrivateUpstreams.
+var ErrForbiddenUpstream = errors.New("upstream address not allowed")
+
+// reservedNets are non-public ranges the net.IP predicates do not cover.
+var reservedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this network"
+		"100.64.0.0/10", // carrier-grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved, including broadcast
+		"64:ff9b::/96",  // NAT64, which can embed any IPv4 address
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicAddress reports whether ip is a public unicast address.
+func publicAddress(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	hostOverridesMu sync.RWMutex
+	hostOverrides   = make(map[string]net.IP)
+)
+
+// SetHostOverride makes direct upstream connections to host go to ip
+// instead of its DNS answer, like an /etc/hosts entry scoped to the
+// proxy.  Only the dial changes: requests keep their Host header, and TLS
+// still sends SNI for host and verifies its certificate against host.
+// Non-public addresses are refused unless AllowPrivateUpstreams is set
+// first, and the dialer checks the pinned address again like any
+// resolved one.  Connections through an egress proxy are resolved by the
+// proxy and are unaffected.  An empty ip removes the override.
+func SetHostOverride(host, ip string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	hostOverridesMu.Lock()
+	defer hostOverridesMu.Unlock()
+	if ip == "" {
+		delete(hostOverrides, host)
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("host override for %s: invalid IP %q", host, ip)
+	}
+	if !AllowPrivateUpstreams && !publicAddress(addr) {
+		return fmt.Errorf("host override for %s: %w: %s", host, ErrForbiddenUpstream, addr)
+	}
+	hostOverrides[host] = addr
+	return nil
+}
+
+// hostOverride returns the pinned address for host, if any.
+func hostOverride(host string) (net.IP, bool) {
+	hostOverridesMu.RLock()
+	defer hostOverridesMu.RUnlock()
+	ip, ok := hostOverrides[strings.ToLower(strings.TrimSuffix(host, "."))]
+	return ip, ok
+}
+
+// resolve returns the addresses for host, from the cache when fresh.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	ttl := c.ttl
+	if e, ok := c.entries[host]; ok && ttl > 0 && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.addrs, e.err
+	}
+	c.mu.Unlock()
+
+	addrs, err := c.lookup(ctx, host)
+	var dnsErr *net.DNSError
+	if ttl <= 0 || (err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound)) {
+		return addrs, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxDNSEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[host] = dnsEntry{addrs: addrs, err: err, expires: now.Add(ttl)}
+	c.mu.Unlock()
+	return addrs, err
+}
+
+// dialUpstream is streamTransport's DialContext: it resolves the host
+// through SetHostOverride or upstreamDNS, refuses the dial if any address
+// is not public (unless AllowPrivateUpstreams is set), and tries each
+// address in turn.  Egress proxies are the operator's choice rather than
+// a proxied URL's, so their own addresses are not checked.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else if ip, ok := hostOverride(host); ok {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else if addrs, err = upstreamDNS.resolve(ctx, host); err != nil {
+		return nil, err
+	}
+
+	if !AllowPrivateUpstreams && !isEgressProxyAddr(addr) {
+		for _, ip := range addrs {
+			if !publicAddress(ip.IP) {
+				return nil, fmt.Errorf("%w: %s is %s", ErrForbiddenUpstream, host, ip.IP)
+			}
+		}
+	}
+
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := upstreamDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withAddressPolicy refuses non-public upstreams for the test.
+func withAddressPolicy(t *testing.T) {
+	t.Helper()
+	AllowPrivateUpstreams = false
+	t.Cleanup(func() { AllowPrivateUpstreams = true })
+}
+
+// withLookup answers upstream DNS queries from addrs for the test.
+func withLookup(t *testing.T, addrs map[string][]string) {
+	t.Helper()
+	old := upstreamDNS.lookup
+	upstreamDNS.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		var ips []net.IPAddr
+		for _, a := range addrs[host] {
+			ips = append(ips, net.IPAddr{IP: net.ParseIP(a)})
+		}
+		if ips == nil {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return ips, nil
+	}
+	SetDNSCacheTTL(0)
+	t.Cleanup(func() {
+		upstreamDNS.lookup = old
+		SetDNSCacheTTL(30 * time.Second)
+	})
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestDialUpstreamAddressPolicy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	withLookup(t, map[string][]string{
+		"loopback.test": {"127.0.0.1"},
+		"metadata.test": {"169.254.169.254"},
+		"mixed.test":    {"93.184.216.34", "10.0.0.1"},
+	})
+	tests := []struct {
+		name      string
+		host      string
+		allow     bool
+		forbidden bool
+	}{
+		{"literal loopback", "127.0.0.1", false, true},
+		{"resolved loopback", "loopback.test", false, true},
+		{"resolved metadata", "metadata.test", false, true},
+		{"any private answer", "mixed.test", false, true},
+		{"opt-out", "loopback.test", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AllowPrivateUpstreams = tt.allow
+			t.Cleanup(func() { AllowPrivateUpstreams = true })
+			conn, err := dialUpstream(context.Background(), "tcp", net.JoinHostPort(tt.host, port))
+			if conn != nil {
+				conn.Close()
+			}
+			if got := errors.Is(err, ErrForbiddenUpstream); got != tt.forbidden {
+				t.Errorf("err = %v, want forbidden %v", err, tt.forbidden)
+			}
+			if !tt.forbidden && err != nil {
+				t.Errorf("dial failed: %v", err)
+			}
+		})
+	}
+
+	t.Run("egress proxy exempt", func(t *testing.T) {
+		withAddressPolicy(t)
+		addr := net.JoinHostPort("127.0.0.1", port)
+		egressAddrs.Store(addr, true)
+		defer egressAddrs.Delete(addr)
+		conn, err := dialUpstream(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("dial to egress proxy: %v", err)
+		}
+		conn.Close()
+	})
+}
+
+func TestProxyRefusesPrivateUpstreams(t *testing.T) {
+	resetSessions(t)
+	withAddressPolicy(t)
+	up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	})
+	rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if hits.Load() != 0 {
+		t.Error("request reached the loopback upstream")
+	}
+}
+
+func TestSetHostOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		allow   bool
+		wantErr error
+	}{
+		{"public", "93.184.216.34", false, nil},
+		{"loopback", "127.0.0.1", false, ErrForbiddenUpstream},
+		{"metadata", "169.254.169.254", false, ErrForbiddenUpstream},
+		{"private", "10.0.0.5", false, ErrForbiddenUpstream},
+		{"private allowed", "10.0.0.5", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AllowPrivateUpstreams = tt.allow
+			t.Cleanup(func() {
+				AllowPrivateUpstreams = true
+				SetHostOverride("pinned.test", "")
+			})
+			err := SetHostOverride("pinned.test", tt.ip)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("SetHostOverride = %v, want %v", err, tt.wantErr)
+			}
+			_, ok := hostOverride("pinned.test")
+			if ok != (tt.wantErr == nil) {
+				t.Errorf("override installed = %v", ok)
+			}
+		})
+	}
+
+	t.Run("checked again when dialed", func(t *testing.T) {
+		if err := SetHostOverride("pinned.test", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { SetHostOverride("pinned.test", "") })
+		withAddressPolicy(t)
+		_, err := dialUpstream(context.Background(), "tcp", "pinned.test:80")
+		if !errors.Is(err, ErrForbiddenUpstream) {
+			t.Errorf("dial err = %v, want ErrForbiddenUpstream", err)
+		}
+	})
+}
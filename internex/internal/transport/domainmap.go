@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Cookie domain mapping
+// ---------------------------------------------------------------------------
+//
+// By default every proxied cookie is host-only on the proxy's own host,
+// which collapses an upstream's subdomains together and loses any
+// Domain=.example.com sharing that SSO flows rely on.  With
+// CookieDomainMapping, each upstream host is served from its own
+// proxy-side subdomain formed by appending the proxy host:
+//
+//	a.example.com  →  a.example.com.proxy.test
+//	b.example.com  →  b.example.com.proxy.test
+//
+// A cookie set with Domain=.example.com becomes
+// Domain=example.com.proxy.test, which the browser shares between both
+// mapped hosts exactly as it would upstream.
+//
+// Requirements: wildcard DNS for *.<proxy host> (DNS wildcards match any
+// depth), and for HTTPS a certificate valid for every mapped host, which
+// a single-level *.<proxy host> wildcard certificate is not.  Document
+// navigations that arrive on another host are redirected to the target's
+// mapped host so its cookies are accepted.
+
+// CookieDomainMapping enables per-upstream proxy subdomains.
+var CookieDomainMapping bool
+
+// proxyHostParts returns the proxy's hostname and port (port may be "").
+func proxyHostParts() (string, string) {
+	u, err := url.Parse(ProxyOrigin)
+	if err != nil {
+		return "", ""
+	}
+	return strings.ToLower(u.Hostname()), u.Port()
+}
+
+// mappedHost returns the proxy-side host serving upstreamHost, keeping
+// the proxy's port.  IP-literal upstreams cannot be mapped and yield "".
+func mappedHost(upstreamHost string) string {
+	host := strings.ToLower(upstreamHost)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return ""
+	}
+	proxyHost, port := proxyHostParts()
+	if proxyHost == "" {
+		return ""
+	}
+	mapped := host + "." + proxyHost
+	if port != "" {
+		mapped += ":" + port
+	}
+	return mapped
+}
+
+// mappedOrigin returns the proxy-side origin serving targetURL, or
+// ProxyOrigin when mapping is off or not possible.
+func mappedOrigin(targetURL string) string {
+	if !CookieDomainMapping {
+		return ProxyOrigin
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ProxyOrigin
+	}
+	host := mappedHost(u.Host)
+	if host == "" {
+		return ProxyOrigin
+	}
+	scheme, _, _ := strings.Cut(ProxyOrigin, "://")
+	return scheme + "://" + host + BasePath
+}
+
+// mapCookieDomain maps an upstream cookie Domain attribute value to its
+// proxy-side equivalent.
+func mapCookieDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.Trim(strings.TrimSpace(domain), `"`), ".")
+	if domain == "" {
+		return ""
+	}
+	proxyHost, _ := proxyHostParts()
+	return strings.ToLower(domain) + "." + proxyHost
+}
+
+// redirectToMappedHost sends document navigations that arrived on the
+// wrong host to the target's mapped host.  It reports whether it
+// answered the request.
+func redirectToMappedHost(w http.ResponseWriter, r *http.Request, targetURL string) bool {
+	if !CookieDomainMapping || !isNavigation(r) || r.Method != http.MethodGet {
+		return false
+	}
+	origin := mappedOrigin(targetURL)
+	if origin == ProxyOrigin || strings.EqualFold(ExtractOrigin(origin), "http://"+r.Host) ||
+		strings.EqualFold(ExtractOrigin(origin), "https://"+r.Host) {
+		return false
+	}
+	// r.URL is relative to BasePath, which origin already ends with.
+	http.Redirect(w, r, origin+r.URL.RequestURI(), http.StatusFound)
+	return true
+}
+
+// isProxyOrigin reports whether origin is served by this proxy: the
+// proxy origin itself or, with mapping enabled, one of its subdomains.
+func isProxyOrigin(origin string) bool {
+	proxy := ExtractOrigin(ProxyOrigin)
+	if strings.EqualFold(origin, proxy) {
+		return true
+	}
+	if !CookieDomainMapping {
+		return false
+	}
+	scheme, rest, _ := strings.Cut(proxy, "://")
+	return strings.HasPrefix(strings.ToLower(origin), scheme+"://") &&
+		strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(rest))
+}
@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withDomainMapping turns on CookieDomainMapping for a proxy at origin
+// until the test ends.
+func withDomainMapping(t *testing.T, origin string) {
+	t.Helper()
+	oldMapping, oldOrigin := CookieDomainMapping, ProxyOrigin
+	CookieDomainMapping, ProxyOrigin = true, origin
+	t.Cleanup(func() { CookieDomainMapping, ProxyOrigin = oldMapping, oldOrigin })
+}
+
+func TestMappedHost(t *testing.T) {
+	tests := []struct {
+		proxy, upstream, want string
+	}{
+		{"https://proxy.test", "a.example.com", "a.example.com.proxy.test"},
+		{"https://proxy.test", "A.Example.com:8443", "a.example.com.proxy.test"},
+		{"http://proxy.test:8080", "a.example.com", "a.example.com.proxy.test:8080"},
+		{"https://proxy.test", "203.0.113.7", ""},
+		{"https://proxy.test", "[2001:db8::1]:443", ""},
+		{"https://proxy.test", "", ""},
+	}
+	for _, tt := range tests {
+		withDomainMapping(t, tt.proxy)
+		if got := mappedHost(tt.upstream); got != tt.want {
+			t.Errorf("proxy %s: mappedHost(%q) = %q, want %q", tt.proxy, tt.upstream, got, tt.want)
+		}
+	}
+}
+
+func TestMappedOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping bool
+		base    string
+		target  string
+		want    string
+	}{
+		{"mapped", true, "", "https://a.example.com/x", "https://a.example.com.proxy.test:8443"},
+		{"mapped under a base path", true, "/internex", "https://a.example.com/x", "https://a.example.com.proxy.test:8443/internex"},
+		{"IP literal falls back", true, "", "https://203.0.113.7/", "https://proxy.test:8443"},
+		{"mapping off", false, "", "https://a.example.com/x", "https://proxy.test:8443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDomainMapping(t, "https://proxy.test:8443"+tt.base)
+			CookieDomainMapping = tt.mapping
+			oldBase := BasePath
+			BasePath = tt.base
+			t.Cleanup(func() { BasePath = oldBase })
+
+			if got := mappedOrigin(tt.target); got != tt.want {
+				t.Errorf("mappedOrigin(%q) = %q, want %q", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMapCookieDomain(t *testing.T) {
+	withDomainMapping(t, "https://proxy.test:8443")
+	tests := []struct{ domain, want string }{
+		{".example.com", "example.com.proxy.test"},
+		{"Example.COM", "example.com.proxy.test"},
+		{` ".a.example.com" `, "a.example.com.proxy.test"},
+		{"", ""},
+		{".", ""},
+	}
+	for _, tt := range tests {
+		if got := mapCookieDomain(tt.domain); got != tt.want {
+			t.Errorf("mapCookieDomain(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+
+	// Both mapped hosts share the parent-domain cookie, as upstream.
+	out := RewriteSetCookieDomain("sso=1; Domain=.example.com; Path=/", "proxy.test")
+	if d, _ := cookieAttr(out, "Domain"); d != "example.com.proxy.test" {
+		t.Errorf("Set-Cookie Domain = %q in %q", d, out)
+	}
+}
+
+func TestIsProxyOriginMapped(t *testing.T) {
+	withDomainMapping(t, "https://proxy.test")
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://proxy.test", true},
+		{"https://a.example.com.proxy.test", true},
+		{"http://a.example.com.proxy.test", false},
+		{"https://evilproxy.test", false},
+		{"https://proxy.test.evil.example", false},
+	}
+	for _, tt := range tests {
+		if got := isProxyOrigin(tt.origin); got != tt.want {
+			t.Errorf("isProxyOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectToMappedHost(t *testing.T) {
+	withDomainMapping(t, "https://proxy.test")
+	const target = "https://a.example.com/page"
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		mode   string // Sec-Fetch-Mode
+		want   bool
+	}{
+		{"navigation on the bare proxy host", http.MethodGet, "proxy.test", "navigate", true},
+		{"already on the mapped host", http.MethodGet, "a.example.com.proxy.test", "navigate", false},
+		{"subresource", http.MethodGet, "proxy.test", "no-cors", false},
+		{"form post", http.MethodPost, "proxy.test", "navigate", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, EncodeProxyPath(target), nil)
+			r.Host = tt.host
+			r.Header.Set("Sec-Fetch-Mode", tt.mode)
+			w := httptest.NewRecorder()
+			if got := redirectToMappedHost(w, r, target); got != tt.want {
+				t.Fatalf("redirected = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			want := "https://a.example.com.proxy.test" + EncodeProxyPath(target)
+			if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+				t.Errorf("redirect = %d %s, want 302 %s", w.Code, w.Header().Get("Location"), want)
+			}
+		})
+	}
+}
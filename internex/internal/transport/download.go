@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Forced downloads
+// ---------------------------------------------------------------------------
+//
+// Content-Disposition is relayed untouched, so filename and RFC 5987
+// filename* parameters reach the browser byte-for-byte.  Responses of a
+// type listed in ForceDownloadTypes are additionally turned into
+// attachments, which also makes them stream unrewritten.
+
+// ForceDownloadTypes lists media types always served as attachments.  A
+// "type/*" entry matches every subtype.  Empty by default.
+var ForceDownloadTypes []string
+
+// forceDownload makes h an attachment if mediaType is listed in
+// ForceDownloadTypes.  An existing disposition keeps its parameters; only
+// its type is replaced.  Without one, the filename is taken from the last
+// segment of targetURL's path.
+func forceDownload(h http.Header, mediaType, targetURL string) {
+	if !matchMediaType(ForceDownloadTypes, mediaType) || isAttachment(h) {
+		return
+	}
+	if v := h.Get("Content-Disposition"); v != "" {
+		// Splice rather than reformat so filename* survives verbatim.
+		if _, params, ok := strings.Cut(v, ";"); ok {
+			h.Set("Content-Disposition", "attachment;"+params)
+		} else {
+			h.Set("Content-Disposition", "attachment")
+		}
+		return
+	}
+	disposition := "attachment"
+	if u, err := url.Parse(targetURL); err == nil {
+		if name := path.Base(u.Path); name != "/" && name != "." {
+			// FormatMediaType switches to filename* for non-ASCII names.
+			if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+				disposition = v
+			}
+		}
+	}
+	h.Set("Content-Disposition", disposition)
+}
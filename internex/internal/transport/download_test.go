@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentDispositionFilename(t *testing.T) {
+	old := ForceDownloadTypes
+	ForceDownloadTypes = []string{"application/pdf"}
+	t.Cleanup(func() { ForceDownloadTypes = old })
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		disposition string // upstream's, "" for none
+		want        string // exact header, "" to only check the filename
+		wantName    string
+	}{
+		{
+			name:        "non-ASCII filename* relayed verbatim",
+			path:        "/dl",
+			contentType: "application/zip",
+			disposition: "attachment; filename*=UTF-8''%E2%82%AC%20rates.zip",
+			want:        "attachment; filename*=UTF-8''%E2%82%AC%20rates.zip",
+			wantName:    "€ rates.zip",
+		},
+		{
+			name:        "quoted filename with escapes relayed verbatim",
+			path:        "/dl",
+			contentType: "application/zip",
+			disposition: `attachment; filename="say \"hi\".zip"`,
+			want:        `attachment; filename="say \"hi\".zip"`,
+			wantName:    `say "hi".zip`,
+		},
+		{
+			name:        "fallback filename kept beside filename*",
+			path:        "/dl",
+			contentType: "application/zip",
+			disposition: `attachment; filename="resume.zip"; filename*=UTF-8''r%C3%A9sum%C3%A9.zip`,
+			want:        `attachment; filename="resume.zip"; filename*=UTF-8''r%C3%A9sum%C3%A9.zip`,
+			wantName:    "résumé.zip",
+		},
+		{
+			name:        "forced inline keeps filename* and fallback",
+			path:        "/dl",
+			contentType: "application/pdf",
+			disposition: `inline; filename="euro.pdf"; filename*=UTF-8''%E2%82%AC.pdf`,
+			want:        `attachment; filename="euro.pdf"; filename*=UTF-8''%E2%82%AC.pdf`,
+			wantName:    "€.pdf",
+		},
+		{
+			name:        "forced non-ASCII name from the path",
+			path:        "/files/r%C3%A9sum%C3%A9.pdf",
+			contentType: "application/pdf",
+			wantName:    "résumé.pdf",
+		},
+		{
+			name:        "forced quoted name from the path",
+			path:        "/files/a%22b.pdf",
+			contentType: "application/pdf",
+			wantName:    `a"b.pdf`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.disposition != "" {
+					w.Header().Set("Content-Disposition", tt.disposition)
+				}
+				w.Write([]byte("data"))
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+tt.path, nil)
+			got := rec.Header().Get("Content-Disposition")
+			if tt.want != "" && got != tt.want {
+				t.Errorf("Content-Disposition = %s, want %s", got, tt.want)
+			}
+			disposition, params, err := mime.ParseMediaType(got)
+			if err != nil {
+				t.Fatalf("Content-Disposition %q: %v", got, err)
+			}
+			if disposition != "attachment" || params["filename"] != tt.wantName {
+				t.Errorf("Content-Disposition %q parses to %s %q, want attachment %q",
+					got, disposition, params["filename"], tt.wantName)
+			}
+		})
+	}
+}
+
+func TestAttachmentNotRewritten(t *testing.T) {
+	const page = `<html><body><a href="https://example.com/next">next</a></body></html>`
+	tests := []struct {
+		name        string
+		contentType string // "" sends no Content-Type
+		disposition string
+		gzip        bool
+		rewritten   bool
+	}{
+		{"HTML attachment", "text/html", `attachment; filename="page.html"`, false, false},
+		{"case-insensitive", "text/html", `ATTACHMENT; filename="page.html"`, false, false},
+		{"malformed parameters", "text/html", `attachment; filename`, false, false},
+		{"gzipped attachment", "text/html", `attachment; filename="page.html"`, true, false},
+		{"typeless attachment not sniffed", "", `attachment; filename="page.html"`, false, false},
+		{"inline still rewritten", "text/html", `inline`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			body := []byte(page)
+			if tt.gzip {
+				body = encodeGzip(t, page)
+			}
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType == "" {
+					w.Header()["Content-Type"] = nil
+				} else {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.gzip {
+					w.Header().Set("Content-Encoding", "gzip")
+				}
+				w.Header().Set("Content-Disposition", tt.disposition)
+				w.Write(body)
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/page.html", http.Header{"Accept-Encoding": {"gzip"}})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			if got := strings.Contains(rec.Body.String(), "/proxy?url="); got != tt.rewritten {
+				t.Errorf("rewritten = %v, want %v", got, tt.rewritten)
+			}
+			if tt.rewritten {
+				return
+			}
+			if !bytes.Equal(rec.Body.Bytes(), body) {
+				t.Errorf("body = %q, want the upstream bytes", rec.Body)
+			}
+			if d := rec.Header().Get("Content-Disposition"); d != tt.disposition {
+				t.Errorf("Content-Disposition = %q, want %q", d, tt.disposition)
+			}
+		})
+	}
+}
+
+func TestAttachmentStreamed(t *testing.T) {
+	resetSessions(t)
+	// Well beyond the proxy's write buffer, so most of it reaches the
+	// client without a flush.
+	first := "<html>" + strings.Repeat("x", 64<<10)
+	head := first[:32<<10]
+	release := make(chan struct{})
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Disposition", `attachment; filename="big.html"`)
+		io.WriteString(w, first)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		io.WriteString(w, "</html>")
+	})
+	proxy := httptest.NewServer(NewMux())
+	t.Cleanup(proxy.Close)
+
+	got := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(proxy.URL + EncodeProxyPath(up.URL+"/big.html"))
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		buf := make([]byte, len(head))
+		n, _ := io.ReadFull(resp.Body, buf)
+		got <- string(buf[:n])
+		<-release
+		rest, _ := io.ReadAll(resp.Body)
+		got <- string(rest)
+	}()
+	select {
+	case s := <-got:
+		if s != head {
+			t.Fatalf("first part = %.40q (%d bytes), want the upstream's", s, len(s))
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("body held back until the upstream finished")
+	}
+	close(release)
+	if rest := <-got; rest != first[len(head):]+"</html>" {
+		t.Errorf("rest = %.40q (%d bytes), want the remainder", rest, len(rest))
+	}
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Egress proxy
+// ---------------------------------------------------------------------------
+//
+// In locked-down networks upstream traffic must leave through a corporate
+// HTTP proxy (CONNECT for TLS) or a SOCKS5 gateway.  By default the
+// standard HTTP_PROXY / HTTPS_PROXY / NO_PROXY variables are honored, with
+// ALL_PROXY as a fallback; SetEgressProxy overrides them.  Because
+// streamTransport carries WebSocket upgrades too, they follow the same
+// route.
+
+var (
+	egressMu  sync.RWMutex
+	egressURL *url.URL
+	// egressAddrs records the host:port of every egress proxy chosen, so
+	// dialUpstream can tell proxy dials from upstream ones.
+	egressAddrs sync.Map
+)
+
+// SetEgressProxy routes all upstream requests through proxyURL, which may
+// use the http, https, socks5 or socks5h scheme.  An empty string restores
+// the environment-based default.
+func SetEgressProxy(proxyURL string) error {
+	var u *url.URL
+	if proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("parsing egress proxy: %w", err)
+		}
+		switch parsed.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("unsupported egress proxy scheme %q", parsed.Scheme)
+		}
+		if parsed.Host == "" {
+			return fmt.Errorf("egress proxy %q has no host", proxyURL)
+		}
+		u = parsed
+	}
+
+	egressMu.Lock()
+	egressURL = u
+	egressMu.Unlock()
+	streamTransport.CloseIdleConnections()
+	return nil
+}
+
+// egressProxy is streamTransport's Proxy func.
+func egressProxy(req *http.Request) (*url.URL, error) {
+	u, err := chooseEgressProxy(req)
+	if u != nil {
+		egressAddrs.Store(hostPort(u), true)
+	}
+	return u, err
+}
+
+// isEgressProxyAddr reports whether addr is an egress proxy's address.
+func isEgressProxyAddr(addr string) bool {
+	_, ok := egressAddrs.Load(addr)
+	return ok
+}
+
+// chooseEgressProxy returns the egress proxy for req, if any.
+func chooseEgressProxy(req *http.Request) (*url.URL, error) {
+	egressMu.RLock()
+	u := egressURL
+	egressMu.RUnlock()
+	if u != nil {
+		return u, nil
+	}
+
+	if p, err := http.ProxyFromEnvironment(req); p != nil || err != nil {
+		return p, err
+	}
+	return allProxyFromEnvironment(req)
+}
+
+// allProxyFromEnvironment applies ALL_PROXY, which net/http ignores,
+// respecting NO_PROXY host suffixes.
+func allProxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	raw := os.Getenv("ALL_PROXY")
+	if raw == "" {
+		raw = os.Getenv("all_proxy")
+	}
+	if raw == "" || noProxyMatches(req.URL.Hostname()) {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ALL_PROXY: %w", err)
+	}
+	return u, nil
+}
+
+// noProxyMatches reports whether host is excluded by NO_PROXY.
+func noProxyMatches(host string) bool {
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" || host == strings.TrimPrefix(entry, ".") ||
+			strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
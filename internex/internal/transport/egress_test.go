@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// egressStub is an HTTP forward proxy that records what it was asked to
+// do: absolute-form requests for http targets, CONNECT tunnels for https.
+type egressStub struct {
+	mu       sync.Mutex
+	requests []string // "GET http://host/path" or "CONNECT host:port"
+}
+
+func (p *egressStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	if r.Method == http.MethodConnect {
+		p.requests = append(p.requests, "CONNECT "+r.Host)
+	} else {
+		p.requests = append(p.requests, r.Method+" "+r.URL.String())
+	}
+	p.mu.Unlock()
+
+	if r.Method == http.MethodConnect {
+		up, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer up.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(up, brw)
+		io.Copy(conn, up)
+		return
+	}
+	resp, err := (&http.Transport{}).RoundTrip(r.Clone(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *egressStub) seen() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+func TestHTTPEgressProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "via egress")
+	})
+	plain := httptest.NewServer(handler)
+	t.Cleanup(plain.Close)
+	secure := httptest.NewTLSServer(handler)
+	t.Cleanup(secure.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(secure.Certificate())
+	SetTLSConfig(&tls.Config{RootCAs: pool})
+	t.Cleanup(func() { SetTLSConfig(nil) })
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"http target forwarded", plain.URL + "/page", "GET " + plain.URL + "/page"},
+		{"https target tunnelled", secure.URL + "/page", "CONNECT " + secure.Listener.Addr().String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			stub := &egressStub{}
+			egress := httptest.NewServer(stub)
+			t.Cleanup(egress.Close)
+			if err := SetEgressProxy(egress.URL); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { SetEgressProxy("") })
+
+			rec := proxyRequest(t, http.MethodGet, tt.target, nil)
+			if rec.Code != http.StatusOK || rec.Body.String() != "via egress" {
+				t.Fatalf("response = %d %q", rec.Code, rec.Body)
+			}
+			if got := stub.seen(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("egress proxy saw %q, want [%s]", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetEgressProxyValidation(t *testing.T) {
+	t.Cleanup(func() { SetEgressProxy("") })
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"", true},
+		{"http://egress.internal:3128", true},
+		{"https://egress.internal", true},
+		{"socks5h://gw.internal:1080", true},
+		{"ftp://egress.internal", false},
+		{"egress.internal:3128", false},
+		{"http://", false},
+	}
+	for _, tt := range tests {
+		if err := SetEgressProxy(tt.url); (err == nil) != tt.ok {
+			t.Errorf("SetEgressProxy(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestEgressFromEnvironment(t *testing.T) {
+	// net/http reads HTTP(S)_PROXY once per process; only ALL_PROXY and
+	// NO_PROXY are looked up here on every request.
+	for _, k := range []string{"HTTPS_PROXY", "https_proxy"} {
+		if os.Getenv(k) != "" {
+			t.Skip(k + " is set")
+		}
+	}
+	SetEgressProxy("")
+	t.Setenv("ALL_PROXY", "socks5://gw.internal:1080")
+	t.Setenv("NO_PROXY", "internal.example, .corp.example")
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"site.example", "socks5://gw.internal:1080"},
+		{"internal.example", ""},
+		{"a.corp.example", ""},
+		{"corp.example", ""},
+		{"notcorp.example", "socks5://gw.internal:1080"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+tt.host+"/", nil)
+		u, err := chooseEgressProxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("egress for %s = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Proxy error responses
+// ---------------------------------------------------------------------------
+//
+// Failures of /proxy itself (bad URL, upstream unreachable, limits) are
+// rendered as an HTML page that fits the UI, or as JSON for clients that
+// ask for it with Accept: application/json.
+
+// ErrorPageData is passed to the error template.
+type ErrorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	// TargetURL is the upstream URL, when known; RetryURL loads it again
+	// through the proxy.
+	TargetURL string
+	RetryURL  string
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status}} {{.StatusText}}</title>
+<style>
+  html, body { height: 100%; margin: 0; }
+  body { display: flex; align-items: center; justify-content: center;
+         font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
+         background: #0e0e10; color: #e4e4e7; }
+  main { max-width: 560px; padding: 24px; }
+  h1 { font-size: 20px; color: #a78bfa; margin: 0 0 12px; }
+  p { line-height: 1.5; margin: 0 0 12px; }
+  code { word-break: break-all; color: #a1a1aa; }
+  a { color: #a78bfa; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{- if .TargetURL}}
+<p><code>{{.TargetURL}}</code></p>
+{{- end}}
+{{- if .RetryURL}}
+<p><a href="{{.RetryURL}}">Try again</a></p>
+{{- end}}
+</main>
+</body>
+</html>
+`))
+
+var (
+	errorTemplateMu sync.RWMutex
+	errorTemplate   = defaultErrorTemplate
+)
+
+// SetErrorTemplate replaces the HTML template used for proxy errors.  It
+// is executed with an ErrorPageData.  A nil template restores the default.
+func SetErrorTemplate(t *template.Template) {
+	errorTemplateMu.Lock()
+	defer errorTemplateMu.Unlock()
+	if t == nil {
+		t = defaultErrorTemplate
+	}
+	errorTemplate = t
+}
+
+// wantsJSON reports whether the client prefers a JSON error body.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			return true
+		case mt == "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// proxyError answers a failed /proxy request with status and msg, in the
+// form the client asked for.  targetURL may be empty.
+func proxyError(w http.ResponseWriter, r *http.Request, status int, msg, targetURL string) {
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+		TargetURL:  targetURL,
+	}
+	if targetURL != "" && r.Method == http.MethodGet {
+		data.RetryURL = EncodeProxyURL(targetURL)
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if wantsJSON(r) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+			URL    string `json:"url,omitempty"`
+		}{msg, status, targetURL})
+		return
+	}
+
+	errorTemplateMu.RLock()
+	t := errorTemplate
+	errorTemplateMu.RUnlock()
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		getLogger().Error("error template failed", "err", err)
+		http.Error(w, msg, status)
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyErrorFormat(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	target := dead.URL + "/page"
+	dead.Close()
+
+	tests := []struct {
+		accept   string
+		wantJSON bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"application/json, text/html", true},
+		{"text/html, application/json", false},
+		{"bogus;;, application/json", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			resetSessions(t)
+			rec := proxyRequest(t, http.MethodGet, target, http.Header{"Accept": {tt.accept}})
+			if rec.Code != http.StatusBadGateway {
+				t.Fatalf("status = %d, want 502", rec.Code)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", cc)
+			}
+			ct := rec.Header().Get("Content-Type")
+			if tt.wantJSON {
+				var body struct {
+					Error  string `json:"error"`
+					Status int    `json:"status"`
+					URL    string `json:"url"`
+				}
+				if ct != "application/json" {
+					t.Fatalf("Content-Type = %q, want application/json", ct)
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body is not JSON: %v: %q", err, rec.Body)
+				}
+				if body.Status != http.StatusBadGateway || body.Error == "" || body.URL != target {
+					t.Errorf("body = %+v", body)
+				}
+				return
+			}
+			if !strings.HasPrefix(ct, "text/html") {
+				t.Fatalf("Content-Type = %q, want text/html", ct)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, "502 Bad Gateway") || !strings.Contains(body, `href="`+EncodeProxyURL(target)+`"`) {
+				t.Errorf("HTML page lacks the status or retry link: %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package transport
+
+import "strings"
+
+// ---------------------------------------------------------------------------
+// Rewrite fast path
+// ---------------------------------------------------------------------------
+//
+// Most stylesheets and many scripts contain nothing the rewriter would
+// change, yet each one costs an envelope encode, a cgo call and a parse.
+// With the fast path on, a cheap scan for URL-shaped tokens lets such
+// documents skip the rewriter.  The scan only looks for absolute and
+// protocol-relative URLs and url()/@import, so a script that passes a
+// relative URL to fetch or new Worker is left to the client runtime,
+// which resolves it at call time.  HTML is always rewritten: even a page
+// without URLs gets the runtime injected and its relative links resolved.
+
+// EnableRewriteFastPath lets CSS and JS documents without URL tokens
+// bypass the rewriter.
+var EnableRewriteFastPath bool
+
+// skipRewrite reports whether content of category can be served as is.
+func skipRewrite(category ContentCategory, content string) bool {
+	if !EnableRewriteFastPath {
+		return false
+	}
+	switch category {
+	case ContentCSS:
+		return !hasURLToken(content) && !hasCSSURLFunction(content)
+	case ContentJS:
+		if hasURLToken(content) {
+			return false
+		}
+		// Options that rewrite more than URLs.
+		if RewriteModuleURLs && strings.Contains(content, "import") {
+			return false
+		}
+		if RewriteLocation && (strings.Contains(content, "location") || strings.Contains(content, "domain")) {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// hasURLToken reports whether s contains an absolute or protocol-relative
+// URL ("//" covers http://, https://, ws:// and wss://).
+func hasURLToken(s string) bool {
+	return strings.Contains(s, "//")
+}
+
+// hasCSSURLFunction reports whether s contains url( or @import, in any
+// case.
+func hasCSSURLFunction(s string) bool {
+	for i := strings.IndexByte(s, '('); i >= 0; {
+		if i >= 3 && strings.EqualFold(s[i-3:i], "url") {
+			return true
+		}
+		next := strings.IndexByte(s[i+1:], '(')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	for i := strings.IndexByte(s, '@'); i >= 0; {
+		if len(s)-i > 6 && strings.EqualFold(s[i+1:i+7], "import") {
+			return true
+		}
+		next := strings.IndexByte(s[i+1:], '@')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
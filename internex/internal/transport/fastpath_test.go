@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"internex/internal/rewriter"
+)
+
+// withFastPath sets EnableRewriteFastPath for the test.
+func withFastPath(t testing.TB, on bool) {
+	t.Helper()
+	old := EnableRewriteFastPath
+	EnableRewriteFastPath = on
+	t.Cleanup(func() { EnableRewriteFastPath = old })
+}
+
+func rewriteFor(ctx context.Context, category ContentCategory, doc, contentType string) string {
+	_, out := rewriteDocument(ctx, category, []byte(doc), http.Header{"Content-Type": {contentType}}, "https://example.com/a")
+	return out
+}
+
+func TestRewriteFastPath(t *testing.T) {
+	ctx := rewriter.WithOptions(context.Background(), rewriter.DefaultOptions(ProxyOrigin, "https://example.com/a"))
+	tests := []struct {
+		name     string
+		category ContentCategory
+		doc      string
+		skip     bool
+	}{
+		{"plain css", ContentCSS, "body { color: #333; margin: 0 }\n.a > .b { display: none }", true},
+		{"css url()", ContentCSS, `.logo { background: URL("/img/logo.png") }`, false},
+		{"css @import", ContentCSS, `@IMPORT "theme.css"; body { margin: 0 }`, false},
+		{"css absolute url", ContentCSS, `/* see https://example.com/docs */ body {}`, false},
+		{"plain js", ContentJS, "function add(a, b) { return a + b }\nconsole.log(add(1, 2));", true},
+		{"js absolute url", ContentJS, `fetch("https://api.example.com/v1")`, false},
+		{"js protocol relative", ContentJS, `img.src = "//cdn.example.com/a.png"`, false},
+		{"html is never skipped", ContentHTML, "<p>hello</p>", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType := map[ContentCategory]string{ContentCSS: "text/css", ContentJS: "text/javascript"}[tt.category]
+			withFastPath(t, true)
+			if got := skipRewrite(tt.category, tt.doc); got != tt.skip {
+				t.Fatalf("skipRewrite = %v, want %v", got, tt.skip)
+			}
+			if !tt.skip {
+				return
+			}
+			fast := rewriteFor(ctx, tt.category, tt.doc, contentType)
+
+			withFastPath(t, false)
+			full := rewriteFor(ctx, tt.category, tt.doc, contentType)
+			if fast != full {
+				t.Errorf("fast path output differs from the rewriter:\nfast: %q\nfull: %q", fast, full)
+			}
+		})
+	}
+}
+
+func BenchmarkRewriteFastPath(b *testing.B) {
+	ctx := rewriter.WithOptions(context.Background(), rewriter.DefaultOptions(ProxyOrigin, "https://example.com/a"))
+	doc := strings.Repeat(".card { padding: 4px 8px; border: 1px solid #ddd; color: #333 }\n", 1000)
+	for _, on := range []bool{false, true} {
+		name := "off"
+		if on {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			withFastPath(b, on)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			for i := 0; i < b.N; i++ {
+				rewriteFor(ctx, ContentCSS, doc, "text/css")
+			}
+		})
+	}
+}
@@ -1,29 +1,46 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // streamTransport is tuned for long-lived / streaming connections.
 // ResponseHeaderTimeout is intentionally zero so streamed bodies are
-// never cut short.
+// never cut short.  HTTP/2 is negotiated via ALPN unless DisableHTTP2 is
+// set; WebSocket upgrades always use HTTP/1.1 (see dialWebSocket).
 var streamTransport = &http.Transport{
-	DialContext: (&net.Dialer{
-		Timeout:   15 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).DialContext,
+	ForceAttemptHTTP2:   true,
+	Proxy:               egressProxy,
+	DialContext:         dialUpstream,
 	TLSHandshakeTimeout: 10 * time.Second,
 	TLSClientConfig:     &tls.Config{},
 	DisableCompression:  true,
 	MaxIdleConns:        100,
 	IdleConnTimeout:     90 * time.Second,
+	// Bounds the wait for an upstream 100 Continue; see forwardBody.
+	ExpectContinueTimeout: time.Second,
+}
+
+// DisableHTTP2 restricts upstream connections to HTTP/1.1.  It must be
+// set before NewMux is called.
+var DisableHTTP2 bool
+
+// applyHTTP2Setting makes streamTransport honor DisableHTTP2.  It must
+// run before the transport makes its first request.
+func applyHTTP2Setting() {
+	if DisableHTTP2 {
+		streamTransport.ForceAttemptHTTP2 = false
+		// A non-nil, empty map turns off the transport's built-in h2.
+		streamTransport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
 }
 
 // httpClient is used for regular (non-upgrade) requests.
@@ -44,16 +61,27 @@ var httpClient = &http.Client{
 // upstream target. It supports streaming responses and WebSocket
 // upgrade requests.
 func FetchUpstream(targetURL, method string, headers http.Header, body io.Reader) (*http.Response, error) {
-	return fetchInternal(targetURL, method, headers, body, "")
+	return FetchUpstreamContext(context.Background(), targetURL, method, headers, body)
+}
+
+// FetchUpstreamContext is like FetchUpstream but bound to ctx: cancelling
+// it aborts the request, including a response body still being read, and
+// any retry backoff.  Pass the incoming request's context so a client
+// that goes away stops the upstream fetch.
+func FetchUpstreamContext(ctx context.Context, targetURL, method string, headers http.Header, body io.Reader) (*http.Response, error) {
+	return fetchInternal(ctx, targetURL, method, headers, body, "", forwardedInfo{})
 }
 
 // FetchUpstreamWithCookies is like FetchUpstream but additionally
-// attaches the provided cookie header from the session store.
-func FetchUpstreamWithCookies(targetURL, method string, headers http.Header, body io.Reader, cookieHeader string) (*http.Response, error) {
-	return fetchInternal(targetURL, method, headers, body, cookieHeader)
+// attaches the provided cookie header from the session store.  clientIP,
+// if not empty, is sent as X-Forwarded-For when ForwardClientIP is set.
+func FetchUpstreamWithCookies(targetURL, method string, headers http.Header, body io.Reader, cookieHeader, clientIP string) (*http.Response, error) {
+	return fetchInternal(context.Background(), targetURL, method, headers, body, cookieHeader, forwardedForClient(clientIP))
 }
 
-func fetchInternal(targetURL, method string, headers http.Header, body io.Reader, cookieHeader string) (*http.Response, error) {
+// fetchInternal builds and sends the upstream request.  ctx bounds the
+// whole exchange, including retry backoff.
+func fetchInternal(ctx context.Context, targetURL, method string, headers http.Header, body io.Reader, cookieHeader string, fwd forwardedInfo) (*http.Response, error) {
 	parsed, err := url.Parse(targetURL)
 	if err != nil {
 		return nil, fmt.Errorf("parsing target URL: %w", err)
@@ -61,8 +89,8 @@ func fetchInternal(targetURL, method string, headers http.Header, body io.Reader
 
 	// WebSocket schemes must be translated to HTTP(S) for the handshake.
 	requestURL := targetURL
-	if parsed.Scheme == "ws" || parsed.Scheme == "wss" {
-		parsed.Scheme = map[string]string{"ws": "http", "wss": "https"}[parsed.Scheme]
+	if scheme := httpScheme(parsed.Scheme); scheme != parsed.Scheme {
+		parsed.Scheme = scheme
 		requestURL = parsed.String()
 	}
 
@@ -70,55 +98,140 @@ func fetchInternal(targetURL, method string, headers http.Header, body io.Reader
 		method = http.MethodGet
 	}
 
-	req, err := http.NewRequest(method, requestURL, body)
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
 	if err != nil {
 		return nil, fmt.Errorf("building request: %w", err)
 	}
 
 	// ---- safe headers ----
 	forwardHeaders(req.Header, headers)
+	forwardBody(req, headers)
+	fwd.apply(req.Header)
+	applyOriginHeaders(req.Header, upstreamOrigin(targetURL))
 
-	// Always avoid compressed responses for rewritable content.
-	req.Header.Set("Accept-Encoding", "identity")
+	// Only ask for codings we can decode before rewriting.
+	req.Header.Set("Accept-Encoding", upstreamAcceptEncoding())
 
 	// ---- rewrite Host / Origin / Referer to upstream ----
 	req.Host = parsed.Host
 	req.Header.Set("Host", parsed.Host)
 
-	upstreamOrigin := parsed.Scheme + "://" + parsed.Host
-	if headers.Get("Origin") != "" {
-		req.Header.Set("Origin", upstreamOrigin)
-	}
-	if headers.Get("Referer") != "" {
-		req.Header.Set("Referer", targetURL)
+	setOutboundOrigin(req, headers, parsed)
+	if ref := outboundReferer(headers.Get("Referer"), targetURL); ref != "" {
+		req.Header.Set("Referer", ref)
+	} else {
+		req.Header.Del("Referer")
 	}
 
 	// ---- session cookies ----
 	injectCookies(req, cookieHeader)
+	if err := limitRequestHeaders(req.Header); err != nil {
+		return nil, err
+	}
+
+	runRequestHooks(req)
 
 	// ---- WebSocket upgrade ----
 	if isWebSocketUpgrade(headers) {
 		req.Header.Set("Connection", "Upgrade")
 		req.Header.Set("Upgrade", "websocket")
 
+		// These may be repeated (several offered subprotocols), so every
+		// value is forwarded in order.
 		for _, k := range []string{
 			"Sec-WebSocket-Key",
 			"Sec-WebSocket-Version",
 			"Sec-WebSocket-Extensions",
 			"Sec-WebSocket-Protocol",
 		} {
-			if v := headers.Get(k); v != "" {
-				req.Header.Set(k, v)
+			if vs := headers.Values(k); len(vs) > 0 {
+				req.Header[k] = append([]string(nil), vs...)
 			}
 		}
 
-		// RoundTrip preserves the 101 Switching Protocols response and
-		// keeps the underlying connection open for bidirectional I/O.
-		return streamTransport.RoundTrip(req)
+		// The handshake runs on an explicitly dialed connection, which
+		// becomes the 101 response's body for bidirectional I/O.
+		release, err := acquireGlobalSlot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		getLogger().Debug("upstream websocket upgrade", "url", requestURL)
+		resp, err := dialWebSocket(req)
+		if err != nil {
+			release()
+			getLogger().Warn("upstream websocket upgrade failed", "url", requestURL, "err", err)
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// Established bridges don't count against the limit.
+			release()
+		} else {
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+		}
+		return resp, nil
 	}
 
 	// ---- regular streaming fetch ----
-	return httpClient.Do(req)
+	release, err := acquireGlobalSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	getLogger().Debug("upstream request", "method", method, "url", requestURL)
+	resp, err := doWithRetry(req)
+	if err != nil {
+		release()
+		getLogger().Warn("upstream request failed", "method", method, "url", requestURL, "err", err)
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// forwardBody carries the client's body framing over to req.  The body
+// is streamed, never buffered: a declared Content-Length is kept (the
+// client ignores it as a header), so uploads are not re-chunked, and an
+// Expect: 100-continue is forwarded for the transport to negotiate.  The
+// server sends the client its 100 Continue once the upstream has asked
+// for the body and the transport starts reading it.
+func forwardBody(req *http.Request, headers http.Header) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	if n, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		req.ContentLength = n
+		if n == 0 {
+			req.Body = http.NoBody
+			return
+		}
+	}
+	if strings.EqualFold(strings.TrimSpace(headers.Get("Expect")), "100-continue") {
+		req.Header.Set("Expect", "100-continue")
+	}
+}
+
+// outboundReferer maps the browser's Referer, normally a proxy URL of the
+// page that made the request, back to that page's upstream URL.  As under
+// the browser default policy (strict-origin-when-cross-origin), only the
+// page's origin is sent to another origin.  Other proxy pages (the proxy
+// UI) would leak the proxy and yield no referer; a referer from another
+// site, as on a link followed into the proxy, is passed on unchanged.
+// The Origin sent upstream is derived the same way; see
+// setOutboundOrigin.
+func outboundReferer(referer, targetURL string) string {
+	if referer == "" {
+		return ""
+	}
+	page, ok := decodeProxiedReferer(referer)
+	if !ok {
+		if u, err := url.Parse(referer); err != nil || !u.IsAbs() || isProxyOrigin(ExtractOrigin(referer)) {
+			return ""
+		}
+		return referer
+	}
+	if origin := upstreamOrigin(page); origin != upstreamOrigin(targetURL) {
+		return origin + "/"
+	}
+	return page
 }
 
 // injectCookies merges per-origin cookies from the session store into
@@ -0,0 +1,282 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchUpstreamContextCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		// headersFirst makes the upstream send its headers before stalling,
+		// so cancellation has to abort the body read.
+		headersFirst bool
+	}{
+		{"while waiting for headers", false},
+		{"while reading the body", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrived, aborted := make(chan struct{}), make(chan struct{})
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.headersFirst {
+					w.Write([]byte("partial"))
+					w.(http.Flusher).Flush()
+				}
+				close(arrived)
+				select {
+				case <-r.Context().Done():
+					close(aborted)
+				case <-time.After(10 * time.Second):
+				}
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-arrived
+				cancel()
+			}()
+			start := time.Now()
+			resp, err := FetchUpstreamContext(ctx, up.URL+"/slow", http.MethodGet, http.Header{}, nil)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("err = %v, want context.Canceled", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("fetch took %v after cancellation", elapsed)
+			}
+			select {
+			case <-aborted:
+			case <-time.After(2 * time.Second):
+				t.Error("upstream request was not aborted")
+			}
+		})
+	}
+}
+
+func TestProxyClientDisconnectCancelsFetch(t *testing.T) {
+	resetSessions(t)
+	arrived, aborted := make(chan struct{}), make(chan struct{})
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(10 * time.Second):
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, EncodeProxyPath(up.URL+"/slow"), nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		NewMux().ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-arrived
+	cancel()
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request outlived the client")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return after the client went away")
+	}
+}
+
+func TestProxyExpectContinue(t *testing.T) {
+	const payload = "upload-body"
+	tests := []struct {
+		name   string
+		reject bool // upstream answers 413 without reading the body
+	}{
+		{"upstream reads the body", false},
+		{"upstream rejects before reading", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			type seen struct{ expect, body string }
+			got := make(chan seen, 1)
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.reject {
+					got <- seen{expect: r.Header.Get("Expect")}
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				b, _ := io.ReadAll(r.Body)
+				got <- seen{r.Header.Get("Expect"), string(b)}
+			})
+			proxy := httptest.NewServer(NewMux())
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\nContent-Type: text/plain\r\n"+
+				"Content-Length: %d\r\nExpect: 100-continue\r\n\r\n",
+				EncodeProxyPath(up.URL+"/upload"), proxy.Listener.Addr(), len(payload))
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.reject {
+				if resp.StatusCode != http.StatusRequestEntityTooLarge {
+					t.Fatalf("status = %d, want 413 before any body", resp.StatusCode)
+				}
+				if s := <-got; s.expect != "100-continue" {
+					t.Errorf("upstream Expect = %q", s.expect)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusContinue {
+				t.Fatalf("status = %d, want 100 Continue before the body", resp.StatusCode)
+			}
+			io.WriteString(conn, payload)
+			if resp, err = http.ReadResponse(br, nil); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("final status = %d", resp.StatusCode)
+			}
+			if s := <-got; s.expect != "100-continue" || s.body != payload {
+				t.Errorf("upstream saw Expect %q, body %q", s.expect, s.body)
+			}
+		})
+	}
+}
+
+func TestHTTP2Upstream(t *testing.T) {
+	resetSessions(t)
+	var proto atomic.Value
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Echo", string(b))
+		io.WriteString(w, `<a href="https://example.com/next">next</a>`)
+	}))
+	up.EnableHTTP2 = true
+	up.StartTLS()
+	t.Cleanup(up.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(up.Certificate())
+	SetTLSConfig(&tls.Config{RootCAs: pool})
+	t.Cleanup(func() { SetTLSConfig(nil) })
+
+	req := httptest.NewRequest(http.MethodPost, EncodeProxyPath(up.URL+"/form"), strings.NewReader("a=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	NewMux().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := proto.Load(); got != "HTTP/2.0" {
+		t.Errorf("upstream saw %v, want HTTP/2.0", got)
+	}
+	if got := rec.Header().Get("X-Echo"); got != "a=1" {
+		t.Errorf("upstream body = %q, want a=1", got)
+	}
+	if !strings.Contains(rec.Body.String(), "/proxy?url=") {
+		t.Errorf("h2 response not rewritten: %s", rec.Body)
+	}
+}
+
+func TestOutboundRefererEndToEnd(t *testing.T) {
+	var got []string
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Values("Referer")
+	})
+	samePage := up.URL + "/app/page.html?tab=2"
+	tests := []struct {
+		name    string
+		referer string
+		want    string // "" means no Referer at all
+	}{
+		{"same-origin page decoded in full", ProxyOrigin + EncodeProxyPath(samePage), samePage},
+		{"cross-origin page reduced to its origin", ProxyOrigin + EncodeProxyPath("https://other.example/secret/path?token=1"), "https://other.example/"},
+		{"proxy UI dropped", ProxyOrigin + "/", ""},
+		{"external referer passed on", "https://search.example/?q=x", "https://search.example/?q=x"},
+		{"relative referer dropped", "/app/page.html", ""},
+		{"no referer", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			got = nil
+			var h http.Header
+			if tt.referer != "" {
+				h = http.Header{"Referer": {tt.referer}}
+			}
+			proxyRequest(t, http.MethodGet, up.URL+"/api/data", h)
+			var want []string
+			if tt.want != "" {
+				want = []string{tt.want}
+			}
+			if strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("upstream Referer = %q, want %q", got, want)
+			}
+			for _, r := range got {
+				if strings.Contains(r, "/proxy?url=") || strings.HasPrefix(r, ProxyOrigin) {
+					t.Errorf("upstream Referer %q leaks the proxy", r)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboundRefererDecodesProxyURL(t *testing.T) {
+	const page = "https://site.example/docs/a b.html?q=1&r=%2F#frag"
+	norm, ok := DecodeProxyURL(url.QueryEscape(page))
+	if !ok {
+		t.Fatal("page does not decode")
+	}
+	tests := []struct {
+		name    string
+		base    string
+		referer func() string
+	}{
+		{"query form", "", func() string { return EncodeProxyURL(page) }},
+		{"base64 path form", "", func() string { return EncodeProxyURLB64(page) }},
+		{"under a base path", "/internex", func() string { return EncodeProxyURL(page) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldBase, oldOrigin := BasePath, ProxyOrigin
+			BasePath, ProxyOrigin = tt.base, "http://localhost:8080"+tt.base
+			t.Cleanup(func() { BasePath, ProxyOrigin = oldBase, oldOrigin })
+
+			ref := tt.referer()
+			if got := outboundReferer(ref, "https://site.example/api"); got != norm {
+				t.Errorf("outboundReferer(%q) = %q, want %q", ref, got, norm)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Client IP forwarding
+// ---------------------------------------------------------------------------
+
+// ForwardClientIP makes upstream requests carry X-Forwarded-For with the
+// browser's address, plus X-Forwarded-Host and X-Forwarded-Proto naming
+// the proxy as the browser reached it.
+var ForwardClientIP bool
+
+// trustedProxies are the networks whose X-Forwarded-For is believed.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the load balancers / reverse proxies in front of
+// this server, as CIDRs ("10.0.0.0/8") or single addresses.  A request
+// arriving from one of them has its X-Forwarded-For kept and the client
+// taken from it; from anywhere else the header is discarded.
+func SetTrustedProxies(cidrs []string) error {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", c)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of the request's remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedChain returns the X-Forwarded-For hops to send upstream: the
+// incoming chain when the peer is a trusted proxy, then the peer itself.
+func forwardedChain(r *http.Request) []string {
+	peer := remoteHost(r)
+	var hops []string
+	if isTrustedProxy(peer) {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	return append(hops, peer)
+}
+
+// clientIP returns the browser's address: the rightmost X-Forwarded-For
+// hop that is not a trusted proxy, or the remote address.
+func clientIP(r *http.Request) string {
+	hops := forwardedChain(r)
+	for i := len(hops) - 1; i > 0; i-- {
+		if !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	return hops[0]
+}
+
+// forwardedInfo is what fetchInternal adds as X-Forwarded-* headers.
+type forwardedInfo struct {
+	chain []string // X-Forwarded-For hops, client first
+	host  string
+	proto string
+}
+
+// forwardedFromRequest describes the browser request r.
+func forwardedFromRequest(r *http.Request) forwardedInfo {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if isTrustedProxy(remoteHost(r)) {
+		if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+			proto = p
+		}
+	}
+	return forwardedInfo{chain: forwardedChain(r), host: r.Host, proto: proto}
+}
+
+// forwardedForClient describes a fetch on behalf of clientIP made outside
+// a proxied request, naming ProxyOrigin as the host.
+func forwardedForClient(clientIP string) forwardedInfo {
+	f := forwardedInfo{}
+	if clientIP != "" {
+		f.chain = []string{clientIP}
+	}
+	if u, err := url.Parse(ProxyOrigin); err == nil {
+		f.host, f.proto = u.Host, u.Scheme
+	}
+	return f
+}
+
+// apply sets the X-Forwarded-* headers on an upstream request when
+// ForwardClientIP is enabled.
+func (f forwardedInfo) apply(h http.Header) {
+	if !ForwardClientIP || len(f.chain) == 0 {
+		return
+	}
+	h.Set("X-Forwarded-For", strings.Join(f.chain, ", "))
+	if f.host != "" {
+		h.Set("X-Forwarded-Host", f.host)
+	}
+	if f.proto != "" {
+		h.Set("X-Forwarded-Proto", f.proto)
+	}
+}
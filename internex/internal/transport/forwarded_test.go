@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+
+	var got http.Header
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+	tests := []struct {
+		name      string
+		forward   bool
+		peer      string
+		xff       string
+		xfp       string
+		wantXFF   string
+		wantProto string
+	}{
+		{"off strips the chain", false, "10.0.0.1", "203.0.113.5", "https", "", ""},
+		{"untrusted peer's chain dropped", true, "192.0.2.1", "1.2.3.4", "https", "192.0.2.1", "http"},
+		{"trusted peer's chain appended", true, "10.0.0.1", "203.0.113.5", "https", "203.0.113.5, 10.0.0.1", "https"},
+		{"multi-hop chain kept in order", true, "10.0.0.1", "198.51.100.1, 203.0.113.5", "", "198.51.100.1, 203.0.113.5, 10.0.0.1", "http"},
+		{"direct client", true, "192.0.2.1", "", "", "192.0.2.1", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := ForwardClientIP
+			ForwardClientIP = tt.forward
+			t.Cleanup(func() { ForwardClientIP = old })
+
+			r := httptest.NewRequest(http.MethodGet, EncodeProxyPath(up.URL+"/"), nil)
+			r.RemoteAddr = tt.peer + ":40000"
+			r.Host = "proxy.example"
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xfp != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.xfp)
+			}
+			NewMux().ServeHTTP(httptest.NewRecorder(), r)
+
+			if xff := got.Get("X-Forwarded-For"); xff != tt.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", xff, tt.wantXFF)
+			}
+			if p := got.Get("X-Forwarded-Proto"); p != tt.wantProto {
+				t.Errorf("X-Forwarded-Proto = %q, want %q", p, tt.wantProto)
+			}
+			wantHost := ""
+			if tt.forward {
+				wantHost = "proxy.example"
+			}
+			if h := got.Get("X-Forwarded-Host"); h != wantHost {
+				t.Errorf("X-Forwarded-Host = %q, want %q", h, wantHost)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+	tests := []struct {
+		peer, xff, want string
+	}{
+		{"192.0.2.1", "1.2.3.4", "192.0.2.1"},
+		{"10.0.0.1", "203.0.113.5", "203.0.113.5"},
+		{"10.0.0.1", "203.0.113.5, 192.0.2.10", "203.0.113.5"},
+		{"10.0.0.1", "1.2.3.4, 203.0.113.5", "203.0.113.5"},
+		{"10.0.0.1", "", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.peer + ":40000"
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(peer %s, XFF %q) = %s, want %s", tt.peer, tt.xff, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"fmt"
 	"mime"
 	"net/http"
 	"net/url"
@@ -15,6 +16,13 @@ const (
 	ContentHTML
 	ContentCSS
 	ContentJS
+	// ContentJSON is only assigned when JSON rewriting is enabled; see
+	// RewriteJSON.
+	ContentJSON
+	// ContentXML covers RSS, Atom and other XML documents.
+	ContentXML
+	// ContentManifest is a web app manifest; see rewriteManifest.
+	ContentManifest
 )
 
 // DetectContentType extracts the media type from an HTTP header set.
@@ -27,6 +35,16 @@ func DetectContentType(h http.Header) string {
 	return mediaType
 }
 
+// xmlMediaTypes are the XML types rewritten as feeds.  Other +xml types
+// (SVG, for one) are left alone.
+var xmlMediaTypes = map[string]bool{
+	"text/xml":             true,
+	"application/xml":      true,
+	"application/rss+xml":  true,
+	"application/atom+xml": true,
+	"application/rdf+xml":  true,
+}
+
 // Categorize maps a media-type string to a ContentCategory.
 func Categorize(mediaType string) ContentCategory {
 	switch {
@@ -36,11 +54,70 @@ func Categorize(mediaType string) ContentCategory {
 		return ContentCSS
 	case strings.Contains(mediaType, "javascript"):
 		return ContentJS
+	case xmlMediaTypes[mediaType]:
+		return ContentXML
 	default:
 		return ContentOther
 	}
 }
 
+// RewriteCategories lists the categories that are rewritten; documents
+// in any other category stream through unmodified, like ContentOther.
+// JSON is governed by RewriteJSON instead.  A request can switch off
+// more categories with norewrite=js,css (see categoryNames).
+var RewriteCategories = map[ContentCategory]bool{
+	ContentHTML:     true,
+	ContentCSS:      true,
+	ContentJS:       true,
+	ContentXML:      true,
+	ContentManifest: true,
+}
+
+// categoryNames maps the names accepted by norewrite and
+// REWRITE_CATEGORIES to categories.
+var categoryNames = map[string]ContentCategory{
+	"html":     ContentHTML,
+	"css":      ContentCSS,
+	"js":       ContentJS,
+	"xml":      ContentXML,
+	"json":     ContentJSON,
+	"manifest": ContentManifest,
+}
+
+// ParseContentCategories parses a comma-separated list of category names
+// ("html,css,js,xml,json,manifest") into a set.  It fails on an unknown name.
+func ParseContentCategories(list string) (map[ContentCategory]bool, error) {
+	set := make(map[ContentCategory]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		c, ok := categoryNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown content category %q", name)
+		}
+		set[c] = true
+	}
+	return set, nil
+}
+
+// rewriteEnabled reports whether category is rewritten for a request
+// with query.  Unknown names in norewrite are ignored.
+func rewriteEnabled(category ContentCategory, query url.Values) bool {
+	if category != ContentJSON && !RewriteCategories[category] {
+		return false
+	}
+	for _, v := range query["norewrite"] {
+		for _, name := range strings.Split(v, ",") {
+			if c, ok := categoryNames[strings.ToLower(strings.TrimSpace(name))]; ok && c == category {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // ---------------------------------------------------------------------------
 // Request header forwarding
 // ---------------------------------------------------------------------------
@@ -67,6 +144,8 @@ var safeRequestHeaders = []string{
 	"Cache-Control",
 	"Range",
 	"DNT",
+	"Access-Control-Request-Method",
+	"Access-Control-Request-Headers",
 }
 
 // forwardHeaders copies safe headers from src into dst.
@@ -122,18 +201,29 @@ func CopyResponseHeaders(dst http.Header, src http.Header) {
 	CopyResponseHeadersWithContext(dst, src, targetURL)
 }
 
+// PreservedHeaders lists security headers that are passed through
+// instead of stripped, for every response.
+var PreservedHeaders []string
+
+// droppedResponseHeader reports whether CopyResponseHeadersWithContext
+// drops the upstream header k: hop-by-hop headers always, and security
+// headers that block proxying unless named in keep or PreservedHeaders.
+func droppedResponseHeader(k string, keep []string) bool {
+	if hopByHopHeaders[k] {
+		return true
+	}
+	return strippedSecurityHeaders[k] && !containsHeader(keep, k) && !containsHeader(PreservedHeaders, k)
+}
+
 // CopyResponseHeadersWithContext copies upstream response headers with
-// full rewriting of Location and Set-Cookie.
-func CopyResponseHeadersWithContext(dst http.Header, src http.Header, targetURL string) {
+// full rewriting of Location and Set-Cookie.  Security headers named in
+// keep (case-insensitively) or PreservedHeaders are passed through for
+// this response; hop-by-hop headers are always dropped.
+func CopyResponseHeadersWithContext(dst http.Header, src http.Header, targetURL string, keep ...string) {
 	proxyHost := strings.TrimPrefix(strings.TrimPrefix(ProxyOrigin, "https://"), "http://")
 
 	for k, vv := range src {
-		// Skip hop-by-hop.
-		if hopByHopHeaders[k] {
-			continue
-		}
-		// Strip security headers that block proxying.
-		if strippedSecurityHeaders[k] {
+		if droppedResponseHeader(k, keep) {
 			continue
 		}
 
@@ -146,12 +236,23 @@ func CopyResponseHeadersWithContext(dst http.Header, src http.Header, targetURL
 
 		case "set-cookie":
 			// Rewrite cookie domain / attributes so the browser
-			// stores them under the proxy's host.
-			for _, v := range vv {
+			// stores them under the proxy's host.  Each cookie is
+			// rewritten on its own line; oversized ones, which the jar
+			// drops as well, are not relayed.
+			for _, v := range setCookieValues(http.Header{k: vv}) {
+				if pair, _, _ := strings.Cut(v, ";"); len(strings.TrimSpace(pair))-1 > maxCookieBytes {
+					continue
+				}
 				rewritten := RewriteSetCookieDomain(v, proxyHost)
 				dst.Add(k, rewritten)
 			}
 
+		case "vary":
+			// Merged and deduplicated once all headers are copied.
+			for _, v := range vv {
+				dst.Add(k, v)
+			}
+
 		case "content-length":
 			// Will be re-set after rewriting if needed; skip for now.
 			for _, v := range vv {
@@ -164,6 +265,103 @@ func CopyResponseHeadersWithContext(dst http.Header, src http.Header, targetURL
 			}
 		}
 	}
+
+	rewriteCORSHeaders(dst)
+	normalizeVary(dst)
+}
+
+// setCookieValues returns the Set-Cookie values of h, one cookie each.
+// Some servers and intermediaries fold several cookies into one line
+// separated by commas, which would otherwise be read as a single cookie.
+// A comma only starts a new cookie when a name=value pair follows it, so
+// the comma in an Expires date such as "Wed, 21 Oct 2026 07:28:00 GMT"
+// never splits a cookie.
+func setCookieValues(h http.Header) []string {
+	var out []string
+	for _, line := range h.Values("Set-Cookie") {
+		start := 0
+		for i := 0; i < len(line); i++ {
+			if line[i] == ',' && startsCookiePair(line[i+1:]) {
+				if v := strings.TrimSpace(line[start:i]); v != "" {
+					out = append(out, v)
+				}
+				start = i + 1
+			}
+		}
+		if v := strings.TrimSpace(line[start:]); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// startsCookiePair reports whether s begins, after spaces, with a cookie
+// name immediately followed by '='.
+func startsCookiePair(s string) bool {
+	s = strings.TrimLeft(s, " \t")
+	n := 0
+	for n < len(s) && s[n] > ' ' && s[n] < 0x7f && !strings.ContainsRune(`()<>@,;:\"/[]?={}`, rune(s[n])) {
+		n++
+	}
+	return n > 0 && n < len(s) && s[n] == '='
+}
+
+// containsHeader reports whether names holds name, compared as
+// canonical header keys.
+func containsHeader(names []string, name string) bool {
+	for _, n := range names {
+		if http.CanonicalHeaderKey(strings.TrimSpace(n)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// keptHeaders returns the header names listed in a request's keep query
+// parameter (comma-separated, possibly repeated).
+func keptHeaders(query url.Values) []string {
+	var names []string
+	for _, v := range query["keep"] {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
+// normalizeVary merges every Vary header in h into a single value with
+// duplicates removed (case-insensitively), adding any extra fields such
+// as "Accept-Encoding" when the proxy itself compresses.  A "*" member
+// makes the response vary on everything, so it replaces the list.
+func normalizeVary(h http.Header, extra ...string) {
+	values := append(h.Values("Vary"), extra...)
+	if len(values) == 0 {
+		return
+	}
+
+	seen := make(map[string]bool)
+	var fields []string
+	for _, v := range values {
+		for _, f := range strings.Split(v, ",") {
+			f = http.CanonicalHeaderKey(strings.TrimSpace(f))
+			if f == "" || seen[f] {
+				continue
+			}
+			if f == "*" {
+				h.Set("Vary", "*")
+				return
+			}
+			seen[f] = true
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		h.Del("Vary")
+		return
+	}
+	h.Set("Vary", strings.Join(fields, ", "))
 }
 
 // ExtractOrigin returns "scheme://host" from a full URL string.
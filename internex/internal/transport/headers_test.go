@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNoRewriteParam(t *testing.T) {
+	docs := map[string]struct{ contentType, body string }{
+		"/app.js":    {"text/javascript", `fetch("https://api.example.com/data");`},
+		"/page.html": {"text/html", `<a href="https://example.com/next">next</a>`},
+		"/style.css": {"text/css", `a{background:url("https://cdn.example.com/a.png")}`},
+	}
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		d := docs[r.URL.Path]
+		w.Header().Set("Content-Type", d.contentType)
+		io.WriteString(w, d.body)
+	})
+	tests := []struct {
+		name      string
+		norewrite string
+		path      string
+		rewritten bool
+	}{
+		{"js untouched", "js", "/app.js", false},
+		{"html still rewritten", "js", "/page.html", true},
+		{"css still rewritten", "js", "/style.css", true},
+		{"list and case", "CSS, js", "/style.css", false},
+		{"unknown names ignored", "nope", "/app.js", true},
+		{"without the param", "", "/page.html", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			path := EncodeProxyPath(up.URL + tt.path)
+			if tt.norewrite != "" {
+				path += "&norewrite=" + strings.ReplaceAll(tt.norewrite, " ", "%20")
+			}
+			rec := serve(t, http.MethodGet, path, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			body, want := rec.Body.String(), docs[tt.path].body
+			if got := strings.Contains(body, "/proxy?url="); got != tt.rewritten {
+				t.Errorf("rewritten = %v, want %v; body %q", got, tt.rewritten, body)
+			}
+			if !tt.rewritten && body != want {
+				t.Errorf("body = %q, want it untouched", body)
+			}
+		})
+	}
+}
+
+func TestKeepParamPreservesHeaders(t *testing.T) {
+	security := map[string]string{
+		"Content-Security-Policy": "default-src 'self'",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "no-referrer",
+	}
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range security {
+			w.Header().Set(k, v)
+		}
+		io.WriteString(w, "ok")
+	})
+	tests := []struct {
+		name      string
+		keep      []string // one keep= parameter each
+		preserved []string
+		want      []string
+	}{
+		{"stripped by default", nil, nil, nil},
+		{"single", []string{"X-Frame-Options"}, nil, []string{"X-Frame-Options"}},
+		{"list, case and spaces", []string{"x-frame-options, content-security-policy"}, nil, []string{"X-Frame-Options", "Content-Security-Policy"}},
+		{"repeated", []string{"Referrer-Policy", "X-Frame-Options"}, nil, []string{"Referrer-Policy", "X-Frame-Options"}},
+		{"PreservedHeaders", nil, []string{"Referrer-Policy"}, []string{"Referrer-Policy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := PreservedHeaders
+			PreservedHeaders = tt.preserved
+			t.Cleanup(func() { PreservedHeaders = old })
+
+			path := EncodeProxyPath(up.URL + "/")
+			for _, k := range tt.keep {
+				path += "&keep=" + url.QueryEscape(k)
+			}
+			rec := serve(t, http.MethodGet, path, nil)
+			for k, v := range security {
+				want := ""
+				for _, w := range tt.want {
+					if w == k {
+						want = v
+					}
+				}
+				if got := rec.Header().Get(k); got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepCannotPreserveHopByHop(t *testing.T) {
+	for _, k := range []string{"Connection", "Keep-Alive", "Transfer-Encoding"} {
+		if !droppedResponseHeader(k, []string{k}) {
+			t.Errorf("%s kept, want hop-by-hop headers always dropped", k)
+		}
+	}
+	if droppedResponseHeader("X-Custom", nil) {
+		t.Error("X-Custom dropped, want ordinary headers kept")
+	}
+}
+
+func TestNormalizeVary(t *testing.T) {
+	tests := []struct {
+		name  string
+		vary  []string
+		extra []string
+		want  []string // nil means no Vary header
+	}{
+		{"none", nil, nil, nil},
+		{"merged lines", []string{"Accept", "Cookie"}, nil, []string{"Accept, Cookie"}},
+		{"duplicates and case", []string{"accept-encoding, Origin", "Accept-Encoding", "origin"}, nil, []string{"Accept-Encoding, Origin"}},
+		{"extra added once", []string{"Accept-Encoding"}, []string{"Accept-Encoding"}, []string{"Accept-Encoding"}},
+		{"extra without upstream Vary", nil, []string{"Accept-Encoding"}, []string{"Accept-Encoding"}},
+		{"star wins", []string{"Accept", "*"}, []string{"Accept-Encoding"}, []string{"*"}},
+		{"empty members dropped", []string{" , ,"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range tt.vary {
+				h.Add("Vary", v)
+			}
+			normalizeVary(h, tt.extra...)
+			if got := h.Values("Vary"); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Vary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyVaryMerged(t *testing.T) {
+	resetSessions(t)
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Add("Vary", "accept-encoding, Cookie")
+		io.WriteString(w, "ok")
+	})
+	rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+	if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding, Cookie" {
+		t.Errorf("Vary = %q, want one merged line", got)
+	}
+}
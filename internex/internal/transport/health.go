@@ -0,0 +1,33 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+
+	"internex/internal/rewriter"
+)
+
+// ---------------------------------------------------------------------------
+// Readiness
+// ---------------------------------------------------------------------------
+
+// PassThrough disables rewriting: every response is relayed as is.  It
+// is the fallback when the rewriter fails to warm up.
+var PassThrough bool
+
+// handleReadyz reports whether the proxy can serve rewritten pages.  In
+// pass-through mode the rewriter is not needed, so it is not probed.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if PassThrough {
+		io.WriteString(w, "ok (pass-through)\n")
+		return
+	}
+	if err := rewriter.Ping(); err != nil {
+		getLogger().Error("readiness check failed", "err", err)
+		http.Error(w, "rewriter unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Extension hooks
+// ---------------------------------------------------------------------------
+//
+// Embedders add behaviour without forking: middleware around the proxy
+// routes (auth, logging), and hooks that see each upstream request and
+// response.  Everything runs in registration order.  Register before
+// NewMux is called; middleware added later does not apply to muxes that
+// already exist, hooks do.
+
+var (
+	hooksMu       sync.RWMutex
+	middleware    []func(http.Handler) http.Handler
+	requestHooks  []func(*http.Request)
+	responseHooks []func(resp *http.Response, targetURL string)
+)
+
+// Use adds middleware around the /proxy and /p/ routes.  The first
+// registered is the outermost, so it sees the request first.
+func Use(mw func(next http.Handler) http.Handler) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	middleware = append(middleware, mw)
+}
+
+// OnRequest adds a hook run on every upstream request just before it is
+// sent, after the proxy has set its headers and cookies, so it may add
+// or replace headers.
+func OnRequest(fn func(*http.Request)) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	requestHooks = append(requestHooks, fn)
+}
+
+// OnResponse adds a hook run on every upstream response Proxy.Fetch
+// (and so /proxy) receives, before its cookies are stored and its headers are copied to
+// the client, so it may inspect or modify both.  A hook that replaces
+// resp.Body must close the original.
+func OnResponse(fn func(resp *http.Response, targetURL string)) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	responseHooks = append(responseHooks, fn)
+}
+
+// withMiddleware wraps h in the registered middleware.
+func withMiddleware(h http.Handler) http.Handler {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+func runRequestHooks(req *http.Request) {
+	hooksMu.RLock()
+	hooks := requestHooks
+	hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(req)
+	}
+}
+
+func runResponseHooks(resp *http.Response, targetURL string) {
+	hooksMu.RLock()
+	hooks := responseHooks
+	hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(resp, targetURL)
+	}
+}
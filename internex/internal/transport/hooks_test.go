@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withResponseHook registers fn for the duration of the test.
+func withResponseHook(t *testing.T, fn func(*http.Response, string)) {
+	t.Helper()
+	hooksMu.Lock()
+	saved := responseHooks
+	hooksMu.Unlock()
+	OnResponse(fn)
+	t.Cleanup(func() {
+		hooksMu.Lock()
+		responseHooks = saved
+		hooksMu.Unlock()
+	})
+}
+
+// closeCounter counts Close calls on a replaced body.
+type closeCounter struct {
+	io.ReadCloser
+	closed *atomic.Int32
+}
+
+func (c closeCounter) Close() error {
+	c.closed.Add(1)
+	return c.ReadCloser.Close()
+}
+
+func TestOnResponseMutatesHeader(t *testing.T) {
+	resetSessions(t)
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Upstream", "raw")
+		w.Write([]byte("ok"))
+	})
+	var seen string
+	withResponseHook(t, func(resp *http.Response, targetURL string) {
+		seen = targetURL
+		resp.Header.Set("X-Upstream", "hooked")
+	})
+
+	rec := proxyRequest(t, http.MethodGet, up.URL+"/page", nil)
+	if got := rec.Header().Get("X-Upstream"); got != "hooked" {
+		t.Errorf("X-Upstream = %q, want the hook's value", got)
+	}
+	if seen != up.URL+"/page" {
+		t.Errorf("hook saw target %q", seen)
+	}
+}
+
+func TestOnResponseReplacedBodyIsClosed(t *testing.T) {
+	resetSessions(t)
+	up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("payload"))
+	})
+	// One slot: a leaked slot would make the second request wait out
+	// the queue timeout and fail with 503.
+	origin := upstreamOrigin(up.URL)
+	SetOriginConcurrency(origin, 1)
+	t.Cleanup(func() { SetOriginConcurrency(origin, 0) })
+	oldTimeout := OriginQueueTimeout
+	OriginQueueTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { OriginQueueTimeout = oldTimeout })
+
+	var closed atomic.Int32
+	withResponseHook(t, func(resp *http.Response, _ string) {
+		resp.Body = closeCounter{ReadCloser: resp.Body, closed: &closed}
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := proxyRequest(t, http.MethodGet, up.URL+"/file.bin", nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+			t.Fatalf("request %d: status %d, body %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if got := closed.Load(); got != 2 {
+		t.Errorf("replaced bodies closed %d times, want 2", got)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream hits = %d, want 2", got)
+	}
+}
@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// JSON response rewriting (opt-in)
+// ---------------------------------------------------------------------------
+//
+// SPAs often fetch JSON embedding absolute URLs (image CDNs, next-page
+// links) that would otherwise bypass the proxy.  When enabled, string
+// values holding an absolute http(s) URL are routed through /proxy.  The
+// document is edited in place, token by token, so keys, ordering,
+// whitespace and every other value survive byte for byte.
+
+// RewriteJSON enables URL rewriting for every JSON response.  A single
+// request can opt in with the rewrite_json=1 query parameter instead.
+var RewriteJSON bool
+
+// wantsJSONRewrite reports whether a response of mediaType to r should
+// have its URLs rewritten.
+func wantsJSONRewrite(query url.Values, mediaType string) bool {
+	if !isJSONMediaType(mediaType) {
+		return false
+	}
+	return RewriteJSON || query.Get("rewrite_json") == "1"
+}
+
+// isJSONMediaType matches application/json and structured +json types.
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// rewriteJSONURLs returns src with absolute http(s) URL string values
+// replaced by proxy URLs.  Object keys are never touched, and invalid
+// JSON is returned unchanged.
+func rewriteJSONURLs(src string) string {
+	if !json.Valid([]byte(src)) {
+		return src
+	}
+
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(src); i++ {
+		if src[i] != '"' {
+			continue
+		}
+		// Find the closing quote; the input is valid, so it exists.
+		end := i + 1
+		for src[end] != '"' {
+			if src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		literal := src[i : end+1]
+
+		if !isJSONKey(src, end+1) {
+			var s string
+			if json.Unmarshal([]byte(literal), &s) == nil && isRewritableJSONURL(s) {
+				if enc, err := json.Marshal(EncodeProxyURL(s)); err == nil {
+					b.WriteString(src[last:i])
+					b.Write(enc)
+					last = end + 1
+				}
+			}
+		}
+		i = end
+	}
+	if last == 0 {
+		return src
+	}
+	b.WriteString(src[last:])
+	return b.String()
+}
+
+// isJSONKey reports whether the string literal ending just before pos is
+// an object key, i.e. is followed by a colon.
+func isJSONKey(src string, pos int) bool {
+	for ; pos < len(src); pos++ {
+		switch src[pos] {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case ':':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// isRewritableJSONURL reports whether s is exactly one absolute http(s)
+// URL that does not already point at the proxy.
+func isRewritableJSONURL(s string) bool {
+	lower := strings.ToLower(s)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return false
+	}
+	if strings.ContainsAny(s, " \t\r\n") {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if _, ok := decodeProxiedReferer(s); ok {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteJSONURLs(t *testing.T) {
+	p := func(u string) string { return `"` + EncodeProxyURL(u) + `"` }
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "nested objects",
+			in:   `{"user":{"avatar":{"url":"https://cdn.example.com/a.png","w":64}}}`,
+			want: `{"user":{"avatar":{"url":` + p("https://cdn.example.com/a.png") + `,"w":64}}}`,
+		},
+		{
+			name: "arrays of strings and objects",
+			in:   `{"images":["https://cdn.example.com/1.png","http://cdn.example.com/2.png"],"items":[{"next":"https://api.example.com/p/2"},[["https://x.example/"]]]}`,
+			want: `{"images":[` + p("https://cdn.example.com/1.png") + `,` + p("http://cdn.example.com/2.png") + `],"items":[{"next":` + p("https://api.example.com/p/2") + `},[[` + p("https://x.example/") + `]]]}`,
+		},
+		{
+			name: "top-level array, whitespace kept",
+			in:   "[\n  \"https://example.com/a\",\n  1,\n  null\n]",
+			want: "[\n  " + p("https://example.com/a") + ",\n  1,\n  null\n]",
+		},
+		{
+			name: "URL keys and non-URL strings untouched",
+			in:   `{"https://example.com/":"home","rel":"/relative","note":"see https://example.com/ here","mail":"mailto:a@example.com"}`,
+			want: `{"https://example.com/":"home","rel":"/relative","note":"see https://example.com/ here","mail":"mailto:a@example.com"}`,
+		},
+		{
+			name: "escaped URL",
+			in:   `{"u":"https:\/\/example.com\/a?x=1&y=2"}`,
+			want: `{"u":` + p("https://example.com/a?x=1&y=2") + `}`,
+		},
+		{
+			name: "already proxied left alone",
+			in:   `{"u":` + p("https://example.com/") + `}`,
+			want: `{"u":` + p("https://example.com/") + `}`,
+		},
+		{
+			name: "invalid JSON unchanged",
+			in:   `{"u":"https://example.com/"`,
+			want: `{"u":"https://example.com/"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteJSONURLs(tt.in); got != tt.want {
+				t.Errorf("rewriteJSONURLs =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyJSONRewrite(t *testing.T) {
+	resetSessions(t)
+	const doc = `{"data":{"posts":[{"img":"https://cdn.example.com/1.png"}]}}`
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		w.Write([]byte(doc))
+	})
+	tests := []struct {
+		name   string
+		global bool
+		query  string
+		want   string
+	}{
+		{"off by default", false, "", doc},
+		{"per request", false, "&rewrite_json=1", rewriteJSONURLs(doc)},
+		{"globally", true, "", rewriteJSONURLs(doc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := RewriteJSON
+			RewriteJSON = tt.global
+			t.Cleanup(func() { RewriteJSON = old })
+
+			rec := serve(t, http.MethodGet, EncodeProxyPath(up.URL+"/api")+tt.query, nil)
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNoGoroutineLeaks(t *testing.T) {
+	resetSessions(t)
+	before := runtime.NumGoroutine()
+
+	echo := httptest.NewServer(http.HandlerFunc(wsEcho))
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if _, err := w.Write([]byte("chunk\n")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	proxy := httptest.NewServer(NewMux())
+	proxyAddr := proxy.Listener.Addr().String()
+	client := &http.Client{Transport: &http.Transport{}}
+
+	for i := 0; i < 10; i++ {
+		// A bridge closed by the client, and one by CloseWebSockets.
+		conn, _ := openBridge(t, proxyAddr, echo.URL+"/ws", nil)
+		conn.Close()
+		kept, _ := openBridge(t, proxyAddr, echo.URL+"/ws", nil)
+		CloseWebSockets()
+		kept.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := kept.Read(make([]byte, 1)); err == nil {
+			t.Fatal("bridge still open after CloseWebSockets")
+		}
+		kept.Close()
+
+		// A stream the client abandons part-way.
+		resp, err := client.Get(proxy.URL + EncodeProxyPath(stream.URL+"/events"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadFull(resp.Body, make([]byte, 12))
+		resp.Body.Close()
+
+		// A failing and a succeeding fetch.
+		for _, target := range []string{closed.URL + "/", plain.URL + "/"} {
+			resp, err := client.Get(proxy.URL + EncodeProxyPath(target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	client.CloseIdleConnections()
+	proxy.Close()
+	echo.Close()
+	stream.Close()
+	plain.Close()
+	streamTransport.CloseIdleConnections()
+
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(5 * time.Second); after > before && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if after > before {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines before, %d after:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
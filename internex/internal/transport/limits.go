@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Size limits
+// ---------------------------------------------------------------------------
+
+// MaxBodyBytes caps how much of a rewritable upstream body is buffered in
+// memory for rewriting.  Zero or negative disables the cap.  Bodies that
+// are not rewritten always stream and are unaffected.
+var MaxBodyBytes int64 = 32 << 20
+
+// OversizeAction selects what handleProxy does with a rewritable body
+// larger than MaxBodyBytes.
+type OversizeAction int
+
+const (
+	// OversizeStream sends the body through unrewritten.
+	OversizeStream OversizeAction = iota
+	// OversizeReject answers 502 Bad Gateway.
+	OversizeReject
+)
+
+// OversizeBodyAction is the policy applied when MaxBodyBytes is exceeded.
+var OversizeBodyAction = OversizeStream
+
+// LengthCheck selects how a buffered body whose size differs from the
+// upstream's declared Content-Length is treated.  A mismatch means the
+// response was truncated or smuggled.
+type LengthCheck int
+
+const (
+	// LengthCheckLog logs mismatches and rewrites the body anyway.
+	LengthCheckLog LengthCheck = iota
+	// LengthCheckReject answers 502 Bad Gateway on mismatch.
+	LengthCheckReject
+	// LengthCheckOff skips the comparison.
+	LengthCheckOff
+)
+
+// ContentLengthCheck is the policy applied on the buffered rewrite path.
+var ContentLengthCheck = LengthCheckLog
+
+// MaxCookieHeaderBytes caps the Cookie header sent upstream, the
+// browser's cookies and the session jar's together.  Zero or negative
+// disables the cap.
+var MaxCookieHeaderBytes = 8 << 10
+
+// MaxForwardedHeaderBytes caps the total size of the headers sent
+// upstream, counted as on the wire.  Zero or negative disables the cap.
+var MaxForwardedHeaderBytes = 32 << 10
+
+// HeaderLimitAction selects what happens to an upstream request over a
+// header limit.
+type HeaderLimitAction int
+
+const (
+	// HeaderLimitTruncate sheds cookies (whole pairs, last first) and
+	// then the largest headers until the request fits.
+	HeaderLimitTruncate HeaderLimitAction = iota
+	// HeaderLimitReject fails the request with ErrHeadersTooLarge;
+	// handleProxy answers 431 Request Header Fields Too Large.
+	HeaderLimitReject
+)
+
+// HeaderLimitPolicy is the action applied by the header limits.
+var HeaderLimitPolicy = HeaderLimitTruncate
+
+// ErrHeadersTooLarge is returned for upstream requests over a header
+// limit when HeaderLimitPolicy is HeaderLimitReject.
+var ErrHeadersTooLarge = errors.New("request headers too large")
+
+// limitRequestHeaders enforces MaxCookieHeaderBytes and
+// MaxForwardedHeaderBytes on an outgoing request's headers.
+func limitRequestHeaders(h http.Header) error {
+	if c := h.Get("Cookie"); MaxCookieHeaderBytes > 0 && len(c) > MaxCookieHeaderBytes {
+		if HeaderLimitPolicy == HeaderLimitReject {
+			return ErrHeadersTooLarge
+		}
+		getLogger().Warn("truncating upstream cookie header", "size", len(c), "limit", MaxCookieHeaderBytes)
+		setOrDel(h, "Cookie", truncateCookieHeader(c, MaxCookieHeaderBytes))
+	}
+	if MaxForwardedHeaderBytes <= 0 {
+		return nil
+	}
+	over := headerBytes(h) - MaxForwardedHeaderBytes
+	if over <= 0 {
+		return nil
+	}
+	if HeaderLimitPolicy == HeaderLimitReject {
+		return ErrHeadersTooLarge
+	}
+	getLogger().Warn("truncating upstream request headers", "over", over, "limit", MaxForwardedHeaderBytes)
+	if c := h.Get("Cookie"); c != "" {
+		kept := truncateCookieHeader(c, len(c)-over)
+		over -= len(c) - len(kept)
+		if kept == "" {
+			over -= len("Cookie") + 4
+		}
+		setOrDel(h, "Cookie", kept)
+	}
+	for over > 0 {
+		largest, size := "", 0
+		for k, vs := range h {
+			if k == "Host" {
+				continue
+			}
+			if n := headerBytes(http.Header{k: vs}); n > size {
+				largest, size = k, n
+			}
+		}
+		if largest == "" {
+			break
+		}
+		h.Del(largest)
+		over -= size
+	}
+	return nil
+}
+
+// headerBytes is the wire size of h: "Name: value\r\n" per value.
+func headerBytes(h http.Header) int {
+	n := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// truncateCookieHeader keeps the leading name=value pairs of a Cookie
+// header that fit in max bytes; a pair is never cut.
+func truncateCookieHeader(c string, max int) string {
+	if len(c) <= max {
+		return c
+	}
+	if max <= 0 {
+		return ""
+	}
+	cut := strings.LastIndex(c[:max+1], "; ")
+	if cut <= 0 {
+		return ""
+	}
+	return c[:cut]
+}
+
+// setOrDel sets h[k] to v, or removes it when v is empty.
+func setOrDel(h http.Header, k, v string) {
+	if v == "" {
+		h.Del(k)
+		return
+	}
+	h.Set(k, v)
+}
+
+// frameResponse fixes the Content-Length relayed for resp in h, so the
+// client never sees one that disagrees with the body it gets.
+// Transfer-Encoding is never relayed: the server re-chunks (or, for an
+// HTTP/1.0 client, closes the connection) whenever no length is set.
+// Only a streamed ContentOther body keeps its length, and only when the
+// upstream framed it with one (not chunked, not delimited by close, not
+// decoded).  Rewritten documents get their length from writeRewritten;
+// a HEAD for one, or a status without a body, carries none.
+func frameResponse(h http.Header, resp *http.Response, method string, category ContentCategory) {
+	h.Del("Transfer-Encoding")
+	if category != ContentOther || !statusAllowsBody(resp.StatusCode) {
+		h.Del("Content-Length")
+		return
+	}
+	if method == http.MethodHead {
+		// The upstream's header describes the body a GET would return.
+		if vs := resp.Header.Values("Content-Length"); len(vs) != 1 || !validContentLength(vs[0]) {
+			h.Del("Content-Length")
+		}
+		return
+	}
+	if resp.ContentLength < 0 {
+		h.Del("Content-Length")
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+}
+
+// validContentLength reports whether v is a single non-negative length.
+func validContentLength(v string) bool {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	return err == nil && n >= 0
+}
+
+// NeverBufferTypes lists media types that are always streamed, whatever
+// their category, so large downloads can never be read into memory.  A
+// "type/*" entry matches every subtype.
+var NeverBufferTypes = []string{
+	"application/zip",
+	"application/octet-stream",
+	"video/*",
+}
+
+// neverBuffer reports whether mediaType matches NeverBufferTypes.
+func neverBuffer(mediaType string) bool {
+	return matchMediaType(NeverBufferTypes, mediaType)
+}
+
+// matchMediaType reports whether mediaType matches an entry of patterns,
+// where "type/*" matches every subtype.
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, t := range patterns {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
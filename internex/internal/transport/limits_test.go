@@ -0,0 +1,291 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxBodyBytes(t *testing.T) {
+	const link = "https://cdn.example.com/a.png"
+	doc := `{"image":"` + link + `"}`
+	size := int64(len(doc))
+	tests := []struct {
+		name       string
+		limit      int64
+		action     OversizeAction
+		wantStatus int
+		rewritten  bool
+	}{
+		{"under the limit", size + 1, OversizeStream, http.StatusOK, true},
+		{"at the limit", size, OversizeStream, http.StatusOK, true},
+		{"over the limit streams", size - 1, OversizeStream, http.StatusOK, false},
+		{"over the limit rejects", size - 1, OversizeReject, http.StatusBadGateway, false},
+		{"no limit", 0, OversizeReject, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			oldMax, oldAction := MaxBodyBytes, OversizeBodyAction
+			MaxBodyBytes, OversizeBodyAction = tt.limit, tt.action
+			t.Cleanup(func() { MaxBodyBytes, OversizeBodyAction = oldMax, oldAction })
+
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(doc))
+			})
+			rec := serve(t, http.MethodGet, EncodeProxyPath(up.URL+"/data.json")+"&rewrite_json=1", nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "/proxy?url="+url.QueryEscape(link)); got != tt.rewritten {
+				t.Errorf("rewritten = %v, want %v; body %q", got, tt.rewritten, body)
+			}
+			if !tt.rewritten && body != doc {
+				t.Errorf("streamed body = %q, want it unchanged", body)
+			}
+		})
+	}
+}
+
+func TestOversizedCookie(t *testing.T) {
+	resetSessions(t)
+	big := strings.Repeat("x", maxCookieBytes)
+	var sent []string
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.Header.Get("Cookie"))
+		if r.URL.Path == "/login" {
+			w.Header().Add("Set-Cookie", "small=1; Path=/")
+			w.Header().Add("Set-Cookie", "big="+big+"; Path=/")
+		}
+	})
+
+	rec := proxyRequest(t, http.MethodGet, up.URL+"/login", nil)
+	if got := rec.Header().Values("Set-Cookie"); len(got) != 1 || !strings.HasPrefix(got[0], "small=1") {
+		t.Errorf("relayed Set-Cookie = %.80q, want only small", got)
+	}
+	if names := cookieNames(DefaultSessions.GetCookies(up.URL)); len(names) != 1 || names[0] != "small=1;/" {
+		t.Errorf("jar = %v, want only small", names)
+	}
+
+	proxyRequest(t, http.MethodGet, up.URL+"/account", nil)
+	if got := sent[len(sent)-1]; got != "small=1" {
+		t.Errorf("upstream Cookie = %.80q, want small=1", got)
+	}
+}
+
+func TestCookieHeaderLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     HeaderLimitAction
+		wantStatus int
+		wantCookie string
+	}{
+		{"truncate sheds the last cookie", HeaderLimitTruncate, http.StatusOK, "a=1"},
+		{"reject", HeaderLimitReject, http.StatusRequestHeaderFieldsTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			oldMax, oldPolicy := MaxCookieHeaderBytes, HeaderLimitPolicy
+			MaxCookieHeaderBytes, HeaderLimitPolicy = 1000, tt.policy
+			t.Cleanup(func() { MaxCookieHeaderBytes, HeaderLimitPolicy = oldMax, oldPolicy })
+
+			var got []string
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, r.Header.Get("Cookie"))
+				if r.URL.Path == "/login" {
+					w.Header().Add("Set-Cookie", "a=1")
+					w.Header().Add("Set-Cookie", "b="+strings.Repeat("x", 2000))
+				}
+			})
+			proxyRequest(t, http.MethodGet, up.URL+"/login", nil)
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/account", nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(got) != 1 {
+					t.Error("rejected request reached the upstream")
+				}
+				return
+			}
+			if c := got[len(got)-1]; c != tt.wantCookie {
+				t.Errorf("upstream Cookie = %.80q, want %q", c, tt.wantCookie)
+			}
+		})
+	}
+}
+
+func TestChunkedUpstreamBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		rewritten   bool
+	}{
+		{"rewritten document", "text/html", true},
+		{"streamed download", "application/zip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			parts := []string{`<a href="https://example.com/one">one</a>`, `<a href="https://example.com/two">two</a>`}
+			if !tt.rewritten {
+				// Past the server's buffer, so the relay has to be framed
+				// before the body ends.
+				parts = append(parts, strings.Repeat("z", 16<<10), strings.Repeat("z", 16<<10))
+			}
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				for _, p := range parts {
+					io.WriteString(w, p)
+					w.(http.Flusher).Flush()
+				}
+			})
+			proxy := httptest.NewServer(NewMux())
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + EncodeProxyPath(up.URL+"/doc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := string(b)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if tt.rewritten {
+				if resp.ContentLength != int64(len(body)) {
+					t.Errorf("Content-Length = %d for a %d-byte body", resp.ContentLength, len(body))
+				}
+				if strings.Count(body, "/proxy?url=") != 2 {
+					t.Errorf("body not rewritten across chunks: %q", body)
+				}
+				return
+			}
+			if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 {
+				t.Errorf("streamed with Content-Length %d, Transfer-Encoding %v; want chunked", resp.ContentLength, resp.TransferEncoding)
+			}
+			if body != strings.Join(parts, "") {
+				t.Errorf("body = %q, want it unchanged", body)
+			}
+		})
+	}
+}
+
+func TestShortUpstreamBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		check       LengthCheck
+	}{
+		{"rewritten, log policy", "text/html", LengthCheckLog},
+		{"rewritten, reject policy", "text/html", LengthCheckReject},
+		{"rewritten, check off", "text/html", LengthCheckOff},
+		{"streamed", "application/zip", LengthCheckLog},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := ContentLengthCheck
+			ContentLengthCheck = tt.check
+			t.Cleanup(func() { ContentLengthCheck = old })
+
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				conn, brw, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				// Declares 100 bytes, sends 12 and hangs up.
+				brw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: " + tt.contentType + "\r\nContent-Length: 100\r\n\r\n<p>short</p>")
+				brw.Flush()
+			})
+			proxy := httptest.NewServer(NewMux())
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + EncodeProxyPath(up.URL+"/doc"))
+			if err != nil {
+				// The streamed relay was aborted before its headers went out.
+				if tt.contentType == "text/html" {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer resp.Body.Close()
+			_, readErr := io.ReadAll(resp.Body)
+			if resp.StatusCode == http.StatusOK && readErr == nil {
+				t.Fatal("short body relayed as a complete 200")
+			}
+			if tt.contentType == "text/html" && resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestLargeZipStreamed(t *testing.T) {
+	resetSessions(t)
+	chunk := strings.Repeat(`"https://example.com/x" `, 1<<15) // 768 KiB
+	const chunks = 8
+	release := make(chan struct{})
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		for i := 0; i < chunks; i++ {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+			if i == 0 {
+				// Hold the rest until the client has the first chunk,
+				// which it only gets if the proxy does not buffer.
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	})
+	proxy := httptest.NewServer(NewMux())
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + EncodeProxyPath(up.URL+"/big.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len(chunk))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("first chunk not relayed before the upstream finished")
+	}
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != chunk || len(rest) != (chunks-1)*len(chunk) || string(rest[:len(chunk)]) != chunk {
+		t.Errorf("body altered: %d + %d bytes", len(first), len(rest))
+	}
+}
@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Structured logging
+// ---------------------------------------------------------------------------
+
+// Logger is the structured logger used by the transport package.  Fields are
+// passed as alternating key/value pairs, as with log/slog.  A *slog.Logger
+// satisfies this interface directly.
+type Logger interface {
+	Debug(msg string, kv ...any)
+	Info(msg string, kv ...any)
+	Warn(msg string, kv ...any)
+	Error(msg string, kv ...any)
+}
+
+// slogLogger is the default Logger.  It resolves slog.Default() on every
+// call so changes made with slog.SetDefault are picked up.
+type slogLogger struct{}
+
+func (slogLogger) Debug(msg string, kv ...any) { slog.Default().Debug(msg, kv...) }
+func (slogLogger) Info(msg string, kv ...any)  { slog.Default().Info(msg, kv...) }
+func (slogLogger) Warn(msg string, kv ...any)  { slog.Default().Warn(msg, kv...) }
+func (slogLogger) Error(msg string, kv ...any) { slog.Default().Error(msg, kv...) }
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = slogLogger{}
+)
+
+// SetLogger replaces the package logger.  Passing nil restores the default
+// log/slog-backed logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = slogLogger{}
+	}
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// getLogger returns the current package logger.
+func getLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// ---------------------------------------------------------------------------
+// Request accounting
+// ---------------------------------------------------------------------------
+
+// responseRecorder captures the status code and body size written to a
+// client so each proxied request can be logged once it completes.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// mods is set when ModificationLog is enabled.
+	mods *modifications
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.status = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// logProxyRequest emits the per-request summary line.
+func logProxyRequest(r *http.Request, targetURL string, rec *responseRecorder, start time.Time) {
+	host := ""
+	if u, err := url.Parse(targetURL); err == nil {
+		host = u.Host
+	}
+	kv := []any{
+		"method", r.Method,
+		"host", host,
+		"status", rec.status,
+		"duration", time.Since(start),
+		"bytes", rec.bytes,
+	}
+	if rec.mods != nil {
+		kv = append(kv, rec.mods.logFields()...)
+	}
+	getLogger().Info("proxy request", kv...)
+}
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCustomLoggerGetsRequestRecord(t *testing.T) {
+	resetSessions(t)
+	logs := withCaptureLogger(t)
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	upHost := mustParseURL(t, up.URL).Host
+
+	rec := proxyRequest(t, http.MethodPost, up.URL+"/items", nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	e := logs.wait(t, "proxy request")
+	want := map[string]any{"method": "POST", "status": http.StatusCreated, "host": upHost, "bytes": int64(len("created"))}
+	for k, v := range want {
+		if e.kv[k] != v {
+			t.Errorf("%s = %#v, want %#v", k, e.kv[k], v)
+		}
+	}
+	if d, ok := e.kv["duration"].(time.Duration); !ok || d < 5*time.Millisecond {
+		t.Errorf("duration = %#v, want at least the upstream's 5ms", e.kv["duration"])
+	}
+}
+
+func TestSetLoggerNilRestoresDefault(t *testing.T) {
+	withCaptureLogger(t)
+	SetLogger(nil)
+	if _, ok := getLogger().(slogLogger); !ok {
+		t.Errorf("logger after SetLogger(nil) = %T, want slogLogger", getLogger())
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
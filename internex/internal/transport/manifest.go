@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Web app manifest rewriting
+// ---------------------------------------------------------------------------
+//
+// A PWA's <link rel="manifest"> is rewritten like any other link, but the
+// manifest it loads names the app's start page, scope and icons by URLs
+// on the real origin, often relative to the manifest itself.  Those
+// members are resolved against the manifest URL and routed through the
+// proxy; the rest of the document is left byte for byte, as with JSON
+// rewriting.
+
+// manifestURLMembers are the members holding URLs, as paths of object
+// keys with "*" for array elements.
+var manifestURLMembers = map[string]bool{
+	"start_url":               true,
+	"scope":                   true,
+	"icons/*/src":             true,
+	"screenshots/*/src":       true,
+	"shortcuts/*/url":         true,
+	"shortcuts/*/icons/*/src": true,
+}
+
+// isWebManifest reports whether a response of mediaType from targetURL is
+// a web app manifest.  Servers without a mapping for .webmanifest send it
+// as JSON or a generic type.
+func isWebManifest(mediaType, targetURL string) bool {
+	if mediaType == "application/manifest+json" {
+		return true
+	}
+	u, err := url.Parse(targetURL)
+	return err == nil && strings.HasSuffix(strings.ToLower(u.Path), ".webmanifest")
+}
+
+// manifestFrame is an open object or array while scanning a manifest.
+type manifestFrame struct {
+	object  bool
+	key     string // member being read, objects only
+	wantKey bool   // next string is a member name
+}
+
+// rewriteManifest returns the manifest src fetched from manifestURL with
+// its URL members routed through the proxy.  Invalid JSON is returned
+// unchanged.
+func rewriteManifest(src, manifestURL string) string {
+	base, err := url.Parse(manifestURL)
+	if err != nil || !json.Valid([]byte(src)) {
+		return src
+	}
+
+	dec := json.NewDecoder(strings.NewReader(src))
+	var (
+		stack []manifestFrame
+		b     strings.Builder
+		last  int
+		prev  int
+	)
+	// valueDone moves the enclosing object on to its next member.
+	valueDone := func() {
+		if n := len(stack); n > 0 && stack[n-1].object {
+			stack[n-1].wantKey = true
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return src
+		}
+		end := int(dec.InputOffset())
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				stack = append(stack, manifestFrame{object: true, wantKey: true})
+			case '[':
+				stack = append(stack, manifestFrame{})
+			default:
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+		case string:
+			if n := len(stack); n > 0 && stack[n-1].object && stack[n-1].wantKey {
+				stack[n-1].key = t
+				stack[n-1].wantKey = false
+				break
+			}
+			if manifestURLMembers[manifestPath(stack)] {
+				if enc, ok := manifestProxyURL(base, t); ok {
+					// The literal ends at end; only separators precede it.
+					start := prev + strings.IndexByte(src[prev:end], '"')
+					b.WriteString(src[last:start])
+					b.Write(enc)
+					last = end
+				}
+			}
+			valueDone()
+		default:
+			valueDone()
+		}
+		prev = end
+	}
+	if last == 0 {
+		return src
+	}
+	b.WriteString(src[last:])
+	return b.String()
+}
+
+// manifestPath returns the member path of the value being read.
+func manifestPath(stack []manifestFrame) string {
+	parts := make([]string, len(stack))
+	for i, f := range stack {
+		if f.object {
+			parts[i] = f.key
+		} else {
+			parts[i] = "*"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// manifestProxyURL resolves ref against the manifest URL and returns the
+// proxy URL for it as a JSON string literal.  Non-http(s) URLs (data:
+// icons, for one) and URLs already on the proxy are left alone.
+func manifestProxyURL(base *url.URL, ref string) ([]byte, bool) {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return nil, false
+	}
+	abs := u.String()
+	if !isRewritableJSONURL(abs) {
+		return nil, false
+	}
+	enc, err := json.Marshal(EncodeProxyURL(abs))
+	return enc, err == nil
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestRewriteManifest(t *testing.T) {
+	const manifestURL = "https://app.example.com/static/site.webmanifest"
+	p := func(u string) string { return `"` + EncodeProxyURL(u) + `"` }
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "start_url and scope relative to the manifest",
+			in:   `{"name":"App","start_url":"../index.html?src=pwa","scope":"/"}`,
+			want: `{"name":"App","start_url":` + p("https://app.example.com/index.html?src=pwa") + `,"scope":` + p("https://app.example.com/") + `}`,
+		},
+		{
+			name: "icons src, other members kept",
+			in:   "{\n  \"icons\": [\n    {\"src\": \"icon-192.png\", \"sizes\": \"192x192\"},\n    {\"src\": \"https://cdn.example.com/512.png\", \"type\": \"image/png\"}\n  ]\n}",
+			want: "{\n  \"icons\": [\n    {\"src\": " + p("https://app.example.com/static/icon-192.png") + ", \"sizes\": \"192x192\"},\n    {\"src\": " + p("https://cdn.example.com/512.png") + ", \"type\": \"image/png\"}\n  ]\n}",
+		},
+		{
+			name: "data: icon and non-URL members untouched",
+			in:   `{"description":"https://app.example.com/","icons":[{"src":"data:image/png;base64,AAAA"}]}`,
+			want: `{"description":"https://app.example.com/","icons":[{"src":"data:image/png;base64,AAAA"}]}`,
+		},
+		{
+			name: "src outside icons untouched",
+			in:   `{"related_applications":[{"src":"/x.png","url":"https://play.example.com/app"}]}`,
+			want: `{"related_applications":[{"src":"/x.png","url":"https://play.example.com/app"}]}`,
+		},
+		{
+			name: "invalid JSON returned unchanged",
+			in:   `{"start_url":"/",`,
+			want: `{"start_url":"/",`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteManifest(tt.in, manifestURL); got != tt.want {
+				t.Errorf("rewriteManifest =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyManifest(t *testing.T) {
+	resetSessions(t)
+	const doc = `{"start_url":"/app/","scope":"/app/","icons":[{"src":"/i.png"}]}`
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// Served with a generic type; the extension identifies it.
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, doc)
+	})
+	rec := proxyRequest(t, http.MethodGet, up.URL+"/site.webmanifest", nil)
+	app := `"` + EncodeProxyURL(up.URL+"/app/") + `"`
+	want := `{"start_url":` + app + `,"scope":` + app + `,"icons":[{"src":"` + EncodeProxyURL(up.URL+"/i.png") + `"}]}`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Session namespaces
+// ---------------------------------------------------------------------------
+//
+// Embedders that manage their own user identity (e.g. a multi-tenant app
+// in front of the proxy) can name a request header whose value
+// partitions the session store.  Each namespace gets its own cookie jar
+// and storage per origin; requests without the header share the default
+// namespace.
+
+// SessionNamespaceHeader is the request header that namespaces session
+// keys, e.g. "X-Tenant-ID".  Empty disables namespacing.
+var SessionNamespaceHeader string
+
+// maxNamespaceLen bounds namespace values so they stay cheap map keys.
+const maxNamespaceLen = 64
+
+// ClientSessions gives every browser its own session: the proxy issues a
+// random token in the ClientTokenCookie cookie and partitions the store
+// by it, on top of any SessionNamespaceHeader namespace.  Without it all
+// clients of a namespace share one cookie jar per origin.  With a shared
+// SessionBackend, a client keeps its session across proxy instances.
+var ClientSessions bool
+
+// ClientTokenCookie names the cookie carrying the client token.
+const ClientTokenCookie = "internex_client"
+
+// sessionKey returns the session store key for origin as seen by r:
+//
+//	[~<client token>|][<namespace>|]<origin>
+//
+// It reports false if r carries a namespace or client token that is not
+// a valid token: 1–64 ASCII letters, digits, '-', '_' or '.'.
+func sessionKey(r *http.Request, origin string) (string, bool) {
+	var client, ns string
+	if SessionNamespaceHeader != "" {
+		ns = r.Header.Get(SessionNamespaceHeader)
+	}
+	if ClientSessions {
+		if c, err := r.Cookie(ClientTokenCookie); err == nil {
+			if !validNamespace(c.Value) {
+				return "", false
+			}
+			client = c.Value
+		}
+	}
+	return makeSessionKey(client, ns, origin)
+}
+
+// makeSessionKey returns the session store key for origin in namespace ns
+// of the client with token client; either may be empty for none.  It
+// reports false if one is not a valid token.
+func makeSessionKey(client, ns, origin string) (string, bool) {
+	key := origin
+	if ns != "" {
+		if !validNamespace(ns) {
+			return "", false
+		}
+		key = ns + "|" + key
+	}
+	if client != "" {
+		if !validNamespace(client) {
+			return "", false
+		}
+		key = "~" + client + "|" + key
+	}
+	return key, true
+}
+
+// issueClientToken gives r a client token when ClientSessions is on and
+// it has none (or an invalid one), setting the cookie on w and adding it
+// to r so sessionKey sees it at once.
+func issueClientToken(w http.ResponseWriter, r *http.Request) {
+	if !ClientSessions {
+		return
+	}
+	if c, err := r.Cookie(ClientTokenCookie); err == nil && validNamespace(c.Value) {
+		return
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		getLogger().Error("generating client token failed", "err", err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	c := &http.Cookie{
+		Name:     ClientTokenCookie,
+		Value:    token,
+		Path:     BasePath + "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(ProxyOrigin, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if CookieDomainMapping {
+		// Shared by every mapped upstream host; see domainmap.go.
+		c.Domain, _ = proxyHostParts()
+	}
+	http.SetCookie(w, c)
+	// Replace any invalid value the request carried.
+	var kept []string
+	for _, rc := range r.Cookies() {
+		if rc.Name != ClientTokenCookie {
+			kept = append(kept, rc.String())
+		}
+	}
+	r.Header.Set("Cookie", strings.Join(append(kept, ClientTokenCookie+"="+token), "; "))
+}
+
+// validNamespace reports whether ns is a valid namespace or client token.
+// The empty string is not: an empty client token would put every browser
+// sending one in the same session.
+func validNamespace(ns string) bool {
+	if len(ns) == 0 || len(ns) > maxNamespaceLen {
+		return false
+	}
+	for i := 0; i < len(ns); i++ {
+		c := ns[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidNamespace(t *testing.T) {
+	tests := []struct {
+		ns   string
+		want bool
+	}{
+		{"tenant-1", true},
+		{"A.b_C", true},
+		{strings.Repeat("x", maxNamespaceLen), true},
+		{"", false},
+		{strings.Repeat("x", maxNamespaceLen+1), false},
+		{"a|b", false},
+		{"~a", false},
+		{"a b", false},
+	}
+	for _, tt := range tests {
+		if got := validNamespace(tt.ns); got != tt.want {
+			t.Errorf("validNamespace(%q) = %v, want %v", tt.ns, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyClientTokenIsReplaced(t *testing.T) {
+	ClientSessions = true
+	t.Cleanup(func() { ClientSessions = false })
+
+	const origin = "https://example.com"
+	keys := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+		r.Header.Set("Cookie", ClientTokenCookie+"=")
+		w := httptest.NewRecorder()
+		issueClientToken(w, r)
+		if w.Header().Get("Set-Cookie") == "" {
+			t.Fatal("no client token issued for an empty one")
+		}
+		key, ok := sessionKey(r, origin)
+		if !ok {
+			t.Fatal("sessionKey rejected the issued token")
+		}
+		if strings.HasPrefix(key, "~|") {
+			t.Fatalf("session key %q has an empty client token", key)
+		}
+		keys[key] = true
+	}
+	if len(keys) != 2 {
+		t.Error("clients with empty tokens share a session")
+	}
+}
+
+func TestNamespacedSessionsSharedAcrossInstances(t *testing.T) {
+	ClientSessions = true
+	SessionNamespaceHeader = "X-Tenant"
+	old := DefaultSessions
+	t.Cleanup(func() { ClientSessions, SessionNamespaceHeader, DefaultSessions = false, "", old })
+
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "alice", Path: "/"})
+		}
+		w.Write([]byte(r.Header.Get("Cookie")))
+	})
+	as := func(client, tenant, path string) string {
+		rec := proxyRequest(t, http.MethodGet, up.URL+path, http.Header{
+			"Cookie":   {ClientTokenCookie + "=" + client},
+			"X-Tenant": {tenant},
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s as %s/%s: status %d", path, client, tenant, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	// Two proxy instances over one backend, as with a shared Redis.
+	shared := newFakeBackend()
+	instanceA := NewSessionStoreWithBackend(shared)
+	instanceB := NewSessionStoreWithBackend(shared)
+
+	DefaultSessions = instanceA
+	as("c1", "t1", "/login")
+
+	DefaultSessions = instanceB
+	tests := []struct {
+		client, tenant string
+		want           string
+	}{
+		{"c1", "t1", "sid=alice"},
+		{"c1", "t2", ""},
+		{"c2", "t1", ""},
+	}
+	for _, tt := range tests {
+		if got := as(tt.client, tt.tenant, "/me"); got != tt.want {
+			t.Errorf("instance B, %s/%s: upstream Cookie = %q, want %q", tt.client, tt.tenant, got, tt.want)
+		}
+	}
+	if cs := shared.Cookies("~c1|t1|" + up.URL); len(cs) != 1 || cs[0].Value != "alice" {
+		t.Errorf("backend cookies under ~c1|t1|origin = %v", cs)
+	}
+}
+
+func TestTenantHeadersIsolateSessions(t *testing.T) {
+	resetSessions(t)
+	SessionNamespaceHeader = "X-Tenant-ID"
+	t.Cleanup(func() { SessionNamespaceHeader = "" })
+
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if user := r.URL.Query().Get("user"); user != "" {
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: user, Path: "/"})
+		}
+		w.Write([]byte(r.Header.Get("Cookie")))
+	})
+	as := func(tenant, path string) *httptest.ResponseRecorder {
+		h := http.Header{}
+		if tenant != "" {
+			h.Set("X-Tenant-ID", tenant)
+		}
+		return proxyRequest(t, http.MethodGet, up.URL+path, h)
+	}
+	as("acme", "/login?user=ann")
+	as("globex", "/login?user=bob")
+
+	tests := []struct {
+		tenant     string
+		wantStatus int
+		want       string
+	}{
+		{"acme", http.StatusOK, "sid=ann"},
+		{"globex", http.StatusOK, "sid=bob"},
+		{"", http.StatusOK, ""},
+		{"initech", http.StatusOK, ""},
+		{"bad|tenant", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := as(tt.tenant, "/me")
+		if rec.Code != tt.wantStatus {
+			t.Errorf("tenant %q: status %d, want %d", tt.tenant, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusOK && rec.Body.String() != tt.want {
+			t.Errorf("tenant %q: upstream Cookie = %q, want %q", tt.tenant, rec.Body, tt.want)
+		}
+	}
+}
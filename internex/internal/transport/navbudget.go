@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Per-navigation time budgets
+// ---------------------------------------------------------------------------
+//
+// A page navigation fans out into many subresource requests.  When
+// NavigationBudget is set, each navigation (a document request) opens a
+// budget keyed by client + page URL.  Subresource requests whose proxied
+// Referer names that page share the same deadline and fail fast once it
+// has passed, so one slow page cannot tie up the proxy indefinitely.
+
+// NavigationBudget is the total time allowed for a navigation and its
+// subresources.  Zero disables budgets.
+var NavigationBudget time.Duration
+
+// maxNavigations bounds the budget map; expired entries are swept past it.
+const maxNavigations = 10000
+
+var (
+	navMu       sync.Mutex
+	navDeadline = make(map[string]time.Time)
+)
+
+// isNavigation reports whether r loads a top-level or framed document.
+func isNavigation(r *http.Request) bool {
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return r.Header.Get("Referer") == ""
+}
+
+// navigationDeadline returns the deadline shared by r's navigation, if a
+// budget applies.  Document requests start a fresh budget; subresource
+// requests look up the budget of the page named in their Referer.
+func navigationDeadline(r *http.Request, targetURL string) (time.Time, bool) {
+	if NavigationBudget <= 0 {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	navMu.Lock()
+	defer navMu.Unlock()
+
+	if isNavigation(r) {
+		if len(navDeadline) >= maxNavigations {
+			for k, d := range navDeadline {
+				if now.After(d) {
+					delete(navDeadline, k)
+				}
+			}
+		}
+		d := now.Add(NavigationBudget)
+		navDeadline[navigationKey(r, targetURL)] = d
+		return d, true
+	}
+
+	page, ok := decodeProxiedReferer(r.Header.Get("Referer"))
+	if !ok {
+		return time.Time{}, false
+	}
+	d, ok := navDeadline[navigationKey(r, page)]
+	return d, ok
+}
+
+func navigationKey(r *http.Request, pageURL string) string {
+	return clientIP(r) + "|" + pageURL
+}
@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNavigationBudgetExhausted(t *testing.T) {
+	resetSessions(t)
+	old := NavigationBudget
+	NavigationBudget = 100 * time.Millisecond
+	t.Cleanup(func() {
+		NavigationBudget = old
+		navMu.Lock()
+		clear(navDeadline)
+		navMu.Unlock()
+	})
+
+	up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	page, other := up.URL+"/page", up.URL+"/other"
+	mux := NewMux()
+	get := func(target, mode, referer, peer string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, EncodeProxyPath(target), nil)
+		r.RemoteAddr = peer + ":40000"
+		r.Header.Set("Sec-Fetch-Mode", mode)
+		if referer != "" {
+			r.Header.Set("Referer", ProxyOrigin+EncodeProxyPath(referer))
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	const client, otherClient = "192.0.2.1", "192.0.2.2"
+
+	get(page, "navigate", "", client)
+	get(page, "navigate", "", otherClient)
+	if code := get(up.URL+"/a.js", "no-cors", page, client); code != http.StatusOK {
+		t.Fatalf("subresource within budget = %d, want 200", code)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	before := hits.Load()
+	if code := get(up.URL+"/b.js", "no-cors", page, client); code != http.StatusServiceUnavailable {
+		t.Errorf("subresource after budget = %d, want 503", code)
+	}
+	if hits.Load() != before {
+		t.Error("exhausted subresource still reached upstream")
+	}
+	if code := get(up.URL+"/c.js", "no-cors", other, client); code != http.StatusOK {
+		t.Errorf("subresource of a page without a budget = %d, want 200", code)
+	}
+
+	// A new navigation to the page starts a fresh budget, for its client
+	// only.
+	get(page, "navigate", "", client)
+	if code := get(up.URL+"/d.js", "no-cors", page, client); code != http.StatusOK {
+		t.Errorf("subresource after re-navigation = %d, want 200", code)
+	}
+	if code := get(up.URL+"/e.js", "no-cors", page, otherClient); code != http.StatusServiceUnavailable {
+		t.Errorf("other client's subresource = %d, want its own expired budget", code)
+	}
+
+	NavigationBudget = 0
+	if code := get(up.URL+"/f.js", "no-cors", page, otherClient); code != http.StatusOK {
+		t.Errorf("subresource with budgets off = %d, want 200", code)
+	}
+}
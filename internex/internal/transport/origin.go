@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// ---------------------------------------------------------------------------
+// Outbound Origin header
+// ---------------------------------------------------------------------------
+//
+// The browser's Origin always names the proxy, which upstreams checking
+// an allowlist will reject.  OriginPolicy decides what is sent instead;
+// it applies to WebSocket handshakes as well.
+
+// OriginMode selects how the Origin header is sent upstream.
+type OriginMode int
+
+const (
+	// OriginUpstream sends the origin of the proxied page that made the
+	// request, taken from its proxied Referer, falling back to the target's
+	// own origin.  It is added to every request the browser sent an
+	// Origin for, and to any non-GET/HEAD request, which some upstreams
+	// require for CSRF checks.
+	OriginUpstream OriginMode = iota
+	// OriginPreserveProxy forwards the browser's Origin (the proxy's own
+	// origin) unchanged, and sends none if the browser sent none.
+	OriginPreserveProxy
+	// OriginStrip never sends an Origin header.
+	OriginStrip
+)
+
+// OriginPolicy is the Origin handling applied to every upstream request.
+var OriginPolicy = OriginUpstream
+
+// setOutboundOrigin applies OriginPolicy to req, where headers are the
+// browser's request headers and target is the (http/https) upstream URL.
+func setOutboundOrigin(req *http.Request, headers http.Header, target *url.URL) {
+	switch OriginPolicy {
+	case OriginStrip:
+		req.Header.Del("Origin")
+	case OriginPreserveProxy:
+		if o := headers.Get("Origin"); o != "" {
+			req.Header.Set("Origin", o)
+		} else {
+			req.Header.Del("Origin")
+		}
+	default:
+		unsafe := req.Method != http.MethodGet && req.Method != http.MethodHead
+		// WebSocket servers commonly check Origin, so upgrades always
+		// carry one.
+		if headers.Get("Origin") == "" && !unsafe && !isWebSocketUpgrade(headers) {
+			return
+		}
+		origin := target.Scheme + "://" + target.Host
+		if page, ok := decodeProxiedReferer(headers.Get("Referer")); ok {
+			origin = upstreamOrigin(page)
+		}
+		req.Header.Set("Origin", origin)
+	}
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOutboundOrigin(t *testing.T) {
+	referer := ProxyOrigin + EncodeProxyPath("https://page.example/app/index.html")
+	tests := []struct {
+		name    string
+		policy  OriginMode
+		method  string
+		headers http.Header
+		want    string // "" means none; "TARGET" the upstream's own origin
+	}{
+		{"upstream: proxied page origin", OriginUpstream, http.MethodGet,
+			http.Header{"Origin": {ProxyOrigin}, "Referer": {referer}}, "https://page.example"},
+		{"upstream: target origin without a referer", OriginUpstream, http.MethodGet,
+			http.Header{"Origin": {ProxyOrigin}}, "TARGET"},
+		{"upstream: none for a plain GET", OriginUpstream, http.MethodGet,
+			http.Header{"Referer": {referer}}, ""},
+		{"upstream: added for a POST", OriginUpstream, http.MethodPost,
+			http.Header{"Referer": {referer}}, "https://page.example"},
+		{"preserve-proxy: browser Origin kept", OriginPreserveProxy, http.MethodPost,
+			http.Header{"Origin": {ProxyOrigin}, "Referer": {referer}}, ProxyOrigin},
+		{"preserve-proxy: none sent, none added", OriginPreserveProxy, http.MethodPost,
+			http.Header{"Referer": {referer}}, ""},
+		{"strip: browser Origin removed", OriginStrip, http.MethodPost,
+			http.Header{"Origin": {ProxyOrigin}, "Referer": {referer}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := OriginPolicy
+			OriginPolicy = tt.policy
+			t.Cleanup(func() { OriginPolicy = old })
+
+			var got []string
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Values("Origin")
+			})
+			resp, err := FetchUpstream(up.URL+"/api", tt.method, tt.headers, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			want := tt.want
+			if want == "TARGET" {
+				want = up.URL
+			}
+			switch {
+			case want == "" && len(got) != 0:
+				t.Errorf("upstream Origin = %q, want none", got)
+			case want != "" && (len(got) != 1 || got[0] != want):
+				t.Errorf("upstream Origin = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Per-origin outbound header overrides
+// ---------------------------------------------------------------------------
+//
+// Some upstreams reject the browser's User-Agent or need extra headers
+// (an API key, a specific Accept-Language).  Overrides are applied to the
+// upstream request right after the browser's safe headers are forwarded,
+// so they win over those.  Headers the proxy manages itself (Host, Origin,
+// Referer, Cookie, Accept-Encoding and the WebSocket handshake) are set
+// afterwards and cannot be overridden.
+
+var (
+	originHeadersMu sync.RWMutex
+	originHeaders   = make(map[string]http.Header)
+)
+
+// SetOriginHeaders sets the outbound headers injected for an upstream
+// origin such as "https://example.com"; "*" applies to every origin.
+// For a given name a per-origin entry replaces the "*" one, which
+// replaces the browser's value.  A nil or empty extra removes the entry.
+func SetOriginHeaders(origin string, extra http.Header) {
+	originHeadersMu.Lock()
+	defer originHeadersMu.Unlock()
+	if len(extra) == 0 {
+		delete(originHeaders, origin)
+		return
+	}
+	originHeaders[origin] = extra.Clone()
+}
+
+// managedHeaders are set by the proxy itself and never taken from an
+// override, even when the proxy sends none.
+var managedHeaders = map[string]bool{
+	"Host":                     true,
+	"Origin":                   true,
+	"Referer":                  true,
+	"Cookie":                   true,
+	"Accept-Encoding":          true,
+	"Connection":               true,
+	"Upgrade":                  true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+}
+
+// applyOriginHeaders writes the "*" and then the origin's overrides into
+// dst, skipping managedHeaders.
+func applyOriginHeaders(dst http.Header, origin string) {
+	originHeadersMu.RLock()
+	defer originHeadersMu.RUnlock()
+	for _, key := range []string{"*", origin} {
+		for k, vv := range originHeaders[key] {
+			if k = http.CanonicalHeaderKey(k); !managedHeaders[k] {
+				dst[k] = append([]string(nil), vv...)
+			}
+		}
+	}
+}
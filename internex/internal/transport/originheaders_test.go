@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOriginHeadersUserAgent(t *testing.T) {
+	const browserUA = "Mozilla/5.0 (browser)"
+	var got http.Header
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+	tests := []struct {
+		name      string
+		overrides map[string]http.Header
+		wantUA    string
+	}{
+		{"browser's by default", nil, browserUA},
+		{"every origin", map[string]http.Header{
+			"*": {"User-Agent": {"Internex/1.0"}},
+		}, "Internex/1.0"},
+		{"per origin wins over every origin", map[string]http.Header{
+			"*":    {"User-Agent": {"Internex/1.0"}},
+			up.URL: {"user-agent": {"LegacyBot/2"}},
+		}, "LegacyBot/2"},
+		{"other origins unaffected", map[string]http.Header{
+			"https://other.example": {"User-Agent": {"LegacyBot/2"}},
+		}, browserUA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			for origin, h := range tt.overrides {
+				SetOriginHeaders(origin, h)
+				t.Cleanup(func() { SetOriginHeaders(origin, nil) })
+			}
+			proxyRequest(t, http.MethodGet, up.URL+"/", http.Header{"User-Agent": {browserUA}})
+			if ua := got.Values("User-Agent"); len(ua) != 1 || ua[0] != tt.wantUA {
+				t.Errorf("upstream User-Agent = %q, want %q", ua, tt.wantUA)
+			}
+		})
+	}
+}
+
+func TestOriginHeadersCannotOverrideManaged(t *testing.T) {
+	resetSessions(t)
+	var got http.Header
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+	SetOriginHeaders("*", http.Header{
+		"X-Api-Key": {"k1"},
+		"Cookie":    {"forged=1"},
+		"origin":    {"https://evil.example"},
+		"Host":      {"evil.example"},
+	})
+	t.Cleanup(func() { SetOriginHeaders("*", nil) })
+
+	proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+	if got.Get("X-Api-Key") != "k1" {
+		t.Errorf("X-Api-Key = %q, want the override", got.Get("X-Api-Key"))
+	}
+	for _, k := range []string{"Cookie", "Origin"} {
+		if v := got.Get(k); v != "" {
+			t.Errorf("%s = %q from an override, want none", k, v)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"internex/internal/rewriter"
+)
+
+// ---------------------------------------------------------------------------
+// Embeddable proxy
+// ---------------------------------------------------------------------------
+//
+// Proxy runs the /proxy pipeline in-process: upstream fetch with session
+// cookies, response hooks, header rewriting, body limits and content
+// rewriting, without an HTTP server in front.  handleProxy is an adapter
+// over it that adds what only makes sense for a live browser request:
+// rate and navigation limits, the document cache, WebSocket bridging,
+// streaming, preflight and error pages.
+
+// Proxy fetches and rewrites upstream documents.  The zero value uses
+// DefaultSessions and ProxyOrigin.
+type Proxy struct {
+	// Sessions holds cookies between fetches; nil means DefaultSessions.
+	Sessions *SessionStore
+	// ProxyOrigin is the origin rewritten URLs point at; "" means the
+	// package-level ProxyOrigin.
+	ProxyOrigin string
+}
+
+// FetchOptions configures a single Proxy.Fetch.
+type FetchOptions struct {
+	// Method defaults to GET.  CONNECT, TRACE and malformed methods are
+	// rejected with ErrMethodNotAllowed.
+	Method string
+	// Header holds browser-style request headers; only the safe subset is
+	// forwarded, as for /proxy.
+	Header http.Header
+	// Body is the request body, if any.
+	Body io.Reader
+	// SessionKey selects the cookie jar; "" means the target's origin.
+	SessionKey string
+	// Params holds the per-request parameters /proxy reads from its
+	// query: keep, norewrite and rewrite_json.
+	Params url.Values
+
+	// forwarded describes the browser request handleProxy relays; nil
+	// names ProxyOrigin as the forwarding host.
+	forwarded *forwardedInfo
+}
+
+// ProxyResponse is the rewritten upstream response.  The caller must
+// close Body.
+type ProxyResponse struct {
+	// StatusCode is the upstream status.  For 101 Switching Protocols,
+	// Body is the upgraded upstream connection.
+	StatusCode int
+	// Header is the response header as /proxy would send it: Location and
+	// Set-Cookie rewritten, hop-by-hop and blocking headers removed.
+	Header http.Header
+	Body   io.ReadCloser
+	// Rewritten reports whether Body went through a rewriter; otherwise it
+	// is the upstream body, decoded where possible.
+	Rewritten bool
+
+	upstream  *http.Response
+	mediaType string
+	input     string // decoded document, when Rewritten
+	output    string // rewritten document, when Rewritten
+}
+
+// Errors returned by Proxy.Fetch besides those of the upstream exchange.
+var (
+	// ErrMethodNotAllowed rejects methods that are never relayed; see
+	// forwardableMethod.
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// ErrOriginBusy means no per-origin slot (SetOriginConcurrency) came
+	// free within OriginQueueTimeout.
+	ErrOriginBusy = errors.New("too many concurrent requests to upstream")
+	// ErrNoFinalResponse means the upstream ended the exchange with an
+	// interim 1xx status.
+	ErrNoFinalResponse = errors.New("upstream sent no final response")
+	// ErrUpstreamProxyAuth means an upstream proxy demanded credentials
+	// (407), which are never relayed to the browser.
+	ErrUpstreamProxyAuth = errors.New("upstream proxy authentication required")
+	// ErrBodyTooLarge is returned for rewritable bodies over MaxBodyBytes
+	// when OversizeBodyAction is OversizeReject.
+	ErrBodyTooLarge = errors.New("upstream response too large to rewrite")
+	// ErrLengthMismatch is returned for a rewritable body whose length
+	// differs from its Content-Length when ContentLengthCheck is
+	// LengthCheckReject.
+	ErrLengthMismatch = errors.New("upstream body length mismatch")
+
+	errDecodeBody = errors.New("decoding upstream body")
+	errReadBody   = errors.New("reading upstream body")
+)
+
+// Fetch retrieves targetURL (a plain upstream URL, not a /proxy URL) and
+// returns the response as /proxy would serve it.
+func (p *Proxy) Fetch(ctx context.Context, targetURL string, opts FetchOptions) (*ProxyResponse, error) {
+	target, ok := DecodeProxyURL(url.QueryEscape(targetURL))
+	if !ok {
+		return nil, fmt.Errorf("invalid target URL %q", targetURL)
+	}
+	method := opts.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !forwardableMethod(method) {
+		return nil, ErrMethodNotAllowed
+	}
+	sessions := p.Sessions
+	if sessions == nil {
+		sessions = DefaultSessions
+	}
+	reqHeader := opts.Header
+	if reqHeader == nil {
+		reqHeader = http.Header{}
+	}
+	key := opts.SessionKey
+	if key == "" {
+		key = upstreamOrigin(target)
+	}
+	fwd := forwardedForClient("")
+	if opts.forwarded != nil {
+		fwd = *opts.forwarded
+	}
+
+	// Cap simultaneous requests to fragile origins.
+	release, ok := acquireOriginSlot(ctx, upstreamOrigin(target))
+	if !ok {
+		return nil, ErrOriginBusy
+	}
+	cookieHeader := sessions.CookieHeader(key)
+	resp, err := fetchInternal(ctx, target, method, reqHeader, opts.Body, cookieHeader, fwd)
+	if err == nil && method == http.MethodHead && HeadFallbackToGET && headRejected(resp.StatusCode) {
+		// Retry as GET; only its status and headers are relayed.
+		resp.Body.Close()
+		resp, err = fetchInternal(ctx, target, http.MethodGet, reqHeader, nil, cookieHeader, fwd)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// WebSocket bridges are long-lived; don't hold a request slot.
+		release()
+	} else {
+		resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	}
+
+	// Hooks may replace resp.Body; only the current one is used below.
+	runResponseHooks(resp, target)
+	sessions.SetCookiesFromResponse(key, resp)
+
+	out := &ProxyResponse{StatusCode: resp.StatusCode, Header: make(http.Header), upstream: resp}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		out.Body = resp.Body
+		return out, nil
+	}
+	fail := func(err error) (*ProxyResponse, error) {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	// The client reads past interim responses, so a final 1xx comes from
+	// a non-conforming upstream or RoundTripper.  Relaying it would send
+	// an informational response followed by an implicit empty 200.
+	if isInterimStatus(resp.StatusCode) {
+		getLogger().Warn("upstream sent interim status as final response", "url", target, "status", resp.StatusCode)
+		return fail(ErrNoFinalResponse)
+	}
+
+	info, err := classifyResponse(resp, target, method, opts.Params, reqHeader)
+	if err != nil {
+		getLogger().Error("proxy decode error", "url", target, "err", err)
+		return fail(fmt.Errorf("%w: %w", errDecodeBody, err))
+	}
+	out.mediaType = info.mediaType
+	CopyResponseHeadersWithContext(out.Header, resp.Header, target, keptHeaders(opts.Params)...)
+	if info.sniffedType != "" {
+		out.Header.Set("Content-Type", info.sniffedType)
+	}
+	frameResponse(out.Header, resp, method, info.category)
+	if !applyAuthChallenge(out.Header, resp) {
+		getLogger().Warn("upstream proxy requires authentication", "url", target)
+		return fail(ErrUpstreamProxyAuth)
+	}
+
+	// HEAD, 204 and 304 responses carry no body to rewrite, and other
+	// types stream straight through.  Any other status, uncommon ones
+	// such as 418 or 451 included, is relayed as is, and error pages are
+	// rewritten like any other document.
+	if method == http.MethodHead || !statusAllowsBody(resp.StatusCode) || info.category == ContentOther {
+		out.Body = withTrailerCookies(resp.Body, resp, sessions, key)
+		return out, nil
+	}
+
+	// Read body for rewriting, buffering at most MaxBodyBytes.
+	var src io.Reader = resp.Body
+	if MaxBodyBytes > 0 {
+		src = io.LimitReader(resp.Body, MaxBodyBytes+1)
+	}
+	body, err := io.ReadAll(src)
+	if err != nil {
+		getLogger().Error("proxy body read error", "url", target, "err", err)
+		return fail(fmt.Errorf("%w: %w", errReadBody, err))
+	}
+	if MaxBodyBytes > 0 && int64(len(body)) > MaxBodyBytes {
+		getLogger().Warn("upstream body exceeds rewrite limit", "url", target, "limit", MaxBodyBytes)
+		if OversizeBodyAction == OversizeReject {
+			return fail(ErrBodyTooLarge)
+		}
+		// Stream the rest through unrewritten.
+		out.Body = withTrailerCookies(io.MultiReader(bytes.NewReader(body), resp.Body), resp, sessions, key)
+		return out, nil
+	}
+
+	// Compare against the declared length (unknown once decoded).
+	if ContentLengthCheck != LengthCheckOff && resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+		getLogger().Warn("upstream body length mismatch", "url", target,
+			"declared", resp.ContentLength, "actual", len(body))
+		if ContentLengthCheck == LengthCheckReject {
+			return fail(ErrLengthMismatch)
+		}
+	}
+	withTrailerCookies(resp.Body, resp, sessions, key).Close()
+
+	// Bodyless redirects and empty documents have nothing to rewrite.
+	// Any 3xx that does carry an HTML fallback ("click here if you are
+	// not redirected") falls through and is rewritten like a 200 page so
+	// the link routes through the proxy.
+	if len(body) == 0 {
+		out.Body = http.NoBody
+		return out, nil
+	}
+
+	rwOpts := proxyRewriteOptions(target)
+	if p.ProxyOrigin != "" {
+		rwOpts.ProxyOrigin = p.ProxyOrigin
+	}
+	out.input, out.output = rewriteDocument(rewriter.WithOptions(ctx, rwOpts), info.category, body, out.Header, target)
+	out.Body = io.NopCloser(strings.NewReader(out.output))
+	out.Rewritten = true
+	return out, nil
+}
+
+// trailerCookieBody stores the upstream's trailer cookies when closed,
+// by which time the body has been read and its trailers are known.
+type trailerCookieBody struct {
+	io.Reader
+	closer io.Closer
+	store  func()
+	once   sync.Once
+}
+
+func (b *trailerCookieBody) Close() error {
+	b.once.Do(b.store)
+	return b.closer.Close()
+}
+
+// withTrailerCookies returns r, read from resp.Body, as a body that
+// closes resp.Body and, with StoreTrailerCookies, stores resp's trailer
+// cookies under key.
+func withTrailerCookies(r io.Reader, resp *http.Response, sessions *SessionStore, key string) io.ReadCloser {
+	if !StoreTrailerCookies {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, resp.Body}
+	}
+	return &trailerCookieBody{
+		Reader: r,
+		closer: resp.Body,
+		store:  func() { sessions.SetCookiesFromTrailer(key, resp) },
+	}
+}
@@ -0,0 +1,280 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxyFetch(t *testing.T) {
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "abc", Path: "/"})
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("welcome"))
+		case "/data.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"next":"https://example.com/page/2"}`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(r.Method + " cookie=" + r.Header.Get("Cookie")))
+		}
+	})
+
+	p := &Proxy{Sessions: NewSessionStore()}
+	read := func(t *testing.T, resp *ProxyResponse) string {
+		t.Helper()
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("cookies persist between fetches", func(t *testing.T) {
+		resp, err := p.Fetch(context.Background(), up.URL+"/login", FetchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read(t, resp)
+		if got := resp.Header.Get("Set-Cookie"); !strings.HasPrefix(got, "sid=abc") {
+			t.Errorf("Set-Cookie = %q", got)
+		}
+		resp, err = p.Fetch(context.Background(), up.URL+"/echo", FetchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := read(t, resp); got != "GET cookie=sid=abc" {
+			t.Errorf("body = %q, want the stored cookie sent", got)
+		}
+	})
+
+	t.Run("params enable JSON rewriting", func(t *testing.T) {
+		resp, err := p.Fetch(context.Background(), up.URL+"/data.json", FetchOptions{
+			Params: url.Values{"rewrite_json": {"1"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := read(t, resp)
+		if !resp.Rewritten || !strings.Contains(body, "/proxy?url=") {
+			t.Errorf("Rewritten = %v, body = %q", resp.Rewritten, body)
+		}
+	})
+
+	t.Run("streamed types are not rewritten", func(t *testing.T) {
+		resp, err := p.Fetch(context.Background(), up.URL+"/echo", FetchOptions{Method: "PURGE"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := read(t, resp); resp.Rewritten || !strings.HasPrefix(got, "PURGE ") {
+			t.Errorf("Rewritten = %v, body = %q", resp.Rewritten, got)
+		}
+	})
+
+	for _, method := range []string{http.MethodConnect, http.MethodTrace, "TRACK", "get", "BAD METHOD"} {
+		t.Run("rejects "+method, func(t *testing.T) {
+			_, err := p.Fetch(context.Background(), up.URL+"/echo", FetchOptions{Method: method})
+			if !errors.Is(err, ErrMethodNotAllowed) {
+				t.Errorf("err = %v, want ErrMethodNotAllowed", err)
+			}
+		})
+	}
+
+	t.Run("rejects non-http targets", func(t *testing.T) {
+		if _, err := p.Fetch(context.Background(), "file:///etc/passwd", FetchOptions{}); err == nil {
+			t.Error("file: target accepted")
+		}
+	})
+}
+
+func TestProxyMethodChecks(t *testing.T) {
+	resetSessions(t)
+	up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	})
+	old := AllowMethodOverride
+	AllowMethodOverride = true
+	t.Cleanup(func() { AllowMethodOverride = old })
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		want   int
+	}{
+		{"get", http.MethodGet, "", http.StatusOK},
+		{"custom method", "PROPFIND", "", http.StatusOK},
+		{"trace", http.MethodTrace, "", http.StatusMethodNotAllowed},
+		{"trace override", http.MethodGet, "&method=TRACE", http.StatusMethodNotAllowed},
+		{"connect override", http.MethodGet, "&method=CONNECT", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits.Store(0)
+			rec := serve(t, tt.method, EncodeProxyPath(up.URL+"/")+tt.query, nil)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rejected := tt.want == http.StatusMethodNotAllowed; rejected && hits.Load() != 0 {
+				t.Error("rejected method reached the upstream")
+			}
+		})
+	}
+}
+
+func TestHeadFallbackToGET(t *testing.T) {
+	tests := []struct {
+		name        string
+		fallback    bool
+		rejection   int
+		wantStatus  int
+		wantMethods string
+	}{
+		{"405 retried as GET", true, http.StatusMethodNotAllowed, http.StatusOK, "HEAD,GET"},
+		{"501 retried as GET", true, http.StatusNotImplemented, http.StatusOK, "HEAD,GET"},
+		{"fallback off", false, http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, "HEAD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := HeadFallbackToGET
+			HeadFallbackToGET = tt.fallback
+			t.Cleanup(func() { HeadFallbackToGET = old })
+
+			var methods []string
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				methods = append(methods, r.Method)
+				if r.Method == http.MethodHead {
+					w.WriteHeader(tt.rejection)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("ETag", `"v1"`)
+				w.Write([]byte(`<a href="https://example.com/">home</a>`))
+			})
+			rec := proxyRequest(t, http.MethodHead, up.URL+"/page", nil)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := strings.Join(methods, ","); got != tt.wantMethods {
+				t.Errorf("upstream saw %s, want %s", got, tt.wantMethods)
+			}
+			if rec.Body.Len() != 0 {
+				t.Errorf("HEAD response has a %d-byte body", rec.Body.Len())
+			}
+			if tt.wantStatus == http.StatusOK && rec.Header().Get("ETag") != `"v1"` {
+				t.Errorf("GET headers not relayed: %v", rec.Header())
+			}
+		})
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	type seen struct{ method, body string }
+	tests := []struct {
+		name       string
+		allow      bool
+		method     string
+		query      string
+		header     http.Header
+		body       string
+		wantStatus int
+		want       seen
+	}{
+		{"override", true, http.MethodGet, "&method=DELETE", nil, "", http.StatusOK, seen{"DELETE", ""}},
+		{"override with a body", true, http.MethodPost, "&method=PUT", nil, "a=1", http.StatusOK, seen{"PUT", "a=1"}},
+		{"disabled", false, http.MethodGet, "&method=DELETE", nil, "", http.StatusOK, seen{"GET", ""}},
+		{"lowercase rejected", true, http.MethodGet, "&method=delete", nil, "", http.StatusMethodNotAllowed, seen{}},
+		{"header not honoured", true, http.MethodPost, "", http.Header{"X-Http-Method-Override": {"DELETE"}}, "", http.StatusOK, seen{"POST", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := AllowMethodOverride
+			AllowMethodOverride = tt.allow
+			t.Cleanup(func() { AllowMethodOverride = old })
+
+			var got seen
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = seen{r.Method, string(b)}
+			})
+			req := httptest.NewRequest(tt.method, EncodeProxyPath(up.URL+"/item")+tt.query, strings.NewReader(tt.body))
+			for k, vs := range tt.header {
+				req.Header[k] = vs
+			}
+			rec := httptest.NewRecorder()
+			NewMux().ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got != tt.want {
+				t.Errorf("upstream saw %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedirectBodyRewritten(t *testing.T) {
+	const dest = "https://dest.example/landing"
+	const fallback = `<html><body>If you are not redirected, <a href="` + dest + `">click here</a>.</body></html>`
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/no-location":
+			// The client only follows a 3xx with a Location, so this one
+			// reaches the browser with its body.
+			w.WriteHeader(http.StatusFound)
+		case "/choices":
+			w.Header().Set("Location", dest)
+			w.WriteHeader(http.StatusMultipleChoices)
+		case "/followed":
+			http.Redirect(w, r, "/landing", http.StatusFound)
+			return
+		case "/landing":
+			io.WriteString(w, "landed")
+			return
+		}
+		io.WriteString(w, fallback)
+	})
+	tests := []struct {
+		path     string
+		status   int
+		location string
+		body     string // "" means the fallback, rewritten
+	}{
+		{"/no-location", http.StatusFound, "", ""},
+		{"/choices", http.StatusMultipleChoices, EncodeProxyPath(dest), ""},
+		{"/followed", http.StatusOK, "", "landed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resetSessions(t)
+			rec := proxyRequest(t, http.MethodGet, up.URL+tt.path, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if loc := rec.Header().Get("Location"); loc != tt.location {
+				t.Errorf("Location = %q, want %q", loc, tt.location)
+			}
+			body := rec.Body.String()
+			if tt.body != "" {
+				if body != tt.body {
+					t.Errorf("body = %q, want %q", body, tt.body)
+				}
+				return
+			}
+			if !strings.Contains(body, "/proxy?url=") || strings.Contains(body, `href="`+dest+`"`) {
+				t.Errorf("fallback link not routed through the proxy: %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ---------------------------------------------------------------------------
+// Per-origin rate limiting
+// ---------------------------------------------------------------------------
+//
+// Each upstream origin gets a rate.Limiter refilled at RPS tokens per
+// second up to Burst.  A request that finds it empty is answered with 429
+// before anything is sent upstream.
+
+// RateLimitPerClient keys limiters by session (see sessionKey) instead of
+// by origin alone, so with ClientSessions one noisy browser cannot exhaust
+// the budget of everyone else using the same origin.
+var RateLimitPerClient bool
+
+// rateLimit is a limiter configuration.  A zero rps disables limiting.
+type rateLimit struct {
+	rps   float64
+	burst int
+}
+
+// maxRateLimiters bounds the limiter map; full ones are swept past it.
+const maxRateLimiters = 10000
+
+var (
+	rateMu      sync.Mutex
+	defaultRate rateLimit
+	originRates = make(map[string]rateLimit)
+	limiters    = make(map[string]*rate.Limiter)
+	// rateNow is the limiters' clock; replaced in tests.
+	rateNow = time.Now
+)
+
+// SetRateLimit configures the limiter for an upstream origin such as
+// "https://example.com".  An empty origin or "*" sets the global default
+// used for origins without their own entry.  rps <= 0 disables limiting
+// for that origin; burst is raised to at least 1.
+func SetRateLimit(origin string, rps float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	lim := rateLimit{rps: rps, burst: burst}
+	if rps <= 0 {
+		lim = rateLimit{}
+	}
+
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	if origin == "" || origin == "*" {
+		defaultRate = lim
+	} else {
+		originRates[origin] = lim
+	}
+	// Start every limiter afresh under the new configuration.
+	limiters = make(map[string]*rate.Limiter)
+}
+
+// allowRequest reports whether a request for origin from the session
+// sessKey may proceed.  When it may not, the returned duration is the
+// suggested Retry-After delay.
+func allowRequest(origin, sessKey string) (bool, time.Duration) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+
+	lim, ok := originRates[origin]
+	if !ok {
+		lim = defaultRate
+	}
+	if lim.rps <= 0 {
+		return true, 0
+	}
+
+	// Session keys already end in the origin.
+	key := origin
+	if RateLimitPerClient {
+		key = sessKey
+	}
+
+	now := rateNow()
+	l, ok := limiters[key]
+	if !ok {
+		if len(limiters) >= maxRateLimiters {
+			sweepLimiters(now)
+		}
+		l = rate.NewLimiter(rate.Limit(lim.rps), lim.burst)
+		limiters[key] = l
+	}
+	res := l.ReserveN(now, 1)
+	if wait := res.DelayFrom(now); wait > 0 {
+		res.CancelAt(now)
+		return false, wait
+	}
+	return true, 0
+}
+
+// sweepLimiters drops limiters that have refilled completely, since a
+// fresh limiter would behave identically.
+func sweepLimiters(now time.Time) {
+	for k, l := range limiters {
+		if l.TokensAt(now) >= float64(l.Burst()) {
+			delete(limiters, k)
+		}
+	}
+}
+
+// retryAfterSeconds formats a wait as a whole-second Retry-After value.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
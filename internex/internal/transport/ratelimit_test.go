@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withRateLimit limits every origin to rps and burst on a clock the test
+// advances by hand.
+func withRateLimit(t *testing.T, rps float64, burst int) *time.Time {
+	t.Helper()
+	now := time.Unix(1_700_000_000, 0)
+	rateNow = func() time.Time { return now }
+	SetRateLimit("*", rps, burst)
+	t.Cleanup(func() {
+		rateNow = time.Now
+		SetRateLimit("*", 0, 0)
+		RateLimitPerClient = false
+	})
+	return &now
+}
+
+func TestAllowRequest(t *testing.T) {
+	const origin = "https://example.com"
+	type step struct {
+		advance time.Duration
+		key     string
+		want    bool
+	}
+	tests := []struct {
+		name      string
+		perClient bool
+		steps     []step
+	}{
+		{
+			name: "burst then refusal",
+			steps: []step{
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, false},
+			},
+		},
+		{
+			name: "refill one token per interval",
+			steps: []step{
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{400 * time.Millisecond, "a|" + origin, false},
+				{100 * time.Millisecond, "a|" + origin, true},
+				{0, "a|" + origin, false},
+				{time.Second, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, false},
+			},
+		},
+		{
+			name: "sessions share the origin budget",
+			steps: []step{
+				{0, "a|" + origin, true},
+				{0, "b|" + origin, true},
+				{0, "c|" + origin, true},
+				{0, "d|" + origin, false},
+			},
+		},
+		{
+			name:      "per-client budgets",
+			perClient: true,
+			steps: []step{
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, true},
+				{0, "a|" + origin, false},
+				{0, "b|" + origin, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := withRateLimit(t, 2, 3)
+			RateLimitPerClient = tt.perClient
+			for i, s := range tt.steps {
+				*now = now.Add(s.advance)
+				ok, wait := allowRequest(origin, s.key)
+				if ok != s.want {
+					t.Fatalf("step %d: allowed = %v, want %v", i, ok, s.want)
+				}
+				if !ok && (wait <= 0 || wait > 500*time.Millisecond) {
+					t.Errorf("step %d: wait = %v, want (0, 500ms]", i, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyRateLimited(t *testing.T) {
+	resetSessions(t)
+	withRateLimit(t, 1, 2)
+	up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("upstream hits = %d, want 2", hits.Load())
+	}
+}
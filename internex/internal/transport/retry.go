@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Upstream retries
+// ---------------------------------------------------------------------------
+//
+// Transient upstream failures (connection errors, 502, 503) are retried
+// for idempotent requests without a body, with exponential backoff and
+// full jitter.  Waiting stops as soon as the request context is done.
+
+// RetryPolicy configures upstream retries.
+type RetryPolicy struct {
+	// Attempts is the total number of tries, including the first.
+	// Values below 1 mean a single try.
+	Attempts int
+	// BaseDelay is the backoff ceiling before the second try; it doubles
+	// for each further try up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var (
+	retryMu     sync.RWMutex
+	retryPolicy = RetryPolicy{Attempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+)
+
+// SetRetryPolicy replaces the upstream retry policy.  Use
+// RetryPolicy{Attempts: 1} to disable retries.
+func SetRetryPolicy(p RetryPolicy) {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retryPolicy = p
+}
+
+func currentRetryPolicy() RetryPolicy {
+	retryMu.RLock()
+	defer retryMu.RUnlock()
+	return retryPolicy
+}
+
+// retryableRequest reports whether req may safely be sent again: GET or
+// HEAD with no body to replay.
+func retryableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// retryableStatus reports whether an upstream status is worth retrying.
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// backoff returns the jittered delay before try number attempt (2, 3, …).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << (attempt - 2)
+	if ceiling <= 0 || (p.MaxDelay > 0 && ceiling > p.MaxDelay) {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// doWithRetry sends req through httpClient, retrying per the current
+// policy.  The last response or error is returned.
+func doWithRetry(req *http.Request) (*http.Response, error) {
+	p := currentRetryPolicy()
+	if p.Attempts < 1 || !retryableRequest(req) {
+		p.Attempts = 1
+	}
+
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := httpClient.Do(req.Clone(ctx))
+		if attempt >= p.Attempts || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if errors.Is(err, ErrForbiddenUpstream) {
+			return nil, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		delay := p.backoff(attempt + 1)
+		getLogger().Debug("retrying upstream request", "url", req.URL.String(),
+			"attempt", attempt+1, "delay", delay, "err", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRetries(t *testing.T) {
+	unavailable := func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		failures   int32
+		fail       func(http.ResponseWriter)
+		wantStatus int
+		wantHits   int32
+	}{
+		{"503 twice then success", http.MethodGet, "", 2, unavailable, http.StatusOK, 3},
+		{"connection reset twice then success", http.MethodGet, "", 2, func(w http.ResponseWriter) {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				conn.Close()
+			}
+		}, http.StatusOK, 3},
+		{"gives up after the last attempt", http.MethodGet, "", 5, unavailable, http.StatusServiceUnavailable, 3},
+		{"404 is not retried", http.MethodGet, "", 2, func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+		}, http.StatusNotFound, 1},
+		{"POST is never retried", http.MethodPost, "a=1", 2, unavailable, http.StatusServiceUnavailable, 1},
+		{"DELETE is never retried", http.MethodDelete, "", 2, unavailable, http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := currentRetryPolicy()
+			SetRetryPolicy(RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond})
+			t.Cleanup(func() { SetRetryPolicy(old) })
+
+			var calls atomic.Int32
+			up, hits := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				if calls.Add(1) <= tt.failures {
+					tt.fail(w)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("ok"))
+			})
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, EncodeProxyPath(up.URL+"/"), body)
+			rec := httptest.NewRecorder()
+			NewMux().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
@@ -1,12 +1,24 @@
 package transport
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"internex/internal/rewriter"
 )
@@ -14,134 +26,603 @@ import (
 // AssetsDir is the path to the assets directory.  Set by cmd/server/main.go.
 var AssetsDir string
 
-// NewMux returns an http.ServeMux wired with all proxy / rewrite routes.
+// NewMux returns an http.ServeMux wired with all proxy / rewrite routes,
+// mounted under BasePath.
 func NewMux() *http.ServeMux {
+	applyHTTP2Setting()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /proxy", handleProxy)
+	if BasePath == "" {
+		registerRoutes(mux)
+		return mux
+	}
+	// Handlers see paths relative to the mount point; the encoders add
+	// BasePath back.
+	inner := http.NewServeMux()
+	registerRoutes(inner)
+	mux.Handle(BasePath+"/", http.StripPrefix(BasePath, inner))
+	mux.Handle(BasePath, http.RedirectHandler(BasePath+"/", http.StatusMovedPermanently))
+	return mux
+}
+
+// registerRoutes wires every route onto mux at the root.
+func registerRoutes(mux *http.ServeMux) {
+	// Any method is relayed; Proxy.Fetch rejects the unsafe ones.
+	proxy := withMiddleware(http.HandlerFunc(handleProxy))
+	mux.Handle("/proxy", proxy)
+	mux.Handle("/p/{target}", proxy)
+	mux.Handle("GET /f/{form}", proxy)
 	mux.HandleFunc("POST /rewrite/html", handleRewriteHTML)
 	mux.HandleFunc("POST /rewrite/css", handleRewriteCSS)
 	mux.HandleFunc("POST /rewrite/js", handleRewriteJS)
+	mux.HandleFunc("POST /rewrite/batch", handleRewriteBatch)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	if RuntimeShimPath != "" {
+		mux.HandleFunc("GET "+RuntimeShimPath, handleRuntimeShim)
+	}
+	registerSessionAdmin(mux)
+	registerStorage(mux)
 	mux.HandleFunc("/", handleStatic)
-	return mux
 }
 
 // ---------- /proxy?url=<encoded> ----------
 
-func handleProxy(w http.ResponseWriter, r *http.Request) {
-	raw := r.URL.Query().Get("url")
-	if raw == "" {
-		http.Error(w, "missing 'url' query parameter", http.StatusBadRequest)
+// InjectBaseTag makes rewritten HTML pages carry a <base href> pointing
+// through the proxy.  See rewriter.Options.InjectBase.
+var InjectBaseTag bool
+
+// RewriteModuleURLs enables rewriting of literal dynamic imports and
+// import.meta.url in proxied scripts.  See rewriter.Options.ModuleURLs.
+var RewriteModuleURLs bool
+
+// RewriteMetaCSP keeps policy <meta> tags in proxied pages, rewritten to
+// admit the proxy, instead of removing them like the CSP header.  See
+// rewriter.Options.RewriteMetaCSP.
+var RewriteMetaCSP bool
+
+// RewriteLocation routes location assignments and document.domain in
+// proxied scripts through the client runtime.  See
+// rewriter.Options.RewriteLocation.
+var RewriteLocation bool
+
+// DisableServiceWorkers stubs out service worker registration in proxied
+// pages.  A worker registered on the proxy origin would control every
+// proxied site under its scope.  See rewriter.Options.DisableServiceWorkers.
+var DisableServiceWorkers bool
+
+// RuntimeShimPath is the path the client runtime is served from and
+// injected as into every proxied page, ahead of the page's own scripts.
+// It must start with "/" and is relative to BasePath; the file is
+// internex.runtime.js in AssetsDir.
+// Empty disables injection.  Set before NewMux is called.
+var RuntimeShimPath = "/internex.runtime.js"
+
+// runtimeShimFile is the runtime's file name in AssetsDir.
+const runtimeShimFile = "internex.runtime.js"
+
+// handleRuntimeShim serves the client runtime at RuntimeShimPath.
+func handleRuntimeShim(w http.ResponseWriter, r *http.Request) {
+	data, err := os.ReadFile(filepath.Join(AssetsDir, runtimeShimFile))
+	if err != nil {
+		getLogger().Error("client runtime missing", "dir", AssetsDir, "err", err)
+		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Write(data)
+}
+
+// proxyRewriteOptions returns the rewriter options for a document fetched
+// from targetURL.
+func proxyRewriteOptions(targetURL string) rewriter.Options {
+	opts := rewriter.DefaultOptions(mappedOrigin(targetURL), targetURL)
+	opts.InjectBase = InjectBaseTag
+	opts.ModuleURLs = RewriteModuleURLs
+	opts.RewriteMetaCSP = RewriteMetaCSP
+	opts.RewriteLocation = RewriteLocation
+	opts.RuntimePath = BasePath + RuntimeShimPath
+	opts.OmitRuntime = RuntimeShimPath == ""
+	opts.DisableServiceWorkers = DisableServiceWorkers
+	return opts
+}
+
+// AllowMethodOverride lets clients that can only issue GET choose the
+// upstream method with a method=<METHOD> query parameter.  The incoming
+// body, if any, is forwarded.
+var AllowMethodOverride bool
+
+// forwardableMethod reports whether method may be relayed upstream.  Any
+// uppercase token is, so PURGE, PROPFIND and other CDN or WebDAV methods
+// pass through verbatim, except CONNECT (a tunnel, not a request for the
+// target) and TRACE/TRACK, which would echo the proxy's headers, cookies
+// included, back to the page.
+func forwardableMethod(method string) bool {
+	switch method {
+	case "", http.MethodConnect, http.MethodTrace, "TRACK":
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		c := method[i]
+		if c >= 'a' && c <= 'z' || c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// HeadFallbackToGET retries HEAD requests that the upstream rejects with
+// 405 or 501 as a GET, relaying the GET's status and headers.
+var HeadFallbackToGET bool
+
+// headRejected reports whether status means the upstream does not
+// implement HEAD.
+func headRejected(status int) bool {
+	return status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented
+}
+
+// StoreTrailerCookies makes the proxy also store Set-Cookie values that
+// the upstream sends as HTTP trailers.
+var StoreTrailerCookies = true
+
+// proxyTarget extracts the upstream URL of a proxy request, from the
+// /p/{target} or /f/{form} path or the url query parameter.  On failure
+// it returns a description of the problem and the raw value, if any.
+func proxyTarget(r *http.Request) (target, raw, problem string) {
+	if raw = r.PathValue("form"); raw != "" {
+		target, ok := formTarget(raw, r.URL.RawQuery)
+		if !ok {
+			return "", raw, "invalid target URL"
+		}
+		return target, raw, ""
+	}
+	if raw = r.PathValue("target"); raw != "" {
+		target, ok := DecodeProxyURLB64(raw)
+		if !ok {
+			return "", raw, "invalid target URL"
+		}
+		return target, raw, ""
+	}
+	raw = r.URL.Query().Get("url")
+	if raw == "" {
+		return "", "", "missing 'url' query parameter"
+	}
+	target, ok := DecodeProxyURL(raw)
+	if !ok {
+		return "", raw, "invalid target URL"
+	}
+	return target, raw, ""
+}
+
+// formTarget decodes the <base64url> segment of a /f/ URL, which a GET
+// form submits to, and gives it the submitted query.  The rewriter
+// points GET forms there because a GET submission replaces the query of
+// its action, which for /proxy would drop the url parameter.
+func formTarget(encoded, query string) (string, bool) {
+	target, ok := DecodeProxyURLB64(encoded)
+	if !ok {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	u.RawQuery = query
+	return u.String(), true
+}
+
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+
+	var targetURL string
+	defer func() { logProxyRequest(r, targetURL, rec, start) }()
 
 	// Decode & validate target URL.
-	targetURL, ok := DecodeProxyURL(raw)
+	decoded, raw, problem := proxyTarget(r)
+	if problem != "" {
+		proxyError(w, r, http.StatusBadRequest, problem, raw)
+		return
+	}
+	targetURL = decoded
+
+	origin := upstreamOrigin(targetURL)
+	if redirectToMappedHost(w, r, targetURL) {
+		return
+	}
+	if r.PathValue("form") != "" {
+		// The query is the submitted form, now part of targetURL; it
+		// must not be read as proxy parameters.
+		r.URL.RawQuery = ""
+	}
+
+	method := r.Method
+	if AllowMethodOverride {
+		// Proxy.Fetch rejects methods that are never relayed.
+		if m := r.URL.Query().Get("method"); m != "" {
+			method = m
+		}
+	}
+
+	issueClientToken(w, r)
+	sessKey, ok := sessionKey(r, origin)
 	if !ok {
-		http.Error(w, "invalid target URL", http.StatusBadRequest)
+		proxyError(w, r, http.StatusBadRequest, "invalid session namespace", targetURL)
+		return
+	}
+
+	// Protect upstreams from pages that hammer them.
+	if allowed, wait := allowRequest(origin, sessKey); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		proxyError(w, r, http.StatusTooManyRequests, "rate limit exceeded", targetURL)
 		return
 	}
 
-	origin := ExtractOrigin(targetURL)
+	// Fail fast once the page's navigation budget is spent.
+	if deadline, ok := navigationDeadline(r, targetURL); ok && time.Now().After(deadline) {
+		proxyError(w, r, http.StatusServiceUnavailable, "navigation time budget exhausted", targetURL)
+		return
+	}
 
 	// Attach per-origin cookies from our session store.
-	cookieHeader := DefaultSessions.CookieHeader(origin)
+	if values := r.URL.Query()["set_cookie"]; DebugMode && len(values) > 0 {
+		injectDebugCookies(sessKey, values)
+	}
+	cookieHeader := DefaultSessions.CookieHeader(sessKey)
+
+	// Serve reloads of rewritten documents from the cache.
+	var cacheKeyStr string
+	if docCache.enabled() && cacheableRequest(r, method) {
+		cacheKeyStr = cacheKey(sessKey, targetURL, cookieHeader)
+		if e, ok := docCache.get(cacheKeyStr); ok {
+			serveCached(w, r, e)
+			return
+		}
+	}
+
+	// Cap long-lived WebSocket bridges.  hijackWebSocket returns only once
+	// the bridge closes, so the slot is held for its lifetime.
+	if isWebSocketUpgrade(r.Header) {
+		releaseWS, ok := acquireWebSocketSlot(webSocketKey(r, origin))
+		if !ok {
+			proxyError(w, r, http.StatusServiceUnavailable, "too many open websockets", targetURL)
+			return
+		}
+		defer releaseWS()
+	}
+
+	// In debug mode, capture a bounded copy of the body as it streams upstream.
+	var reqBody io.Reader = r.Body
+	if DebugMode && r.Body != nil && r.Body != http.NoBody {
+		reqBody = teeRequestBody(r.Body, targetURL)
+	}
 
-	resp, err := FetchUpstreamWithCookies(targetURL, r.Method, r.Header, r.Body, cookieHeader)
+	fwd := forwardedFromRequest(r)
+	resp, err := (&Proxy{}).Fetch(r.Context(), targetURL, FetchOptions{
+		Method:     method,
+		Header:     r.Header,
+		Body:       reqBody,
+		SessionKey: sessKey,
+		Params:     r.URL.Query(),
+		forwarded:  &fwd,
+	})
 	if err != nil {
-		log.Printf("proxy fetch error: %v", err)
-		http.Error(w, "upstream fetch failed", http.StatusBadGateway)
+		proxyFetchError(w, r, err, targetURL)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Store any Set-Cookie headers in our per-origin jar.
-	DefaultSessions.SetCookiesFromResponse(origin, resp)
-
 	// WebSocket upgrade — hijack and bridge.
 	if resp.StatusCode == http.StatusSwitchingProtocols {
-		hijackWebSocket(w, resp)
+		rec.status = resp.StatusCode
+		hijackWebSocket(w, r, resp.upstream)
 		return
 	}
 
-	// Copy upstream response headers with rewriting.
-	CopyResponseHeadersWithContext(w.Header(), resp.Header, targetURL)
-
-	// Detect content type and decide whether to rewrite.
-	contentType := DetectContentType(resp.Header)
-	category := Categorize(contentType)
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h[k] = append(h[k], vs...)
+	}
+	if ModificationLog {
+		rec.mods = &modifications{}
+		rec.mods.countHeaders(resp.upstream.Header, keptHeaders(r.URL.Query()))
+	}
+	if isPreflight(r) {
+		synthesizePreflightHeaders(h, r.Header)
+	}
 
-	if r.Method == http.MethodHead {
+	if !resp.Rewritten {
 		w.WriteHeader(resp.StatusCode)
+		if r.Method != http.MethodHead && statusAllowsBody(resp.StatusCode) {
+			streamBody(w, resp.Body, targetURL, resp.mediaType)
+		}
 		return
 	}
 
-	if category == ContentOther {
-		// Not a rewritable type — stream straight through.
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-		return
+	if rec.mods != nil {
+		rec.mods.countBody(resp.input, resp.output, mappedOrigin(targetURL), ProxyOrigin)
+	}
+	if cacheKeyStr != "" && cacheableResponse(resp.upstream) {
+		header := h.Clone()
+		header.Del("Content-Length")
+		docCache.put(cacheKeyStr, resp.StatusCode, header, resp.output)
 	}
 
-	// Read body for rewriting.
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("proxy body read error: %v", err)
-		http.Error(w, "reading upstream body failed", http.StatusBadGateway)
-		return
+	// The rewritten size differs; writeRewritten sets Content-Length.
+	writeRewritten(w, r, resp.StatusCode, resp.output)
+}
+
+// fetchErrors maps Proxy.Fetch errors to the status and message
+// handleProxy answers with.  Anything else is a 502.
+var fetchErrors = []struct {
+	err    error
+	status int
+	msg    string
+}{
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, "method not allowed"},
+	{ErrForbiddenUpstream, http.StatusForbidden, "upstream address not allowed"},
+	{ErrOriginBusy, http.StatusServiceUnavailable, "too many concurrent requests to upstream"},
+	{ErrUpstreamBusy, http.StatusServiceUnavailable, "too many concurrent upstream requests"},
+	{ErrHeadersTooLarge, http.StatusRequestHeaderFieldsTooLarge, "request headers too large"},
+	{ErrNoFinalResponse, http.StatusBadGateway, "upstream sent no final response"},
+	{ErrUpstreamProxyAuth, http.StatusBadGateway, "upstream proxy authentication required"},
+	{ErrBodyTooLarge, http.StatusBadGateway, "upstream response too large to rewrite"},
+	{ErrLengthMismatch, http.StatusBadGateway, "upstream body length mismatch"},
+	{errDecodeBody, http.StatusBadGateway, "decoding upstream body failed"},
+	{errReadBody, http.StatusBadGateway, "reading upstream body failed"},
+}
+
+// proxyFetchError answers a request whose Proxy.Fetch failed with err.
+func proxyFetchError(w http.ResponseWriter, r *http.Request, err error, targetURL string) {
+	for _, e := range fetchErrors {
+		if errors.Is(err, e.err) {
+			proxyError(w, r, e.status, e.msg, targetURL)
+			return
+		}
 	}
+	getLogger().Error("proxy fetch error", "url", targetURL, "err", err)
+	proxyError(w, r, http.StatusBadGateway, "upstream fetch failed", targetURL)
+}
 
-	content := string(body)
-	var result string
+// responseInfo is how a proxied response is to be handled.
+type responseInfo struct {
+	mediaType   string
+	sniffedType string // full Content-Type to send, if sniffed
+	category    ContentCategory
+}
+
+// classifyResponse decides how to treat an upstream response and decodes
+// its body where needed.  Documents are categorized for rewriting unless
+// they are partial, attachments or NeverBufferTypes; a body that must be
+// rewritten, or whose coding reqHeader does not accept, is decoded.  A
+// body in a coding we cannot decode is relayed as ContentOther.
+func classifyResponse(resp *http.Response, targetURL, method string, query url.Values, reqHeader http.Header) (responseInfo, error) {
+	var info responseInfo
+
+	// Sniff bodies whose type is missing or generic.  The body must be
+	// decoded first; decoding again below is then a no-op.
+	if SniffContentType && method != http.MethodHead && shouldSniff(resp.Header) &&
+		!isPartialResponse(resp) && !isAttachment(resp.Header) {
+		decoded, err := decodeResponseBody(resp)
+		if err != nil {
+			return info, err
+		}
+		if decoded {
+			info.sniffedType = sniffContentType(resp, targetURL)
+		}
+	}
 
-	switch category {
-	case ContentHTML:
-		result = rewriter.RewriteHTML(ProxyOrigin, targetURL, content)
-	case ContentCSS:
-		result = rewriter.RewriteCSS(ProxyOrigin, targetURL, content)
-	case ContentJS:
-		result = rewriter.RewriteJS(ProxyOrigin, targetURL, content)
+	info.mediaType = DetectContentType(resp.Header)
+	if info.sniffedType != "" {
+		info.mediaType, _, _ = mime.ParseMediaType(info.sniffedType)
+	}
+	info.category = Categorize(info.mediaType)
+	if PassThrough {
+		info.category = ContentOther
+	}
+	if info.category == ContentOther && isWebManifest(info.mediaType, targetURL) {
+		info.category = ContentManifest
+	}
+	if info.category == ContentOther && wantsJSONRewrite(query, info.mediaType) {
+		info.category = ContentJSON
+	}
+	if info.category != ContentOther && !rewriteEnabled(info.category, query) {
+		info.category = ContentOther
+	}
+
+	// A byte range of a document cannot be rewritten (or decoded) on its
+	// own; relay it verbatim with its 206 status and Content-Range.
+	forceDownload(resp.Header, info.mediaType, targetURL)
+	partial := isPartialResponse(resp)
+	if partial || neverBuffer(info.mediaType) || isAttachment(resp.Header) {
+		info.category = ContentOther
+	}
+
+	// Decode compressed bodies that we need to rewrite or that the client
+	// did not advertise support for.  Unknown codings are streamed as-is.
+	coding := resp.Header.Get("Content-Encoding")
+	if method != http.MethodHead && !partial && (info.category != ContentOther || !clientAcceptsEncoding(reqHeader, coding)) {
+		decoded, err := decodeResponseBody(resp)
+		if err != nil {
+			return info, err
+		}
+		if !decoded {
+			info.category = ContentOther
+		}
+	}
+	return info, nil
+}
+
+// rewriteDocument converts body to UTF-8 and rewrites it per category,
+// with the rewriter options carried by ctx.  h is the outgoing header
+// set, whose charset is updated when the document was transcoded.  It
+// returns the decoded input and the result, which is the input unchanged
+// if rewriting failed.
+func rewriteDocument(ctx context.Context, category ContentCategory, body []byte, h http.Header, targetURL string) (content, result string) {
+	content = string(body)
+	if category != ContentJSON && category != ContentManifest {
+		label := documentCharset(h.Get("Content-Type"), category, body)
+		text, ok, err := decodeDocument(label, body)
+		switch {
+		case err != nil || !ok:
+			getLogger().Warn("unsupported document charset", "url", targetURL, "charset", label, "err", err)
+			return content, content
+		case label != "":
+			content = text
+			setUTF8Charset(h)
+		}
+	}
+
+	var err error
+	switch {
+	case skipRewrite(category, content):
+		result = content
+	case category == ContentHTML:
+		result, err = rewriteString(ctx, rewriter.HTML, content)
+	case category == ContentCSS:
+		result, err = rewriteString(ctx, rewriter.CSS, content)
+	case category == ContentJS:
+		result, err = rewriteString(ctx, rewriter.JS, content)
+	case category == ContentXML:
+		result, err = rewriteString(ctx, rewriter.XML, content)
+	case category == ContentJSON:
+		result = rewriteJSONURLs(content)
+	case category == ContentManifest:
+		result = rewriteManifest(content, targetURL)
 	default:
 		result = content
 	}
+	if err != nil {
+		getLogger().Warn("rewrite failed", "url", targetURL, "err", err)
+		result = content
+	}
+	return content, result
+}
 
-	// Remove Content-Length since the rewritten size may differ.
-	w.Header().Del("Content-Length")
-	w.WriteHeader(resp.StatusCode)
-	io.WriteString(w, result)
+// rewriteString runs content through rewriter.RewriteContext.
+func rewriteString(ctx context.Context, kind rewriter.ContentKind, content string) (string, error) {
+	out, err := rewriter.RewriteContext(ctx, kind, strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.Grow(len(content))
+	_, err = io.Copy(&sb, out)
+	return sb.String(), err
+}
+
+// isAttachment reports whether the response is a download
+// (Content-Disposition: attachment), which must reach the client
+// byte-for-byte whatever its Content-Type.
+func isAttachment(h http.Header) bool {
+	v := h.Get("Content-Disposition")
+	if v == "" {
+		return false
+	}
+	disposition, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		// Malformed parameters still start with the disposition type.
+		disposition, _, _ = strings.Cut(v, ";")
+	}
+	return strings.EqualFold(strings.TrimSpace(disposition), "attachment")
+}
+
+// isPartialResponse reports whether resp answers a byte-range request,
+// either as a 206 or as a 416 for an unsatisfiable range.  An upstream
+// that ignores Range and sends the full 200 body is rewritten as usual.
+func isPartialResponse(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return true
+	}
+	return resp.Header.Get("Content-Range") != ""
+}
+
+// statusAllowsBody reports whether a response with the given status may
+// include a body (RFC 9110 §6.4.1).
+func statusAllowsBody(code int) bool {
+	switch {
+	case code >= 100 && code < 200:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// isInterimStatus reports whether code is a 1xx informational status
+// other than 101, which never ends an exchange.
+func isInterimStatus(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// StrictWebSocketAccept refuses to bridge a WebSocket whose upstream
+// Sec-WebSocket-Accept does not match the client's key.  When false a
+// mismatch is only logged.
+var StrictWebSocketAccept bool
+
+// websocketGUID is the fixed GUID from RFC 6455 §1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
 }
 
 // hijackWebSocket takes over the client connection and bridges it
 // bidirectionally with the upstream WebSocket connection.
-func hijackWebSocket(w http.ResponseWriter, upResp *http.Response) {
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "webSocket hijack not supported", http.StatusInternalServerError)
-		return
+func hijackWebSocket(w http.ResponseWriter, r *http.Request, upResp *http.Response) {
+	// The client key is forwarded verbatim, so the upstream's accept hash
+	// must match it.  A mismatch means the handshake was mangled in
+	// transit and the browser will reject the relayed 101.
+	if key := r.Header.Get("Sec-WebSocket-Key"); key != "" {
+		if got, want := upResp.Header.Get("Sec-WebSocket-Accept"), websocketAccept(key); got != want {
+			getLogger().Error("websocket accept mismatch", "got", got, "want", want)
+			if StrictWebSocketAccept {
+				http.Error(w, "upstream websocket handshake invalid", http.StatusBadGateway)
+				return
+			}
+		}
 	}
 
-	clientConn, clientBuf, err := hj.Hijack()
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
 	if err != nil {
-		log.Printf("websocket hijack: %v", err)
+		getLogger().Error("websocket hijack failed", "err", err)
+		http.Error(w, "webSocket hijack not supported", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
+	defer trackBridge(clientConn)()
+	// The server's timeouts stay armed on a hijacked connection.
+	clientConn.SetDeadline(time.Time{})
+
+	// Relay the 101 with its headers (Sec-WebSocket-Accept/-Protocol/
+	// -Extensions) untouched.
+	if err := writeSwitchingProtocols(clientConn, upResp); err != nil {
+		getLogger().Error("websocket handshake relay failed", "err", err)
+		return
+	}
 
-	// Write the raw 101 response back to the client.
-	_ = upResp.Write(clientConn)
-
-	// upResp.Body is the raw upstream connection.
+	// upResp.Body is the raw upstream connection (see dialWebSocket).
 	upConn, ok := upResp.Body.(io.ReadWriteCloser)
 	if !ok {
-		log.Print("upstream body is not ReadWriteCloser")
+		getLogger().Error("websocket upstream body is not a ReadWriteCloser")
 		return
 	}
 	defer upConn.Close()
 
-	// Bidirectional copy.
+	// Bidirectional copy.  A copier that panics still signals done, so
+	// both connections are closed and the handler returns.
 	done := make(chan struct{}, 2)
 	copy := func(dst io.Writer, src io.Reader) {
+		defer func() {
+			if p := recover(); p != nil {
+				getLogger().Error("websocket bridge panic", "panic", p)
+			}
+			done <- struct{}{}
+		}()
 		io.Copy(dst, src)
-		done <- struct{}{}
 	}
 
 	// Flush anything the buffered reader already consumed.
@@ -154,6 +635,67 @@ func hijackWebSocket(w http.ResponseWriter, upResp *http.Response) {
 	go copy(upConn, clientConn)
 	go copy(clientConn, upConn)
 	<-done
+	// Either side ending ends the bridge: closing both unblocks the other
+	// copier, which is waited for so no goroutine outlives the handler.
+	upConn.Close()
+	clientConn.Close()
+	<-done
+	getLogger().Debug("websocket bridge closed")
+}
+
+// writeSwitchingProtocols writes upResp's status line, keeping the
+// upstream reason phrase, and headers.  Response.Write is not used: it
+// probes the body for content, which here is the live upstream
+// connection, and would consume the first frame.
+func writeSwitchingProtocols(w io.Writer, upResp *http.Response) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", upResp.StatusCode, reasonPhrase(upResp))
+	if err := upResp.Header.Write(bw); err != nil {
+		return err
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// reasonPhrase returns the reason phrase resp was sent with, or the
+// standard one if it had none.
+func reasonPhrase(resp *http.Response) string {
+	reason, ok := strings.CutPrefix(resp.Status, strconv.Itoa(resp.StatusCode))
+	if reason = strings.TrimSpace(reason); !ok || reason == "" {
+		return http.StatusText(resp.StatusCode)
+	}
+	return reason
+}
+
+// activeBridges tracks hijacked WebSocket client connections.  Hijacked
+// connections are invisible to http.Server.Shutdown, so they are closed
+// explicitly via CloseWebSockets.
+var (
+	bridgesMu     sync.Mutex
+	activeBridges = make(map[net.Conn]struct{})
+)
+
+// trackBridge registers conn as an active bridge and returns a func that
+// unregisters it.
+func trackBridge(conn net.Conn) func() {
+	bridgesMu.Lock()
+	activeBridges[conn] = struct{}{}
+	bridgesMu.Unlock()
+	return func() {
+		bridgesMu.Lock()
+		delete(activeBridges, conn)
+		bridgesMu.Unlock()
+	}
+}
+
+// CloseWebSockets closes every active WebSocket bridge.  Intended to be
+// registered with http.Server.RegisterOnShutdown.
+func CloseWebSockets() {
+	bridgesMu.Lock()
+	defer bridgesMu.Unlock()
+	for conn := range activeBridges {
+		conn.Close()
+	}
 }
 
 // ---------- POST /rewrite/* ----------
@@ -170,15 +712,23 @@ func handleRewriteJS(w http.ResponseWriter, r *http.Request) {
 	rewriteBodyDirect(w, r, "js")
 }
 
+// rewriteBodyDirect rewrites the request body.  The optional base query
+// parameter is the document's original URL; it must be an absolute
+// http(s) URL.  Without it nothing is inferred: relative references are
+// left as they are and only absolute URLs are routed through the proxy.
 func rewriteBodyDirect(w http.ResponseWriter, r *http.Request, kind string) {
 	defer r.Body.Close()
 
 	proxyOrigin := ProxyOrigin
-	baseURL := r.URL.Query().Get("base") // optional base URL hint
+	baseURL := r.URL.Query().Get("base")
+	if err := checkRewriteBase(baseURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("rewrite body read error: %v", err)
+		getLogger().Error("rewrite body read error", "err", err)
 		http.Error(w, "reading body failed", http.StatusBadRequest)
 		return
 	}
@@ -204,6 +754,76 @@ func rewriteBodyDirect(w http.ResponseWriter, r *http.Request, kind string) {
 	io.WriteString(w, result)
 }
 
+// checkRewriteBase validates a base URL given to the /rewrite endpoints.
+// An empty base is allowed.
+func checkRewriteBase(base string) error {
+	if base == "" {
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil || strings.ContainsAny(base, "\x00\r\n\t") {
+		return fmt.Errorf("invalid base URL %q", base)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("base must be an absolute http or https URL, got %q", base)
+	}
+	return nil
+}
+
+// ---------- POST /rewrite/batch ----------
+
+// batchItem is one document in a POST /rewrite/batch request.
+type batchItem struct {
+	Kind    string `json:"kind"`
+	Base    string `json:"base"`
+	Content string `json:"content"`
+}
+
+// batchResult is the rewritten counterpart of a batchItem.  Exactly one
+// of Content or Error is set.
+type batchResult struct {
+	Content string `json:"content,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleRewriteBatch rewrites a JSON array of documents in one call,
+// preserving order.  A bad item yields an error entry without failing
+// the rest of the batch.
+func handleRewriteBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var src io.Reader = r.Body
+	if MaxBodyBytes > 0 {
+		src = io.LimitReader(r.Body, MaxBodyBytes)
+	}
+	var items []batchItem
+	if err := json.NewDecoder(src).Decode(&items); err != nil {
+		http.Error(w, "invalid batch: expected a JSON array of {kind, base, content}", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	for i, it := range items {
+		if err := checkRewriteBase(it.Base); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		switch it.Kind {
+		case "html":
+			results[i].Content = rewriter.RewriteHTML(ProxyOrigin, it.Base, it.Content)
+		case "css":
+			results[i].Content = rewriter.RewriteCSS(ProxyOrigin, it.Base, it.Content)
+		case "js":
+			results[i].Content = rewriter.RewriteJS(ProxyOrigin, it.Base, it.Content)
+		default:
+			results[i].Error = fmt.Sprintf("unknown kind %q", it.Kind)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(results)
+}
+
 // ---------- Static file serving ----------
 
 var mimeTypes = map[string]string{
@@ -0,0 +1,310 @@
+package transport
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Test upstreams listen on loopback; tests of the address policy turn
+	// it back on with withAddressPolicy.
+	AllowPrivateUpstreams = true
+	os.Exit(m.Run())
+}
+
+// serve sends a request for path through a fresh mux and returns the
+// recorded response.
+func serve(t *testing.T, method, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	NewMux().ServeHTTP(rec, req)
+	return rec
+}
+
+// proxyRequest sends a request for target through /proxy.
+func proxyRequest(t *testing.T, method, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, method, EncodeProxyPath(target), header)
+}
+
+// countingUpstream starts a test upstream serving h and counting the
+// requests it receives.
+func countingUpstream(t *testing.T, h http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// resetSessions empties the default session store when the test ends.
+func resetSessions(t *testing.T) {
+	t.Helper()
+	DefaultSessions.ClearAll()
+	t.Cleanup(DefaultSessions.ClearAll)
+}
+
+func TestBasePathRoundTrip(t *testing.T) {
+	oldBase, oldOrigin := BasePath, ProxyOrigin
+	BasePath, ProxyOrigin = "/internex", "http://localhost:8080/internex"
+	t.Cleanup(func() { BasePath, ProxyOrigin = oldBase, oldOrigin })
+	resetSessions(t)
+
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		case "/items":
+			w.Header().Set("Location", "/items/1")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			io.WriteString(w, r.URL.RequestURI())
+		}
+	})
+	b64 := func(u string) string { return base64.RawURLEncoding.EncodeToString([]byte(u)) }
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		body     string
+		location string
+	}{
+		{"proxy", "/internex/proxy?url=" + up.URL + "/page%3Fa%3D1", http.StatusOK, "/page?a=1", ""},
+		{"path form", "/internex/p/" + b64(up.URL+"/page"), http.StatusOK, "/page", ""},
+		{"form", "/internex/f/" + b64(up.URL+"/search?old=1") + "?q=go", http.StatusOK, "/search?q=go", ""},
+		{"followed redirect", EncodeProxyPath(up.URL + "/old"), http.StatusOK, "/new", ""},
+		{"Location rewritten", EncodeProxyPath(up.URL + "/items"), http.StatusCreated, "", EncodeProxyPath(up.URL + "/items/1")},
+		{"mount point redirect", "/internex", http.StatusMovedPermanently, "", "/internex/"},
+		{"routes only under the base", EncodeProxyPath(up.URL + "/page")[len("/internex"):], http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, http.MethodGet, tt.path, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("GET %s = %d, want %d: %s", tt.path, rec.Code, tt.status, rec.Body)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("upstream saw %q, want %q", rec.Body, tt.body)
+			}
+			if loc := rec.Header().Get("Location"); loc != tt.location {
+				t.Errorf("Location = %q, want %q", loc, tt.location)
+			}
+			if !strings.HasPrefix(tt.location, "/internex/proxy") {
+				return
+			}
+			// The rewritten Location leads back through the mount.
+			if rec := serve(t, http.MethodGet, tt.location, nil); rec.Code != http.StatusOK || rec.Body.String() != "/items/1" {
+				t.Errorf("following %s = %d %q", tt.location, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestProxyStatusPreserved(t *testing.T) {
+	resetSessions(t)
+	const link = "https://example.com/home"
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		rewritten   bool
+	}{
+		{"404 HTML page rewritten", http.StatusNotFound, "text/html; charset=utf-8", true},
+		{"451 passed through", http.StatusUnavailableForLegalReasons, "text/plain; charset=utf-8", false},
+		{"418 passed through", http.StatusTeapot, "text/plain; charset=utf-8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `<html><body><a href="` + link + `">home</a></body></html>`
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, body)
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/missing", nil)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			got := rec.Body.String()
+			if tt.rewritten {
+				if strings.Contains(got, `href="`+link) || !strings.Contains(got, "/proxy?url=") {
+					t.Errorf("error page not rewritten: %s", got)
+				}
+			} else if got != body {
+				t.Errorf("body = %q, want it untouched", got)
+			}
+		})
+	}
+}
+
+func TestPartialContentPassThrough(t *testing.T) {
+	const doc = `<html><body><a href="https://example.com/next">next</a></body></html>`
+	tests := []struct {
+		name       string
+		rangeHdr   string
+		ignore     bool // upstream ignores Range and sends the whole page
+		wantStatus int
+		wantBody   string
+	}{
+		{"206 relayed verbatim", "bytes=0-19", false, http.StatusPartialContent, doc[:20]},
+		{"range over a link", "bytes=15-50", false, http.StatusPartialContent, doc[15:51]},
+		{"unsatisfiable range", "bytes=9999-", false, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"ignored range rewritten", "bytes=0-19", true, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				if tt.ignore {
+					io.WriteString(w, doc)
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(doc))
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/page", http.Header{"Range": {tt.rangeHdr}})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.ignore {
+				if !strings.Contains(rec.Body.String(), "/proxy?url=") {
+					t.Errorf("full page not rewritten: %q", rec.Body)
+				}
+				return
+			}
+			if tt.wantStatus == http.StatusPartialContent {
+				if got := rec.Body.String(); got != tt.wantBody {
+					t.Errorf("body = %q, want %q", got, tt.wantBody)
+				}
+				if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(tt.wantBody)) {
+					t.Errorf("Content-Length = %q, want %d", cl, len(tt.wantBody))
+				}
+			}
+			if rec.Header().Get("Content-Range") == "" {
+				t.Error("Content-Range not relayed")
+			}
+		})
+	}
+}
+
+func TestCheckRewriteBase(t *testing.T) {
+	tests := []struct {
+		base string
+		ok   bool
+	}{
+		{"", true},
+		{"https://example.com/a/page.html", true},
+		{"http://example.com", true},
+		{"ftp://example.com/file", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"/relative/path", false},
+		{"page.html", false},
+		{"//example.com/page", false},
+		{"https:///no-host", false},
+		{"https://example.com/a\nb", false},
+	}
+	for _, tt := range tests {
+		if err := checkRewriteBase(tt.base); (err == nil) != tt.ok {
+			t.Errorf("checkRewriteBase(%q) = %v, want ok %v", tt.base, err, tt.ok)
+		}
+	}
+
+	for _, base := range []string{"ftp://example.com/", "/relative"} {
+		req := httptest.NewRequest(http.MethodPost, "/rewrite/html?base="+url.QueryEscape(base), strings.NewReader("<p>x</p>"))
+		rec := httptest.NewRecorder()
+		NewMux().ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("POST /rewrite/html with base %q = %d, want 400", base, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	NewMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rewrite/html", strings.NewReader("<p>x</p>")))
+	if rec.Code != http.StatusOK {
+		t.Errorf("POST /rewrite/html without a base = %d, want 200", rec.Code)
+	}
+}
+
+func TestRewriteBatch(t *testing.T) {
+	post := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		NewMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rewrite/batch", strings.NewReader(body)))
+		return rec
+	}
+
+	t.Run("mixed kinds", func(t *testing.T) {
+		rec := post(`[
+			{"kind":"html","base":"https://example.com/","content":"<a href=\"https://example.com/a\">a</a>"},
+			{"kind":"css","content":"a{background:url(\"https://example.com/b.png\")}"},
+			{"kind":"xml","content":"<x/>"},
+			{"kind":"js","base":"ftp://example.com/","content":"x"},
+			{"kind":"js","content":"fetch(\"https://example.com/c\")"}
+		]`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var results []batchResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 5 {
+			t.Fatalf("%d results, want 5", len(results))
+		}
+		for _, i := range []int{0, 1, 4} {
+			if results[i].Error != "" || !strings.Contains(results[i].Content, "/proxy?url=") {
+				t.Errorf("result %d = %+v, want rewritten content", i, results[i])
+			}
+		}
+		if !strings.Contains(results[2].Error, "unknown kind") || results[2].Content != "" {
+			t.Errorf("result 2 = %+v, want an unknown kind error", results[2])
+		}
+		if !strings.Contains(results[3].Error, "base") || results[3].Content != "" {
+			t.Errorf("result 3 = %+v, want a base error", results[3])
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if rec := post(`[]`); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+			t.Errorf("empty batch = %d %q", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		if rec := post(`{"kind":"html"}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", rec.Code)
+		}
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		old := MaxBodyBytes
+		MaxBodyBytes = 1024
+		t.Cleanup(func() { MaxBodyBytes = old })
+		big := `[{"kind":"js","content":"` + strings.Repeat("x", 2048) + `"}]`
+		if rec := post(big); rec.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400 for a batch over MaxBodyBytes", rec.Code)
+		}
+		if rec := post(`[{"kind":"js","content":"x"}]`); rec.Code != http.StatusOK {
+			t.Errorf("small batch under the limit = %d, want 200", rec.Code)
+		}
+	})
+}
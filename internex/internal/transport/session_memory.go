@@ -0,0 +1,242 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// In-memory session backend (default)
+// ---------------------------------------------------------------------------
+
+// OriginSession holds cookies and key-value storage for a single origin.
+type OriginSession struct {
+	mu             sync.RWMutex
+	Cookies        []*http.Cookie
+	LocalStorage   map[string]string
+	SessionStorage map[string]string
+}
+
+// area returns the map backing a storage area.  Callers hold sess.mu.
+func (sess *OriginSession) area(a StorageArea) map[string]string {
+	if a == AreaSession {
+		return sess.SessionStorage
+	}
+	return sess.LocalStorage
+}
+
+// memoryBackend keeps every session in process memory.
+type memoryBackend struct {
+	mu      sync.RWMutex
+	origins map[string]*OriginSession
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{origins: make(map[string]*OriginSession)}
+}
+
+// get returns the OriginSession for key, or nil.
+func (m *memoryBackend) get(key string) *OriginSession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.origins[key]
+}
+
+// getOrCreate returns the OriginSession for the given key, creating one
+// if necessary.
+func (m *memoryBackend) getOrCreate(key string) *OriginSession {
+	if sess := m.get(key); sess != nil {
+		return sess
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Double-check after acquiring write lock.
+	if sess, ok := m.origins[key]; ok {
+		return sess
+	}
+	sess := &OriginSession{
+		LocalStorage:   make(map[string]string),
+		SessionStorage: make(map[string]string),
+	}
+	m.origins[key] = sess
+	return sess
+}
+
+func (m *memoryBackend) Cookies(key string) []*http.Cookie {
+	sess := m.get(key)
+	if sess == nil {
+		return nil
+	}
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	out := make([]*http.Cookie, len(sess.Cookies))
+	copy(out, sess.Cookies)
+	return out
+}
+
+func (m *memoryBackend) PutCookies(key string, cookies []*http.Cookie) {
+	sess := m.getOrCreate(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for _, c := range cookies {
+		replaced := false
+		for i, existing := range sess.Cookies {
+			if existing.Name == c.Name && strings.EqualFold(existing.Path, c.Path) {
+				sess.Cookies[i] = c
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			sess.Cookies = append(sess.Cookies, c)
+		}
+	}
+}
+
+func (m *memoryBackend) DeleteCookie(key, name string) {
+	sess := m.get(key)
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for i, c := range sess.Cookies {
+		if c.Name == name {
+			sess.Cookies = append(sess.Cookies[:i], sess.Cookies[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *memoryBackend) GetItem(key string, area StorageArea, name string) (string, bool) {
+	sess := m.get(key)
+	if sess == nil {
+		return "", false
+	}
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	v, ok := sess.area(area)[name]
+	return v, ok
+}
+
+func (m *memoryBackend) SetItem(key string, area StorageArea, name, value string) {
+	sess := m.getOrCreate(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.area(area)[name] = value
+}
+
+func (m *memoryBackend) DeleteItem(key string, area StorageArea, name string) {
+	sess := m.get(key)
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	delete(sess.area(area), name)
+}
+
+func (m *memoryBackend) Items(key string, area StorageArea) map[string]string {
+	out := make(map[string]string)
+	sess := m.get(key)
+	if sess == nil {
+		return out
+	}
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	for k, v := range sess.area(area) {
+		out[k] = v
+	}
+	return out
+}
+
+func (m *memoryBackend) ClearArea(key string, area StorageArea) {
+	sess := m.get(key)
+	if sess == nil {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if area == AreaSession {
+		sess.SessionStorage = make(map[string]string)
+	} else {
+		sess.LocalStorage = make(map[string]string)
+	}
+}
+
+func (m *memoryBackend) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.origins))
+	for k := range m.origins {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// snapshot copies every session under its own lock.
+func (m *memoryBackend) snapshot() map[string]OriginSessionData {
+	m.mu.RLock()
+	sessions := make(map[string]*OriginSession, len(m.origins))
+	for k, sess := range m.origins {
+		sessions[k] = sess
+	}
+	m.mu.RUnlock()
+
+	out := make(map[string]OriginSessionData, len(sessions))
+	for k, sess := range sessions {
+		sess.mu.RLock()
+		data := OriginSessionData{
+			Cookies:        copyCookies(sess.Cookies),
+			LocalStorage:   make(map[string]string, len(sess.LocalStorage)),
+			SessionStorage: make(map[string]string, len(sess.SessionStorage)),
+		}
+		for name, v := range sess.LocalStorage {
+			data.LocalStorage[name] = v
+		}
+		for name, v := range sess.SessionStorage {
+			data.SessionStorage[name] = v
+		}
+		sess.mu.RUnlock()
+		out[k] = data
+	}
+	return out
+}
+
+// stats counts every session under its own lock.
+func (m *memoryBackend) stats() []OriginStat {
+	m.mu.RLock()
+	sessions := make(map[string]*OriginSession, len(m.origins))
+	for k, sess := range m.origins {
+		sessions[k] = sess
+	}
+	m.mu.RUnlock()
+
+	out := make([]OriginStat, 0, len(sessions))
+	for k, sess := range sessions {
+		sess.mu.RLock()
+		out = append(out, OriginStat{
+			Origin:         k,
+			Cookies:        len(sess.Cookies),
+			LocalStorage:   len(sess.LocalStorage),
+			SessionStorage: len(sess.SessionStorage),
+		})
+		sess.mu.RUnlock()
+	}
+	return out
+}
+
+func (m *memoryBackend) Clear(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.origins, key)
+}
+
+func (m *memoryBackend) ClearAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.origins = make(map[string]*OriginSession)
+}
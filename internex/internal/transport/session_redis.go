@@ -0,0 +1,312 @@
+//go:build redis
+
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Building with `-tags redis` registers a "redis" session backend so
+// several proxy instances can share session state.  Its DSN is a URL of
+// the form redis://[:password@]host:port[/db].  Each session key maps to
+// three hashes: internex:c:<key> (cookies, by name and path),
+// internex:l:<key> and internex:s:<key> (localStorage/sessionStorage).
+func init() {
+	RegisterSessionBackend("redis", func(dsn string) (SessionBackend, error) {
+		return newRedisBackend(dsn)
+	})
+}
+
+const redisKeyPrefix = "internex:"
+
+// redisBackend speaks RESP over a single connection, serialised by mu,
+// and redials after an I/O error.
+type redisBackend struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisBackend(dsn string) (*redisBackend, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis DSN %q", dsn)
+	}
+	b := &redisBackend{addr: u.Host}
+	if pw, ok := u.User.Password(); ok {
+		b.password = pw
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if b.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if _, err := b.do("PING"); err != nil {
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	return b, nil
+}
+
+func (b *redisBackend) dial() error {
+	conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	b.conn, b.rd = conn, bufio.NewReader(conn)
+	if b.password != "" {
+		if _, err := b.roundTrip("AUTH", b.password); err != nil {
+			return err
+		}
+	}
+	if b.db != 0 {
+		if _, err := b.roundTrip("SELECT", strconv.Itoa(b.db)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do runs one command, dialing first if needed.
+func (b *redisBackend) do(args ...string) (any, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		if err := b.dial(); err != nil {
+			if b.conn != nil {
+				b.conn.Close()
+				b.conn = nil
+			}
+			return nil, err
+		}
+	}
+	v, err := b.roundTrip(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		b.conn.Close()
+		b.conn = nil
+	}
+	return v, err
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (b *redisBackend) roundTrip(args ...string) (any, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	b.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(b.conn, sb.String()); err != nil {
+		return nil, err
+	}
+	return b.readReply()
+}
+
+// readReply parses one RESP reply: strings, integers, bulk strings (nil
+// when absent) and arrays.
+func (b *redisBackend) readReply() (any, error) {
+	line, err := b.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(b.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = b.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// logErr reports backend failures; the SessionBackend interface has no
+// error returns, so a failed call behaves like an empty session.
+func logRedisErr(op string, err error) {
+	if err != nil {
+		getLogger().Error("redis session backend", "op", op, "err", err)
+	}
+}
+
+func cookieHashKey(key string) string { return redisKeyPrefix + "c:" + key }
+
+func areaHashKey(key string, area StorageArea) string {
+	if area == AreaSession {
+		return redisKeyPrefix + "s:" + key
+	}
+	return redisKeyPrefix + "l:" + key
+}
+
+// hashPairs turns an HGETALL reply into a map.
+func hashPairs(v any) map[string]string {
+	out := make(map[string]string)
+	arr, _ := v.([]any)
+	for i := 0; i+1 < len(arr); i += 2 {
+		k, _ := arr[i].(string)
+		val, _ := arr[i+1].(string)
+		out[k] = val
+	}
+	return out
+}
+
+func (b *redisBackend) Cookies(key string) []*http.Cookie {
+	v, err := b.do("HGETALL", cookieHashKey(key))
+	logRedisErr("HGETALL", err)
+	var values []string
+	for _, raw := range hashPairs(v) {
+		values = append(values, raw)
+	}
+	return (&http.Response{Header: http.Header{"Set-Cookie": values}}).Cookies()
+}
+
+func (b *redisBackend) PutCookies(key string, cookies []*http.Cookie) {
+	args := []string{"HSET", cookieHashKey(key)}
+	for _, c := range cookies {
+		args = append(args, c.Name+"\x00"+strings.ToLower(c.Path), c.String())
+	}
+	_, err := b.do(args...)
+	logRedisErr("HSET", err)
+}
+
+func (b *redisBackend) DeleteCookie(key, name string) {
+	v, err := b.do("HKEYS", cookieHashKey(key))
+	logRedisErr("HKEYS", err)
+	fields, _ := v.([]any)
+	for _, f := range fields {
+		field, _ := f.(string)
+		if n, _, _ := strings.Cut(field, "\x00"); n == name {
+			_, err := b.do("HDEL", cookieHashKey(key), field)
+			logRedisErr("HDEL", err)
+			return
+		}
+	}
+}
+
+func (b *redisBackend) GetItem(key string, area StorageArea, name string) (string, bool) {
+	v, err := b.do("HGET", areaHashKey(key, area), name)
+	logRedisErr("HGET", err)
+	s, ok := v.(string)
+	return s, ok
+}
+
+func (b *redisBackend) SetItem(key string, area StorageArea, name, value string) {
+	_, err := b.do("HSET", areaHashKey(key, area), name, value)
+	logRedisErr("HSET", err)
+}
+
+func (b *redisBackend) DeleteItem(key string, area StorageArea, name string) {
+	_, err := b.do("HDEL", areaHashKey(key, area), name)
+	logRedisErr("HDEL", err)
+}
+
+func (b *redisBackend) Items(key string, area StorageArea) map[string]string {
+	v, err := b.do("HGETALL", areaHashKey(key, area))
+	logRedisErr("HGETALL", err)
+	return hashPairs(v)
+}
+
+func (b *redisBackend) ClearArea(key string, area StorageArea) {
+	_, err := b.do("DEL", areaHashKey(key, area))
+	logRedisErr("DEL", err)
+}
+
+func (b *redisBackend) Clear(key string) {
+	_, err := b.do("DEL", cookieHashKey(key), areaHashKey(key, AreaLocal), areaHashKey(key, AreaSession))
+	logRedisErr("DEL", err)
+}
+
+func (b *redisBackend) Keys() []string {
+	seen := make(map[string]bool)
+	var keys []string
+	b.scan(func(k string) {
+		// Strip "internex:<c|l|s>:".
+		rest, ok := strings.CutPrefix(k, redisKeyPrefix)
+		if !ok || len(rest) < 2 || rest[1] != ':' {
+			return
+		}
+		if key := rest[2:]; !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// scan calls fn for every key under redisKeyPrefix.
+func (b *redisBackend) scan(fn func(key string)) {
+	cursor := "0"
+	for {
+		v, err := b.do("SCAN", cursor, "MATCH", redisKeyPrefix+"*", "COUNT", "500")
+		if err != nil {
+			logRedisErr("SCAN", err)
+			return
+		}
+		reply, _ := v.([]any)
+		if len(reply) != 2 {
+			return
+		}
+		cursor, _ = reply[0].(string)
+		keys, _ := reply[1].([]any)
+		for _, k := range keys {
+			s, _ := k.(string)
+			fn(s)
+		}
+		if cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+func (b *redisBackend) ClearAll() {
+	var keys []string
+	b.scan(func(k string) { keys = append(keys, k) })
+	for len(keys) > 0 {
+		n := min(len(keys), 500)
+		_, err := b.do(append([]string{"DEL"}, keys[:n]...)...)
+		logRedisErr("DEL", err)
+		keys = keys[n:]
+	}
+}
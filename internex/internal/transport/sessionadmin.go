@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Session admin endpoints
+// ---------------------------------------------------------------------------
+//
+//	GET    /session/stats                    per-origin cookie and storage counts
+//	GET    /session/{origin}                 cookies and storage as JSON
+//	DELETE /session/{origin}                 clear the origin's session
+//	DELETE /session/{origin}/cookies/{name}  delete one cookie
+//
+// {origin} is the percent-encoded upstream origin, e.g.
+// /session/https%3A%2F%2Fexample.com.  The session is named by the query
+// parameters client (a ClientTokenCookie value, with ClientSessions) and
+// namespace (a SessionNamespaceHeader value); without them the origin's
+// shared session is addressed.  The admin's own cookies and headers are
+// never used.  The routes are only registered when SessionAdminToken is
+// set, and every call must carry it as "Authorization: Bearer <token>".
+
+// SessionAdminToken enables the session admin endpoints.  Set before
+// NewMux is called.
+var SessionAdminToken string
+
+// sessionCookie is the JSON form of a stored cookie.
+type sessionCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"httpOnly,omitempty"`
+}
+
+// sessionView is the JSON body of GET /session/{origin}.
+type sessionView struct {
+	Origin         string            `json:"origin"`
+	Cookies        []sessionCookie   `json:"cookies"`
+	LocalStorage   map[string]string `json:"localStorage"`
+	SessionStorage map[string]string `json:"sessionStorage"`
+}
+
+func registerSessionAdmin(mux *http.ServeMux) {
+	if SessionAdminToken == "" {
+		return
+	}
+	mux.HandleFunc("GET /session/stats", requireAdmin(handleSessionStats))
+	mux.HandleFunc("GET /session/{origin}", requireAdmin(handleSessionGet))
+	mux.HandleFunc("DELETE /session/{origin}", requireAdmin(handleSessionDelete))
+	mux.HandleFunc("DELETE /session/{origin}/cookies/{name}", requireAdmin(handleSessionDeleteCookie))
+}
+
+// requireAdmin rejects requests without the admin bearer token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(SessionAdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="internex-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminSessionKey resolves the {origin} path value and the client and
+// namespace query parameters to a session key.
+func adminSessionKey(w http.ResponseWriter, r *http.Request) (origin, key string, ok bool) {
+	origin = ExtractOrigin(r.PathValue("origin"))
+	if origin == "" || origin == "://" {
+		http.Error(w, "invalid origin", http.StatusBadRequest)
+		return "", "", false
+	}
+	q := r.URL.Query()
+	key, ok = makeSessionKey(q.Get("client"), q.Get("namespace"), origin)
+	if !ok {
+		http.Error(w, "invalid client or namespace", http.StatusBadRequest)
+		return "", "", false
+	}
+	return origin, key, true
+}
+
+func handleSessionGet(w http.ResponseWriter, r *http.Request) {
+	origin, key, ok := adminSessionKey(w, r)
+	if !ok {
+		return
+	}
+
+	view := sessionView{
+		Origin:         origin,
+		Cookies:        []sessionCookie{},
+		LocalStorage:   DefaultSessions.LocalStorageItems(key),
+		SessionStorage: DefaultSessions.SessionStorageItems(key),
+	}
+	for _, c := range DefaultSessions.GetCookies(key) {
+		sc := sessionCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			sc.Expires = &expires
+		}
+		view.Cookies = append(view.Cookies, sc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(view)
+}
+
+// handleSessionStats lists every session key in the store, across
+// namespaces and client tokens.
+func handleSessionStats(w http.ResponseWriter, r *http.Request) {
+	stats := DefaultSessions.Stats()
+	if stats == nil {
+		stats = []OriginStat{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func handleSessionDelete(w http.ResponseWriter, r *http.Request) {
+	_, key, ok := adminSessionKey(w, r)
+	if !ok {
+		return
+	}
+	DefaultSessions.ClearOrigin(key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleSessionDeleteCookie(w http.ResponseWriter, r *http.Request) {
+	_, key, ok := adminSessionKey(w, r)
+	if !ok {
+		return
+	}
+	DefaultSessions.DeleteCookie(key, r.PathValue("name"))
+	w.WriteHeader(http.StatusNoContent)
+}
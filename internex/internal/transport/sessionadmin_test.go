@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+const testAdminToken = "s3cret"
+
+// withSessionAdmin registers the session admin routes for the test.
+func withSessionAdmin(t *testing.T) http.Header {
+	t.Helper()
+	SessionAdminToken = testAdminToken
+	t.Cleanup(func() { SessionAdminToken = "" })
+	return http.Header{"Authorization": {"Bearer " + testAdminToken}}
+}
+
+func TestSessionAdminAddressesClientSessions(t *testing.T) {
+	resetSessions(t)
+	admin := withSessionAdmin(t)
+	ClientSessions = true
+	t.Cleanup(func() { ClientSessions = false })
+
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "alice-session"})
+	})
+	alice := http.Header{"Cookie": {ClientTokenCookie + "=alice"}}
+	if rec := proxyRequest(t, http.MethodGet, up.URL+"/", alice); rec.Code != http.StatusOK {
+		t.Fatalf("proxy status = %d", rec.Code)
+	}
+
+	path := "/session/" + url.PathEscape(up.URL)
+	tests := []struct {
+		name        string
+		query       string
+		header      http.Header
+		wantStatus  int
+		wantCookies int
+	}{
+		{"client named explicitly", "?client=alice", admin, http.StatusOK, 1},
+		{"shared session", "", admin, http.StatusOK, 0},
+		{"other client", "?client=bob", admin, http.StatusOK, 0},
+		{"admin cookie ignored", "", http.Header{
+			"Authorization": admin["Authorization"],
+			"Cookie":        {ClientTokenCookie + "=alice"},
+		}, http.StatusOK, 0},
+		{"invalid client", "?client=a%7Cb", admin, http.StatusBadRequest, 0},
+		{"no token", "?client=alice", nil, http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, http.MethodGet, path+tt.query, tt.header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var view sessionView
+			if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+				t.Fatal(err)
+			}
+			if len(view.Cookies) != tt.wantCookies {
+				t.Errorf("cookies = %+v, want %d", view.Cookies, tt.wantCookies)
+			}
+		})
+	}
+
+	if rec := serve(t, http.MethodDelete, path+"?client=alice", admin); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d", rec.Code)
+	}
+	if key, _ := makeSessionKey("alice", "", up.URL); len(DefaultSessions.GetCookies(key)) != 0 {
+		t.Error("client session not cleared")
+	}
+}
+
+func TestSessionStatsEndpoint(t *testing.T) {
+	resetSessions(t)
+	admin := withSessionAdmin(t)
+
+	var origins []string
+	for _, n := range []int{1, 2} {
+		up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < n; i++ {
+				http.SetCookie(w, &http.Cookie{Name: "c" + strconv.Itoa(i), Value: "v"})
+			}
+		})
+		if rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil); rec.Code != http.StatusOK {
+			t.Fatalf("proxy status = %d", rec.Code)
+		}
+		origins = append(origins, up.URL)
+	}
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"admin", admin, http.StatusOK},
+		{"no token", nil, http.StatusUnauthorized},
+		{"wrong token", http.Header{"Authorization": {"Bearer nope"}}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, http.MethodGet, "/session/stats", tt.header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var stats []OriginStat
+			if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			cookies := make(map[string]int)
+			for _, s := range stats {
+				cookies[s.Origin] = s.Cookies
+			}
+			for i, origin := range origins {
+				if cookies[origin] != i+1 {
+					t.Errorf("%s: cookies = %d, want %d (stats %+v)", origin, cookies[origin], i+1, stats)
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,14 @@
 package transport
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,53 +19,95 @@ import (
 // ---------------------------------------------------------------------------
 
 // SessionStore holds virtualized browser state keyed by upstream origin
-// (e.g. "https://example.com").  It is safe for concurrent use.
+// (e.g. "https://example.com").  It is safe for concurrent use.  The
+// state itself lives in a SessionBackend; the default keeps it in memory.
 type SessionStore struct {
-	mu       sync.RWMutex
-	origins  map[string]*OriginSession
+	backend SessionBackend
 }
 
-// OriginSession holds cookies and key-value storage for a single origin.
-type OriginSession struct {
-	mu            sync.RWMutex
-	Cookies       []*http.Cookie
-	LocalStorage  map[string]string
-	SessionStorage map[string]string
+// StorageArea selects localStorage or sessionStorage.
+type StorageArea int
+
+const (
+	AreaLocal StorageArea = iota
+	AreaSession
+)
+
+// SessionBackend stores cookies and storage items per session key (an
+// origin, optionally namespaced).  Implementations must be safe for
+// concurrent use.  Items returns a copy; a missing key behaves as empty.
+type SessionBackend interface {
+	// Cookies returns the key's cookies, expired ones included.
+	Cookies(key string) []*http.Cookie
+	// PutCookies adds cookies, replacing any with the same name and path.
+	PutCookies(key string, cookies []*http.Cookie)
+	// DeleteCookie removes the named cookie.
+	DeleteCookie(key, name string)
+
+	GetItem(key string, area StorageArea, name string) (string, bool)
+	SetItem(key string, area StorageArea, name, value string)
+	DeleteItem(key string, area StorageArea, name string)
+	Items(key string, area StorageArea) map[string]string
+	ClearArea(key string, area StorageArea)
+
+	// Keys lists the session keys with any stored state.
+	Keys() []string
+
+	// Clear removes all state for key; ClearAll removes everything.
+	Clear(key string)
+	ClearAll()
 }
 
 // Global default session store.
 var DefaultSessions = NewSessionStore()
 
-// NewSessionStore creates an empty session store.
+// NewSessionStore creates an empty in-memory session store.
 func NewSessionStore() *SessionStore {
-	return &SessionStore{
-		origins: make(map[string]*OriginSession),
-	}
+	return NewSessionStoreWithBackend(newMemoryBackend())
 }
 
-// getOrCreate returns the OriginSession for the given origin, creating one
-// if necessary.
-func (s *SessionStore) getOrCreate(origin string) *OriginSession {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if ok {
-		return sess
-	}
+// NewSessionStoreWithBackend creates a session store over backend.
+func NewSessionStoreWithBackend(backend SessionBackend) *SessionStore {
+	return &SessionStore{backend: backend}
+}
+
+// ---------------------------------------------------------------------------
+// Backend registry
+// ---------------------------------------------------------------------------
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	// Double-check after acquiring write lock.
-	if sess, ok = s.origins[origin]; ok {
-		return sess
+var (
+	backendsMu       sync.RWMutex
+	backendFactories = map[string]func(dsn string) (SessionBackend, error){
+		"memory": func(string) (SessionBackend, error) { return newMemoryBackend(), nil },
 	}
-	sess = &OriginSession{
-		Cookies:        nil,
-		LocalStorage:   make(map[string]string),
-		SessionStorage: make(map[string]string),
+)
+
+// RegisterSessionBackend makes a backend available to OpenSessionBackend
+// under name.  Optional backends register themselves from build-tagged
+// files (see session_redis.go).
+func RegisterSessionBackend(name string, factory func(dsn string) (SessionBackend, error)) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backendFactories[name] = factory
+}
+
+// OpenSessionBackend opens the named backend with a backend-specific
+// connection string.
+func OpenSessionBackend(name, dsn string) (SessionBackend, error) {
+	backendsMu.RLock()
+	factory, ok := backendFactories[name]
+	backendsMu.RUnlock()
+	if !ok {
+		var names []string
+		backendsMu.RLock()
+		for n := range backendFactories {
+			names = append(names, n)
+		}
+		backendsMu.RUnlock()
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown session backend %q (available: %s)", name, strings.Join(names, ", "))
 	}
-	s.origins[origin] = sess
-	return sess
+	return factory(dsn)
 }
 
 // ---------------------------------------------------------------------------
@@ -68,25 +117,75 @@ func (s *SessionStore) getOrCreate(origin string) *OriginSession {
 // SetCookiesFromResponse parses Set-Cookie headers from an upstream
 // response and stores them in the per-origin jar.
 func (s *SessionStore) SetCookiesFromResponse(origin string, resp *http.Response) {
-	cookies := resp.Cookies()
-	if len(cookies) == 0 {
-		return
+	s.storeCookies(origin, parseSetCookies(resp.Header))
+}
+
+// SetCookiesFromTrailer stores Set-Cookie values an upstream sent as
+// trailers.  resp.Trailer is only populated once the body has been read
+// to EOF, so call this after consuming the body.
+func (s *SessionStore) SetCookiesFromTrailer(origin string, resp *http.Response) {
+	s.storeCookies(origin, parseSetCookies(resp.Trailer))
+}
+
+// parseSetCookies parses every Set-Cookie in h, one cookie per line, after
+// splitting lines that fold several cookies together (see
+// setCookieValues).
+func parseSetCookies(h http.Header) []*http.Cookie {
+	values := setCookieValues(h)
+	if len(values) == 0 {
+		return nil
 	}
-	sess := s.getOrCreate(origin)
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
+	return (&http.Response{Header: http.Header{"Set-Cookie": values}}).Cookies()
+}
+
+// maxCookieBytes is the largest name plus value a cookie may have;
+// browsers ignore bigger ones (RFC 6265bis §5.6), and so does the jar.
+const maxCookieBytes = 4096
 
+// storeCookies adds cookies to the origin's jar, replacing any existing
+// cookie with the same name and path.  Oversized cookies are dropped.
+func (s *SessionStore) storeCookies(origin string, cookies []*http.Cookie) {
+	now := time.Now()
+	kept := cookies[:0]
 	for _, c := range cookies {
-		replaced := false
-		for i, existing := range sess.Cookies {
-			if existing.Name == c.Name && strings.EqualFold(existing.Path, c.Path) {
-				sess.Cookies[i] = c
-				replaced = true
-				break
-			}
+		if len(c.Name)+len(c.Value) > maxCookieBytes {
+			getLogger().Warn("dropping oversized cookie", "origin", origin, "name", c.Name, "size", len(c.Name)+len(c.Value))
+			continue
 		}
-		if !replaced {
-			sess.Cookies = append(sess.Cookies, c)
+		normalizeCookieExpiry(c, now)
+		kept = append(kept, c)
+	}
+	if len(kept) == 0 {
+		return
+	}
+	s.backend.PutCookies(origin, kept)
+}
+
+// cookieDateLayouts are the Expires formats net/http does not parse
+// itself but servers still send (RFC 850 and asctime dates).
+var cookieDateLayouts = []string{
+	"Monday, 02-Jan-06 15:04:05 MST",
+	"Mon, 02-Jan-06 15:04:05 MST",
+	"Mon, 02 Jan 06 15:04:05 MST",
+	time.ANSIC,
+}
+
+// normalizeCookieExpiry resolves a cookie's lifetime into Expires, the
+// only field CookieHeader checks: Max-Age, when present, takes
+// precedence (RFC 6265 §5.3), and Expires dates net/http could not parse
+// are retried with cookieDateLayouts.
+func normalizeCookieExpiry(c *http.Cookie, now time.Time) {
+	switch {
+	case c.MaxAge < 0:
+		c.Expires = time.Unix(0, 0)
+	case c.MaxAge > 0:
+		c.Expires = maxAgeExpiry(c.MaxAge, now)
+	case c.Expires.IsZero() && c.RawExpires != "":
+		for _, layout := range cookieDateLayouts {
+			if t, err := time.Parse(layout, c.RawExpires); err == nil {
+				c.Expires = t.UTC()
+				return
+			}
 		}
 	}
 }
@@ -94,19 +193,9 @@ func (s *SessionStore) SetCookiesFromResponse(origin string, resp *http.Response
 // CookieHeader builds a Cookie header value to send to the upstream
 // origin, filtering out expired cookies.
 func (s *SessionStore) CookieHeader(origin string) string {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return ""
-	}
-
-	sess.mu.RLock()
-	defer sess.mu.RUnlock()
-
 	now := time.Now()
 	var parts []string
-	for _, c := range sess.Cookies {
+	for _, c := range s.backend.Cookies(origin) {
 		// Skip expired cookies.
 		if !c.Expires.IsZero() && c.Expires.Before(now) {
 			continue
@@ -118,39 +207,12 @@ func (s *SessionStore) CookieHeader(origin string) string {
 
 // GetCookies returns a copy of the stored cookies for an origin.
 func (s *SessionStore) GetCookies(origin string) []*http.Cookie {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return nil
-	}
-
-	sess.mu.RLock()
-	defer sess.mu.RUnlock()
-
-	out := make([]*http.Cookie, len(sess.Cookies))
-	copy(out, sess.Cookies)
-	return out
+	return s.backend.Cookies(origin)
 }
 
 // DeleteCookie removes a named cookie from the origin's jar.
 func (s *SessionStore) DeleteCookie(origin, name string) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return
-	}
-
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-
-	for i, c := range sess.Cookies {
-		if c.Name == name {
-			sess.Cookies = append(sess.Cookies[:i], sess.Cookies[i+1:]...)
-			return
-		}
-	}
+	s.backend.DeleteCookie(origin, name)
 }
 
 // ---------------------------------------------------------------------------
@@ -159,103 +221,209 @@ func (s *SessionStore) DeleteCookie(origin, name string) {
 
 // SetLocalStorage sets a key-value pair in the origin's localStorage.
 func (s *SessionStore) SetLocalStorage(origin, key, value string) {
-	sess := s.getOrCreate(origin)
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-	sess.LocalStorage[key] = value
+	s.backend.SetItem(origin, AreaLocal, key, value)
 }
 
 // GetLocalStorage retrieves a value from the origin's localStorage.
 func (s *SessionStore) GetLocalStorage(origin, key string) (string, bool) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return "", false
-	}
-	sess.mu.RLock()
-	defer sess.mu.RUnlock()
-	v, found := sess.LocalStorage[key]
-	return v, found
+	return s.backend.GetItem(origin, AreaLocal, key)
 }
 
 // DeleteLocalStorage removes a key from the origin's localStorage.
 func (s *SessionStore) DeleteLocalStorage(origin, key string) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return
-	}
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-	delete(sess.LocalStorage, key)
+	s.backend.DeleteItem(origin, AreaLocal, key)
 }
 
 // ClearLocalStorage wipes all localStorage for an origin.
 func (s *SessionStore) ClearLocalStorage(origin string) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return
-	}
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-	sess.LocalStorage = make(map[string]string)
+	s.backend.ClearArea(origin, AreaLocal)
 }
 
 // SetSessionStorage sets a key-value pair in the origin's sessionStorage.
 func (s *SessionStore) SetSessionStorage(origin, key, value string) {
-	sess := s.getOrCreate(origin)
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-	sess.SessionStorage[key] = value
+	s.backend.SetItem(origin, AreaSession, key, value)
 }
 
 // GetSessionStorage retrieves a value from the origin's sessionStorage.
 func (s *SessionStore) GetSessionStorage(origin, key string) (string, bool) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return "", false
-	}
-	sess.mu.RLock()
-	defer sess.mu.RUnlock()
-	v, found := sess.SessionStorage[key]
-	return v, found
+	return s.backend.GetItem(origin, AreaSession, key)
 }
 
 // DeleteSessionStorage removes a key from the origin's sessionStorage.
 func (s *SessionStore) DeleteSessionStorage(origin, key string) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return
-	}
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-	delete(sess.SessionStorage, key)
+	s.backend.DeleteItem(origin, AreaSession, key)
 }
 
 // ClearSessionStorage wipes all sessionStorage for an origin.
 func (s *SessionStore) ClearSessionStorage(origin string) {
-	s.mu.RLock()
-	sess, ok := s.origins[origin]
-	s.mu.RUnlock()
-	if !ok {
-		return
-	}
-	sess.mu.Lock()
-	defer sess.mu.Unlock()
-	sess.SessionStorage = make(map[string]string)
+	s.backend.ClearArea(origin, AreaSession)
+}
+
+// LocalStorageItems returns a copy of the origin's localStorage.
+func (s *SessionStore) LocalStorageItems(origin string) map[string]string {
+	return s.backend.Items(origin, AreaLocal)
+}
+
+// SessionStorageItems returns a copy of the origin's sessionStorage.
+func (s *SessionStore) SessionStorageItems(origin string) map[string]string {
+	return s.backend.Items(origin, AreaSession)
+}
+
+// ClearOrigin wipes cookies and storage for a single origin.
+func (s *SessionStore) ClearOrigin(origin string) {
+	s.backend.Clear(origin)
 }
 
 // ClearAll wipes the entire session store.
 func (s *SessionStore) ClearAll() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.origins = make(map[string]*OriginSession)
-}
\ No newline at end of file
+	s.backend.ClearAll()
+}
+
+// ---------------------------------------------------------------------------
+// Snapshots
+// ---------------------------------------------------------------------------
+
+// OriginSessionData is a detached copy of one session's state, safe to
+// keep, modify or serialize.
+type OriginSessionData struct {
+	Cookies        []http.Cookie     `json:"cookies"`
+	LocalStorage   map[string]string `json:"localStorage"`
+	SessionStorage map[string]string `json:"sessionStorage"`
+}
+
+// sessionSnapshotter is implemented by backends that can copy a session
+// atomically rather than field by field.
+type sessionSnapshotter interface {
+	snapshot() map[string]OriginSessionData
+}
+
+// Snapshot returns a deep copy of every session, keyed by session key.
+// Nothing in the result is shared with the store.  With the in-memory
+// backend each session is copied under its lock; other backends are read
+// field by field, so a session written concurrently may mix old cookies
+// with new storage.
+func (s *SessionStore) Snapshot() map[string]OriginSessionData {
+	if snap, ok := s.backend.(sessionSnapshotter); ok {
+		return snap.snapshot()
+	}
+	out := make(map[string]OriginSessionData)
+	for _, key := range s.backend.Keys() {
+		out[key] = OriginSessionData{
+			Cookies:        copyCookies(s.backend.Cookies(key)),
+			LocalStorage:   s.backend.Items(key, AreaLocal),
+			SessionStorage: s.backend.Items(key, AreaSession),
+		}
+	}
+	return out
+}
+
+// OriginStat counts the state held for one session key.
+type OriginStat struct {
+	// Origin is the session key: the upstream origin, prefixed by the
+	// client token and namespace when those are in use.
+	Origin         string `json:"origin"`
+	Cookies        int    `json:"cookies"`
+	LocalStorage   int    `json:"localStorage"`
+	SessionStorage int    `json:"sessionStorage"`
+}
+
+// sessionStatser is implemented by backends that can count a session's
+// state without copying it.
+type sessionStatser interface {
+	stats() []OriginStat
+}
+
+// Stats returns the number of cookies and storage entries held for each
+// session key, sorted by key.  Values are not copied, so it is cheap
+// enough for a dashboard to poll; other backends than the in-memory one
+// fall back to reading each session.
+func (s *SessionStore) Stats() []OriginStat {
+	var out []OriginStat
+	if st, ok := s.backend.(sessionStatser); ok {
+		out = st.stats()
+	} else {
+		for _, key := range s.backend.Keys() {
+			out = append(out, OriginStat{
+				Origin:         key,
+				Cookies:        len(s.backend.Cookies(key)),
+				LocalStorage:   len(s.backend.Items(key, AreaLocal)),
+				SessionStorage: len(s.backend.Items(key, AreaSession)),
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Origin < out[j].Origin })
+	return out
+}
+
+// copyCookies returns deep copies of cookies as values.
+func copyCookies(cookies []*http.Cookie) []http.Cookie {
+	out := make([]http.Cookie, len(cookies))
+	for i, c := range cookies {
+		out[i] = *c
+		out[i].Unparsed = append([]string(nil), c.Unparsed...)
+	}
+	return out
+}
+
+// ---------------------------------------------------------------------------
+// Persistence
+// ---------------------------------------------------------------------------
+
+// SaveFile writes a Snapshot of the store to path as JSON, replacing the
+// file atomically.  The file holds session cookies, so it is created
+// readable by the owner only.
+func (s *SessionStore) SaveFile(path string) error {
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		return fmt.Errorf("encoding sessions: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile adds the sessions saved by SaveFile at path to the store,
+// skipping cookies that have expired since.  A missing file is not an
+// error.
+func (s *SessionStore) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sessions map[string]OriginSessionData
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+	now := time.Now()
+	for key, sess := range sessions {
+		var cookies []*http.Cookie
+		for i := range sess.Cookies {
+			if c := &sess.Cookies[i]; c.Expires.IsZero() || c.Expires.After(now) {
+				cookies = append(cookies, c)
+			}
+		}
+		if len(cookies) > 0 {
+			s.backend.PutCookies(key, cookies)
+		}
+		for name, value := range sess.LocalStorage {
+			s.backend.SetItem(key, AreaLocal, name, value)
+		}
+		for name, value := range sess.SessionStorage {
+			s.backend.SetItem(key, AreaSession, name, value)
+		}
+	}
+	return nil
+}
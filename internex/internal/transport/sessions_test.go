@@ -0,0 +1,447 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// plainBackend hides the memory backend's stats method, so Stats takes
+// the generic path.
+type plainBackend struct{ SessionBackend }
+
+func TestSessionStoreStats(t *testing.T) {
+	fill := func(s *SessionStore) {
+		s.storeCookies("https://b.example", []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}})
+		s.SetLocalStorage("https://b.example", "theme", "dark")
+		s.SetSessionStorage("~tok|https://a.example", "step", "2")
+		s.SetSessionStorage("~tok|https://a.example", "cart", "3")
+	}
+	want := []OriginStat{
+		{Origin: "https://b.example", Cookies: 2, LocalStorage: 1},
+		{Origin: "~tok|https://a.example", SessionStorage: 2},
+	}
+	tests := []struct {
+		name  string
+		store func() *SessionStore
+		want  []OriginStat
+	}{
+		{"empty", NewSessionStore, nil},
+		{"memory backend", func() *SessionStore {
+			s := NewSessionStore()
+			fill(s)
+			return s
+		}, want},
+		{"generic backend", func() *SessionStore {
+			s := NewSessionStoreWithBackend(plainBackend{newMemoryBackend()})
+			fill(s)
+			return s
+		}, want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.store().Stats()
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetCookiesFromResponseExpiry(t *testing.T) {
+	s := NewSessionStore()
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {
+		"a=1; Expires=Thu, 01 Jan 2099 00:00:00 GMT; Path=/",
+		"b=2; Max-Age=9999999999, gone=3; Expires=Sat, 01 Jan 2000 00:00:00 GMT",
+	}}}
+	s.SetCookiesFromResponse("https://example.com", resp)
+
+	if got, want := s.CookieHeader("https://example.com"), "a=1; b=2"; got != want {
+		t.Errorf("CookieHeader = %q, want %q", got, want)
+	}
+	for _, c := range s.GetCookies("https://example.com") {
+		if c.Name == "b" && c.Expires.After(time.Now().Add(maxCookieAge)) {
+			t.Errorf("b expires %v, past the %v cap", c.Expires, maxCookieAge)
+		}
+	}
+}
+
+func TestSessionStoreSaveLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	if err := NewSessionStore().LoadFile(path); err != nil {
+		t.Fatalf("LoadFile of a missing file: %v", err)
+	}
+
+	s := NewSessionStore()
+	s.storeCookies("https://example.com", []*http.Cookie{
+		{Name: "sid", Value: "1", Path: "/", HttpOnly: true},
+		{Name: "old", Value: "2", Expires: time.Now().Add(-time.Hour)},
+	})
+	s.SetLocalStorage("https://example.com", "theme", "dark")
+	s.SetSessionStorage("~tok|https://example.com", "step", "2")
+	if err := s.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSessionStore()
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.CookieHeader("https://example.com"); got != "sid=1" {
+		t.Errorf("CookieHeader = %q, want sid=1", got)
+	}
+	if n := len(loaded.GetCookies("https://example.com")); n != 1 {
+		t.Errorf("loaded %d cookies, want the expired one skipped", n)
+	}
+	if v, _ := loaded.GetLocalStorage("https://example.com", "theme"); v != "dark" {
+		t.Errorf("localStorage theme = %q, want dark", v)
+	}
+	if v, _ := loaded.GetSessionStorage("~tok|https://example.com", "step"); v != "2" {
+		t.Errorf("sessionStorage step = %q, want 2", v)
+	}
+}
+
+// fakeBackend is a minimal SessionBackend over plain maps, standing in
+// for an external store.
+type fakeBackend struct {
+	mu      sync.Mutex
+	cookies map[string][]*http.Cookie
+	items   map[string]map[StorageArea]map[string]string
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{cookies: map[string][]*http.Cookie{}, items: map[string]map[StorageArea]map[string]string{}}
+}
+
+func (f *fakeBackend) Cookies(key string) []*http.Cookie {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*http.Cookie(nil), f.cookies[key]...)
+}
+
+func (f *fakeBackend) PutCookies(key string, cookies []*http.Cookie) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+next:
+	for _, c := range cookies {
+		for i, old := range f.cookies[key] {
+			if old.Name == c.Name && strings.EqualFold(old.Path, c.Path) {
+				f.cookies[key][i] = c
+				continue next
+			}
+		}
+		f.cookies[key] = append(f.cookies[key], c)
+	}
+}
+
+func (f *fakeBackend) DeleteCookie(key, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, c := range f.cookies[key] {
+		if c.Name == name {
+			f.cookies[key] = append(f.cookies[key][:i], f.cookies[key][i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *fakeBackend) area(key string, area StorageArea) map[string]string {
+	if f.items[key] == nil {
+		f.items[key] = map[StorageArea]map[string]string{}
+	}
+	if f.items[key][area] == nil {
+		f.items[key][area] = map[string]string{}
+	}
+	return f.items[key][area]
+}
+
+func (f *fakeBackend) GetItem(key string, area StorageArea, name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.items[key][area][name]
+	return v, ok
+}
+
+func (f *fakeBackend) SetItem(key string, area StorageArea, name, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.area(key, area)[name] = value
+}
+
+func (f *fakeBackend) DeleteItem(key string, area StorageArea, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items[key][area], name)
+}
+
+func (f *fakeBackend) Items(key string, area StorageArea) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]string{}
+	for k, v := range f.items[key][area] {
+		out[k] = v
+	}
+	return out
+}
+
+func (f *fakeBackend) ClearArea(key string, area StorageArea) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items[key], area)
+}
+
+func (f *fakeBackend) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k, cs := range f.cookies {
+		if len(cs) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	for k := range f.items {
+		if len(f.cookies[k]) == 0 {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (f *fakeBackend) Clear(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cookies, key)
+	delete(f.items, key)
+}
+
+func (f *fakeBackend) ClearAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cookies = map[string][]*http.Cookie{}
+	f.items = map[string]map[StorageArea]map[string]string{}
+}
+
+// cookieNames lists the names and paths of cookies, sorted.
+func cookieNames(cookies []*http.Cookie) []string {
+	var out []string
+	for _, c := range cookies {
+		out = append(out, c.Name+"="+c.Value+";"+c.Path)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestSessionBackendContract(t *testing.T) {
+	const a, b = "https://a.example", "~tok|https://b.example"
+	contract := []struct {
+		name  string
+		check func(t *testing.T, be SessionBackend)
+	}{
+		{"missing key is empty", func(t *testing.T, be SessionBackend) {
+			if cs := be.Cookies(a); len(cs) != 0 {
+				t.Errorf("Cookies = %v", cs)
+			}
+			if _, ok := be.GetItem(a, AreaLocal, "x"); ok {
+				t.Error("GetItem found an item")
+			}
+			if items := be.Items(a, AreaSession); items == nil || len(items) != 0 {
+				t.Errorf("Items = %#v, want an empty map", items)
+			}
+			be.DeleteCookie(a, "x")
+			be.DeleteItem(a, AreaLocal, "x")
+			be.ClearArea(a, AreaLocal)
+			be.Clear(a)
+		}},
+		{"cookies replace by name and path", func(t *testing.T, be SessionBackend) {
+			be.PutCookies(a, []*http.Cookie{{Name: "sid", Value: "1", Path: "/"}, {Name: "sid", Value: "2", Path: "/app"}})
+			be.PutCookies(a, []*http.Cookie{{Name: "sid", Value: "3", Path: "/"}, {Name: "pref", Value: "x", Path: "/"}})
+			want := []string{"pref=x;/", "sid=2;/app", "sid=3;/"}
+			if got := cookieNames(be.Cookies(a)); !reflect.DeepEqual(got, want) {
+				t.Errorf("Cookies = %v, want %v", got, want)
+			}
+			be.DeleteCookie(a, "pref")
+			if got := cookieNames(be.Cookies(a)); !reflect.DeepEqual(got, want[1:]) {
+				t.Errorf("after DeleteCookie, Cookies = %v, want %v", got, want[1:])
+			}
+		}},
+		{"storage areas are separate", func(t *testing.T, be SessionBackend) {
+			be.SetItem(a, AreaLocal, "k", "local")
+			be.SetItem(a, AreaSession, "k", "session")
+			if v, _ := be.GetItem(a, AreaLocal, "k"); v != "local" {
+				t.Errorf("local k = %q", v)
+			}
+			be.ClearArea(a, AreaSession)
+			if _, ok := be.GetItem(a, AreaSession, "k"); ok {
+				t.Error("ClearArea left the session item")
+			}
+			if _, ok := be.GetItem(a, AreaLocal, "k"); !ok {
+				t.Error("ClearArea of sessionStorage removed the local item")
+			}
+			be.DeleteItem(a, AreaLocal, "k")
+			if _, ok := be.GetItem(a, AreaLocal, "k"); ok {
+				t.Error("DeleteItem left the item")
+			}
+		}},
+		{"Items returns a copy", func(t *testing.T, be SessionBackend) {
+			be.SetItem(a, AreaLocal, "k", "v")
+			be.Items(a, AreaLocal)["k"] = "changed"
+			if v, _ := be.GetItem(a, AreaLocal, "k"); v != "v" {
+				t.Errorf("k = %q after modifying the Items result", v)
+			}
+		}},
+		{"keys are isolated", func(t *testing.T, be SessionBackend) {
+			be.PutCookies(a, []*http.Cookie{{Name: "sid", Value: "a"}})
+			be.SetItem(b, AreaLocal, "k", "b")
+			if cs := be.Cookies(b); len(cs) != 0 {
+				t.Errorf("b sees a's cookies: %v", cs)
+			}
+			keys := be.Keys()
+			sort.Strings(keys)
+			if want := []string{a, b}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("Keys = %v, want %v", keys, want)
+			}
+			be.Clear(a)
+			if cs := be.Cookies(a); len(cs) != 0 {
+				t.Errorf("Clear left cookies: %v", cs)
+			}
+			if v, _ := be.GetItem(b, AreaLocal, "k"); v != "b" {
+				t.Error("Clear(a) touched b")
+			}
+			be.ClearAll()
+			if keys := be.Keys(); len(keys) != 0 {
+				t.Errorf("Keys after ClearAll = %v", keys)
+			}
+		}},
+	}
+	backends := []struct {
+		name string
+		new  func() SessionBackend
+	}{
+		{"memory", func() SessionBackend { return newMemoryBackend() }},
+		{"fake", func() SessionBackend { return newFakeBackend() }},
+	}
+	for _, be := range backends {
+		for _, c := range contract {
+			t.Run(be.name+"/"+c.name, func(t *testing.T) { c.check(t, be.new()) })
+		}
+	}
+}
+
+func TestSnapshotConcurrentWithMutations(t *testing.T) {
+	for _, backend := range []struct {
+		name string
+		new  func() SessionBackend
+	}{
+		{"memory", func() SessionBackend { return newMemoryBackend() }},
+		{"generic", func() SessionBackend { return plainBackend{newMemoryBackend()} }},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			s := NewSessionStoreWithBackend(backend.new())
+			const origin = "https://example.com"
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						v := strconv.Itoa(i)
+						s.storeCookies(origin, []*http.Cookie{{Name: "c" + strconv.Itoa(w), Value: v, Unparsed: []string{"x=" + v}}})
+						s.SetLocalStorage(origin, "k", v)
+						s.SetSessionStorage(origin, "k", v)
+						if i%10 == 0 {
+							s.DeleteCookie(origin, "c"+strconv.Itoa(w))
+							s.ClearSessionStorage(origin)
+						}
+					}
+				}(w)
+			}
+			for i := 0; i < 200; i++ {
+				snap := s.Snapshot()
+				// Snapshots are detached: writing to one must not race
+				// with the store or change it.
+				if sess, ok := snap[origin]; ok {
+					for j := range sess.Cookies {
+						sess.Cookies[j].Value = "mutated"
+						if len(sess.Cookies[j].Unparsed) > 0 {
+							sess.Cookies[j].Unparsed[0] = "mutated"
+						}
+					}
+					if sess.LocalStorage != nil {
+						sess.LocalStorage["k"] = "mutated"
+					}
+				}
+			}
+			close(stop)
+			wg.Wait()
+
+			for _, c := range s.GetCookies(origin) {
+				if c.Value == "mutated" || (len(c.Unparsed) > 0 && c.Unparsed[0] == "mutated") {
+					t.Errorf("cookie %s changed through a snapshot", c.Name)
+				}
+			}
+			if v, _ := s.GetLocalStorage(origin, "k"); v == "mutated" {
+				t.Error("localStorage changed through a snapshot")
+			}
+		})
+	}
+}
+
+func TestTrailerSetCookie(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		store bool
+	}{
+		{"rewritten page", "/page", true},
+		{"streamed download", "/archive.zip", true},
+		{"disabled", "/page", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := StoreTrailerCookies
+			StoreTrailerCookies = tt.store
+			t.Cleanup(func() { StoreTrailerCookies = old })
+
+			var gotCookie string
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/check" {
+					gotCookie = r.Header.Get("Cookie")
+					return
+				}
+				w.Header().Set("Trailer", "Set-Cookie")
+				if r.URL.Path == "/archive.zip" {
+					w.Header().Set("Content-Type", "application/zip")
+					w.Write(make([]byte, 64<<10))
+				} else {
+					w.Header().Set("Content-Type", "text/html")
+					io.WriteString(w, `<a href="https://example.com/">x</a>`)
+				}
+				w.Header().Set("Set-Cookie", "late=1; Path=/")
+			})
+			if rec := proxyRequest(t, http.MethodGet, up.URL+tt.path, nil); rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			proxyRequest(t, http.MethodGet, up.URL+"/check", nil)
+			if stored := gotCookie == "late=1"; stored != tt.store {
+				t.Errorf("next request sent Cookie %q, want trailer cookie stored: %v", gotCookie, tt.store)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Content sniffing
+// ---------------------------------------------------------------------------
+
+// SniffContentType makes handleProxy sniff the body of responses whose
+// Content-Type is missing or generic, so an HTML page served without a
+// type is still rewritten.  Only the first 512 bytes are inspected; the
+// body streams or buffers as usual afterwards.
+var SniffContentType = true
+
+// genericContentTypes are declared types that say nothing useful.
+var genericContentTypes = map[string]bool{
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/unknown":      true,
+	"unknown/unknown":          true,
+}
+
+// sniffLen is how much of the body http.DetectContentType considers.
+const sniffLen = 512
+
+// shouldSniff reports whether the response's declared type is missing or
+// generic.
+func shouldSniff(h http.Header) bool {
+	if h.Get("Content-Type") == "" {
+		return true
+	}
+	return genericContentTypes[DetectContentType(h)]
+}
+
+// sniffContentType peeks at the start of resp.Body, which must already be
+// decoded, and returns the full Content-Type to use for it.  resp.Body is
+// replaced by a reader that still yields every byte.
+//
+// The URL's extension is consulted too: a type it names that we rewrite
+// (CSS, JS, HTML) wins over the sniffed one, and a sniffed HTML guess
+// yields to any other type the extension names, since markup-looking
+// JSON or text must not be rewritten as a page.
+func sniffContentType(resp *http.Response, targetURL string) string {
+	br := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+
+	sniffed := http.DetectContentType(head)
+	byExt := extensionContentType(targetURL)
+	if byExt == "" {
+		return sniffed
+	}
+	extMedia, _, _ := mime.ParseMediaType(byExt)
+	sniffedMedia, _, _ := mime.ParseMediaType(sniffed)
+	switch {
+	case Categorize(extMedia) != ContentOther:
+		return byExt
+	case Categorize(sniffedMedia) == ContentHTML && !strings.HasPrefix(extMedia, "application/x-httpd"):
+		return byExt
+	}
+	return sniffed
+}
+
+// extensionContentType returns the type registered for the extension of
+// targetURL's path, or "".
+func extensionContentType(targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	ext := path.Ext(u.Path)
+	if ext == "" {
+		return ""
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSniffTypelessBody(t *testing.T) {
+	const page = `<!DOCTYPE html><html><body><a href="https://example.com/next">next</a></body></html>`
+	tests := []struct {
+		name        string
+		path        string
+		contentType string // "" sends no Content-Type at all
+		gzip        bool
+		body        string
+		sniff       bool
+		rewritten   bool
+		wantType    string
+	}{
+		{"no type", "/page", "", false, page, true, true, "text/html"},
+		{"generic type", "/page", "application/octet-stream", false, page, true, true, "text/html"},
+		{"no type, gzipped", "/page", "", true, page, true, true, "text/html"},
+		{"extension wins over an HTML guess", "/data.json", "", false, page, true, false, "application/json"},
+		{"stylesheet by extension", "/site.css", "", false, `a{background:url("https://example.com/a.png")}`, true, true, "text/css"},
+		{"sniffing off", "/page", "", false, page, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := SniffContentType
+			SniffContentType = tt.sniff
+			t.Cleanup(func() { SniffContentType = old })
+
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType == "" {
+					// Stop net/http from sniffing a type of its own.
+					w.Header()["Content-Type"] = nil
+				} else {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.gzip {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Write(encodeGzip(t, tt.body))
+					return
+				}
+				w.Write([]byte(tt.body))
+			})
+			rec := proxyRequest(t, http.MethodGet, up.URL+tt.path, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "/proxy?url="); got != tt.rewritten {
+				t.Errorf("rewritten = %v, want %v: %q", got, tt.rewritten, body)
+			}
+			if !tt.rewritten && !tt.gzip && body != tt.body {
+				t.Errorf("body = %q, want it untouched", body)
+			}
+			if ct := rec.Header().Get("Content-Type"); tt.wantType != "" && !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ---------------------------------------------------------------------------
+// Storage endpoints
+// ---------------------------------------------------------------------------
+//
+//	GET    /storage/{area}/{origin}        all items as a JSON object
+//	GET    /storage/{area}/{origin}/{key}  one value, text/plain
+//	PUT    /storage/{area}/{origin}/{key}  set the value to the request body
+//	DELETE /storage/{area}/{origin}/{key}  remove one item
+//	DELETE /storage/{area}/{origin}        clear the area
+//
+// {area} is "local" or "session".  {origin} and {key} are percent-encoded
+// path segments, e.g. /storage/local/https%3A%2F%2Fexample.com/a%2Fb.
+// These back the injected storage shim, so they are unauthenticated and
+// only registered when StorageEndpoints is set.  SessionNamespaceHeader
+// applies as it does for /proxy.
+
+// StorageEndpoints enables the /storage routes.  Set before NewMux is
+// called.
+var StorageEndpoints bool
+
+// maxStorageValue caps a stored value, in line with browser quotas.
+const maxStorageValue = 5 << 20
+
+func registerStorage(mux *http.ServeMux) {
+	if !StorageEndpoints {
+		return
+	}
+	mux.HandleFunc("GET /storage/{area}/{origin}", handleStorageList)
+	mux.HandleFunc("DELETE /storage/{area}/{origin}", handleStorageClear)
+	mux.HandleFunc("GET /storage/{area}/{origin}/{key}", handleStorageGet)
+	mux.HandleFunc("PUT /storage/{area}/{origin}/{key}", handleStoragePut)
+	mux.HandleFunc("DELETE /storage/{area}/{origin}/{key}", handleStorageDelete)
+}
+
+// storageTarget resolves the {area} and {origin} path values.
+func storageTarget(w http.ResponseWriter, r *http.Request) (key string, area StorageArea, ok bool) {
+	switch r.PathValue("area") {
+	case "local":
+		area = AreaLocal
+	case "session":
+		area = AreaSession
+	default:
+		http.Error(w, "unknown storage area", http.StatusNotFound)
+		return "", 0, false
+	}
+	_, key, ok = adminSessionKey(w, r)
+	return key, area, ok
+}
+
+func handleStorageList(w http.ResponseWriter, r *http.Request) {
+	key, area, ok := storageTarget(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(DefaultSessions.backend.Items(key, area))
+}
+
+func handleStorageClear(w http.ResponseWriter, r *http.Request) {
+	key, area, ok := storageTarget(w, r)
+	if !ok {
+		return
+	}
+	DefaultSessions.backend.ClearArea(key, area)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleStorageGet(w http.ResponseWriter, r *http.Request) {
+	key, area, ok := storageTarget(w, r)
+	if !ok {
+		return
+	}
+	value, found := DefaultSessions.backend.GetItem(key, area, r.PathValue("key"))
+	if !found {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, value)
+}
+
+func handleStoragePut(w http.ResponseWriter, r *http.Request) {
+	key, area, ok := storageTarget(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStorageValue))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "reading body failed", http.StatusBadRequest)
+		return
+	}
+	DefaultSessions.backend.SetItem(key, area, r.PathValue("key"), string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleStorageDelete(w http.ResponseWriter, r *http.Request) {
+	key, area, ok := storageTarget(w, r)
+	if !ok {
+		return
+	}
+	DefaultSessions.backend.DeleteItem(key, area, r.PathValue("key"))
+	w.WriteHeader(http.StatusNoContent)
+}
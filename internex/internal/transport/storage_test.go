@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStorageEndpoints(t *testing.T) {
+	resetSessions(t)
+	StorageEndpoints = true
+	t.Cleanup(func() { StorageEndpoints = false })
+	mux := NewMux()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	origin := url.PathEscape("https://example.com")
+
+	for _, area := range []string{"local", "session"} {
+		t.Run(area, func(t *testing.T) {
+			base := "/storage/" + area + "/" + origin
+			other := "/storage/local/" + origin
+			if area == "local" {
+				other = "/storage/session/" + origin
+			}
+
+			for key, value := range map[string]string{"theme": "dark", "a/b": "two words"} {
+				if rec := do(http.MethodPut, base+"/"+url.PathEscape(key), value); rec.Code != http.StatusNoContent {
+					t.Fatalf("PUT %s = %d", key, rec.Code)
+				}
+			}
+			if rec := do(http.MethodGet, base+"/theme", ""); rec.Code != http.StatusOK || rec.Body.String() != "dark" {
+				t.Errorf("GET theme = %d %q, want dark", rec.Code, rec.Body)
+			}
+			if rec := do(http.MethodGet, base+"/a%2Fb", ""); rec.Body.String() != "two words" {
+				t.Errorf("GET a/b = %q, want the encoded key's value", rec.Body)
+			}
+			var all map[string]string
+			json.Unmarshal(do(http.MethodGet, base, "").Body.Bytes(), &all)
+			if len(all) != 2 || all["theme"] != "dark" || all["a/b"] != "two words" {
+				t.Errorf("list = %v", all)
+			}
+			if rec := do(http.MethodGet, other+"/theme", ""); rec.Code != http.StatusNotFound {
+				t.Errorf("item visible in the other area: %d %q", rec.Code, rec.Body)
+			}
+
+			if rec := do(http.MethodDelete, base+"/theme", ""); rec.Code != http.StatusNoContent {
+				t.Errorf("DELETE theme = %d", rec.Code)
+			}
+			if rec := do(http.MethodGet, base+"/theme", ""); rec.Code != http.StatusNotFound {
+				t.Errorf("GET deleted item = %d, want 404", rec.Code)
+			}
+			if rec := do(http.MethodDelete, base, ""); rec.Code != http.StatusNoContent {
+				t.Errorf("DELETE area = %d", rec.Code)
+			}
+			if body := strings.TrimSpace(do(http.MethodGet, base, "").Body.String()); body != "{}" {
+				t.Errorf("list after clear = %s, want {}", body)
+			}
+		})
+	}
+
+	t.Run("unknown area", func(t *testing.T) {
+		if rec := do(http.MethodGet, "/storage/cookies/"+origin, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", rec.Code)
+		}
+	})
+	t.Run("value too large", func(t *testing.T) {
+		rec := do(http.MethodPut, "/storage/local/"+origin+"/big", strings.Repeat("x", maxStorageValue+1))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", rec.Code)
+		}
+	})
+}
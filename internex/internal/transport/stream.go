@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Streaming pass-through
+// ---------------------------------------------------------------------------
+//
+// A streamed body that the upstream cuts off mid-way would otherwise end
+// with a clean terminator, indistinguishable from a complete response.
+// Read-side failures are logged and signalled to the client: event
+// streams get a final "error" event, everything else is aborted so the
+// client sees an incomplete response rather than a truncated success.
+
+// AbortOnUpstreamReset aborts the client response when the upstream body
+// fails mid-stream.  When false the truncation is only logged.
+var AbortOnUpstreamReset = true
+
+// sseErrorEvent is sent to event-stream clients when the upstream fails.
+const sseErrorEvent = "event: error\ndata: upstream connection lost\n\n"
+
+// readErrReader records the error from the read side of a copy, so
+// upstream failures can be told apart from client write failures.
+type readErrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *readErrReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// streamBody copies body to w.  On an upstream read error it logs the
+// truncation and signals the client as described above.  It may panic
+// with http.ErrAbortHandler, which net/http handles by resetting the
+// client connection.
+func streamBody(w http.ResponseWriter, body io.Reader, targetURL, contentType string) {
+	if contentType == "text/event-stream" {
+		liftDeadlines(w)
+	}
+	src := &readErrReader{r: body}
+	n, _ := io.Copy(w, src)
+	if src.err == nil || errors.Is(src.err, http.ErrBodyReadAfterClose) {
+		return
+	}
+
+	getLogger().Error("upstream stream truncated", "url", targetURL, "bytes", n, "err", src.err)
+	if contentType == "text/event-stream" {
+		io.WriteString(w, sseErrorEvent)
+		http.NewResponseController(w).Flush()
+		return
+	}
+	if AbortOnUpstreamReset {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// liftDeadlines clears the server's read and write deadlines for a
+// long-lived response (event streams, WebSocket bridges), which
+// http.Server's ReadTimeout/WriteTimeout would otherwise cut off.
+func liftDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
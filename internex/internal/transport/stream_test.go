@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamResetMidStream(t *testing.T) {
+	const partial = "data: one\n\n"
+	tests := []struct {
+		name        string
+		contentType string
+		abort       bool // AbortOnUpstreamReset
+		wantErr     bool // the client sees a failed response
+		wantBody    string
+	}{
+		{"download aborted", "application/zip", true, true, ""},
+		{"download truncated when not aborting", "application/zip", false, false, partial},
+		{"event stream gets an error event", "text/event-stream", true, false, partial + sseErrorEvent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			old := AbortOnUpstreamReset
+			AbortOnUpstreamReset = tt.abort
+			t.Cleanup(func() { AbortOnUpstreamReset = old })
+
+			up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				conn, brw, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(brw, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n",
+					tt.contentType, len(partial), partial)
+				brw.Flush()
+				// Reset rather than close, with the body unfinished.
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			})
+			proxy := httptest.NewServer(NewMux())
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + EncodeProxyPath(up.URL+"/stream"))
+			if err == nil {
+				var b []byte
+				b, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil && string(b) != tt.wantBody {
+					t.Errorf("body = %q, want %q", b, tt.wantBody)
+				}
+			}
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("client error = %v, want failure %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ---------------------------------------------------------------------------
+// Upstream TLS configuration
+// ---------------------------------------------------------------------------
+
+// UpstreamTLSOptions describes how the proxy authenticates upstream TLS
+// servers and itself to them.
+type UpstreamTLSOptions struct {
+	// InsecureSkipVerify disables certificate verification.  Only for
+	// internal upstreams with self-signed certificates.
+	InsecureSkipVerify bool
+	// ClientCertFile and ClientKeyFile are a PEM key pair presented to
+	// upstreams that require mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+	// CABundleFile is a PEM file of extra root CAs trusted in addition to
+	// the system pool.
+	CABundleFile string
+}
+
+// BuildTLSConfig turns opts into a *tls.Config suitable for SetTLSConfig.
+func BuildTLSConfig(opts UpstreamTLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CABundleFile != "" {
+		pem, err := os.ReadFile(opts.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no certificates", opts.CABundleFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// SetTLSConfig replaces the TLS configuration used for every upstream
+// connection, including WebSocket upgrades.  A nil cfg restores the
+// default.  Call it during startup, before the server accepts requests.
+func SetTLSConfig(cfg *tls.Config) {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg = cfg.Clone()
+	if len(cfg.NextProtos) == 0 {
+		// The transport adds h2 to its config only on first use; keep it
+		// once that has happened.
+		cfg.NextProtos = streamTransport.TLSClientConfig.NextProtos
+	}
+	streamTransport.TLSClientConfig = cfg
+	streamTransport.CloseIdleConnections()
+}
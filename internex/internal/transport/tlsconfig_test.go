@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamTLSVerification(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	t.Cleanup(up.Close)
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: up.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   *UpstreamTLSOptions // nil keeps the default config
+		status int
+	}{
+		{"default rejects a self-signed upstream", nil, http.StatusBadGateway},
+		{"skip verify", &UpstreamTLSOptions{InsecureSkipVerify: true}, http.StatusOK},
+		{"CA bundle", &UpstreamTLSOptions{CABundleFile: bundle}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSessions(t)
+			SetTLSConfig(nil)
+			t.Cleanup(func() { SetTLSConfig(nil) })
+			if tt.opts != nil {
+				cfg, err := BuildTLSConfig(*tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				SetTLSConfig(cfg)
+			}
+			rec := proxyRequest(t, http.MethodGet, up.URL+"/", nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != "secure" {
+				t.Errorf("body = %q", rec.Body)
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+	tests := []struct {
+		name string
+		opts UpstreamTLSOptions
+	}{
+		{"cert without key", UpstreamTLSOptions{ClientCertFile: "client.pem"}},
+		{"missing key pair", UpstreamTLSOptions{ClientCertFile: filepath.Join(dir, "c.pem"), ClientKeyFile: filepath.Join(dir, "k.pem")}},
+		{"missing CA bundle", UpstreamTLSOptions{CABundleFile: filepath.Join(dir, "none.pem")}},
+		{"CA bundle without certificates", UpstreamTLSOptions{CABundleFile: empty}},
+	}
+	for _, tt := range tests {
+		if _, err := BuildTLSConfig(tt.opts); err == nil {
+			t.Errorf("%s: BuildTLSConfig succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ---------------------------------------------------------------------------
+// Upstream WebSocket dialing
+// ---------------------------------------------------------------------------
+//
+// WebSocket handshakes are sent over a connection dialed here rather than
+// through streamTransport, so the bridge always holds the raw (possibly
+// TLS) net.Conn regardless of how the transport wraps its connections.
+// TLS settings and the egress proxy are shared with streamTransport: the
+// connection is tunnelled with CONNECT through http and https proxies or
+// dialed through SOCKS5 ones, and always speaks HTTP/1.1.
+
+// wsHandshakeTimeout bounds dialing, TLS and the upgrade exchange.
+const wsHandshakeTimeout = 30 * time.Second
+
+// wsConn is the body of a 101 response: the upstream connection, read
+// through the buffered reader the handshake response was parsed from.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// closeConnBody closes the upstream connection along with a non-101
+// response body.
+type closeConnBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closeConnBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// dialWebSocket sends the upgrade request req (with an http or https URL)
+// over a freshly dialed connection and reads the handshake response.  On
+// 101 the response body is the raw connection.
+func dialWebSocket(req *http.Request) (*http.Response, error) {
+	proxyURL, err := egressProxy(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), wsHandshakeTimeout)
+	defer cancel()
+
+	addr := hostPort(req.URL)
+	conn, err := dialTunnel(ctx, addr, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if req.URL.Scheme == "https" {
+		cfg := streamTransport.TLSClientConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = req.URL.Hostname()
+		}
+		// The upgrade handshake only exists in HTTP/1.1.
+		cfg.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("websocket TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing websocket handshake: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading websocket handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &wsConn{Conn: conn, r: br}
+	} else {
+		resp.Body = &closeConnBody{ReadCloser: resp.Body, conn: conn}
+	}
+	return resp, nil
+}
+
+// dialTunnel connects to addr, directly, through a SOCKS5 proxy, or
+// through an HTTP CONNECT proxy reached over plain TCP or TLS.
+func dialTunnel(ctx context.Context, addr string, proxyURL *url.URL) (net.Conn, error) {
+	if proxyURL == nil {
+		return dialUpstream(ctx, "tcp", addr)
+	}
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		return dialSOCKS(ctx, addr, proxyURL)
+	}
+
+	conn, err := dialUpstream(ctx, "tcp", hostPort(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		cfg := streamTransport.TLSClientConfig.Clone()
+		cfg.ServerName = proxyURL.Hostname()
+		cfg.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("egress proxy TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing CONNECT: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy refused CONNECT: %s", resp.Status)
+	}
+	return conn, nil
+}
+
+// upstreamContextDialer adapts dialUpstream to proxy.ContextDialer, so SOCKS
+// proxies are reached the way streamTransport reaches them.
+type upstreamContextDialer struct{}
+
+func (upstreamContextDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialUpstream(context.Background(), network, addr)
+}
+
+func (upstreamContextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialUpstream(ctx, network, addr)
+}
+
+// dialSOCKS connects to addr through the SOCKS5 proxy at proxyURL, which
+// resolves addr itself.
+func dialSOCKS(ctx context.Context, addr string, proxyURL *url.URL) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth = &proxy.Auth{User: u.Username(), Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", hostPort(proxyURL), auth, upstreamContextDialer{})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("egress SOCKS proxy: %w", err)
+	}
+	return conn, nil
+}
+
+// hostPort returns u's host with its scheme's default port filled in.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,422 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// socksServer starts a minimal no-auth SOCKS5 server and returns its
+// address and the number of CONNECTs it has relayed.
+func socksServer(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var connects atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				hdr := make([]byte, 2)
+				if _, err := io.ReadFull(br, hdr); err != nil {
+					return
+				}
+				io.ReadFull(br, make([]byte, hdr[1]))
+				c.Write([]byte{5, 0})
+
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(br, req); err != nil || req[1] != 1 {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(br, ip)
+					host = net.IP(ip).String()
+				case 3:
+					n, _ := br.ReadByte()
+					name := make([]byte, n)
+					io.ReadFull(br, name)
+					host = string(name)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				io.ReadFull(br, port)
+				up, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+				if err != nil {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer up.Close()
+				connects.Add(1)
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(up, br)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &connects
+}
+
+// wsEcho is a WebSocket upstream that completes the handshake, accepting
+// the first subprotocol offered, and then echoes raw bytes back.
+func wsEcho(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	if offered := r.Header.Get("Sec-WebSocket-Protocol"); offered != "" {
+		first, _, _ := strings.Cut(offered, ",")
+		brw.WriteString("Sec-WebSocket-Protocol: " + strings.TrimSpace(first) + "\r\n")
+	}
+	brw.WriteString("\r\n")
+	brw.Flush()
+	io.Copy(conn, brw)
+}
+
+// openBridge upgrades a WebSocket to target through the proxy at
+// proxyAddr, with header added to the handshake, checks that a wsEcho
+// upstream echoes through it and returns the client side of the bridge
+// and the handshake response.
+func openBridge(t *testing.T, proxyAddr, target string, header http.Header) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+proxyAddr+EncodeProxyPath(target), nil)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status = %d", resp.StatusCode)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+	return conn, resp
+}
+
+func TestDialWebSocketThroughSOCKS(t *testing.T) {
+	var proto atomic.Value
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	up.EnableHTTP2 = true
+	up.StartTLS()
+	t.Cleanup(up.Close)
+
+	oldTLS := streamTransport.TLSClientConfig
+	streamTransport.TLSClientConfig = up.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	t.Cleanup(func() { streamTransport.TLSClientConfig = oldTLS })
+
+	addr, connects := socksServer(t)
+	if err := SetEgressProxy("socks5://" + addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetEgressProxy("") })
+
+	req, _ := http.NewRequest(http.MethodGet, up.URL+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	resp, err := dialWebSocket(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := proto.Load(); got != "HTTP/1.1" {
+		t.Errorf("upstream saw %v, want HTTP/1.1", got)
+	}
+	if connects.Load() != 1 {
+		t.Errorf("SOCKS CONNECTs = %d, want 1", connects.Load())
+	}
+	conn, ok := resp.Body.(*wsConn)
+	if !ok {
+		t.Fatalf("101 body is %T, not the dialed connection", resp.Body)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestWebSocketCapPerClient(t *testing.T) {
+	resetSessions(t)
+	SetMaxWebSockets(2)
+	t.Cleanup(func() { SetMaxWebSockets(0) })
+	// Clients behind the loopback proxy are told apart by X-Forwarded-For.
+	if err := SetTrustedProxies([]string{"127.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		brw.Flush()
+		io.Copy(io.Discard, brw)
+	})
+	srv := httptest.NewServer(NewMux())
+	t.Cleanup(srv.Close)
+
+	// open upgrades a socket with header and leaves it open.
+	open := func(header http.Header) int {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+EncodeProxyPath(up.URL+"/ws"), nil)
+		req.Header = header.Clone()
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, clientSessions := range []bool{false, true} {
+		t.Run("client sessions "+strconv.FormatBool(clientSessions), func(t *testing.T) {
+			ClientSessions = clientSessions
+			t.Cleanup(func() { ClientSessions = false })
+			client := func(name, ip string) http.Header {
+				h := http.Header{"X-Forwarded-For": {ip}}
+				if clientSessions {
+					h.Set("Cookie", ClientTokenCookie+"="+name)
+				}
+				return h
+			}
+			alice := client("alice", "203.0.113.1")
+			bob := client("bob", "203.0.113.2")
+			tests := []struct {
+				client http.Header
+				want   int
+			}{
+				{alice, http.StatusSwitchingProtocols},
+				{alice, http.StatusSwitchingProtocols},
+				{alice, http.StatusServiceUnavailable},
+				{bob, http.StatusSwitchingProtocols},
+			}
+			for i, tt := range tests {
+				if got := open(tt.client); got != tt.want {
+					t.Errorf("socket %d: status = %d, want %d", i+1, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketSchemes(t *testing.T) {
+	resetSessions(t)
+	var overTLS atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		overTLS.Store(r.TLS != nil)
+		wsEcho(w, r)
+	})
+	plain := httptest.NewServer(handler)
+	t.Cleanup(plain.Close)
+	secure := httptest.NewTLSServer(handler)
+	t.Cleanup(secure.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(secure.Certificate())
+	SetTLSConfig(&tls.Config{RootCAs: pool})
+	t.Cleanup(func() { SetTLSConfig(nil) })
+
+	proxy := httptest.NewServer(NewMux())
+	t.Cleanup(proxy.Close)
+
+	tests := []struct {
+		name    string
+		target  string
+		wantTLS bool
+	}{
+		{"ws", "ws://" + plain.Listener.Addr().String() + "/chat", false},
+		{"wss", "wss://" + secure.Listener.Addr().String() + "/chat", true},
+		{"https target upgraded", secure.URL + "/chat", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := openBridge(t, proxy.Listener.Addr().String(), tt.target, nil)
+			defer conn.Close()
+			if overTLS.Load() != tt.wantTLS {
+				t.Errorf("upstream over TLS = %v, want %v", overTLS.Load(), tt.wantTLS)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandshakeHeaders(t *testing.T) {
+	resetSessions(t)
+	type seen struct{ origin, protocol string }
+	got := make(chan seen, 1)
+	up, _ := countingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.Header.Get("Origin"), r.Header.Get("Sec-WebSocket-Protocol")}
+		wsEcho(w, r)
+	})
+	proxy := httptest.NewServer(NewMux())
+	t.Cleanup(proxy.Close)
+	page := ProxyOrigin + EncodeProxyPath("https://app.example.com/room")
+
+	tests := []struct {
+		name       string
+		policy     OriginMode
+		header     http.Header
+		wantOrigin string
+	}{
+		{"origin of the proxied page", OriginUpstream,
+			http.Header{"Origin": {ProxyOrigin}, "Referer": {page}}, "https://app.example.com"},
+		{"target origin without a referer", OriginUpstream,
+			http.Header{"Origin": {ProxyOrigin}}, up.URL},
+		{"proxy origin preserved", OriginPreserveProxy,
+			http.Header{"Origin": {ProxyOrigin}, "Referer": {page}}, ProxyOrigin},
+		{"origin stripped", OriginStrip,
+			http.Header{"Origin": {ProxyOrigin}, "Referer": {page}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := OriginPolicy
+			OriginPolicy = tt.policy
+			t.Cleanup(func() { OriginPolicy = old })
+
+			header := tt.header.Clone()
+			header.Set("Sec-WebSocket-Protocol", "chat.v2, chat.v1")
+			conn, resp := openBridge(t, proxy.Listener.Addr().String(), up.URL+"/ws", header)
+			defer conn.Close()
+
+			s := <-got
+			if s.origin != tt.wantOrigin {
+				t.Errorf("upstream Origin = %q, want %q", s.origin, tt.wantOrigin)
+			}
+			if s.protocol != "chat.v2, chat.v1" {
+				t.Errorf("upstream Sec-WebSocket-Protocol = %q", s.protocol)
+			}
+			if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "chat.v2" {
+				t.Errorf("client got Sec-WebSocket-Protocol %q, want chat.v2", p)
+			}
+		})
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// The example handshake from RFC 6455 §1.3.
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %q, want s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", got)
+	}
+
+	resetSessions(t)
+	badAccept := func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept("some other key") + "\r\n\r\n")
+		brw.Flush()
+		io.Copy(io.Discard, brw)
+	}
+	good, _ := countingUpstream(t, wsEcho)
+	bad, _ := countingUpstream(t, badAccept)
+	proxy := httptest.NewServer(NewMux())
+	t.Cleanup(proxy.Close)
+	addr := proxy.Listener.Addr().String()
+
+	conn, resp := openBridge(t, addr, good.URL+"/ws", nil)
+	conn.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("relayed Sec-WebSocket-Accept = %q", got)
+	}
+
+	for _, strict := range []bool{false, true} {
+		old := StrictWebSocketAccept
+		StrictWebSocketAccept = strict
+		t.Cleanup(func() { StrictWebSocketAccept = old })
+
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+EncodeProxyPath(bad.URL+"/ws"), nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Write(c)
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := http.StatusSwitchingProtocols
+		if strict {
+			want = http.StatusBadGateway
+		}
+		if resp.StatusCode != want {
+			t.Errorf("strict %v: mismatched accept gave %d, want %d", strict, resp.StatusCode, want)
+		}
+	}
+}
@@ -77,8 +77,12 @@ fn rewrite_token_stream(
                 out.push(')');
             }
 
-            Token::Function(ref name) if name.eq_ignore_ascii_case("image-set") => {
-                out.push_str("image-set(");
+            Token::Function(ref name)
+                if name.eq_ignore_ascii_case("image-set")
+                    || name.eq_ignore_ascii_case("-webkit-image-set") =>
+            {
+                out.push_str(name.as_ref());
+                out.push('(');
                 rewrite_function_args(parser, proxy, base, out, true);
                 out.push(')');
             }
@@ -321,6 +325,31 @@ mod tests {
         assert!(result.contains("/proxy?url="));
     }
 
+    #[test]
+    fn rewrites_mixed_scheme_urls() {
+        let css = r#"a { background: url(http://insecure.example.com/a.png); } b { background: url("https://secure.example.com/b.png"); }"#;
+        let result = rewrite_css(PROXY, BASE, css);
+        assert!(result.contains("/proxy?url=http://insecure.example.com/a.png"));
+        assert!(result.contains("/proxy?url=https://secure.example.com/b.png"));
+    }
+
+    #[test]
+    fn rewrites_unquoted_import_url_against_base() {
+        let css = "@import url(reset.css) screen;";
+        let result = rewrite_css(PROXY, BASE, css);
+        assert!(result.contains("/proxy?url=https://example.com/style/reset.css"));
+        assert!(result.contains("screen"));
+    }
+
+    #[test]
+    fn rewrites_every_background_layer() {
+        let css = r#"div { background: url(a.png), url("../b.png") no-repeat, -webkit-image-set("c.png" 1x); }"#;
+        let result = rewrite_css(PROXY, BASE, css);
+        assert!(result.contains("/proxy?url=https://example.com/style/a.png"));
+        assert!(result.contains("/proxy?url=https://example.com/b.png"));
+        assert!(result.contains("/proxy?url=https://example.com/style/c.png"));
+    }
+
     #[test]
     fn preserves_data_urls() {
         let css = r#"body { background: url(data:image/png;base64,abc); }"#;
@@ -11,8 +11,11 @@ use html5ever::serialize::{serialize, SerializeOpts};
 use markup5ever::{ns, namespace_url};
 use serde_json;
 
-use crate::url::encode_url_with_base;
+use crate::url::{encode_form_url, encode_url, encode_url_with_base};
 use crate::css::rewrite_css_string;
+use crate::csp::rewrite_csp;
+use crate::js::{rewrite_inline_js, rewrite_location_assignments};
+use crate::RewriteOptions;
 
 // ---------------------------------------------------------------------------
 // Public entry point
@@ -24,14 +27,36 @@ use crate::css::rewrite_css_string;
 /// * `base_url`     – the original page URL (for resolving relative paths)
 /// * `html`         – raw HTML source
 pub fn rewrite_html(proxy_origin: &str, base_url: &str, html: &str) -> String {
+    rewrite_html_with_options(proxy_origin, base_url, html, &RewriteOptions::default())
+}
+
+/// Like `rewrite_html`, honoring the optional knobs in `opts`.
+pub fn rewrite_html_with_options(
+    proxy_origin: &str,
+    base_url: &str,
+    html: &str,
+    opts: &RewriteOptions,
+) -> String {
     let doc = parse_html().one(html);
 
     // Determine <base href> if present – it overrides the page URL for
     // relative resolution.
-    let effective_base = find_base_href(&doc).unwrap_or_else(|| base_url.to_string());
+    let page_base = find_base_href(&doc, base_url);
+    let has_base = page_base.is_some();
+    let effective_base = page_base.unwrap_or_else(|| base_url.to_string());
 
-    walk(&doc, proxy_origin, &effective_base);
-    inject_client_script(&doc, proxy_origin, &effective_base);
+    // Checked before attribute rewriting changes the src.
+    let runtime_src = runtime_src(proxy_origin, &opts.runtime_path);
+    let has_runtime = loads_script(&doc, &runtime_src);
+
+    rewrite_meta_csp(&doc, proxy_origin, base_url, opts);
+    walk(&doc, proxy_origin, &effective_base, opts);
+    if !opts.omit_runtime && !has_runtime {
+        inject_client_script(&doc, &runtime_src, &effective_base, opts.disable_service_workers);
+    }
+    if opts.inject_base && !has_base {
+        inject_base_tag(&doc, proxy_origin, &effective_base);
+    }
 
     let mut buf = Vec::new();
     serialize(
@@ -52,27 +77,55 @@ pub fn rewrite_html(proxy_origin: &str, base_url: &str, html: &str) -> String {
 // DOM walker
 // ---------------------------------------------------------------------------
 
-fn walk(node: &NodeRef, proxy: &str, base: &str) {
+fn walk(node: &NodeRef, proxy: &str, base: &str, opts: &RewriteOptions) {
     if let NodeData::Element(ref el) = *node.data() {
         let tag = el.name.local.to_string().to_ascii_lowercase();
         let mut attrs = el.attributes.borrow_mut();
 
         // ---- URL attributes ----
-        rewrite_url_attrs(&tag, &mut attrs, proxy, base);
+        let get_form = get_form_target(node, &tag, &attrs, base);
+        let rewritten_url = rewrite_url_attrs(&tag, &mut attrs, proxy, base);
+        if let Some((attr, target)) = get_form {
+            if let Some(url) = encode_form_url(proxy, &target) {
+                attrs.set(attr, url);
+            }
+        }
+
+        // ---- Subresource Integrity ----
+        // The proxied resource may be rewritten, so its hash no longer
+        // matches; and it is now same-origin, so crossorigin is moot.
+        if rewritten_url && !opts.keep_integrity && attrs.get("integrity").is_some() {
+            attrs.remove_attr("integrity");
+            attrs.remove_attr("crossorigin");
+        }
 
         // ---- srcset / imagesrcset ----
         rewrite_srcset_attr(&mut attrs, "srcset", proxy, base);
         rewrite_srcset_attr(&mut attrs, "imagesrcset", proxy, base);
 
+        // ---- <iframe srcdoc> ----
+        // The attribute value is already unescaped by the parser and is
+        // re-escaped on serialization.  An about:srcdoc document resolves
+        // URLs against its parent's base, so the same base applies.
+        if tag == "iframe" {
+            if let Some(doc) = attrs.get("srcdoc").map(|s| s.to_string()) {
+                if !doc.trim().is_empty() {
+                    attrs.set("srcdoc", rewrite_html_with_options(proxy, base, &doc, opts));
+                }
+            }
+        }
+
         // ---- <meta http-equiv="refresh"> ----
         if tag == "meta" {
             rewrite_meta_refresh(&mut attrs, proxy, base);
         }
 
         // ---- Inline styles ----
-        if let Some(style) = attrs.get("style").map(|s| s.to_string()) {
-            let rewritten = rewrite_css_string(proxy, base, &style);
-            attrs.set("style", rewritten);
+        if opts.rewrite_inline_styles {
+            if let Some(style) = attrs.get("style").map(|s| s.to_string()) {
+                let rewritten = rewrite_css_string(proxy, base, &style);
+                attrs.set("style", rewritten);
+            }
         }
 
         // ---- Inline event handlers ----
@@ -81,22 +134,31 @@ fn walk(node: &NodeRef, proxy: &str, base: &str) {
         // ---- SVG attributes ----
         rewrite_svg_attrs(&tag, &mut attrs, proxy, base);
 
+        let is_importmap = tag == "script"
+            && attrs
+                .get("type")
+                .map_or(false, |t| t.trim().eq_ignore_ascii_case("importmap"));
+
         // ---- <style> element: rewrite the text content ----
         drop(attrs); // release borrow
-        if tag == "style" {
+        if tag == "style" && opts.rewrite_inline_styles {
             rewrite_inline_style_element(node, proxy, base);
         }
 
-        // ---- <script>: wrap dangerous sinks ----
-        if tag == "script" {
-            rewrite_inline_script(node, proxy, base);
+        // ---- <script type="importmap">: rewrite the mapped URLs ----
+        // Import maps are JSON, not script, so they are never wrapped.
+        if is_importmap {
+            rewrite_import_map_element(node, proxy, base);
+        } else if tag == "script" && opts.inline_js {
+            // ---- <script>: wrap dangerous sinks ----
+            rewrite_inline_script(node, proxy, base, opts);
         }
     }
 
     // Recurse into children (handles <template> content automatically
     // because kuchikiki exposes template contents as children).
     for child in node.children() {
-        walk(&child, proxy, base);
+        walk(&child, proxy, base, opts);
     }
 }
 
@@ -111,16 +173,67 @@ const URL_ATTRS: &[&str] = &[
     "codebase", "classid",
 ];
 
+/// The attribute and absolute target of an element that submits a form
+/// with GET: a `<form>` (its `action`, or the page itself when there is
+/// none) or a submit control with its own `formaction`.  Such targets use
+/// the `/f/` route; see `encode_form_url`.  POST submissions keep the
+/// query string, so the plain `/proxy?url=` rewrite serves them.
+fn get_form_target(
+    node: &NodeRef,
+    tag: &str,
+    attrs: &kuchikiki::Attributes,
+    base: &str,
+) -> Option<(&'static str, String)> {
+    let (attr, method) = match tag {
+        "form" => ("action", attrs.get("method").map(str::to_string)),
+        "button" | "input" if attrs.get("formaction").is_some() => {
+            let method = attrs.get("formmethod").map(str::to_string).or_else(|| {
+                node.ancestors().find_map(|a| {
+                    let el = a.as_element()?;
+                    if el.name.local.as_ref().eq_ignore_ascii_case("form") {
+                        Some(el.attributes.borrow().get("method").unwrap_or("").to_string())
+                    } else {
+                        None
+                    }
+                })
+            });
+            ("formaction", method)
+        }
+        _ => return None,
+    };
+    let method = method.unwrap_or_default().trim().to_ascii_lowercase();
+    if method == "post" || method == "dialog" {
+        return None;
+    }
+    let raw = attrs.get(attr).unwrap_or("").trim();
+    if strip_javascript_scheme(raw).is_some() {
+        return None;
+    }
+    // An empty or missing action submits to the page itself.
+    let target = ::url::Url::parse(base).ok()?.join(raw).ok()?;
+    Some((attr, target.to_string()))
+}
+
+/// Rewrite the URL attributes of one element, reporting whether any was
+/// routed through the proxy.
 fn rewrite_url_attrs(
     tag: &str,
     attrs: &mut kuchikiki::Attributes,
     proxy: &str,
     base: &str,
-) {
+) -> bool {
+    let mut rewritten = false;
     for &attr in URL_ATTRS {
         if let Some(val) = attrs.get(attr).map(|s| s.to_string()) {
+            // javascript: URLs are not fetched, but the code they run can
+            // navigate or fetch – rewrite the URLs inside it instead.
+            if let Some(code) = strip_javascript_scheme(&val) {
+                attrs.set(attr, format!("javascript:{}", rewrite_inline_js(proxy, base, code)));
+                continue;
+            }
             if let Some(encoded) = encode_url_with_base(proxy, base, &val) {
                 attrs.set(attr, encoded);
+                rewritten = true;
             }
         }
     }
@@ -129,6 +242,18 @@ fn rewrite_url_attrs(
     // above, but <link rel="icon"> etc. also use href – all handled.
 
     // <object> and <embed> also may have "type" – no rewriting needed there.
+    rewritten
+}
+
+/// Return the code part of a `javascript:` URL (scheme matched
+/// case-insensitively, surrounding whitespace ignored).
+fn strip_javascript_scheme(val: &str) -> Option<&str> {
+    let trimmed = val.trim_start();
+    if trimmed.len() >= 11 && trimmed[..11].eq_ignore_ascii_case("javascript:") {
+        Some(&trimmed[11..])
+    } else {
+        None
+    }
 }
 
 // ---------------------------------------------------------------------------
@@ -197,6 +322,116 @@ fn rewrite_meta_refresh(
     }
 }
 
+// ---------------------------------------------------------------------------
+// <meta http-equiv="Content-Security-Policy" content="…">
+// ---------------------------------------------------------------------------
+
+/// http-equiv values that carry a policy.  Browsers only honor the first
+/// in a meta tag; the others are treated like the equivalent headers.
+const META_CSP: &[&str] = &[
+    "content-security-policy",
+    "content-security-policy-report-only",
+    "x-content-security-policy",
+];
+
+fn is_meta_csp(attrs: &kuchikiki::Attributes) -> bool {
+    attrs
+        .get("http-equiv")
+        .map_or(false, |v| META_CSP.iter().any(|n| v.trim().eq_ignore_ascii_case(n)))
+}
+
+/// Treat policy meta tags like the CSP response header: remove them, or
+/// with `opts.rewrite_meta_csp` rewrite each policy to admit the proxy.
+/// Every tag is handled, as browsers enforce all of them.
+///
+/// The parser runs with scripting enabled, so `<noscript>` content is raw
+/// text; policy tags in it are removed textually in either mode.
+fn rewrite_meta_csp(doc: &NodeRef, proxy: &str, base: &str, opts: &RewriteOptions) {
+    let upstream = ::url::Url::parse(base)
+        .map(|u| u.origin().ascii_serialization())
+        .unwrap_or_default();
+    let mut remove = Vec::new();
+    for node in doc.descendants() {
+        let el = match node.as_element() {
+            Some(el) => el,
+            None => continue,
+        };
+        match &*el.name.local {
+            "meta" => {
+                let mut attrs = el.attributes.borrow_mut();
+                if !is_meta_csp(&attrs) {
+                    continue;
+                }
+                if !opts.rewrite_meta_csp {
+                    remove.push(node.clone());
+                } else if let Some(policy) = attrs.get("content").map(|s| s.to_string()) {
+                    attrs.set("content", rewrite_csp(proxy, &upstream, &policy));
+                }
+            }
+            "noscript" => {
+                for child in node.children() {
+                    if let Some(text) = child.as_text() {
+                        let stripped = strip_meta_csp_markup(&text.borrow());
+                        *text.borrow_mut() = stripped;
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+    for node in remove {
+        node.detach();
+    }
+}
+
+/// Remove policy `<meta>` tags from raw markup.
+fn strip_meta_csp_markup(text: &str) -> String {
+    // ASCII lowercasing keeps byte offsets identical.
+    let lower = text.to_ascii_lowercase();
+    let mut out = String::with_capacity(text.len());
+    let mut pos = 0;
+    while let Some(i) = lower[pos..].find("<meta") {
+        let start = pos + i;
+        let end = match lower[start..].find('>') {
+            Some(j) => start + j + 1,
+            None => break,
+        };
+        out.push_str(&text[pos..start]);
+        if !markup_is_meta_csp(&lower[start..end]) {
+            out.push_str(&text[start..end]);
+        }
+        pos = end;
+    }
+    out.push_str(&text[pos..]);
+    out
+}
+
+/// Whether a lowercased `<meta …>` tag declares a policy.
+fn markup_is_meta_csp(tag: &str) -> bool {
+    // Reject <metadata> and the like.
+    match tag.as_bytes().get(5) {
+        Some(b) if b.is_ascii_whitespace() || *b == b'/' => {}
+        _ => return false,
+    }
+    let i = match tag.find("http-equiv") {
+        Some(i) => i,
+        None => return false,
+    };
+    let rest = tag[i + "http-equiv".len()..].trim_start();
+    let rest = match rest.strip_prefix('=') {
+        Some(r) => r.trim_start(),
+        None => return false,
+    };
+    let value = match rest.chars().next() {
+        Some(q @ ('"' | '\'')) => rest[1..].split(q).next().unwrap_or(""),
+        _ => rest
+            .split(|c: char| c.is_ascii_whitespace() || c == '>' || c == '/')
+            .next()
+            .unwrap_or(""),
+    };
+    META_CSP.contains(&value.trim())
+}
+
 // ---------------------------------------------------------------------------
 // Inline event handlers  (onclick, onerror, onload, …)
 // ---------------------------------------------------------------------------
@@ -221,16 +456,17 @@ const EVENT_ATTRS: &[&str] = &[
 fn rewrite_event_handlers(
     attrs: &mut kuchikiki::Attributes,
     proxy: &str,
-    _base: &str,
+    base: &str,
 ) {
     for &attr in EVENT_ATTRS {
         if let Some(val) = attrs.get(attr).map(|s| s.to_string()) {
-            // Wrap the handler body so that runtime URL references go
-            // through our client-side hook.  A lightweight approach:
-            // prefix with a scope setter.
+            // Route literal URLs in the handler through the proxy, then
+            // wrap the body so that runtime URL references go through our
+            // client-side hook.
+            let body = rewrite_inline_js(proxy, base, &val);
             let wrapped = format!(
                 "__internex.scope(this,function(){{ {} }}).call(this,event)",
-                val,
+                body,
             );
             attrs.set(attr, wrapped);
         }
@@ -315,7 +551,7 @@ fn rewrite_inline_style_element(node: &NodeRef, proxy: &str, base: &str) {
 // <script> inline: wrap dangerous sinks
 // ---------------------------------------------------------------------------
 
-fn rewrite_inline_script(node: &NodeRef, proxy: &str, _base: &str) {
+fn rewrite_inline_script(node: &NodeRef, proxy: &str, _base: &str, opts: &RewriteOptions) {
     let mut text_content = String::new();
     for child in node.children() {
         if let NodeData::Text(ref t) = *child.data() {
@@ -325,6 +561,9 @@ fn rewrite_inline_script(node: &NodeRef, proxy: &str, _base: &str) {
     if text_content.is_empty() {
         return;
     }
+    if opts.rewrite_location {
+        text_content = rewrite_location_assignments(&text_content);
+    }
 
     // Wrap the script body in our runtime scope so that dynamic DOM
     // manipulation APIs (innerHTML, document.write, etc.) are intercepted
@@ -345,17 +584,130 @@ fn rewrite_inline_script(node: &NodeRef, proxy: &str, _base: &str) {
     node.append(NodeRef::new_text(&wrapped));
 }
 
+// ---------------------------------------------------------------------------
+// Import maps
+// ---------------------------------------------------------------------------
+
+fn rewrite_import_map_element(node: &NodeRef, proxy: &str, base: &str) {
+    let mut text_content = String::new();
+    for child in node.children() {
+        if let NodeData::Text(ref t) = *child.data() {
+            text_content.push_str(&t.borrow());
+        }
+    }
+    // An invalid map is left untouched; the browser reports it.
+    let rewritten = match rewrite_import_map(proxy, base, &text_content) {
+        Some(json) => json,
+        None => return,
+    };
+    for child in node.children() {
+        child.detach();
+    }
+    node.append(NodeRef::new_text(&rewritten));
+}
+
+/// Rewrite an import map so every module URL it names goes through the
+/// proxy.  The browser matches specifiers against the URLs it actually
+/// loads, which are proxied, so URL-like keys are rewritten as well as
+/// the mapped values:
+///
+/// * `imports`   – values, plus URL-like specifier keys;
+/// * `scopes`    – scope prefix keys, and each scope's `imports`-style map;
+/// * `integrity` – URL keys.
+///
+/// Bare specifiers (`"lodash"`) stay as they are.  Trailing-slash
+/// prefix mappings keep working because the proxied form ends with the
+/// unencoded upstream URL.  Returns `None` if the content is not a JSON
+/// object.
+pub fn rewrite_import_map(proxy: &str, base: &str, json: &str) -> Option<String> {
+    let mut map: serde_json::Value = serde_json::from_str(json).ok()?;
+    let obj = map.as_object_mut()?;
+
+    if let Some(imports) = obj.get_mut("imports").and_then(|v| v.as_object_mut()) {
+        rewrite_specifier_map(proxy, base, imports);
+    }
+    if let Some(scopes) = obj.get_mut("scopes").and_then(|v| v.as_object_mut()) {
+        let old = std::mem::take(scopes);
+        for (prefix, mut specifiers) in old {
+            if let Some(m) = specifiers.as_object_mut() {
+                rewrite_specifier_map(proxy, base, m);
+            }
+            scopes.insert(import_map_url(proxy, base, &prefix), specifiers);
+        }
+    }
+    if let Some(integrity) = obj.get_mut("integrity").and_then(|v| v.as_object_mut()) {
+        let old = std::mem::take(integrity);
+        for (url, hash) in old {
+            integrity.insert(import_map_url(proxy, base, &url), hash);
+        }
+    }
+    serde_json::to_string(&map).ok()
+}
+
+fn rewrite_specifier_map(
+    proxy: &str,
+    base: &str,
+    map: &mut serde_json::Map<String, serde_json::Value>,
+) {
+    let old = std::mem::take(map);
+    for (specifier, target) in old {
+        let key = if is_url_like_specifier(&specifier) {
+            import_map_url(proxy, base, &specifier)
+        } else {
+            specifier
+        };
+        let value = match target.as_str() {
+            Some(url) => serde_json::Value::String(import_map_url(proxy, base, url)),
+            None => target,
+        };
+        map.insert(key, value);
+    }
+}
+
+/// Specifiers the browser treats as URLs rather than bare names.
+fn is_url_like_specifier(s: &str) -> bool {
+    s.starts_with('/')
+        || s.starts_with("./")
+        || s.starts_with("../")
+        || url::Url::parse(s).is_ok()
+}
+
+fn import_map_url(proxy: &str, base: &str, raw: &str) -> String {
+    encode_url_with_base(proxy, base, raw).unwrap_or_else(|| raw.to_string())
+}
+
 // ---------------------------------------------------------------------------
 // <base href> detection
 // ---------------------------------------------------------------------------
 
-fn find_base_href(doc: &NodeRef) -> Option<String> {
+/// Return the document's base URL as declared by `<base href>`, resolved
+/// against the page URL.
+///
+/// As in browsers, only the first `<base>` that has an `href` counts;
+/// target-only bases and any later ones are ignored for resolution.  The
+/// `href` itself is rewritten like any other URL attribute, so the
+/// effective base points through `/proxy`, while every relative URL in
+/// the markup is resolved here against the upstream base and emitted as
+/// an absolute proxy URL.
+fn find_base_href(doc: &NodeRef, document_url: &str) -> Option<String> {
     for node in doc.inclusive_descendants() {
         if let NodeData::Element(ref el) = *node.data() {
-            if el.name.local.to_string() == "base" {
-                let attrs = el.attributes.borrow();
-                return attrs.get("href").map(|s| s.to_string());
+            if el.name.local.to_string() != "base" {
+                continue;
             }
+            let attrs = el.attributes.borrow();
+            let href = match attrs.get("href") {
+                Some(h) => h.trim(),
+                None => continue,
+            };
+            let resolved = match ::url::Url::parse(document_url) {
+                Ok(doc_url) => doc_url.join(href).ok()?,
+                Err(_) => ::url::Url::parse(href).ok()?,
+            };
+            return match resolved.scheme() {
+                "http" | "https" => Some(resolved.to_string()),
+                _ => None,
+            };
         }
     }
     None
@@ -367,12 +719,36 @@ fn find_base_href(doc: &NodeRef) -> Option<String> {
 
 /// Inject a tiny <script> at the top of <head> that sets up the runtime
 /// hooks the rewritten inline scripts and event handlers depend on.
-fn inject_client_script(doc: &NodeRef, proxy_origin: &str, base_url: &str) {
-    let script_src = format!("{}/internex.runtime.js", proxy_origin);
+/// The absolute URL the client runtime is loaded from.
+fn runtime_src(proxy_origin: &str, runtime_path: &str) -> String {
+    format!(
+        "{}/{}",
+        proxy_origin.trim_end_matches('/'),
+        runtime_path.trim_start_matches('/')
+    )
+}
+
+/// Whether the document has a `<script src>` equal to `src`.  Documents
+/// that already load the runtime (e.g. rewritten twice) do not get it
+/// injected again.
+fn loads_script(doc: &NodeRef, src: &str) -> bool {
+    doc.descendants().any(|n| {
+        n.as_element().map_or(false, |el| {
+            &*el.name.local == "script"
+                && el.attributes.borrow().get("src").map_or(false, |s| s == src)
+        })
+    })
+}
+
+/// Insert the client runtime, and the settings it reads, as the first
+/// children of `<head>` so they run before any page script.
+fn inject_client_script(doc: &NodeRef, script_src: &str, base_url: &str, no_sw: bool) {
     let base_json = serde_json::to_string(base_url).unwrap_or_else(|_| "\"\"".to_string());
+    let no_sw_js = if no_sw { " window.__internex_no_sw = true;" } else { "" };
     let script_html = format!(
-        r#"<script>window.__internex_base = {};</script><script src="{}"></script>"#,
+        r#"<script>window.__internex_base = {};{}</script><script src="{}"></script>"#,
         base_json,
+        no_sw_js,
         script_src,
     );
 
@@ -393,6 +769,49 @@ fn inject_client_script(doc: &NodeRef, proxy_origin: &str, base_url: &str) {
     }
 }
 
+// ---------------------------------------------------------------------------
+// <base> injection (opt-in)
+// ---------------------------------------------------------------------------
+
+/// Insert `<base href="{proxy}/proxy?url=<encoded base directory>">` as the
+/// first child of `<head>`, so URLs the page builds at runtime from
+/// `document.baseURI` stay on the proxy and fragment-only links resolve
+/// to the proxied document.
+///
+/// Composition with attribute rewriting: every URL attribute has already
+/// been rewritten to an absolute proxy URL, and absolute URLs ignore
+/// `<base>`, so nothing is proxied twice.  Note that browsers drop the
+/// query string when resolving a *path*-relative URL against a base, so
+/// relative paths must still be resolved by the rewriter itself – the
+/// injected tag complements attribute rewriting, it does not replace it.
+/// Pages that declare their own `<base>` are left alone.
+fn inject_base_tag(doc: &NodeRef, proxy_origin: &str, base_url: &str) {
+    let dir = match ::url::Url::parse(base_url).and_then(|u| u.join("./")) {
+        Ok(d) => d.to_string(),
+        Err(_) => return,
+    };
+    let href = match encode_url(proxy_origin, &dir) {
+        Some(h) if h != dir => h,
+        _ => return,
+    };
+
+    for node in doc.inclusive_descendants() {
+        if let NodeData::Element(ref el) = *node.data() {
+            if el.name.local.to_string() == "head" {
+                let base = NodeRef::new_element(
+                    markup5ever::QualName::new(None, ns!(html), markup5ever::local_name!("base")),
+                    vec![(
+                        kuchikiki::ExpandedName::new(ns!(), markup5ever::local_name!("href")),
+                        kuchikiki::Attribute { prefix: None, value: href },
+                    )],
+                );
+                node.prepend(base);
+                return;
+            }
+        }
+    }
+}
+
 // ---------------------------------------------------------------------------
 // Trait impls to make kuchikiki::Attributes easier to work with
 // ---------------------------------------------------------------------------
@@ -400,6 +819,7 @@ fn inject_client_script(doc: &NodeRef, proxy_origin: &str, base_url: &str) {
 trait AttrsExt {
     fn get(&self, name: &str) -> Option<&str>;
     fn set(&mut self, name: &str, value: String);
+    fn remove_attr(&mut self, name: &str);
 }
 
 impl AttrsExt for kuchikiki::Attributes {
@@ -414,6 +834,11 @@ impl AttrsExt for kuchikiki::Attributes {
             attr.value = value.into();
         }
     }
+
+    fn remove_attr(&mut self, name: &str) {
+        let key = kuchikiki::ExpandedName::new(ns!(), markup5ever::LocalName::from(name));
+        self.map.remove(&key);
+    }
 }
 
 #[cfg(test)]
@@ -430,6 +855,192 @@ mod tests {
         assert!(result.contains("/proxy?url="));
     }
 
+    fn form_target(result: &str, attr: &str) -> String {
+        let marker = format!(r#"{}="http://localhost:8080/f/"#, attr);
+        let start = result.find(&marker).unwrap() + marker.len();
+        let end = start + result[start..].find('"').unwrap();
+        use base64::Engine;
+        let bytes = base64::engine::general_purpose::URL_SAFE_NO_PAD
+            .decode(&result[start..end])
+            .unwrap();
+        String::from_utf8(bytes).unwrap()
+    }
+
+    #[test]
+    fn post_form_action_keeps_query_form() {
+        let html = r#"<html><body><form method="POST" action="https://example.com/submit?step=2"><button formaction="/alt">Go</button></form></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains(r#"action="http://localhost:8080/proxy?url=https://example.com/submit?step%3D2""#));
+        assert!(result.contains(r#"formaction="http://localhost:8080/proxy?url=https://example.com/alt""#));
+        assert!(!result.contains("/f/"));
+    }
+
+    #[test]
+    fn get_form_and_formaction_use_form_route() {
+        let html = r#"<html><body><form action="/search?x=1"><input type="submit" formaction="https://other.example.com/find"><button formmethod="post" formaction="/save">Save</button></form><form><input name="q"></form></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert_eq!(form_target(&result, "action"), "https://example.com/search");
+        assert_eq!(form_target(&result, "formaction"), "https://other.example.com/find");
+        assert!(result.contains(r#"formaction="http://localhost:8080/proxy?url=https://example.com/save""#));
+        // The form without an action submits to the page itself.
+        let second = &result[result.rfind("<form").unwrap()..];
+        assert_eq!(form_target(second, "action"), "https://example.com/page");
+    }
+
+    #[test]
+    fn rewrites_inline_style_block() {
+        let html = r#"<html><head><style>@import "theme.css"; @import url(/print.css) print; body { background: url(img/bg.png), url(data:image/gif;base64,R0lG); }</style></head><body></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains("/proxy?url=https://example.com/theme.css"));
+        assert!(result.contains("/proxy?url=https://example.com/print.css"));
+        assert!(result.contains("/proxy?url=https://example.com/img/bg.png"));
+        assert!(result.contains("data:image/gif;base64,R0lG"));
+    }
+
+    #[test]
+    fn rewrites_style_attribute() {
+        let html = r#"<html><head></head><body><div style="background: url(a.png), url('https://cdn.example.com/b.png'); color: red"></div></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains("/proxy?url=https://example.com/a.png"));
+        assert!(result.contains("/proxy?url=https://cdn.example.com/b.png"));
+        assert!(result.contains("color"));
+    }
+
+    #[test]
+    fn injects_runtime_once_before_other_scripts() {
+        let html = r#"<html><head><script src="https://example.com/app.js"></script></head><body><script>go()</script></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        let runtime = format!(r#"src="{}/internex.runtime.js""#, PROXY);
+        assert_eq!(result.matches(&runtime).count(), 1);
+        let runtime_at = result.find(&runtime).unwrap();
+        assert!(runtime_at < result.find("app.js").unwrap());
+        assert!(runtime_at < result.find("go()").unwrap());
+
+        // A page that already loads the runtime does not get a second one.
+        let html = format!(r#"<html><head><script {}></script></head><body></body></html>"#, runtime);
+        let result = rewrite_html(PROXY, BASE, &html);
+        assert_eq!(result.matches("internex.runtime.js").count(), 1);
+    }
+
+    #[test]
+    fn runtime_path_and_omission() {
+        let html = "<html><head></head><body></body></html>";
+        let opts = RewriteOptions { runtime_path: "/static/rt.js".to_string(), ..RewriteOptions::default() };
+        let result = rewrite_html_with_options(PROXY, BASE, html, &opts);
+        assert!(result.contains(&format!(r#"src="{}/static/rt.js""#, PROXY)));
+        let opts = RewriteOptions { omit_runtime: true, ..RewriteOptions::default() };
+        let result = rewrite_html_with_options(PROXY, BASE, html, &opts);
+        assert!(!result.contains("<script"));
+    }
+
+    #[test]
+    fn service_worker_stub_flag() {
+        let html = "<html><head></head><body></body></html>";
+        let opts = RewriteOptions { disable_service_workers: true, ..RewriteOptions::default() };
+        let result = rewrite_html_with_options(PROXY, BASE, html, &opts);
+        assert!(result.contains("window.__internex_no_sw = true;"));
+        // The flag is set before the runtime loads.
+        assert!(result.find("__internex_no_sw").unwrap() < result.find("internex.runtime.js").unwrap());
+        // Off by default.
+        assert!(!rewrite_html(PROXY, BASE, html).contains("__internex_no_sw"));
+    }
+
+    #[test]
+    fn inline_script_location_assignment_uses_runtime() {
+        let opts = RewriteOptions { rewrite_location: true, ..RewriteOptions::default() };
+        let html = r#"<html><head></head><body><script>window.location = "https://other.example.com/";</script></body></html>"#;
+        let result = rewrite_html_with_options(PROXY, BASE, html, &opts);
+        assert!(result.contains(r#"(self.__internex||self).location = "https://other.example.com/";"#));
+        // Off by default.
+        assert!(!rewrite_html(PROXY, BASE, html).contains("(self.__internex||self)"));
+    }
+
+    #[test]
+    fn rewrites_iframe_srcdoc() {
+        let html = r#"<html><body><iframe srcdoc="<p title='a &quot;b&quot;'>&amp;</p><img src=&quot;https://cdn.example.com/a.png&quot;>"></iframe></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        let doc = parse_html().one(result.as_str());
+        let iframe = doc.select_first("iframe").unwrap();
+        let srcdoc = iframe.attributes.borrow().get("srcdoc").unwrap().to_string();
+        assert!(srcdoc.contains(&encode_url(PROXY, "https://cdn.example.com/a.png").unwrap()));
+        assert!(srcdoc.contains(r#"title="a &quot;b&quot;""#));
+        assert!(srcdoc.contains("&amp;"));
+    }
+
+    #[test]
+    fn leaves_empty_srcdoc() {
+        let html = r#"<html><body><iframe srcdoc=""></iframe></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains(r#"<iframe srcdoc="">"#));
+    }
+
+    #[test]
+    fn removes_every_meta_csp() {
+        let html = r#"<html><head><meta http-equiv="Content-Security-Policy" content="default-src 'self'"><meta http-equiv="content-security-policy" content="img-src 'none'"><meta charset="utf-8"></head><body></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(!result.to_ascii_lowercase().contains("content-security-policy"));
+        assert!(result.contains(r#"<meta charset="utf-8">"#));
+    }
+
+    #[test]
+    fn rewrites_meta_csp_when_enabled() {
+        let opts = RewriteOptions { rewrite_meta_csp: true, ..RewriteOptions::default() };
+        let html = r#"<html><head><meta http-equiv="Content-Security-Policy" content="script-src 'self'; upgrade-insecure-requests"></head><body></body></html>"#;
+        let result = rewrite_html_with_options(PROXY, BASE, html, &opts);
+        let policy = rewrite_csp(PROXY, "https://example.com", "script-src 'self'; upgrade-insecure-requests");
+        assert!(result.contains(&format!(r#"content="{}""#, policy)));
+        assert!(!result.contains("upgrade-insecure-requests"));
+    }
+
+    #[test]
+    fn removes_meta_csp_inside_noscript() {
+        let html = r#"<html><head><noscript><meta http-equiv=Content-Security-Policy content="default-src 'none'"><metadata></noscript></head><body></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(!result.to_ascii_lowercase().contains("content-security-policy"));
+        assert!(result.contains("<metadata>"));
+    }
+
+    #[test]
+    fn rewrites_basic_import_map() {
+        let map = r#"{"imports":{"vue":"https://cdn.example.com/vue.js","app/":"/js/app/"}}"#;
+        let out: serde_json::Value =
+            serde_json::from_str(&rewrite_import_map(PROXY, BASE, map).unwrap()).unwrap();
+        assert_eq!(
+            out["imports"]["vue"],
+            encode_url(PROXY, "https://cdn.example.com/vue.js").unwrap()
+        );
+        assert_eq!(
+            out["imports"]["app/"],
+            encode_url(PROXY, "https://example.com/js/app/").unwrap()
+        );
+    }
+
+    #[test]
+    fn rewrites_scoped_import_map() {
+        let map = r#"{"scopes":{"/legacy/":{"vue":"https://cdn.example.com/vue2.js"}},
+            "imports":{"https://cdn.example.com/a.js":"/shim/a.js"}}"#;
+        let out: serde_json::Value =
+            serde_json::from_str(&rewrite_import_map(PROXY, BASE, map).unwrap()).unwrap();
+        let scope = encode_url(PROXY, "https://example.com/legacy/").unwrap();
+        assert_eq!(
+            out["scopes"][scope.as_str()]["vue"],
+            encode_url(PROXY, "https://cdn.example.com/vue2.js").unwrap()
+        );
+        let key = encode_url(PROXY, "https://cdn.example.com/a.js").unwrap();
+        assert_eq!(
+            out["imports"][key.as_str()],
+            encode_url(PROXY, "https://example.com/shim/a.js").unwrap()
+        );
+    }
+
+    #[test]
+    fn import_map_script_is_not_wrapped() {
+        let html = r#"<html><head><script type="importmap">{"imports":{"x":"https://cdn.example.com/x.js"}}</script></head><body></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(!result.contains("__internex_proxy){"));
+        assert!(result.contains("/proxy?url=https://cdn.example.com/x.js"));
+    }
+
     #[test]
     fn rewrites_img_src() {
         let html = r#"<html><head></head><body><img src="https://example.com/img.png"></body></html>"#;
@@ -444,6 +1055,98 @@ mod tests {
         assert!(result.contains("/proxy?url="));
     }
 
+    #[test]
+    fn rewrites_mixed_scheme_subresources() {
+        let html = r#"<html><head><link rel="stylesheet" href="http://insecure.example.com/a.css"></head><body><img src="https://secure.example.com/b.png"></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains("/proxy?url=http://insecure.example.com/a.css"));
+        assert!(result.contains("/proxy?url=https://secure.example.com/b.png"));
+    }
+
+    #[test]
+    fn rewrites_urls_in_event_handlers() {
+        let html = r#"<html><head></head><body><button onclick="location='https://other.example.com/next'">go</button></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains("/proxy?url=https://other.example.com/next"));
+        assert!(result.contains("__internex.scope"));
+    }
+
+    #[test]
+    fn rewrites_urls_in_javascript_links() {
+        let html = r#"<html><head></head><body><a href="javascript:fetch('https://api.example.com/x')">x</a></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains("href=\"javascript:fetch('http://localhost:8080/proxy?url=https://api.example.com/x')\""));
+    }
+
+    #[test]
+    fn strips_integrity_from_rewritten_elements() {
+        let html = r#"<html><head><script src="https://cdn.example.com/lib.js" integrity="sha384-abc" crossorigin="anonymous"></script></head><body></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains(r#"<script src="http://localhost:8080/proxy?url=https://cdn.example.com/lib.js"></script>"#));
+        assert!(!result.contains("integrity"));
+        assert!(!result.contains("crossorigin"));
+    }
+
+    #[test]
+    fn keeps_integrity_when_requested_or_url_untouched() {
+        let html = r#"<html><head><link rel="stylesheet" href="https://cdn.example.com/a.css" integrity="sha384-abc"></head><body></body></html>"#;
+        let opts = RewriteOptions { keep_integrity: true, ..Default::default() };
+        let result = rewrite_html_with_options(PROXY, BASE, html, &opts);
+        assert!(result.contains(r#"integrity="sha384-abc""#));
+
+        let proxied = r#"<html><head><script src="http://localhost:8080/proxy?url=https://cdn.example.com/lib.js" integrity="sha384-abc"></script></head><body></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, proxied);
+        assert!(result.contains(r#"integrity="sha384-abc""#));
+    }
+
+    #[test]
+    fn relative_urls_resolve_against_base_href() {
+        let without = r#"<html><head></head><body><img src="img/a.png"></body></html>"#;
+        let result = rewrite_html(PROXY, "https://example.com/page/index.html", without);
+        assert!(result.contains("/proxy?url=https://example.com/page/img/a.png"));
+
+        let with = r#"<html><head><base href="https://cdn.example.com/app/"></head><body><img src="img/a.png"></body></html>"#;
+        let result = rewrite_html(PROXY, "https://example.com/page/index.html", with);
+        assert!(result.contains("/proxy?url=https://cdn.example.com/app/img/a.png"));
+        assert!(result.contains(r#"<base href="http://localhost:8080/proxy?url=https://cdn.example.com/app/">"#));
+    }
+
+    #[test]
+    fn relative_base_href_resolves_against_page() {
+        let html = r#"<html><head><base href="/app/"></head><body><a href="next">n</a></body></html>"#;
+        let result = rewrite_html(PROXY, "https://example.com/page/index.html", html);
+        assert!(result.contains("/proxy?url=https://example.com/app/next"));
+    }
+
+    #[test]
+    fn only_first_base_with_href_counts() {
+        let html = r#"<html><head><base target="_blank"><base href="https://one.example.com/"><base href="https://two.example.com/"></head><body><a href="x">x</a></body></html>"#;
+        let result = rewrite_html(PROXY, BASE, html);
+        assert!(result.contains("/proxy?url=https://one.example.com/x"));
+        assert!(result.contains(r#"<base target="_blank">"#));
+    }
+
+    #[test]
+    fn injects_base_tag_when_enabled() {
+        let html = r#"<html><head></head><body><img src="https://cdn.example.com/a.png"></body></html>"#;
+        let opts = RewriteOptions { inject_base: true, ..Default::default() };
+        let result = rewrite_html_with_options(PROXY, "https://example.com/dir/page.html", html, &opts);
+        assert!(result.contains(r#"<base href="http://localhost:8080/proxy?url=https://example.com/dir/">"#));
+        // Absolute, already-proxied attributes are not wrapped again.
+        assert!(result.contains(r#"src="http://localhost:8080/proxy?url=https://cdn.example.com/a.png""#));
+    }
+
+    #[test]
+    fn no_base_tag_by_default_or_when_page_has_one() {
+        let plain = "<html><head></head><body></body></html>";
+        assert!(!rewrite_html(PROXY, BASE, plain).contains("<base"));
+
+        let own = r#"<html><head><base href="https://example.com/other/"></head><body></body></html>"#;
+        let opts = RewriteOptions { inject_base: true, ..Default::default() };
+        let result = rewrite_html_with_options(PROXY, BASE, own, &opts);
+        assert_eq!(result.matches("<base").count(), 1);
+    }
+
     #[test]
     fn injects_runtime_script() {
         let html = "<html><head></head><body></body></html>";
@@ -5,7 +5,7 @@
 // It rewrites common URL-bearing call sites and constructors. It is NOT
 // a full JS parser; the client runtime still provides full interception.
 
-use crate::url::encode_url_with_base;
+use crate::url::{encode_url, encode_url_with_base};
 
 pub fn rewrite_js(proxy_origin: &str, base_url: &str, js: &str) -> String {
     if js.is_empty() {
@@ -29,6 +29,280 @@ pub fn rewrite_js(proxy_origin: &str, base_url: &str, js: &str) -> String {
     out
 }
 
+/// Rewrite a JS snippet embedded in HTML – an `on*` handler body or the
+/// payload of a `javascript:` URL.  On top of the call sites handled by
+/// `rewrite_js`, every string literal holding an absolute http(s) URL is
+/// routed through the proxy, so `location='https://x'` cannot escape.
+/// Relative literals are left alone; they are resolved at runtime by the
+/// client shim.
+pub fn rewrite_inline_js(proxy_origin: &str, base_url: &str, js: &str) -> String {
+    let out = rewrite_js(proxy_origin, base_url, js);
+    rewrite_absolute_string_literals(proxy_origin, &out)
+}
+
+/// Replace absolute http(s) URLs found in quoted string literals.
+fn rewrite_absolute_string_literals(proxy_origin: &str, src: &str) -> String {
+    let bytes = src.as_bytes();
+    let mut out = String::with_capacity(src.len());
+    let mut last = 0;
+    let mut i = 0;
+    while i < bytes.len() {
+        let quote = bytes[i];
+        if quote != b'\'' && quote != b'"' && quote != b'`' {
+            i += 1;
+            continue;
+        }
+        // Find the closing quote, skipping backslash escapes.
+        let start = i + 1;
+        let mut j = start;
+        while j < bytes.len() && bytes[j] != quote {
+            if bytes[j] == b'\\' {
+                j += 1;
+            }
+            j += 1;
+        }
+        if j >= bytes.len() {
+            break;
+        }
+        let literal = &src[start..j];
+        let lower = literal.to_ascii_lowercase();
+        let absolute = lower.starts_with("http://") || lower.starts_with("https://");
+        // Escapes and template substitutions can't be rewritten safely.
+        let plain = !literal.contains('\\') && !literal.contains("${");
+        if absolute && plain {
+            if let Some(encoded) = encode_url(proxy_origin, literal) {
+                out.push_str(&src[last..start]);
+                out.push_str(&encoded);
+                last = j;
+            }
+        }
+        i = j + 1;
+    }
+    out.push_str(&src[last..]);
+    out
+}
+
+/// Rewrite ES module URL constructs (opt-in, see `RewriteOptions`):
+///
+/// * `import("…")` with a single string literal argument is routed
+///   through the proxy.  Computed specifiers (`import(name)`, template
+///   literals with substitutions) are left alone.
+/// * `import.meta.url` is replaced with the proxied URL of the module
+///   itself (`base_url`), so it matches the URL the browser loaded.
+///
+/// Like the rest of this module it works on text, not an AST, so the
+/// patterns inside comments and strings are rewritten too.
+pub fn rewrite_module_urls(proxy_origin: &str, base_url: &str, js: &str) -> String {
+    let out = rewrite_dynamic_imports(proxy_origin, base_url, js);
+    if base_url.is_empty() {
+        return out;
+    }
+    match encode_url(proxy_origin, base_url) {
+        Some(proxied) => replace_import_meta_url(&out, &proxied),
+        None => out,
+    }
+}
+
+/// True if `b` can be part of an identifier or member access, i.e. the
+/// keyword match is really `foo.import(` or `reimport(`.
+fn is_ident_byte(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_' || b == b'$' || b == b'.'
+}
+
+fn rewrite_dynamic_imports(proxy_origin: &str, base_url: &str, src: &str) -> String {
+    let bytes = src.as_bytes();
+    let mut out = String::with_capacity(src.len());
+    let mut i = 0;
+    while let Some(pos) = src[i..].find("import") {
+        let start = i + pos;
+        let mut j = start + "import".len();
+        if start > 0 && is_ident_byte(bytes[start - 1]) {
+            out.push_str(&src[i..j]);
+            i = j;
+            continue;
+        }
+        while j < bytes.len() && bytes[j].is_ascii_whitespace() {
+            j += 1;
+        }
+        if j >= bytes.len() || bytes[j] != b'(' {
+            out.push_str(&src[i..start + "import".len()]);
+            i = start + "import".len();
+            continue;
+        }
+        j += 1;
+        while j < bytes.len() && bytes[j].is_ascii_whitespace() {
+            j += 1;
+        }
+        let quote = if j < bytes.len() { bytes[j] } else { 0 };
+        if quote != b'\'' && quote != b'"' && quote != b'`' {
+            out.push_str(&src[i..j]);
+            i = j;
+            continue;
+        }
+        let lit_start = j + 1;
+        let lit_end = match src[lit_start..].find(quote as char) {
+            Some(k) => lit_start + k,
+            None => break,
+        };
+        let raw = &src[lit_start..lit_end];
+        out.push_str(&src[i..lit_start]);
+        if raw.contains('\\') || raw.contains("${") {
+            out.push_str(raw);
+        } else {
+            let rewritten = encode_url_with_base(proxy_origin, base_url, raw)
+                .unwrap_or_else(|| raw.to_string());
+            out.push_str(&rewritten);
+        }
+        i = lit_end;
+    }
+    out.push_str(&src[i..]);
+    out
+}
+
+fn replace_import_meta_url(src: &str, proxied: &str) -> String {
+    const NEEDLE: &str = "import.meta.url";
+    let bytes = src.as_bytes();
+    let literal = serde_json::to_string(proxied).unwrap_or_else(|_| format!("{:?}", proxied));
+    let mut out = String::with_capacity(src.len());
+    let mut i = 0;
+    while let Some(pos) = src[i..].find(NEEDLE) {
+        let start = i + pos;
+        let end = start + NEEDLE.len();
+        let bounded_left = start == 0 || !is_ident_byte(bytes[start - 1]);
+        let bounded_right = end >= bytes.len()
+            || !(bytes[end].is_ascii_alphanumeric() || bytes[end] == b'_' || bytes[end] == b'$');
+        out.push_str(&src[i..start]);
+        if bounded_left && bounded_right {
+            out.push_str(&literal);
+        } else {
+            out.push_str(NEEDLE);
+        }
+        i = end;
+    }
+    out.push_str(&src[i..]);
+    out
+}
+
+/// Route `location` assignments and `document.domain` through the client
+/// runtime (opt-in, see `RewriteOptions`).  The browser's `Location`
+/// members cannot be redefined, so the runtime alone cannot intercept
+/// `location = url`:
+///
+/// * `location = x` and `location.href = x`, bare or through `window.`,
+///   `self.` or `document.`, become `(self.__internex||self).location = x`,
+///   whose setter navigates to the proxied URL;
+/// * `document.domain` (optionally through `window.`) becomes
+///   `(self.__internex||document).domain`, which reports the upstream host.
+///
+/// Without the runtime, e.g. in a worker, the fallbacks behave like the
+/// original code.  Comparisons, compound assignments, declarations and
+/// parameters named `location`, and other objects' `location` members
+/// are left alone.  Like the rest of this module it works on text, so
+/// matches inside strings and comments are rewritten too.
+pub fn rewrite_location_assignments(js: &str) -> String {
+    let out = rewrite_location_targets(js);
+    rewrite_document_domain(&out)
+}
+
+/// Objects whose `location` is the window's.
+const LOCATION_OWNERS: &[&str] = &["window.", "self.", "document."];
+
+/// True if `b` can continue an identifier.
+fn is_word_byte(b: u8) -> bool {
+    b.is_ascii_alphanumeric() || b == b'_' || b == b'$'
+}
+
+/// True if `before` ends in a declaration keyword or an opening parameter
+/// list position, where `location` names a binding rather than the
+/// global.
+fn declares_binding(before: &str) -> bool {
+    let trimmed = before.trim_end();
+    if trimmed.ends_with('(') || trimmed.ends_with(',') {
+        return true;
+    }
+    ["var", "let", "const"].iter().any(|kw| {
+        trimmed.ends_with(kw)
+            && trimmed.len() >= kw.len()
+            && (trimmed.len() == kw.len() || !is_ident_byte(trimmed.as_bytes()[trimmed.len() - kw.len() - 1]))
+    })
+}
+
+fn rewrite_location_targets(src: &str) -> String {
+    const NEEDLE: &str = "location";
+    const TARGET: &str = "(self.__internex||self).location";
+    let bytes = src.as_bytes();
+    let mut out = String::with_capacity(src.len());
+    let mut copied = 0;
+    let mut search = 0;
+    while let Some(pos) = src[search..].find(NEEDLE) {
+        let at = search + pos;
+        let mut end = at + NEEDLE.len();
+        search = end;
+
+        let start = LOCATION_OWNERS
+            .iter()
+            .find(|owner| src[copied..at].ends_with(*owner))
+            .map_or(at, |owner| at - owner.len());
+        if start > 0 && is_ident_byte(bytes[start - 1]) {
+            continue;
+        }
+        if start == at && declares_binding(&src[..at]) {
+            continue;
+        }
+        if src[end..].starts_with(".href") {
+            end += ".href".len();
+        }
+        if end < bytes.len() && is_word_byte(bytes[end]) {
+            continue;
+        }
+
+        // Only a plain assignment: not ==, ===, => or a compound operator.
+        let mut j = end;
+        while j < bytes.len() && bytes[j].is_ascii_whitespace() {
+            j += 1;
+        }
+        if j >= bytes.len() || bytes[j] != b'=' {
+            continue;
+        }
+        if j + 1 < bytes.len() && (bytes[j + 1] == b'=' || bytes[j + 1] == b'>') {
+            continue;
+        }
+
+        out.push_str(&src[copied..start]);
+        out.push_str(TARGET);
+        copied = end;
+        search = end;
+    }
+    out.push_str(&src[copied..]);
+    out
+}
+
+fn rewrite_document_domain(src: &str) -> String {
+    const NEEDLE: &str = "document.domain";
+    const TARGET: &str = "(self.__internex||document).domain";
+    let bytes = src.as_bytes();
+    let mut out = String::with_capacity(src.len());
+    let mut copied = 0;
+    let mut search = 0;
+    while let Some(pos) = src[search..].find(NEEDLE) {
+        let at = search + pos;
+        let end = at + NEEDLE.len();
+        search = end;
+        let start = if src[copied..at].ends_with("window.") { at - "window.".len() } else { at };
+        if start > 0 && is_ident_byte(bytes[start - 1]) {
+            continue;
+        }
+        if end < bytes.len() && is_word_byte(bytes[end]) {
+            continue;
+        }
+        out.push_str(&src[copied..start]);
+        out.push_str(TARGET);
+        copied = end;
+    }
+    out.push_str(&src[copied..]);
+    out
+}
+
 fn rewrite_call_first_arg(proxy_origin: &str, base_url: &str, src: &str, callee: &str) -> String {
     let mut out = String::with_capacity(src.len());
     let needle = format!("{}(", callee);
@@ -106,3 +380,97 @@ fn rewrite_open_second_arg(proxy_origin: &str, base_url: &str, src: &str) -> Str
     out.push_str(&src[i..]);
     out
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PROXY: &str = "http://localhost:8080";
+    const BASE: &str = "https://example.com/app/";
+
+    #[test]
+    fn rewrites_fetch_literal() {
+        let result = rewrite_js(PROXY, BASE, r#"fetch("https://api.example.com/x")"#);
+        assert!(result.contains("/proxy?url=https://api.example.com/x"));
+    }
+
+    #[test]
+    fn inline_js_rewrites_location_assignment() {
+        let result = rewrite_inline_js(PROXY, BASE, "location='https://other.example.com/'");
+        assert_eq!(result, "location='http://localhost:8080/proxy?url=https://other.example.com/'");
+    }
+
+    #[test]
+    fn module_urls_rewrite_literal_dynamic_import() {
+        let result = rewrite_module_urls(PROXY, BASE, r#"const m = await import("./chunk.js");"#);
+        let expected = format!(
+            "const m = await import(\"{}\");",
+            encode_url(PROXY, "https://example.com/app/chunk.js").unwrap()
+        );
+        assert_eq!(result, expected);
+    }
+
+    #[test]
+    fn module_urls_leave_computed_imports() {
+        let src = "import(name); import(`./${x}.js`); obj.import('a'); import x from './x.js';";
+        assert_eq!(rewrite_module_urls(PROXY, BASE, src), src);
+    }
+
+    #[test]
+    fn module_urls_replace_import_meta_url() {
+        let result = rewrite_module_urls(PROXY, BASE, "new URL('./a.wasm', import.meta.url)");
+        let expected = format!(
+            "new URL('./a.wasm', \"{}\")",
+            encode_url(PROXY, BASE).unwrap()
+        );
+        assert_eq!(result, expected);
+        // import.meta itself and other members are untouched.
+        assert_eq!(rewrite_module_urls(PROXY, BASE, "import.meta.urlish"), "import.meta.urlish");
+        assert_eq!(rewrite_module_urls(PROXY, BASE, "import.meta.env"), "import.meta.env");
+    }
+
+    #[test]
+    fn location_assignments_go_through_runtime() {
+        let cases = [
+            ("window.location = 'https://other.example.com/';", "(self.__internex||self).location = 'https://other.example.com/';"),
+            ("location.href=\"https://a.example.com/\"", "(self.__internex||self).location=\"https://a.example.com/\""),
+            ("if (ok) document.location.href = u;", "if (ok) (self.__internex||self).location = u;"),
+        ];
+        for (src, want) in cases {
+            assert_eq!(rewrite_location_assignments(src), want);
+        }
+    }
+
+    #[test]
+    fn location_reads_and_bindings_untouched() {
+        for src in [
+            "if (location == u) {}",
+            "var location = 1;",
+            "function f(location) {}",
+            "obj.location = u;",
+            "top.location = u;",
+            "location.hash = '#a';",
+            "location += '#a';",
+            "const f = location => location;",
+            "locationX = 1;",
+        ] {
+            let out = rewrite_location_assignments(src);
+            assert_eq!(out, src);
+        }
+    }
+
+    #[test]
+    fn document_domain_goes_through_runtime() {
+        assert_eq!(
+            rewrite_location_assignments("var d = window.document.domain; document.domain = d;"),
+            "var d = (self.__internex||document).domain; (self.__internex||document).domain = d;"
+        );
+        assert_eq!(rewrite_location_assignments("my.document.domains"), "my.document.domains");
+    }
+
+    #[test]
+    fn inline_js_leaves_relative_and_proxied_literals() {
+        let src = "go('/local'); go('http://localhost:8080/proxy?url=https://a.example.com/')";
+        assert_eq!(rewrite_inline_js(PROXY, "", src), src);
+    }
+}
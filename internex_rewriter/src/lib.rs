@@ -7,9 +7,15 @@
 //   rewrite_html(input: *const c_char) -> *mut c_char
 //   rewrite_css(input: *const c_char) -> *mut c_char
 //   rewrite_js(input: *const c_char) -> *mut c_char
+//   rewrite_{html,css,js}_n(input: *const c_char, len: usize) -> *mut c_char
+//
+// The `_n` variants take a length instead of a NUL terminator, so the Go
+// side can lend its own buffer for the duration of the call instead of
+// copying it into C memory.  The input is only read during the call.
 //
 // Input is a JSON-encoded object:
 //   { "proxy_origin": "…", "base_url": "…", "content": "…" }
+// plus optional flags (see `RewriteOptions`), e.g. `"inject_base": true`.
 //
 // Return value is a NUL-terminated C string allocated with CString.
 // The caller MUST free it by calling `free_string`.
@@ -30,13 +36,89 @@ use serde_json::Value;
 // Helpers
 // ---------------------------------------------------------------------------
 
-/// Parse the JSON envelope and return (proxy_origin, base_url, content).
-fn parse_input(json: &str) -> Option<(String, String, String)> {
+/// Where the client runtime is served unless `runtime_path` says otherwise.
+pub const DEFAULT_RUNTIME_PATH: &str = "/internex.runtime.js";
+
+/// Optional rewriting knobs carried in the JSON envelope.  Missing keys
+/// take their defaults, so older callers keep working unchanged.
+#[derive(Debug, Clone)]
+pub struct RewriteOptions {
+    /// Inject a `<base href>` pointing through the proxy (HTML only).
+    pub inject_base: bool,
+    /// Wrap inline `<script>` bodies in the runtime scope (HTML only).
+    pub inline_js: bool,
+    /// Rewrite `style` attributes and `<style>` elements (HTML only).
+    pub rewrite_inline_styles: bool,
+    /// Leave `integrity` attributes in place (HTML only).
+    pub keep_integrity: bool,
+    /// Rewrite literal `import()` specifiers and `import.meta.url` (JS
+    /// only).  See `js::rewrite_module_urls` for its limitations.
+    pub module_urls: bool,
+    /// Rewrite `<meta http-equiv="Content-Security-Policy">` policies to
+    /// admit the proxy instead of removing the tags (HTML only).
+    pub rewrite_meta_csp: bool,
+    /// Route `location` assignments and `document.domain` through the
+    /// client runtime (JS and inline scripts).  See
+    /// `js::rewrite_location_assignments`.
+    pub rewrite_location: bool,
+    /// Path on the proxy origin the client runtime is loaded from (HTML
+    /// only).
+    pub runtime_path: String,
+    /// Do not inject the client runtime (HTML only).
+    pub omit_runtime: bool,
+    /// Have the injected runtime stub out `navigator.serviceWorker`
+    /// registration (HTML only).
+    pub disable_service_workers: bool,
+}
+
+impl Default for RewriteOptions {
+    fn default() -> Self {
+        RewriteOptions {
+            inject_base: false,
+            inline_js: true,
+            rewrite_inline_styles: true,
+            keep_integrity: false,
+            module_urls: false,
+            rewrite_meta_csp: false,
+            rewrite_location: false,
+            runtime_path: DEFAULT_RUNTIME_PATH.to_string(),
+            omit_runtime: false,
+            disable_service_workers: false,
+        }
+    }
+}
+
+impl RewriteOptions {
+    fn from_json(v: &Value) -> Self {
+        let d = RewriteOptions::default();
+        let flag = |key: &str, def: bool| v.get(key).and_then(Value::as_bool).unwrap_or(def);
+        RewriteOptions {
+            inject_base: flag("inject_base", d.inject_base),
+            inline_js: flag("inline_js", d.inline_js),
+            rewrite_inline_styles: flag("rewrite_inline_styles", d.rewrite_inline_styles),
+            keep_integrity: flag("keep_integrity", d.keep_integrity),
+            module_urls: flag("module_urls", d.module_urls),
+            rewrite_meta_csp: flag("rewrite_meta_csp", d.rewrite_meta_csp),
+            rewrite_location: flag("rewrite_location", d.rewrite_location),
+            runtime_path: v
+                .get("runtime_path")
+                .and_then(Value::as_str)
+                .filter(|p| !p.is_empty())
+                .map_or(d.runtime_path, str::to_string),
+            omit_runtime: flag("omit_runtime", d.omit_runtime),
+            disable_service_workers: flag("disable_service_workers", d.disable_service_workers),
+        }
+    }
+}
+
+/// Parse the JSON envelope and return (proxy_origin, base_url, content,
+/// options).
+fn parse_input(json: &str) -> Option<(String, String, String, RewriteOptions)> {
     let v: Value = serde_json::from_str(json).ok()?;
     let proxy_origin = v.get("proxy_origin")?.as_str()?.to_string();
     let base_url = v.get("base_url")?.as_str()?.to_string();
     let content = v.get("content")?.as_str()?.to_string();
-    Some((proxy_origin, base_url, content))
+    Some((proxy_origin, base_url, content, RewriteOptions::from_json(&v)))
 }
 
 /// Convert a Rust String into a heap-allocated C string.
@@ -56,6 +138,51 @@ unsafe fn read_c_str<'a>(ptr: *const c_char) -> Option<&'a str> {
     CStr::from_ptr(ptr).to_str().ok()
 }
 
+/// Read `len` bytes at `ptr` into a `&str`.  Returns `None` on null or
+/// invalid UTF-8.
+unsafe fn read_c_bytes<'a>(ptr: *const c_char, len: usize) -> Option<&'a str> {
+    if ptr.is_null() {
+        return None;
+    }
+    std::str::from_utf8(std::slice::from_raw_parts(ptr as *const u8, len)).ok()
+}
+
+fn html_from_json(json: &str) -> *mut c_char {
+    let (proxy_origin, base_url, content, opts) = match parse_input(json) {
+        Some(t) => t,
+        None => return ptr::null_mut(),
+    };
+
+    let result = html::rewrite_html_with_options(&proxy_origin, &base_url, &content, &opts);
+    to_c_string(result)
+}
+
+fn css_from_json(json: &str) -> *mut c_char {
+    let (proxy_origin, base_url, content, _opts) = match parse_input(json) {
+        Some(t) => t,
+        None => return ptr::null_mut(),
+    };
+
+    let result = css::rewrite_css(&proxy_origin, &base_url, &content);
+    to_c_string(result)
+}
+
+fn js_from_json(json: &str) -> *mut c_char {
+    let (proxy_origin, base_url, content, opts) = match parse_input(json) {
+        Some(t) => t,
+        None => return ptr::null_mut(),
+    };
+
+    let mut result = js::rewrite_js(&proxy_origin, &base_url, &content);
+    if opts.module_urls {
+        result = js::rewrite_module_urls(&proxy_origin, &base_url, &result);
+    }
+    if opts.rewrite_location {
+        result = js::rewrite_location_assignments(&result);
+    }
+    to_c_string(result)
+}
+
 // ---------------------------------------------------------------------------
 // C ABI exports
 // ---------------------------------------------------------------------------
@@ -66,17 +193,19 @@ unsafe fn read_c_str<'a>(ptr: *const c_char) -> Option<&'a str> {
 /// Returns: rewritten HTML as a NUL-terminated C string, or null on error.
 #[no_mangle]
 pub unsafe extern "C" fn rewrite_html(input: *const c_char) -> *mut c_char {
-    let json = match read_c_str(input) {
-        Some(s) => s,
-        None => return ptr::null_mut(),
-    };
-    let (proxy_origin, base_url, content) = match parse_input(json) {
-        Some(t) => t,
-        None => return ptr::null_mut(),
-    };
+    match read_c_str(input) {
+        Some(json) => html_from_json(json),
+        None => ptr::null_mut(),
+    }
+}
 
-    let result = html::rewrite_html(&proxy_origin, &base_url, &content);
-    to_c_string(result)
+/// Like `rewrite_html`, with the input given as `len` bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rewrite_html_n(input: *const c_char, len: usize) -> *mut c_char {
+    match read_c_bytes(input, len) {
+        Some(json) => html_from_json(json),
+        None => ptr::null_mut(),
+    }
 }
 
 /// Rewrite a CSS stylesheet / fragment.
@@ -85,17 +214,19 @@ pub unsafe extern "C" fn rewrite_html(input: *const c_char) -> *mut c_char {
 /// Returns: rewritten CSS as a NUL-terminated C string, or null on error.
 #[no_mangle]
 pub unsafe extern "C" fn rewrite_css(input: *const c_char) -> *mut c_char {
-    let json = match read_c_str(input) {
-        Some(s) => s,
-        None => return ptr::null_mut(),
-    };
-    let (proxy_origin, base_url, content) = match parse_input(json) {
-        Some(t) => t,
-        None => return ptr::null_mut(),
-    };
+    match read_c_str(input) {
+        Some(json) => css_from_json(json),
+        None => ptr::null_mut(),
+    }
+}
 
-    let result = css::rewrite_css(&proxy_origin, &base_url, &content);
-    to_c_string(result)
+/// Like `rewrite_css`, with the input given as `len` bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rewrite_css_n(input: *const c_char, len: usize) -> *mut c_char {
+    match read_c_bytes(input, len) {
+        Some(json) => css_from_json(json),
+        None => ptr::null_mut(),
+    }
 }
 
 /// Rewrite a JavaScript source file.
@@ -104,17 +235,19 @@ pub unsafe extern "C" fn rewrite_css(input: *const c_char) -> *mut c_char {
 /// Returns: rewritten JS as a NUL-terminated C string, or null on error.
 #[no_mangle]
 pub unsafe extern "C" fn rewrite_js(input: *const c_char) -> *mut c_char {
-    let json = match read_c_str(input) {
-        Some(s) => s,
-        None => return ptr::null_mut(),
-    };
-    let (proxy_origin, base_url, content) = match parse_input(json) {
-        Some(t) => t,
-        None => return ptr::null_mut(),
-    };
+    match read_c_str(input) {
+        Some(json) => js_from_json(json),
+        None => ptr::null_mut(),
+    }
+}
 
-    let result = js::rewrite_js(&proxy_origin, &base_url, &content);
-    to_c_string(result)
+/// Like `rewrite_js`, with the input given as `len` bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rewrite_js_n(input: *const c_char, len: usize) -> *mut c_char {
+    match read_c_bytes(input, len) {
+        Some(json) => js_from_json(json),
+        None => ptr::null_mut(),
+    }
 }
 
 /// Free a C string previously returned by one of the rewrite_* functions.
@@ -126,3 +259,81 @@ pub unsafe extern "C" fn free_string(ptr: *mut c_char) {
         let _ = CString::from_raw(ptr);
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn call_html(json: &str) -> String {
+        let input = CString::new(json).unwrap();
+        unsafe {
+            let out = rewrite_html(input.as_ptr());
+            assert!(!out.is_null());
+            let s = CStr::from_ptr(out).to_str().unwrap().to_string();
+            free_string(out);
+            s
+        }
+    }
+
+    #[test]
+    fn length_delimited_input_ignores_trailing_bytes() {
+        let json = r#"{"proxy_origin":"http://localhost:8080","base_url":"https://example.com/","content":"a{background:url(b.png)}"}"#;
+        let mut buf = json.as_bytes().to_vec();
+        buf.extend_from_slice(b"garbage");
+        unsafe {
+            let out = rewrite_css_n(buf.as_ptr() as *const c_char, json.len());
+            assert!(!out.is_null());
+            let s = CStr::from_ptr(out).to_str().unwrap().to_string();
+            free_string(out);
+            assert!(s.contains("/proxy?url=https://example.com/b.png"));
+        }
+    }
+
+    #[test]
+    fn length_delimited_input_rejects_null() {
+        unsafe {
+            assert!(rewrite_js_n(ptr::null(), 0).is_null());
+        }
+    }
+
+    #[test]
+    fn missing_flags_take_defaults() {
+        let (_, _, _, opts) =
+            parse_input(r#"{"proxy_origin":"p","base_url":"b","content":"c"}"#).unwrap();
+        assert!(!opts.inject_base);
+        assert!(opts.inline_js);
+        assert!(opts.rewrite_inline_styles);
+        assert!(!opts.keep_integrity);
+        assert!(!opts.module_urls);
+    }
+
+    #[test]
+    fn envelope_flags_are_parsed() {
+        let (_, _, _, opts) = parse_input(
+            r#"{"proxy_origin":"p","base_url":"b","content":"c","inline_js":false,"keep_integrity":true}"#,
+        )
+        .unwrap();
+        assert!(!opts.inline_js);
+        assert!(opts.rewrite_inline_styles);
+        assert!(opts.keep_integrity);
+    }
+
+    #[test]
+    fn envelope_disables_inline_rewriting() {
+        let json = r#"{"proxy_origin":"http://localhost:8080","base_url":"https://example.com/",
+            "content":"<div style=\"background:url(/a.png)\"></div><script>go()</script>",
+            "inline_js":false,"rewrite_inline_styles":false}"#;
+        let out = call_html(json);
+        assert!(out.contains("url(/a.png)"));
+        assert!(out.contains("<script>go()</script>"));
+    }
+
+    #[test]
+    fn envelope_defaults_rewrite_inline_content() {
+        let json = r#"{"proxy_origin":"http://localhost:8080","base_url":"https://example.com/",
+            "content":"<div style=\"background:url(/a.png)\"></div><script>go()</script>"}"#;
+        let out = call_html(json);
+        assert!(out.contains("/proxy?url="));
+        assert!(out.contains("window.__internex"));
+    }
+}
@@ -18,6 +18,8 @@
 // The proxy_origin is the origin of OUR proxy server, e.g.
 // "http://localhost:8080".
 
+use base64::engine::general_purpose::URL_SAFE_NO_PAD;
+use base64::Engine;
 use percent_encoding::{utf8_percent_encode, percent_decode_str, AsciiSet, CONTROLS};
 use url::Url;
 
@@ -43,6 +45,11 @@ pub fn encode_url(proxy_origin: &str, raw: &str) -> Option<String> {
         return None;
     }
 
+    // Already routed through the proxy – never wrap twice.
+    if is_proxied(proxy_origin, trimmed) {
+        return Some(trimmed.to_string());
+    }
+
     // Block file: scheme outright.
     if trimmed.to_ascii_lowercase().starts_with("file:") {
         return None;
@@ -83,21 +90,42 @@ pub fn encode_url(proxy_origin: &str, raw: &str) -> Option<String> {
         trimmed.to_string()
     };
 
-    // Validate.
-    if Url::parse(&absolute).is_err() {
-        return Some(trimmed.to_string());
+    // Validate.  Only network schemes are proxied; http and https are
+    // treated identically and the original scheme is kept in the encoded
+    // target so the proxy fetches over the same protocol the page asked
+    // for.  Because the browser only ever talks to the proxy, an http
+    // subresource on an https page no longer triggers mixed-content
+    // blocking.  Other schemes (mailto:, tel:, about:, …) pass through.
+    match Url::parse(&absolute) {
+        Ok(parsed) if is_proxyable_scheme(parsed.scheme()) => {}
+        _ => return Some(trimmed.to_string()),
     }
 
     let encoded_target = utf8_percent_encode(&absolute, QUERY_ENCODE_SET).to_string();
     Some(format!("{}/proxy?url={}", proxy_origin.trim_end_matches('/'), encoded_target))
 }
 
+/// Whether a URL already points at our proxy endpoint, either as a
+/// root-relative `/proxy?url=` path or under `proxy_origin`.
+pub fn is_proxied(proxy_origin: &str, url: &str) -> bool {
+    let prefix = format!("{}/proxy?url=", proxy_origin.trim_end_matches('/'));
+    url.starts_with("/proxy?url=") || url.starts_with(&prefix)
+}
+
+/// Schemes the proxy knows how to fetch.
+fn is_proxyable_scheme(scheme: &str) -> bool {
+    matches!(scheme, "http" | "https" | "ws" | "wss")
+}
+
 /// Encode a URL resolved against a known base.
 pub fn encode_url_with_base(proxy_origin: &str, base: &str, raw: &str) -> Option<String> {
     let trimmed = raw.trim();
     if trimmed.is_empty() || trimmed.starts_with('#') {
         return None;
     }
+    if is_proxied(proxy_origin, trimmed) {
+        return Some(trimmed.to_string());
+    }
 
     // Resolve relative URLs against the base.
     let resolved = match Url::parse(base) {
@@ -111,6 +139,28 @@ pub fn encode_url_with_base(proxy_origin: &str, base: &str, raw: &str) -> Option
     encode_url(proxy_origin, &resolved)
 }
 
+/// Encode the target of a GET form submission as
+/// `{proxy}/f/<base64url target>`.
+///
+/// A GET submission replaces the query of its action URL with the form
+/// fields, which would drop a `?url=` parameter.  On the `/f/` route the
+/// submitted query becomes the target's query instead, so the target is
+/// encoded without its own query and fragment.  Returns `None` for
+/// anything but an absolute http(s) URL.
+pub fn encode_form_url(proxy_origin: &str, target: &str) -> Option<String> {
+    let mut parsed = Url::parse(target.trim()).ok()?;
+    if parsed.scheme() != "http" && parsed.scheme() != "https" {
+        return None;
+    }
+    parsed.set_query(None);
+    parsed.set_fragment(None);
+    Some(format!(
+        "{}/f/{}",
+        proxy_origin.trim_end_matches('/'),
+        URL_SAFE_NO_PAD.encode(parsed.as_str())
+    ))
+}
+
 /// Decode a proxied URL back to the original upstream URL.
 /// Input is the `url` query-parameter value (already extracted).
 pub fn decode_url(encoded: &str) -> Option<String> {
@@ -130,6 +180,15 @@ mod tests {
 
     const ORIGIN: &str = "http://localhost:8080";
 
+    #[test]
+    fn form_url_drops_query_and_fragment() {
+        let result = encode_form_url(ORIGIN, "https://example.com/search?old=1#top").unwrap();
+        let b64 = result.strip_prefix("http://localhost:8080/f/").unwrap();
+        let decoded = URL_SAFE_NO_PAD.decode(b64).unwrap();
+        assert_eq!(decoded, b"https://example.com/search");
+        assert!(encode_form_url(ORIGIN, "mailto:a@example.com").is_none());
+    }
+
     #[test]
     fn absolute_url() {
         let result = encode_url(ORIGIN, "https://example.com/page").unwrap();
@@ -168,6 +227,34 @@ mod tests {
         assert_eq!(decoded, "https://example.com/path?q=1");
     }
 
+    #[test]
+    fn mixed_schemes_keep_original_scheme() {
+        let http = encode_url(ORIGIN, "http://insecure.example.com/a.png").unwrap();
+        let https = encode_url(ORIGIN, "https://secure.example.com/b.png").unwrap();
+        assert_eq!(http, "http://localhost:8080/proxy?url=http://insecure.example.com/a.png");
+        assert_eq!(https, "http://localhost:8080/proxy?url=https://secure.example.com/b.png");
+    }
+
+    #[test]
+    fn protocol_relative_inherits_base_scheme() {
+        let result = encode_url_with_base(ORIGIN, "http://example.com/", "//cdn.example.com/x.js").unwrap();
+        assert!(result.ends_with("url=http://cdn.example.com/x.js"));
+    }
+
+    #[test]
+    fn non_network_schemes_passthrough() {
+        assert_eq!(encode_url(ORIGIN, "mailto:a@example.com").unwrap(), "mailto:a@example.com");
+        assert_eq!(encode_url(ORIGIN, "tel:+15551234").unwrap(), "tel:+15551234");
+    }
+
+    #[test]
+    fn already_proxied_not_rewrapped() {
+        let once = encode_url(ORIGIN, "https://example.com/a").unwrap();
+        assert_eq!(encode_url(ORIGIN, &once).unwrap(), once);
+        let path = "/proxy?url=https://example.com/a";
+        assert_eq!(encode_url_with_base(ORIGIN, "https://example.com/", path).unwrap(), path);
+    }
+
     #[test]
     fn empty_and_fragment_ignored() {
         assert!(encode_url(ORIGIN, "").is_none());